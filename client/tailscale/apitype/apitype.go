@@ -38,3 +38,48 @@ type SetPushDeviceTokenRequest struct {
 	// PushDeviceToken is the iOS/macOS APNs device token (and any future Android equivalent).
 	PushDeviceToken string
 }
+
+// SSHPolicyExplanation is the JSON type returned by the LocalAPI endpoint
+// /debug-ssh-policy. It explains how the local SSH server evaluates its
+// access policy for a connection.
+type SSHPolicyExplanation struct {
+	// Source is where the SSH policy in effect came from: "control",
+	// "file", or "control+file" if both. It's empty if there is none.
+	Source string
+
+	// File is the path of the local SSH policy file, if any, and
+	// FileMode how it's combined with the control plane's policy.
+	File     string `json:",omitempty"`
+	FileMode string `json:",omitempty"`
+
+	// FileError is why the local SSH policy file couldn't be used, if
+	// it couldn't. The last valid version of the file is used, if any.
+	FileError string `json:",omitempty"`
+
+	// Rules are the rules evaluated, in order, up to the one which
+	// matched.
+	Rules []SSHRuleExplanation
+
+	// Matched is the index in Rules of the rule which matched, or -1
+	// if none did and the connection would be rejected.
+	Matched int
+
+	// LocalUser is the local user the connection would run as, if a
+	// rule matched.
+	LocalUser string `json:",omitempty"`
+}
+
+// SSHRuleExplanation is the result of evaluating one SSH policy rule
+// for a connection.
+type SSHRuleExplanation struct {
+	// Source is where the rule came from: "control" or "file".
+	Source string
+
+	// Index is the index of the rule in its source's policy.
+	Index int
+
+	Rule *tailcfg.SSHRule
+
+	// Result is "matched", or why the rule didn't match.
+	Result string
+}
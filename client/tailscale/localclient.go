@@ -248,6 +248,17 @@ func (lc *LocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.W
 	return decodeJSON[*apitype.WhoIsResponse](body)
 }
 
+// DebugSSHPolicy returns an explanation of how the local SSH server's
+// access policy applies to a connection from src as sshUser.
+func (lc *LocalClient) DebugSSHPolicy(ctx context.Context, src netip.Addr, sshUser string) (*apitype.SSHPolicyExplanation, error) {
+	v := url.Values{"src": {src.String()}, "user": {sshUser}}
+	body, err := lc.get200(ctx, "/localapi/v0/debug-ssh-policy?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.SSHPolicyExplanation](body)
+}
+
 // Goroutines returns a dump of the Tailscale daemon's current goroutines.
 func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/goroutines")
@@ -276,6 +287,27 @@ func (lc *LocalClient) TailDaemonLogs(ctx context.Context) (io.Reader, error) {
 	return res.Body, nil
 }
 
+// DNSQueryLog returns a stream of the DNS queries handled by the MagicDNS
+// resolver, as JSON dnstype.QueryLogEntry values, one per line. It starts
+// with recently handled queries and, if follow is true, continues with
+// queries as they're handled until the context is closed.
+func (lc *LocalClient) DNSQueryLog(ctx context.Context, follow bool) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/dns-query-log?follow="+strconv.FormatBool(follow), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return res.Body, nil
+}
+
 // Pprof returns a pprof profile of the Tailscale daemon.
 func (lc *LocalClient) Pprof(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -954,6 +986,69 @@ type signRequest struct {
 	return nil
 }
 
+// NetworkLockPrepareModify returns the unsigned updates which would add
+// and/or remove key(s) to the tailnet key authority, for signing by a
+// trusted key held elsewhere. See NetworkLockSubmitUpdates.
+func (lc *LocalClient) NetworkLockPrepareModify(ctx context.Context, addKeys, removeKeys []tka.Key) ([]tka.AUM, error) {
+	var b bytes.Buffer
+	type modifyRequest struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}
+
+	if err := json.NewEncoder(&b).Encode(modifyRequest{AddKeys: addKeys, RemoveKeys: removeKeys}); err != nil {
+		return nil, err
+	}
+
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/prepare-modify", 200, &b)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+	updates, err := decodeJSON[[]tkatype.MarshaledAUM](body)
+	if err != nil {
+		return nil, err
+	}
+	aums := make([]tka.AUM, len(updates))
+	for i, u := range updates {
+		if err := aums[i].Unserialize(u); err != nil {
+			return nil, fmt.Errorf("decoding update %d: %w", i, err)
+		}
+	}
+	return aums, nil
+}
+
+// NetworkLockSubmitUpdates transmits signed updates, as returned by
+// NetworkLockPrepareModify, to the control plane.
+func (lc *LocalClient) NetworkLockSubmitUpdates(ctx context.Context, aums []tka.AUM) error {
+	updates := make([]tkatype.MarshaledAUM, len(aums))
+	for i := range aums {
+		updates[i] = aums[i].Serialize()
+	}
+
+	if _, err := lc.send(ctx, "POST", "/localapi/v0/tka/submit-updates", 204, jsonBody(updates)); err != nil {
+		return fmt.Errorf("error: %w", err)
+	}
+	return nil
+}
+
+// NetworkLockSubmitSignature transmits a node-key signature made elsewhere
+// to the control plane.
+func (lc *LocalClient) NetworkLockSubmitSignature(ctx context.Context, sig tkatype.MarshaledSignature) error {
+	var b bytes.Buffer
+	type submitRequest struct {
+		Signature tkatype.MarshaledSignature
+	}
+
+	if err := json.NewEncoder(&b).Encode(submitRequest{Signature: sig}); err != nil {
+		return err
+	}
+
+	if _, err := lc.send(ctx, "POST", "/localapi/v0/tka/submit-signature", 200, &b); err != nil {
+		return fmt.Errorf("error: %w", err)
+	}
+	return nil
+}
+
 // NetworkLockAffectedSigs returns all signatures signed by the specified keyID.
 func (lc *LocalClient) NetworkLockAffectedSigs(ctx context.Context, keyID tkatype.KeyID) ([]tkatype.MarshaledSignature, error) {
 	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/affected-sigs", 200, bytes.NewReader(keyID))
@@ -55,6 +55,19 @@
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientBytesPerSec   = flag.Float64("client-bytes-per-sec", 0, "if non-zero, per-client limit on bytes/s relayed; packets over the limit are dropped")
+	clientBytesBurst    = flag.Int("client-bytes-burst", 0, "burst size in bytes for --client-bytes-per-sec; 0 means one second's worth")
+	clientPacketsPerSec = flag.Float64("client-packets-per-sec", 0, "if non-zero, per-client limit on packets/s relayed; packets over the limit are dropped")
+	clientPacketsBurst  = flag.Int("client-packets-burst", 0, "burst size in packets for --client-packets-per-sec; 0 means one second's worth")
+	clientMaxConns      = flag.Int("client-max-conns", 0, "if non-zero, maximum number of concurrent connections per client node key")
+
+	controlURL       = flag.String("control-url", "", "if non-empty, run as a DERP server managed by the Mirage control server at this URL, which decides the clients to trust")
+	naviID           = flag.String("navi-id", "", "ID of this DERP server on the control server; required with -control-url")
+	trustListFile    = flag.String("trust-list-file", "", "with -control-url, path of a file to keep the trust list in, so that trusted clients are still accepted after a restart while the control server is unreachable; if empty, the trust list isn't kept")
+	trustListMaxAge  = flag.Duration("trust-list-max-age", 24*time.Hour, "with -trust-list-file, how old a kept trust list may be and still be used at startup; 0 means no limit")
+	trustListSync    = flag.Duration("trust-list-sync-interval", 5*time.Minute, "with -control-url, how often to reconcile the trust list with the control server")
+	trustListSyncJit = flag.Duration("trust-list-sync-jitter", 30*time.Second, "with -control-url, maximum random delay before each trust list reconciliation")
 )
 
 var (
@@ -83,11 +96,15 @@ func init() {
 
 type config struct {
 	PrivateKey key.NodePrivate
+
+	// NaviKey is the key the server identifies itself to the control
+	// server with, when run with -control-url.
+	NaviKey key.MachinePrivate `json:",omitempty"`
 }
 
 func loadConfig() config {
 	if *dev {
-		return config{PrivateKey: key.NewNode()}
+		return config{PrivateKey: key.NewNode(), NaviKey: key.NewMachine()}
 	}
 	if *configPath == "" {
 		if os.Getuid() == 0 {
@@ -109,18 +126,28 @@ func loadConfig() config {
 		if err := json.Unmarshal(b, &cfg); err != nil {
 			log.Fatalf("derper: config: %v", err)
 		}
+		if *controlURL != "" && cfg.NaviKey.IsZero() {
+			// Configs from before -control-url have no NaviKey.
+			cfg.NaviKey = key.NewMachine()
+			writeConfig(cfg)
+		}
 		return cfg
 	}
 }
 
 func writeNewConfig() config {
-	k := key.NewNode()
 	if err := os.MkdirAll(filepath.Dir(*configPath), 0777); err != nil {
 		log.Fatal(err)
 	}
 	cfg := config{
-		PrivateKey: k,
+		PrivateKey: key.NewNode(),
+		NaviKey:    key.NewMachine(),
 	}
+	writeConfig(cfg)
+	return cfg
+}
+
+func writeConfig(cfg config) {
 	b, err := json.MarshalIndent(cfg, "", "\t")
 	if err != nil {
 		log.Fatal(err)
@@ -128,7 +155,6 @@ func writeNewConfig() config {
 	if err := atomicfile.WriteFile(*configPath, b, 0600); err != nil {
 		log.Fatal(err)
 	}
-	return cfg
 }
 
 func main() {
@@ -151,6 +177,13 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	s.SetDefaultClientPolicy(derp.ClientPolicy{
+		BytesPerSec:   *clientBytesPerSec,
+		BytesBurst:    *clientBytesBurst,
+		PacketsPerSec: *clientPacketsPerSec,
+		PacketsBurst:  *clientPacketsBurst,
+		MaxConns:      *clientMaxConns,
+	})
 
 	if *meshPSKFile != "" {
 		b, err := os.ReadFile(*meshPSKFile)
@@ -167,6 +200,11 @@ func main() {
 	if err := startMesh(s); err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
+	if *controlURL != "" {
+		if err := startManaged(s, cfg.NaviKey); err != nil {
+			log.Fatalf("derper: managed mode: %v", err)
+		}
+	}
 	expvar.Publish("derp", s.ExpVar())
 
 	mux := http.NewServeMux()
@@ -180,6 +218,10 @@ func main() {
 		}))
 	}
 	mux.HandleFunc("/derp/probe", probeHandler)
+	if *controlURL != "" {
+		// The control server pushes trust list changes over Noise.
+		mux.HandleFunc("/ts2021", s.NoiseUpgradeHandler)
+	}
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", handleBootstrapDNS)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -217,6 +259,7 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("talkers", "Top talkers", http.HandlerFunc(s.ServeDebugTopTalkers))
 
 	if *runSTUN {
 		go serveSTUN(listenHost, *stunPort)
@@ -0,0 +1,35 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// startManaged registers s with the control server given by -control-url,
+// which from then on decides the clients s accepts, and starts keeping the
+// trust list in sync with it.
+func startManaged(s *derp.Server, naviKey key.MachinePrivate) error {
+	if *naviID == "" {
+		return errors.New("--control-url requires --navi-id")
+	}
+	s.SetTrustListFile(*trustListFile, *trustListMaxAge)
+	if err := s.PrepareManaged(*controlURL, *naviID, naviKey); err != nil {
+		return err
+	}
+	s.SetVerifyClient(true)
+	if _, err := s.TryLogin(); err != nil {
+		return fmt.Errorf("registering with %s: %w", *controlURL, err)
+	}
+	if err := s.StartTrustListSync(*trustListSync, *trustListSyncJit); err != nil {
+		return err
+	}
+	log.Printf("derper: managed by %s as %q", *controlURL, *naviID)
+	return nil
+}
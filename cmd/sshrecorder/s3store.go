@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Store is a recorder.Store which keeps recordings in an S3 bucket,
+// under a key prefix.
+type s3Store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string // empty, or ending in "/"
+}
+
+// newS3Store returns an s3Store using the AWS SDK's default credentials,
+// and the -s3-endpoint and -s3-region flags.
+func newS3Store(ctx context.Context, bucket, prefix string) (*s3Store, error) {
+	if bucket == "" {
+		return nil, errors.New("no S3 bucket given")
+	}
+	var opts []func(*config.LoadOptions) error
+	if *s3Region != "" {
+		opts = append(opts, config.WithRegion(*s3Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if *s3Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(*s3Endpoint)
+			// Most S3-compatible services don't support
+			// virtual-hosted-style bucket addressing.
+			o.UsePathStyle = true
+		}
+	})
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Store{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+		prefix:   prefix,
+	}, nil
+}
+
+// Put implements recorder.Store. The upload is done in parts, so that a
+// recording needn't be held in memory; an upload which fails is aborted.
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader) error {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + name),
+		Body:   r,
+	})
+	return err
+}
+
+// Get implements recorder.Store.
+func (s *s3Store) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + name),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// List implements recorder.Store.
+func (s *s3Store) List(ctx context.Context) ([]string, error) {
+	var names []string
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			if name == "" || strings.HasPrefix(path.Base(name), ".") {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The sshrecorder command is a recorder for Mirage SSH sessions. It joins
+// the tailnet as its own node, receives the session recordings sent by SSH
+// servers whose policy names it as a recorder, stores them on local disk or
+// in an S3-compatible bucket, and serves a web UI to find and replay them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/hostinfo"
+	"tailscale.com/ssh/recorder"
+	"tailscale.com/tsnet"
+)
+
+var (
+	hostname   = flag.String("hostname", "recorder", "hostname to use on the tailnet")
+	stateDir   = flag.String("dir", "", "directory to keep the node's state in; if empty, a directory under the user config directory is used")
+	port       = flag.Int("port", 80, "port to accept recordings and serve the web UI on")
+	storage    = flag.String("storage", "", `where to store recordings: a local directory, or "s3://bucket/prefix"; defaults to "recordings" under -dir`)
+	s3Endpoint = flag.String("s3-endpoint", "", "URL of an S3-compatible service to use instead of AWS S3")
+	s3Region   = flag.String("s3-region", "", "S3 region; if empty, the AWS SDK default is used")
+	ui         = flag.Bool("ui", true, "serve the web UI to list and replay recordings")
+	uiAllow    = flag.String("ui-allow", "", "comma-separated login names of users, and tags of nodes, allowed to use the web UI; if empty, the UI is disabled")
+	listen     = flag.String("listen", "", "if non-empty, an address to listen on instead of joining the tailnet with tsnet; recording senders are identified by the local mirage daemon")
+)
+
+func main() {
+	flag.Parse()
+	hostinfo.SetApp("sshrecorder")
+	ctx := context.Background()
+
+	var ts *tsnet.Server
+	var lc *tailscale.LocalClient
+	if *listen == "" {
+		ts = &tsnet.Server{
+			Dir:      *stateDir,
+			Hostname: *hostname,
+		}
+		defer ts.Close()
+		var err error
+		lc, err = ts.LocalClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		lc = &tailscale.LocalClient{}
+	}
+
+	store, err := openStore(ctx)
+	if err != nil {
+		log.Fatalf("opening storage: %v", err)
+	}
+	var allow []string
+	for _, a := range strings.Split(*uiAllow, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			allow = append(allow, a)
+		}
+	}
+	if *ui && len(allow) == 0 {
+		log.Printf("-ui-allow is empty; disabling the web UI")
+	}
+	srv, err := recorder.NewServer(ctx, store, recorder.Options{
+		Logf:      log.Printf,
+		WhoIs:     lc.WhoIs,
+		DisableUI: !*ui || len(allow) == 0,
+		UIAllow:   allow,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ln net.Listener
+	if ts != nil {
+		ln, err = ts.Listen("tcp", fmt.Sprintf(":%d", *port))
+	} else {
+		ln, err = net.Listen("tcp", *listen)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Accepting recordings on %v ...", ln.Addr())
+	log.Fatal(http.Serve(ln, srv))
+}
+
+// openStore returns the recorder.Store named by the -storage flag.
+func openStore(ctx context.Context) (recorder.Store, error) {
+	if bucket, ok := strings.CutPrefix(*storage, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(bucket, "/")
+		return newS3Store(ctx, bucket, prefix)
+	}
+	dir := *storage
+	if dir == "" {
+		if *stateDir == "" {
+			log.Fatal("-storage or -dir is required")
+		}
+		dir = filepath.Join(*stateDir, "recordings")
+	}
+	return recorder.NewDirStore(dir)
+}
@@ -116,6 +116,7 @@ func Run(args []string) (err error) {
 			netcheckCmd,
 			ipCmd,
 			statusCmd,
+			dnsCmd,
 			pingCmd,
 			versionCmd,
 			//			bugReportCmd,
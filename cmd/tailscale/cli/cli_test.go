@@ -866,6 +866,7 @@ func TestUpdatePrefs(t *testing.T) {
 				AdvertiseRoutesSet:        true,
 				AdvertiseTagsSet:          true,
 				AllowSingleHostsSet:       true,
+				ControlFailoverURLsSet:    true,
 				ControlURLSet:             true,
 				CorpDNSSet:                true,
 				ExitNodeAllowLANAccessSet: true,
@@ -1104,6 +1105,45 @@ func TestUpdatePrefs(t *testing.T) {
 			wantJustEditMP: nil,
 			env:            upCheckEnv{backendState: "Running"},
 		},
+		{
+			name:  "force_reauth_keeps_derp_prefs",
+			flags: []string{"--force-reauth"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:        ipn.DefaultControlURL,
+				Persist:           &persist.Persist{LoginName: "crawshaw.github"},
+				AllowSingleHosts:  true,
+				CorpDNS:           true,
+				NetfilterMode:     preftype.NetfilterOn,
+				DERPHomeRegion:    2,
+				DERPAvoidRegions:  []int{3, 4},
+				DERPHomePeerAware: true,
+			},
+			env: upCheckEnv{backendState: "Running"},
+			checkUpdatePrefsMutations: func(t *testing.T, newPrefs *ipn.Prefs) {
+				if newPrefs.DERPHomeRegion != 2 || !reflect.DeepEqual(newPrefs.DERPAvoidRegions, []int{3, 4}) || !newPrefs.DERPHomePeerAware {
+					t.Errorf("DERP prefs reset: home %d, avoid %v, peer-aware %v", newPrefs.DERPHomeRegion, newPrefs.DERPAvoidRegions, newPrefs.DERPHomePeerAware)
+				}
+			},
+		},
+		{
+			name:  "auth_key_keeps_dns_blocklists",
+			flags: []string{"--auth-key=tskey-abc"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				Persist:          &persist.Persist{LoginName: "crawshaw.github"},
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				DNSBlocklists:    []string{"/etc/mirage/blocklist.txt"},
+				DNSBlockPolicy:   "zeroip",
+			},
+			env: upCheckEnv{backendState: "Stopped"},
+			checkUpdatePrefsMutations: func(t *testing.T, newPrefs *ipn.Prefs) {
+				if !reflect.DeepEqual(newPrefs.DNSBlocklists, []string{"/etc/mirage/blocklist.txt"}) || newPrefs.DNSBlockPolicy != "zeroip" {
+					t.Errorf("DNS blocklist prefs reset: lists %q, policy %q", newPrefs.DNSBlocklists, newPrefs.DNSBlockPolicy)
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/types/dnstype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <sub-command> <arguments>",
+	ShortHelp:  "Inspect MagicDNS",
+	LongHelp:   "Inspect the MagicDNS resolver (100.100.100.100)",
+	Subcommands: []*ffcli.Command{
+		dnsLogCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var dnsLogArgs struct {
+	follow bool
+	json   bool
+}
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "dns log [-f] [--json]",
+	ShortHelp:  "List recent DNS queries handled by MagicDNS",
+	LongHelp: `List recent DNS queries handled by the MagicDNS resolver: how each was
+answered (locally, blocked, from cache or forwarded), the route and
+upstream resolver used, the response code and the latency.`,
+	Exec: runDNSLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("dns log")
+		fs.BoolVar(&dnsLogArgs.follow, "f", false, "keep listing queries as they're handled")
+		fs.BoolVar(&dnsLogArgs.follow, "follow", false, "alias for -f")
+		fs.BoolVar(&dnsLogArgs.json, "json", false, "output in JSON format, one query per line (WARNING: format subject to change)")
+		return fs
+	})(),
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many arguments")
+	}
+	rc, err := localClient.DNSQueryLog(ctx, dnsLogArgs.follow)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		if dnsLogArgs.json {
+			outln(sc.Text())
+			continue
+		}
+		var e dnstype.QueryLogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return err
+		}
+		outln(formatDNSQueryLogEntry(e))
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return sc.Err()
+}
+
+func formatDNSQueryLogEntry(e dnstype.QueryLogEntry) string {
+	s := fmt.Sprintf("%s %-5s %s %s", e.Time.Local().Format("15:04:05.000"), e.Type, e.Name, e.Resolution)
+	if e.Route != "" {
+		s += " route=" + e.Route
+	}
+	if e.Upstream != "" {
+		s += " upstream=" + e.Upstream
+	}
+	if e.RCode != "" {
+		s += " " + e.RCode
+	}
+	if e.Err != "" {
+		s += fmt.Sprintf(" err=%q", e.Err)
+	}
+	return s + " " + e.Latency.Round(time.Microsecond).String()
+}
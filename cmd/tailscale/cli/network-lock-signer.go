@@ -0,0 +1,509 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// nlSignerArgs are the flags shared by the lock commands which make
+// signatures: add, remove and sign.
+var nlSignerArgs struct {
+	signer string // "ssh-agent" or "ssh-agent:<key>"; empty means this node's key
+	export string // file to write unsigned changes to, for "lock sign-offline"
+}
+
+func addNLSignerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&nlSignerArgs.signer, "signer", "", `sign with a key held in ssh-agent rather than this node's key, in the form "ssh-agent" or "ssh-agent:<key>", where <key> is the tlpub, SHA256 fingerprint or comment of an ed25519 key`)
+	fs.StringVar(&nlSignerArgs.export, "export", "", "write the unsigned changes to this file for signing elsewhere with 'lock sign-offline', rather than signing and submitting them")
+}
+
+// nlNodeKey is a node-key awaiting a signature.
+type nlNodeKey struct {
+	NodeKey        key.NodePublic
+	RotationPublic []byte `json:",omitempty"`
+}
+
+// nlBundle is a set of miragenet lock changes exported for signing
+// elsewhere, such as on an air-gapped machine. It is written by the
+// --export flag of add, remove and sign, signed by "lock sign-offline"
+// and submitted by "lock submit".
+type nlBundle struct {
+	// Updates are the serialized AUMs making key changes, chained from
+	// the head of the key authority when they were exported.
+	Updates []tkatype.MarshaledAUM `json:",omitempty"`
+	// NodeKeys are the node-keys awaiting a signature.
+	NodeKeys []nlNodeKey `json:",omitempty"`
+	// Signatures are the serialized signatures of NodeKeys, once signed.
+	Signatures []tkatype.MarshaledSignature `json:",omitempty"`
+}
+
+func (b *nlBundle) aums() ([]tka.AUM, error) {
+	aums := make([]tka.AUM, len(b.Updates))
+	for i, u := range b.Updates {
+		if err := aums[i].Unserialize(u); err != nil {
+			return nil, fmt.Errorf("decoding update %d: %w", i, err)
+		}
+	}
+	return aums, nil
+}
+
+// sign signs the updates and node-keys in b with signer.
+func (b *nlBundle) sign(signer tka.KeySigner) error {
+	aums, err := b.aums()
+	if err != nil {
+		return err
+	}
+	for _, aum := range aums {
+		if len(aum.Signatures) > 0 {
+			return errors.New("bundle is already signed")
+		}
+		// Signatures made by a key are invalidated by its removal.
+		if aum.MessageKind == tka.AUMRemoveKey && bytes.Equal(aum.KeyID, signer.KeyID()) && len(b.NodeKeys) > 0 {
+			return errors.New("cannot re-sign node-keys with a key which is being removed")
+		}
+	}
+
+	if err := tka.SignUpdates(aums, signer); err != nil {
+		return err
+	}
+	for i := range aums {
+		b.Updates[i] = aums[i].Serialize()
+	}
+	for _, nk := range b.NodeKeys {
+		sig, err := tka.SignNodeKey(nk.NodeKey, nk.RotationPublic, signer)
+		if err != nil {
+			return fmt.Errorf("signing %v: %w", nk.NodeKey, err)
+		}
+		b.Signatures = append(b.Signatures, sig.Serialize())
+	}
+	b.NodeKeys = nil
+	return nil
+}
+
+func readNLBundle(path string) (*nlBundle, error) {
+	j, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b nlBundle
+	if err := json.Unmarshal(j, &b); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return &b, nil
+}
+
+func writeNLBundle(path string, b *nlBundle) error {
+	j, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(j, '\n'), 0600)
+}
+
+// nlApply makes the given key changes and node-key signatures, either
+// signing them with the signer chosen by nlSignerArgs and submitting them,
+// or exporting them for signing elsewhere. st is needed only to remove keys.
+func nlApply(ctx context.Context, st *ipnstate.NetworkLockStatus, addKeys, removeKeys []tka.Key, nodeKeys []nlNodeKey) error {
+	if nlSignerArgs.export != "" {
+		if nlSignerArgs.signer != "" {
+			return errors.New("--signer and --export cannot be used together")
+		}
+		b := nlBundle{NodeKeys: nodeKeys}
+		if len(addKeys) > 0 || len(removeKeys) > 0 {
+			aums, err := localClient.NetworkLockPrepareModify(ctx, addKeys, removeKeys)
+			if err != nil {
+				return err
+			}
+			for _, aum := range aums {
+				b.Updates = append(b.Updates, aum.Serialize())
+			}
+		}
+		if err := writeNLBundle(nlSignerArgs.export, &b); err != nil {
+			return err
+		}
+		printf("Wrote unsigned changes to %s; sign them with 'mirage lock sign-offline', then apply them with 'mirage lock submit'.\n", nlSignerArgs.export)
+		return nil
+	}
+
+	if nlSignerArgs.signer == "" {
+		// Sign with this node's key, within tailscaled.
+		if len(removeKeys) > 0 {
+			if err := nlCheckResignKey(st.PublicKey.KeyID(), removeKeys, nodeKeys); err != nil {
+				return err
+			}
+		}
+		for _, nk := range nodeKeys {
+			if err := localClient.NetworkLockSign(ctx, nk.NodeKey, nk.RotationPublic); err != nil {
+				return fmt.Errorf("failed to sign %v: %w", nk.NodeKey, err)
+			}
+		}
+		if len(addKeys) == 0 && len(removeKeys) == 0 {
+			return nil
+		}
+		return localClient.NetworkLockModify(ctx, addKeys, removeKeys)
+	}
+
+	signer, closeSigner, err := nlOpenSigner(nlSignerArgs.signer)
+	if err != nil {
+		return err
+	}
+	defer closeSigner()
+	if err := nlCheckResignKey(signer.KeyID(), removeKeys, nodeKeys); err != nil {
+		return err
+	}
+	for _, nk := range nodeKeys {
+		sig, err := tka.SignNodeKey(nk.NodeKey, nk.RotationPublic, signer)
+		if err != nil {
+			return fmt.Errorf("failed to sign %v: %w", nk.NodeKey, err)
+		}
+		if err := localClient.NetworkLockSubmitSignature(ctx, sig.Serialize()); err != nil {
+			return fmt.Errorf("failed to submit signature for %v: %w", nk.NodeKey, err)
+		}
+	}
+	if len(addKeys) == 0 && len(removeKeys) == 0 {
+		return nil
+	}
+	aums, err := localClient.NetworkLockPrepareModify(ctx, addKeys, removeKeys)
+	if err != nil {
+		return err
+	}
+	if len(aums) == 0 {
+		return nil
+	}
+	if err := tka.SignUpdates(aums, signer); err != nil {
+		return err
+	}
+	return localClient.NetworkLockSubmitUpdates(ctx, aums)
+}
+
+// nlCheckResignKey returns an error if node-keys are to be re-signed by
+// the key signerID while it is being removed, as the new signatures would
+// be immediately invalid.
+func nlCheckResignKey(signerID tkatype.KeyID, removeKeys []tka.Key, nodeKeys []nlNodeKey) error {
+	if len(nodeKeys) == 0 {
+		return nil
+	}
+	for _, k := range removeKeys {
+		kID, err := k.ID()
+		if err != nil {
+			return fmt.Errorf("computing KeyID for key %v: %w", k, err)
+		}
+		if bytes.Equal(signerID, kID) {
+			return errors.New("cannot remove the signing key while resigning; use a different signer or --re-sign=false")
+		}
+	}
+	return nil
+}
+
+// nlOpenSigner returns the signer described by a --signer flag, and a
+// function to release it once done.
+func nlOpenSigner(spec string) (tka.KeySigner, func() error, error) {
+	selector, ok := strings.CutPrefix(spec, "ssh-agent")
+	if !ok || (selector != "" && !strings.HasPrefix(selector, ":")) {
+		return nil, nil, fmt.Errorf("unknown signer %q; want ssh-agent or ssh-agent:<key>", spec)
+	}
+	selector = strings.TrimPrefix(selector, ":")
+
+	ag, closeAgent, err := nlDialAgent()
+	if err != nil {
+		return nil, nil, err
+	}
+	k, err := nlAgentKeyFor(ag, selector)
+	if err != nil {
+		closeAgent()
+		return nil, nil, err
+	}
+	signer, err := tka.NewCryptoSigner(k)
+	if err != nil {
+		closeAgent()
+		return nil, nil, err
+	}
+	return signer, closeAgent, nil
+}
+
+// nlDialAgent connects to the ssh-agent at $SSH_AUTH_SOCK.
+func nlDialAgent() (agent.Agent, func() error, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	return agent.NewClient(conn), conn.Close, nil
+}
+
+// nlAgentKey is an ed25519 key held by an ssh-agent. It implements
+// crypto.Signer.
+type nlAgentKey struct {
+	ag  agent.Agent
+	key *agent.Key
+	pub ed25519.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (k nlAgentKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign implements crypto.Signer. As for ed25519.PrivateKey, the message
+// is signed directly rather than a digest of it.
+func (k nlAgentKey) Sign(_ io.Reader, message []byte, _ crypto.SignerOpts) ([]byte, error) {
+	sig, err := k.ag.Sign(k.key, message)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent: %w", err)
+	}
+	if sig.Format != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("ssh-agent returned a %q signature", sig.Format)
+	}
+	return sig.Blob, nil
+}
+
+// tlpub returns the key in the form used by lock commands.
+func (k nlAgentKey) tlpub() string {
+	return key.NLPublicFromEd25519Unsafe(k.pub).CLIString()
+}
+
+// matches reports whether selector, a tlpub, SHA256 fingerprint or
+// comment, identifies k.
+func (k nlAgentKey) matches(selector string) bool {
+	var nlpk key.NLPublic
+	if err := nlpk.UnmarshalText([]byte(selector)); err == nil {
+		return bytes.Equal(nlpk.Verifier(), k.pub)
+	}
+	return selector == ssh.FingerprintSHA256(k.key) || selector == k.key.Comment
+}
+
+// nlAgentKeys returns the ed25519 keys held by ag. Other types of keys
+// cannot be trusted by miragenet lock, so are skipped.
+func nlAgentKeys(ag agent.Agent) ([]nlAgentKey, error) {
+	keys, err := ag.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing ssh-agent keys: %w", err)
+	}
+	var out []nlAgentKey
+	for _, k := range keys {
+		if k.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		pk, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ssh-agent key %q: %w", k.Comment, err)
+		}
+		cpk, ok := pk.(ssh.CryptoPublicKey)
+		if !ok {
+			continue
+		}
+		pub, ok := cpk.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			continue
+		}
+		out = append(out, nlAgentKey{ag: ag, key: k, pub: pub})
+	}
+	return out, nil
+}
+
+// nlAgentKeyFor returns the ed25519 key in ag identified by selector. If
+// selector is empty, ag must hold exactly one ed25519 key.
+func nlAgentKeyFor(ag agent.Agent, selector string) (nlAgentKey, error) {
+	keys, err := nlAgentKeys(ag)
+	if err != nil {
+		return nlAgentKey{}, err
+	}
+	var found []nlAgentKey
+	for _, k := range keys {
+		if selector == "" || k.matches(selector) {
+			found = append(found, k)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) == 0 && selector == "":
+		return nlAgentKey{}, errors.New("ssh-agent holds no ed25519 keys")
+	case len(found) == 0:
+		return nlAgentKey{}, fmt.Errorf("ssh-agent holds no ed25519 key matching %q", selector)
+	case selector == "":
+		return nlAgentKey{}, errors.New("ssh-agent holds several ed25519 keys; choose one with --signer=ssh-agent:<key>")
+	default:
+		return nlAgentKey{}, fmt.Errorf("several ssh-agent keys match %q", selector)
+	}
+}
+
+var nlSignOfflineArgs struct {
+	signer string
+}
+
+var nlSignOfflineCmd = &ffcli.Command{
+	Name:       "sign-offline",
+	ShortUsage: "sign-offline --signer=ssh-agent[:<key>] <in-file> <out-file>",
+	ShortHelp:  "Signs changes exported with --export, without contacting mirage",
+	LongHelp: strings.TrimSpace(`
+Signs changes written by the --export flag of 'lock add', 'lock remove' or
+'lock sign', using an ed25519 key held in ssh-agent. The signed changes are
+written to <out-file>, to be applied with 'lock submit'.
+
+This command does not need mirage to be running, so can be used on an
+air-gapped machine.
+`),
+	Exec: runNetworkLockSignOffline,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock sign-offline")
+		fs.StringVar(&nlSignOfflineArgs.signer, "signer", "ssh-agent", `the key to sign with, in the form "ssh-agent" or "ssh-agent:<key>", where <key> is the tlpub, SHA256 fingerprint or comment of an ed25519 key`)
+		return fs
+	})(),
+}
+
+func runNetworkLockSignOffline(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lock sign-offline --signer=ssh-agent[:<key>] <in-file> <out-file>")
+	}
+	b, err := readNLBundle(args[0])
+	if err != nil {
+		return err
+	}
+	signer, closeSigner, err := nlOpenSigner(nlSignOfflineArgs.signer)
+	if err != nil {
+		return err
+	}
+	defer closeSigner()
+
+	if err := b.sign(signer); err != nil {
+		return err
+	}
+
+	// Describe what was signed, so it can be checked before submission.
+	aums, err := b.aums()
+	if err != nil {
+		return err
+	}
+	for _, aum := range aums {
+		stanza, err := nlDescribeUpdate(ipnstate.NetworkLockUpdate{
+			Hash:   aum.Hash(),
+			Change: aum.MessageKind.String(),
+			Raw:    aum.Serialize(),
+		}, false)
+		if err != nil {
+			return err
+		}
+		outln(stanza)
+	}
+	for _, sigBytes := range b.Signatures {
+		var sig tka.NodeKeySignature
+		if err := sig.Unserialize(sigBytes); err != nil {
+			return err
+		}
+		var nodeKey key.NodePublic
+		if err := nodeKey.UnmarshalBinary(sig.Pubkey); err != nil {
+			return err
+		}
+		printf("signed node-key %v\n", nodeKey)
+	}
+
+	if err := writeNLBundle(args[1], b); err != nil {
+		return err
+	}
+	printf("Signed with %s; wrote %s.\n", key.NLPublicFromEd25519Unsafe(ed25519.PublicKey(signer.KeyID())).CLIString(), args[1])
+	return nil
+}
+
+var nlSubmitCmd = &ffcli.Command{
+	Name:       "submit",
+	ShortUsage: "submit <file>",
+	ShortHelp:  "Applies changes signed with 'lock sign-offline'",
+	LongHelp:   "Applies changes signed with 'lock sign-offline'",
+	Exec:       runNetworkLockSubmit,
+}
+
+func runNetworkLockSubmit(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lock submit <file>")
+	}
+	b, err := readNLBundle(args[0])
+	if err != nil {
+		return err
+	}
+	aums, err := b.aums()
+	if err != nil {
+		return err
+	}
+	signed := len(b.NodeKeys) == 0
+	for _, aum := range aums {
+		if len(aum.Signatures) == 0 {
+			signed = false
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%s has not been signed; sign it with 'mirage lock sign-offline' first", args[0])
+	}
+
+	// As with 'lock remove --re-sign', signatures are submitted before
+	// any key changes.
+	for _, sig := range b.Signatures {
+		if err := localClient.NetworkLockSubmitSignature(ctx, sig); err != nil {
+			return fixTailscaledConnectError(err)
+		}
+	}
+	if len(aums) == 0 {
+		return nil
+	}
+	if err := localClient.NetworkLockSubmitUpdates(ctx, aums); err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	return nil
+}
+
+var nlAgentKeysCmd = &ffcli.Command{
+	Name:       "agent-keys",
+	ShortUsage: "agent-keys",
+	ShortHelp:  "Lists the ed25519 keys in ssh-agent which can be used as miragenet lock keys",
+	LongHelp: strings.TrimSpace(`
+Lists the ed25519 keys in ssh-agent which can be used as miragenet lock keys.
+
+Each is listed with its miragenet lock public key, which can be trusted with
+'lock add', then its SHA256 fingerprint and comment, either of which can
+choose it with --signer=ssh-agent:<key>.
+`),
+	Exec: runNetworkLockAgentKeys,
+}
+
+func runNetworkLockAgentKeys(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: lock agent-keys")
+	}
+	ag, closeAgent, err := nlDialAgent()
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+	keys, err := nlAgentKeys(ag)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		printf("%s\t%s\t%s\n", k.tlpub(), ssh.FingerprintSHA256(k.key), k.key.Comment)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+)
+
+func newTestAgentKey(t *testing.T, ag agent.Agent, comment string) ed25519.PublicKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Add(agent.AddedKey{PrivateKey: priv, Comment: comment}); err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestNLAgentKeyFor(t *testing.T) {
+	ag := agent.NewKeyring()
+	if _, err := nlAgentKeyFor(ag, ""); err == nil {
+		t.Error("empty agent: got no error")
+	}
+
+	pub1 := newTestAgentKey(t, ag, "one")
+	k, err := nlAgentKeyFor(ag, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.pub.Equal(pub1) {
+		t.Errorf("only key = %x, want %x", k.pub, pub1)
+	}
+
+	pub2 := newTestAgentKey(t, ag, "two")
+	if _, err := nlAgentKeyFor(ag, ""); err == nil {
+		t.Error("two keys, no selector: got no error")
+	}
+	sshPub, err := ssh.NewPublicKey(pub2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sel := range []string{
+		"two",
+		ssh.FingerprintSHA256(sshPub),
+		key.NLPublicFromEd25519Unsafe(pub2).CLIString(),
+	} {
+		k, err := nlAgentKeyFor(ag, sel)
+		if err != nil {
+			t.Errorf("selector %q: %v", sel, err)
+			continue
+		}
+		if !k.pub.Equal(pub2) {
+			t.Errorf("selector %q chose %x, want %x", sel, k.pub, pub2)
+		}
+	}
+	if _, err := nlAgentKeyFor(ag, "three"); err == nil {
+		t.Error("unknown selector: got no error")
+	}
+}
+
+func TestNLBundleSign(t *testing.T) {
+	ag := agent.NewKeyring()
+	pub := newTestAgentKey(t, ag, "lock")
+	k, err := nlAgentKeyFor(ag, "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := tka.NewCryptoSigner(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &tka.Mem{}
+	a, _, err := tka.Create(storage, tka.State{
+		Keys:               []tka.Key{{Kind: tka.Key25519, Public: pub, Votes: 2}},
+		DisablementSecrets: [][]byte{tka.DisablementKDF([]byte{1, 2, 3})},
+	}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Export two unsigned updates and a node-key, as 'lock add --export' would.
+	updater := a.NewUpdater(nil)
+	for i := 0; i < 2; i++ {
+		if err := updater.AddKey(tka.Key{Kind: tka.Key25519, Public: key.NewNLPrivate().Public().Verifier(), Votes: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aums, err := updater.Finalize(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKey := key.NewNode().Public()
+	b := &nlBundle{NodeKeys: []nlNodeKey{{NodeKey: nodeKey}}}
+	for _, aum := range aums {
+		b.Updates = append(b.Updates, aum.Serialize())
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := writeNLBundle(path, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign it, as 'lock sign-offline' would.
+	if b, err = readNLBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sign(signer); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := b.sign(signer); err == nil {
+		t.Error("signing twice: got no error")
+	}
+
+	signed, err := b.aums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.VerifyUpdates(signed); err != nil {
+		t.Errorf("VerifyUpdates: %v", err)
+	}
+	if len(b.NodeKeys) != 0 || len(b.Signatures) != 1 {
+		t.Fatalf("got %d node-keys and %d signatures, want 0 and 1", len(b.NodeKeys), len(b.Signatures))
+	}
+	if err := a.NodeKeyAuthorized(nodeKey, b.Signatures[0]); err != nil {
+		t.Errorf("NodeKeyAuthorized: %v", err)
+	}
+}
@@ -40,6 +40,9 @@
 		nlDisablementKDFCmd,
 		nlLogCmd,
 		nlLocalDisableCmd,
+		nlSignOfflineCmd,
+		nlSubmitCmd,
+		nlAgentKeysCmd,
 	},
 	Exec: runNetworkLockNoSubcommand,
 }
@@ -280,12 +283,17 @@ func runNetworkLockStatus(ctx context.Context, args []string) error {
 
 var nlAddCmd = &ffcli.Command{
 	Name:       "add",
-	ShortUsage: "add <public-key>...",
+	ShortUsage: "add [--signer=ssh-agent[:<key>] | --export=<file>] <public-key>...",
 	ShortHelp:  "Adds one or more trusted signing keys to miragenet lock",
 	LongHelp:   "Adds one or more trusted signing keys to miragenet lock",
 	Exec: func(ctx context.Context, args []string) error {
 		return runNetworkLockModify(ctx, args, nil)
 	},
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock add")
+		addNLSignerFlags(fs)
+		return fs
+	})(),
 }
 
 var nlRemoveArgs struct {
@@ -294,13 +302,14 @@ func runNetworkLockStatus(ctx context.Context, args []string) error {
 
 var nlRemoveCmd = &ffcli.Command{
 	Name:       "remove",
-	ShortUsage: "remove [--re-sign=false] <public-key>...",
+	ShortUsage: "remove [--re-sign=false] [--signer=ssh-agent[:<key>] | --export=<file>] <public-key>...",
 	ShortHelp:  "Removes one or more trusted signing keys from miragenet lock",
 	LongHelp:   "Removes one or more trusted signing keys from miragenet lock",
 	Exec:       runNetworkLockRemove,
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("lock remove")
 		fs.BoolVar(&nlRemoveArgs.resign, "re-sign", true, "resign signatures which would be invalidated by removal of trusted signing keys")
+		addNLSignerFlags(fs)
 		return fs
 	})(),
 }
@@ -318,22 +327,15 @@ func runNetworkLockRemove(ctx context.Context, args []string) error {
 		return errors.New("tailnet lock is not enabled")
 	}
 
+	var resign []nlNodeKey
 	if nlRemoveArgs.resign {
-		// Validate we are not removing trust in ourselves while resigning. This is because
-		// we resign with our own key, so the signatures would be immediately invalid.
+		// Collect the signatures made by each of the keys we are removing,
+		// which must be resigned by a remaining key.
 		for _, k := range removeKeys {
 			kID, err := k.ID()
 			if err != nil {
 				return fmt.Errorf("computing KeyID for key %v: %w", k, err)
 			}
-			if bytes.Equal(st.PublicKey.KeyID(), kID) {
-				return errors.New("cannot remove local trusted signing key while resigning; run command on a different node or with --re-sign=false")
-			}
-		}
-
-		// Resign affected signatures for each of the keys we are removing.
-		for _, k := range removeKeys {
-			kID, _ := k.ID() // err already checked above
 			sigs, err := localClient.NetworkLockAffectedSigs(ctx, kID)
 			if err != nil {
 				return fmt.Errorf("affected sigs for key %X: %w", kID, err)
@@ -352,14 +354,12 @@ func runNetworkLockRemove(ctx context.Context, args []string) error {
 				// Safety: NetworkLockAffectedSigs() verifies all signatures before
 				// successfully returning.
 				rotationKey, _ := sig.UnverifiedWrappingPublic()
-				if err := localClient.NetworkLockSign(ctx, nodeKey, []byte(rotationKey)); err != nil {
-					return fmt.Errorf("failed to sign %v: %w", nodeKey, err)
-				}
+				resign = append(resign, nlNodeKey{NodeKey: nodeKey, RotationPublic: []byte(rotationKey)})
 			}
 		}
 	}
 
-	return localClient.NetworkLockModify(ctx, nil, removeKeys)
+	return nlApply(ctx, st, nil, removeKeys, resign)
 }
 
 // parseNLArgs parses a slice of strings into slices of tka.Key & disablement
@@ -427,24 +427,31 @@ func runNetworkLockModify(ctx context.Context, addArgs, removeArgs []string) err
 		return err
 	}
 
-	if err := localClient.NetworkLockModify(ctx, addKeys, removeKeys); err != nil {
-		return err
-	}
-	return nil
+	return nlApply(ctx, st, addKeys, removeKeys, nil)
 }
 
 var nlSignCmd = &ffcli.Command{
 	Name:       "sign",
-	ShortUsage: "sign <node-key> [<rotation-key>] or sign <auth-key>",
+	ShortUsage: "sign [--signer=ssh-agent[:<key>] | --export=<file>] <node-key> [<rotation-key>] or sign <auth-key>",
 	ShortHelp:  "Signs a node or pre-approved auth key",
 	LongHelp: `Either:
   - signs a node key and transmits the signature to the coordination server, or
-  - signs a pre-approved auth key, printing it in a form that can be used to bring up nodes under tailnet lock`,
+  - signs a pre-approved auth key, printing it in a form that can be used to bring up nodes under tailnet lock
+
+Node keys are signed with this node's key, unless --signer or --export are given.`,
 	Exec: runNetworkLockSign,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("lock sign")
+		addNLSignerFlags(fs)
+		return fs
+	})(),
 }
 
 func runNetworkLockSign(ctx context.Context, args []string) error {
 	if len(args) > 0 && strings.HasPrefix(args[0], "tskey-auth-") {
+		if nlSignerArgs.signer != "" || nlSignerArgs.export != "" {
+			return errors.New("auth keys can only be signed with this node's key")
+		}
 		return runTskeyWrapCmd(ctx, args)
 	}
 
@@ -465,7 +472,7 @@ func runNetworkLockSign(ctx context.Context, args []string) error {
 		}
 	}
 
-	return localClient.NetworkLockSign(ctx, nodeKey, []byte(rotationKey.Verifier()))
+	return nlApply(ctx, nil, nil, nil, []nlNodeKey{{NodeKey: nodeKey, RotationPublic: []byte(rotationKey.Verifier())}})
 }
 
 var nlDisableCmd = &ffcli.Command{
@@ -20,6 +20,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/ipn"
@@ -36,9 +37,10 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
 		Name:      "serve",
 		ShortHelp: "Serve content and local servers",
 		ShortUsage: strings.TrimSpace(`
-serve https:<port> <mount-point> <source> [off]
+serve [flags] https:<port> <mount-point> <source> [off]
   serve tcp:<port> tcp://localhost:<local-port> [off]
   serve tls-terminated-tcp:<port> tcp://localhost:<local-port> [off]
+  serve [--idle-timeout=<duration>] udp:<port> udp://localhost:<local-port> [off]
   serve status [--json]
 `),
 		LongHelp: strings.TrimSpace(`
@@ -67,6 +69,14 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
   - To serve simple static text:
     $ tailscale serve https:8080 / text:"Hello, world!"
 
+  - To redirect requests elsewhere, optionally with a given 3xx status code:
+    $ tailscale serve --code=301 https / redirect:https://example.com/
+
+  - To add a header to requests proxied to a local server, and serve a
+    directory without listing its contents:
+    $ tailscale serve --proxy-set-header="X-Auth: secret" https / http://127.0.0.1:3000
+    $ tailscale serve --no-dir-list https /files/ /home/alice/shared-files
+
   - To forward incoming TCP connections on port 2222 to a local TCP server on
     port 22 (e.g. to run OpenSSH in parallel with Tailscale SSH):
     $ tailscale serve tcp:2222 tcp://localhost:22
@@ -74,9 +84,22 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
   - To accept TCP TLS connections (terminated within tailscaled) proxied to a
     local plaintext server on port 80:
     $ tailscale serve tls-terminated-tcp:443 tcp://localhost:80
+
+  - To forward UDP datagrams on port 53 to a local DNS server, dropping
+    the state of each peer's flow after 30 seconds without traffic:
+    $ tailscale serve --idle-timeout=30s udp:53 udp://localhost:5353
 `),
 		Exec:      e.runServe,
 		UsageFunc: usageFunc,
+		FlagSet: e.newFlags("serve", func(fs *flag.FlagSet) {
+			fs.IntVar(&e.code, "code", 0, "HTTP status code for text: and redirect: sources (default 200 for text, 302 for redirect)")
+			fs.BoolVar(&e.noDirList, "no-dir-list", false, "don't list the contents of directories served from a path source")
+			fs.Var(&e.setHeaders, "set-header", `response header to set, as "Name: value"; may be repeated`)
+			fs.Var(&e.removeHeaders, "remove-header", "response header to remove; may be repeated")
+			fs.Var(&e.proxySetHeaders, "proxy-set-header", `header to set on requests to a proxy source, as "Name: value"; may be repeated`)
+			fs.Var(&e.proxyRemoveHeaders, "proxy-remove-header", "header to remove from requests to a proxy source; may be repeated")
+			fs.DurationVar(&e.idleTimeout, "idle-timeout", 0, "for udp: serving, how long a peer's flow may be idle before its state is dropped (default 2m)")
+		}),
 		Subcommands: []*ffcli.Command{
 			{
 				Name:      "status",
@@ -123,7 +146,14 @@ type localServeClient interface {
 // It also contains the flags, as registered with newServeCommand.
 type serveEnv struct {
 	// flags
-	json bool // output JSON (status only for now)
+	json               bool          // output JSON (status only for now)
+	code               int           // HTTP status code for text and redirect handlers
+	noDirList          bool          // disable directory listings for path handlers
+	setHeaders         stringsFlag   // response headers to set, "Name: value"
+	removeHeaders      stringsFlag   // response headers to remove
+	proxySetHeaders    stringsFlag   // proxied request headers to set, "Name: value"
+	proxyRemoveHeaders stringsFlag   // proxied request headers to remove
+	idleTimeout        time.Duration // idle timeout of forwarded UDP flows
 
 	lc localServeClient // localClient interface, specific to serve
 
@@ -132,6 +162,16 @@ type serveEnv struct {
 	testStdout  io.Writer
 }
 
+// stringsFlag is a flag.Value that collects the values of a repeated flag.
+type stringsFlag []string
+
+func (v *stringsFlag) String() string { return strings.Join(*v, ",") }
+
+func (v *stringsFlag) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
 // getSelfDNSName returns the DNS name of the current node.
 // The trailing dot is removed.
 // Returns an error if local client status fails.
@@ -172,6 +212,7 @@ func (e *serveEnv) getLocalClientStatus(ctx context.Context) (*ipnstate.Status,
 // - tailscale serve https:10000 /motd.txt text:"Hello, world!"
 // - tailscale serve tcp:2222 tcp://localhost:22
 // - tailscale serve tls-terminated-tcp:443 tcp://localhost:80
+// - tailscale serve udp:53 udp://localhost:5353
 func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 	if len(args) == 0 {
 		return flag.ErrHelp
@@ -236,9 +277,14 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 			return e.handleTCPServeRemove(ctx, srcPort)
 		}
 		return e.handleTCPServe(ctx, srcType, srcPort, args[1])
+	case "udp":
+		if turnOff {
+			return e.handleUDPServeRemove(ctx, srcPort)
+		}
+		return e.handleUDPServe(ctx, srcPort, args[1])
 	default:
 		fmt.Fprintf(os.Stderr, "error: invalid serve type %q\n", srcType)
-		fmt.Fprint(os.Stderr, "must be one of: https:<port>, tcp:<port> or tls-terminated-tcp:<port>\n\n", srcType)
+		fmt.Fprint(os.Stderr, "must be one of: https:<port>, tcp:<port>, tls-terminated-tcp:<port> or udp:<port>\n\n", srcType)
 		return flag.ErrHelp
 	}
 }
@@ -251,6 +297,7 @@ func (e *serveEnv) runServe(ctx context.Context, args []string) error {
 //   - tailscale serve https / http://localhost:3000
 //   - tailscale serve https:8443 /files/ /home/alice/shared-files/
 //   - tailscale serve https:10000 /motd.txt text:"Hello, world!"
+//   - tailscale serve https / redirect:https://example.com/
 func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, mount, source string) error {
 	h := new(ipn.HTTPHandler)
 
@@ -262,6 +309,12 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, mount, so
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case ts == "redirect":
+		target := strings.TrimPrefix(source, "redirect:")
+		if err := checkRedirectTarget(target); err != nil {
+			return err
+		}
+		h.Redirect = target
 	case isProxyTarget(source):
 		t, err := expandProxyTarget(source)
 		if err != nil {
@@ -290,6 +343,9 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, mount, so
 		}
 		h.Path = source
 	}
+	if err := e.applyHandlerFlags(h); err != nil {
+		return err
+	}
 
 	cursc, err := e.lc.GetServeConfig(ctx)
 	if err != nil {
@@ -342,6 +398,56 @@ func (e *serveEnv) handleWebServe(ctx context.Context, srvPort uint16, mount, so
 	return nil
 }
 
+// applyHandlerFlags sets the fields of h controlled by flags, and checks
+// that the result is a valid handler.
+func (e *serveEnv) applyHandlerFlags(h *ipn.HTTPHandler) error {
+	h.StatusCode = e.code
+	h.NoDirList = e.noDirList
+	var err error
+	if h.SetResponseHeaders, err = parseHeaderFlags(e.setHeaders); err != nil {
+		return err
+	}
+	if h.SetRequestHeaders, err = parseHeaderFlags(e.proxySetHeaders); err != nil {
+		return err
+	}
+	h.RemoveResponseHeaders = e.removeHeaders
+	h.RemoveRequestHeaders = e.proxyRemoveHeaders
+	if err := h.Check(); err != nil {
+		return fmt.Errorf("unable to serve; %w", err)
+	}
+	return nil
+}
+
+// parseHeaderFlags parses "Name: value" flag values into a header map.
+// It returns nil if there are no values.
+func parseHeaderFlags(vals []string) (map[string]string, error) {
+	var m map[string]string
+	for _, v := range vals {
+		k, val, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q; want \"Name: value\"", v)
+		}
+		mak.Set(&m, strings.TrimSpace(k), strings.TrimSpace(val))
+	}
+	return m, nil
+}
+
+// checkRedirectTarget reports whether target is a valid redirect: source,
+// either an absolute http(s) URL or an absolute path.
+func checkRedirectTarget(target string) error {
+	if target == "" {
+		return errors.New("unable to serve; redirect target cannot be empty")
+	}
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("unable to serve; redirect target %q must be an absolute path or an http:// or https:// URL", target)
+	}
+	return nil
+}
+
 // isProxyTarget reports whether source is a valid proxy target.
 func isProxyTarget(source string) bool {
 	if strings.HasPrefix(source, "http://") ||
@@ -582,6 +688,87 @@ func (e *serveEnv) handleTCPServeRemove(ctx context.Context, src uint16) error {
 	return errors.New("error: serve config does not exist")
 }
 
+// handleUDPServe handles the "tailscale serve udp:..." subcommand. It
+// configures the serve config to forward datagrams sent to srcPort to a
+// local UDP server.
+//
+// Examples:
+//   - tailscale serve udp:53 udp://localhost:5353
+//   - tailscale serve --idle-timeout=10m udp:51820 udp://127.0.0.1:51821
+func (e *serveEnv) handleUDPServe(ctx context.Context, srcPort uint16, dest string) error {
+	dstURL, err := url.Parse(dest)
+	if err != nil || dstURL.Scheme != "udp" {
+		fmt.Fprintf(os.Stderr, "error: invalid UDP source %q\n", dest)
+		fmt.Fprint(os.Stderr, "must be of the form udp://localhost:<port>\n\n")
+		return flag.ErrHelp
+	}
+	host, dstPortStr, err := net.SplitHostPort(dstURL.Host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid UDP source %q: %v\n\n", dest, err)
+		return flag.ErrHelp
+	}
+
+	switch host {
+	case "localhost", "127.0.0.1":
+		// ok
+	default:
+		fmt.Fprintf(os.Stderr, "error: invalid UDP source %q\n", dest)
+		fmt.Fprint(os.Stderr, "must be one of: localhost or 127.0.0.1\n\n")
+		return flag.ErrHelp
+	}
+
+	if p, err := strconv.ParseUint(dstPortStr, 10, 16); p == 0 || err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid port %q\n\n", dstPortStr)
+		return flag.ErrHelp
+	}
+	if e.idleTimeout < 0 || (e.idleTimeout > 0 && e.idleTimeout < time.Second) {
+		return fmt.Errorf("invalid --idle-timeout %v; must be at least 1s", e.idleTimeout)
+	}
+
+	cursc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+
+	mak.Set(&sc.UDP, srcPort, &ipn.UDPPortHandler{
+		UDPForward:     "127.0.0.1:" + dstPortStr,
+		IdleTimeoutSec: int(e.idleTimeout / time.Second),
+	})
+
+	if !reflect.DeepEqual(cursc, sc) {
+		if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUDPServeRemove removes the UDP forwarding configuration for the
+// given serve port.
+func (e *serveEnv) handleUDPServeRemove(ctx context.Context, src uint16) error {
+	cursc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	if !sc.IsUDPForwardingOnPort(src) {
+		return errors.New("error: serve config does not exist")
+	}
+	delete(sc.UDP, src)
+	// clear map mostly for testing
+	if len(sc.UDP) == 0 {
+		sc.UDP = nil
+	}
+	return e.lc.SetServeConfig(ctx, sc)
+}
+
 // runServeStatus is the entry point for the "serve status"
 // subcommand and prints the current serve config.
 //
@@ -603,7 +790,7 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		return nil
 	}
 	printFunnelStatus(ctx)
-	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.UDP) == 0 && len(sc.Web) == 0 && len(sc.AllowFunnel) == 0) {
 		printf("No serve config\n")
 		return nil
 	}
@@ -617,6 +804,10 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 		}
 		printf("\n")
 	}
+	if len(sc.UDP) > 0 {
+		printUDPStatusTree(sc, st)
+		printf("\n")
+	}
 	for hp := range sc.Web {
 		printWebStatusTree(sc, hp)
 		printf("\n")
@@ -657,6 +848,23 @@ func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.S
 	return nil
 }
 
+func printUDPStatusTree(sc *ipn.ServeConfig, st *ipnstate.Status) {
+	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
+	ports := make([]uint16, 0, len(sc.UDP))
+	for p := range sc.UDP {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	for _, p := range ports {
+		h := sc.UDP[p]
+		printf("|-- udp://%s (idle timeout %v, tailnet only)\n", net.JoinHostPort(dnsName, strconv.Itoa(int(p))), h.IdleTimeout())
+		for _, a := range st.TailscaleIPs {
+			printf("|-- udp://%s\n", net.JoinHostPort(a.String(), strconv.Itoa(int(p))))
+		}
+		printf("|--> udp://%s\n", h.UDPForward)
+	}
+}
+
 func printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) {
 	if sc == nil {
 		return
@@ -679,6 +887,10 @@ func printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) {
 			return "proxy", h.Proxy
 		case h.Text != "":
 			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+		case h.Redirect != "":
+			return "redirect", h.Redirect
+		case h.StatusCode != 0:
+			return "status", strconv.Itoa(h.StatusCode)
 		}
 		return "", ""
 	}
@@ -695,7 +907,7 @@ func printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) {
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
 		t, d := srvTypeAndDesc(h)
-		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
+		printf("%s %s%s %-8s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
 	}
 }
 
@@ -591,6 +591,132 @@ type step struct {
 		},
 	})
 
+	// redirects, status codes and header rules
+	add(step{reset: true})
+	add(step{
+		command: cmd("https:443 / redirect:https://example.com/"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Redirect: "https://example.com/"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("--code=308 https:443 /old redirect:/new"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Redirect: "https://example.com/"},
+					"/old": {Redirect: "/new", StatusCode: 308},
+				}},
+			},
+		},
+	})
+	add(step{ // redirect must be absolute
+		command: cmd("https:443 /foo redirect:example.com"),
+		wantErr: anyErr(),
+	})
+	add(step{ // redirect needs a 3xx status code
+		command: cmd("--code=200 https:443 /foo redirect:/bar"),
+		wantErr: anyErr(),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("--code=404 --set-header=Cache-Control:no-store https:443 / text:gone"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Text:               "gone",
+						StatusCode:         404,
+						SetResponseHeaders: map[string]string{"Cache-Control": "no-store"},
+					},
+				}},
+			},
+		},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("--proxy-set-header=X-Auth:secret --proxy-remove-header=Cookie --remove-header=Server https:443 / localhost:3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Proxy:                 "http://127.0.0.1:3000",
+						SetRequestHeaders:     map[string]string{"X-Auth": "secret"},
+						RemoveRequestHeaders:  []string{"Cookie"},
+						RemoveResponseHeaders: []string{"Server"},
+					},
+				}},
+			},
+		},
+	})
+	add(step{ // request header rules only apply to proxies
+		command: cmd("--proxy-set-header=X-Auth:secret https:443 /foo text:hi"),
+		wantErr: anyErr(),
+	})
+	add(step{ // malformed header
+		command: cmd("--set-header=X-Foo https:443 /foo text:hi"),
+		wantErr: anyErr(),
+	})
+
+	// udp forwarding
+	add(step{reset: true})
+	add(step{
+		command: cmd("udp:53 udp://localhost:5353"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}},
+		},
+	})
+	add(step{
+		command: cmd("--idle-timeout=10m udp:51820 udp://127.0.0.1:51821"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53:    {UDPForward: "127.0.0.1:5353"},
+				51820: {UDPForward: "127.0.0.1:51821", IdleTimeoutSec: 600},
+			},
+		},
+	})
+	add(step{ // udp and tcp on the same port don't conflict
+		command: cmd("tcp:53 tcp://localhost:5353"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "127.0.0.1:5353"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53:    {UDPForward: "127.0.0.1:5353"},
+				51820: {UDPForward: "127.0.0.1:51821", IdleTimeoutSec: 600},
+			},
+		},
+	})
+	add(step{
+		command: cmd("udp:51820 off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{53: {TCPForward: "127.0.0.1:5353"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}},
+		},
+	})
+	add(step{
+		command: cmd("udp:51820 off"), // already off
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("udp:5353 udp://somehost:53"), // invalid host
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("udp:5353 tcp://localhost:53"), // invalid scheme
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("--idle-timeout=10ms udp:5353 udp://localhost:53"),
+		wantErr: anyErr(),
+	})
+
 	// error states
 	add(step{reset: true})
 	add(step{ // tcp forward 5432 on serve port 443
@@ -9,11 +9,14 @@
 	"flag"
 	"fmt"
 	"net/netip"
+	"strconv"
+	"strings"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/ipn"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
 )
 
 var setCmd = &ffcli.Command{
@@ -44,6 +47,11 @@ type setArgsT struct {
 	acceptedRisks          string
 	profileName            string
 	forceDaemon            bool
+	derpHome               string
+	derpAvoid              string
+	derpPeerAware          bool
+	dnsBlocklists          string
+	dnsBlockPolicy         string
 }
 
 func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
@@ -59,6 +67,11 @@ func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
 	setf.StringVar(&setArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	setf.StringVar(&setArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
 	setf.BoolVar(&setArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the miragenet")
+	setf.StringVar(&setArgs.derpHome, "derp-home", "", "DERP region (ID or code) to always use as home, or empty string to pick one automatically")
+	setf.StringVar(&setArgs.derpAvoid, "derp-avoid", "", "DERP regions (comma-separated IDs or codes) never to use as home, or empty string to allow all")
+	setf.BoolVar(&setArgs.derpPeerAware, "derp-peer-aware", false, "prefer the home DERP regions of the most active peers over ones with slightly lower latency")
+	setf.StringVar(&setArgs.dnsBlocklists, "dns-blocklists", "", "lists of domains for MagicDNS to block (comma-separated file paths or http(s) URLs), or empty string to block none")
+	setf.StringVar(&setArgs.dnsBlockPolicy, "dns-block-policy", "", `how MagicDNS answers queries for blocked domains: "nxdomain" or "zeroip"`)
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		setf.StringVar(&setArgs.opUser, "operator", "", "Unix username to allow to operate on miraged without sudo")
 	}
@@ -97,8 +110,20 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 			Hostname:               setArgs.hostname,
 			OperatorUser:           setArgs.opUser,
 			ForceDaemon:            setArgs.forceDaemon,
+			DERPHomePeerAware:      setArgs.derpPeerAware,
+			DNSBlockPolicy:         setArgs.dnsBlockPolicy,
 		},
 	}
+	for _, s := range strings.Split(setArgs.dnsBlocklists, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			maskedPrefs.DNSBlocklists = append(maskedPrefs.DNSBlocklists, s)
+		}
+	}
+	switch setArgs.dnsBlockPolicy {
+	case "", "nxdomain", "zeroip":
+	default:
+		return fmt.Errorf("--dns-block-policy: unknown policy %q", setArgs.dnsBlockPolicy)
+	}
 
 	if setArgs.exitNodeIP != "" {
 		if err := maskedPrefs.Prefs.SetExitNodeIP(setArgs.exitNodeIP, st); err != nil {
@@ -124,6 +149,32 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 		return flag.ErrHelp
 	}
 
+	if maskedPrefs.DERPHomeRegionSet || maskedPrefs.DERPAvoidRegionsSet {
+		dm, err := localClient.CurrentDERPMap(ctx)
+		if err != nil {
+			return err
+		}
+		if maskedPrefs.DERPHomeRegionSet {
+			ids, err := parseDERPRegions(dm, setArgs.derpHome)
+			if err != nil {
+				return err
+			}
+			switch len(ids) {
+			case 0:
+			case 1:
+				maskedPrefs.DERPHomeRegion = ids[0]
+			default:
+				return fmt.Errorf("--derp-home takes a single DERP region, got %q", setArgs.derpHome)
+			}
+		}
+		if maskedPrefs.DERPAvoidRegionsSet {
+			maskedPrefs.DERPAvoidRegions, err = parseDERPRegions(dm, setArgs.derpAvoid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	curPrefs, err := localClient.GetPrefs(ctx)
 	if err != nil {
 		return err
@@ -180,3 +231,30 @@ func calcAdvertiseRoutesForSet(advertiseExitNodeSet, advertiseRoutesSet bool, cu
 	}
 	return nil, nil
 }
+
+// parseDERPRegions parses s, a comma-separated list of DERP region IDs or
+// codes, into the IDs of the regions in dm.
+func parseDERPRegions(dm *tailcfg.DERPMap, s string) ([]int, error) {
+	var ids []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			id = 0
+			for rid, r := range dm.Regions {
+				if strings.EqualFold(r.RegionCode, f) {
+					id = rid
+					break
+				}
+			}
+		}
+		if dm.Regions[id] == nil {
+			return nil, fmt.Errorf("unknown DERP region %q", f)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
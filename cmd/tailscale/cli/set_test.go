@@ -10,6 +10,7 @@
 
 	"tailscale.com/ipn"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/ptr"
 )
 
@@ -129,3 +130,34 @@ func TestCalcAdvertiseRoutesForSet(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDERPRegions(t *testing.T) {
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "fra"},
+		},
+	}
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "1", want: []int{1}},
+		{in: "fra", want: []int{2}},
+		{in: "NYC, 2", want: []int{1, 2}},
+		{in: "3", wantErr: true},
+		{in: "sfo", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDERPRegions(dm, tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDERPRegions(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDERPRegions(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -6,7 +6,9 @@
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/netip"
@@ -26,7 +28,7 @@
 
 var sshCmd = &ffcli.Command{
 	Name:       "ssh",
-	ShortUsage: "ssh [user@]<host> [args...]",
+	ShortUsage: "ssh [user@]<host> [args...]\n  ssh --explain [user@]<source-host>",
 	ShortHelp:  "SSH to a Mirage machine",
 	LongHelp: strings.TrimSpace(`
 
@@ -43,11 +45,28 @@
   system 'ssh' command that connects via a pipe through miraged.
 * It automatically checks the destination server's SSH host key against the
   node's SSH host key as advertised via the Mirage coordination server.
+
+With --explain, it instead shows how this machine's Mirage SSH server would
+handle a connection from <source-host> as the given SSH user: which SSH
+policy is in effect, including any local policy file given to miraged with
+--ssh-policy-file, and which of its rules matched.
 `),
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("ssh")
+		fs.BoolVar(&sshArgs.explain, "explain", false, "explain how this machine's SSH server would handle a connection from the given host, instead of connecting to it")
+		return fs
+	})(),
 	Exec: runSSH,
 }
 
+var sshArgs struct {
+	explain bool
+}
+
 func runSSH(ctx context.Context, args []string) error {
+	if sshArgs.explain {
+		return runSSHExplain(ctx, args)
+	}
 	if runtime.GOOS == "darwin" && version.IsSandboxedMacOS() && !envknob.UseWIPCode() {
 		return errors.New("The 'mirage ssh' subcommand is not available on sandboxed macOS builds.\nUse the regular 'ssh' client instead.")
 	}
@@ -143,6 +162,69 @@ func runSSH(ctx context.Context, args []string) error {
 	return execSSH(ssh, argv)
 }
 
+func runSSHExplain(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ssh --explain [user@]<source-host>")
+	}
+	username, host, ok := strings.Cut(args[0], "@")
+	if !ok {
+		host = args[0]
+		lu, err := user.Current()
+		if err != nil {
+			return err
+		}
+		username = lu.Username
+	}
+	ip, _, err := tailscaleIPFromArg(ctx, host)
+	if err != nil {
+		return err
+	}
+	src, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("unknown host %q", host)
+	}
+	e, err := localClient.DebugSSHPolicy(ctx, src, username)
+	if err != nil {
+		return err
+	}
+
+	if e.File != "" {
+		printf("Local SSH policy file: %s (mode %s)\n", e.File, e.FileMode)
+		if e.FileError != "" {
+			printf("  not in use: %s\n", e.FileError)
+		}
+	}
+	if e.Source == "" {
+		outln("No SSH policy is in effect; all connections are rejected.")
+		return nil
+	}
+	printf("SSH policy in effect: %s\n\n", e.Source)
+	for i, r := range e.Rules {
+		printf("%s rule %d: %s\n", r.Source, r.Index, r.Result)
+		if i == e.Matched {
+			j, err := json.MarshalIndent(r.Rule, "  ", "  ")
+			if err != nil {
+				return err
+			}
+			printf("  %s\n", j)
+		}
+	}
+	outln()
+	if e.Matched < 0 {
+		printf("No rule matched; a connection from %s as %q would be rejected.\n", host, username)
+		return nil
+	}
+	switch a := e.Rules[e.Matched].Rule.Action; {
+	case a.Reject:
+		printf("A connection from %s as %q would be rejected.\n", host, username)
+	case a.HoldAndDelegate != "":
+		printf("A connection from %s as %q would run as local user %q, once approved by %s.\n", host, username, e.LocalUser, a.HoldAndDelegate)
+	default:
+		printf("A connection from %s as %q would be accepted as local user %q.\n", host, username, e.LocalUser)
+	}
+	return nil
+}
+
 func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
@@ -16,6 +16,7 @@
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/toqueteos/webbrowser"
@@ -227,6 +228,15 @@ func runStatus(ctx context.Context, args []string) error {
 		outln()
 		printHealth()
 	}
+	if st.NetMapStale {
+		outln()
+		printf("# The coordination server hasn't been reachable since startup; using the\n")
+		printf("# network map it sent at %v. Peers may be out of date.\n", st.NetMapCachedAt.Local().Format(time.RFC1123))
+	}
+	if st.ControlFailover {
+		outln()
+		printf("# The preferred coordination server is unreachable; using %s instead.\n", st.ControlURL)
+	}
 	printFunnelStatus(ctx)
 	return nil
 }
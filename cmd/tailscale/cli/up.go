@@ -105,6 +105,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT, cmd string) *flag.FlagSet {
 	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
 
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
+	upf.StringVar(&upArgs.serverFailover, "login-server-failover", "", "base URLs (comma-separated, in order of preference) of replicas of the control server to fail over to when it's unreachable, or empty string for none")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", acceptRouteDefault(goos), "accept routes advertised by other Mirage nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "HIDDEN: install host routes to other Mirage nodes")
@@ -154,6 +155,7 @@ type upArgsT struct {
 	qr                     bool
 	reset                  bool
 	server                 string
+	serverFailover         string
 	acceptRoutes           bool
 	acceptDNS              bool
 	singleRoutes           bool
@@ -330,8 +332,20 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		return nil, err
 	}
 
+	var failoverURLs []string
+	if upArgs.serverFailover != "" {
+		for _, s := range strings.Split(upArgs.serverFailover, ",") {
+			s = strings.TrimSpace(s)
+			if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("--login-server-failover: invalid URL %q", s)
+			}
+			failoverURLs = append(failoverURLs, s)
+		}
+	}
+
 	prefs := ipn.NewPrefs()
 	prefs.ControlURL = upArgs.server
+	prefs.ControlFailoverURLs = failoverURLs
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
 	if distro.Get() == distro.Synology {
@@ -394,6 +408,7 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 // transition to running from a previously-logged-in but down state,
 // without changing any settings.
 func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, justEditMP *ipn.MaskedPrefs, err error) {
+	keepSetOnlyPrefs(prefs, curPrefs)
 	if !env.upArgs.reset {
 		applyImplicitPrefs(prefs, curPrefs, env)
 
@@ -450,6 +465,17 @@ func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, jus
 	return simpleUp, justEditMP, nil
 }
 
+// keepSetOnlyPrefs copies to prefs, built from "up" flags, the prefs in
+// curPrefs which only "set" can change, so that an "up" which restarts the
+// backend with prefs doesn't reset them.
+func keepSetOnlyPrefs(prefs, curPrefs *ipn.Prefs) {
+	prefs.DERPHomeRegion = curPrefs.DERPHomeRegion
+	prefs.DERPAvoidRegions = curPrefs.DERPAvoidRegions
+	prefs.DERPHomePeerAware = curPrefs.DERPHomePeerAware
+	prefs.DNSBlocklists = curPrefs.DNSBlocklists
+	prefs.DNSBlockPolicy = curPrefs.DNSBlockPolicy
+}
+
 func presentSSHToggleRisk(wantSSH, haveSSH bool, acceptedRisks string) error {
 	if !isSSHOverTailscale() || wantSSH == haveSSH {
 		return nil
@@ -783,6 +809,7 @@ func init() {
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
+	addPrefFlagMapping("login-server-failover", "ControlFailoverURLs")
 	addPrefFlagMapping("netfilter-mode", "NetfilterMode")
 	addPrefFlagMapping("shields-up", "ShieldsUp")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
@@ -791,6 +818,11 @@ func init() {
 	addPrefFlagMapping("operator", "OperatorUser")
 	addPrefFlagMapping("ssh", "RunSSH")
 	addPrefFlagMapping("nickname", "ProfileName")
+	addPrefFlagMapping("derp-home", "DERPHomeRegion")
+	addPrefFlagMapping("derp-avoid", "DERPAvoidRegions")
+	addPrefFlagMapping("derp-peer-aware", "DERPHomePeerAware")
+	addPrefFlagMapping("dns-blocklists", "DNSBlocklists")
+	addPrefFlagMapping("dns-block-policy", "DNSBlockPolicy")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
@@ -996,6 +1028,8 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.RunSSH)
 		case "login-server":
 			set(prefs.ControlURL)
+		case "login-server-failover":
+			set(strings.Join(prefs.ControlFailoverURLs, ","))
 		case "accept-routes":
 			set(prefs.RouteAll)
 		case "host-routes":
@@ -136,6 +136,8 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	sshPolicyFile  string // path of local SSH policy file, or empty
+	sshPolicyMode  ipnlocal.SSHPolicyFileMode
 }
 
 var (
@@ -165,10 +167,12 @@ func main() {
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, defaultPort()), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
-	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an ephemeral node. If empty and --statedir is provided, the default is <statedir>/miraged.state. Default: "+paths.DefaultTailscaledStateFile())
+	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an ephemeral node. If empty and --statedir is provided, the default is <statedir>/miraged.state. The state holds the node's keys and a copy of its last network map, used to reach peers if the coordination server is down at startup; the copy is obfuscated, not encrypted, so protect the state as you would the keys. Default: "+paths.DefaultTailscaledStateFile())
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.StringVar(&args.sshPolicyFile, "ssh-policy-file", "", "optional path of a JSON SSH policy file for the Mirage SSH server, used along with the control plane's SSH policy as per --ssh-policy-mode; it's reloaded when changed")
+	sshPolicyMode := flag.String("ssh-policy-mode", string(ipnlocal.SSHPolicyFileFallback), `how --ssh-policy-file is used: "fallback" to use it only when the control plane sends no SSH policy, "merge" to evaluate its rules after the control plane's, or "override" to ignore the control plane's`)
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	//	flag.BoolVar(&args.disableLogs, "no-logs-no-support", true, "disable log uploads; this also disables any technical support")
 
@@ -215,6 +219,13 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if mode, err := ipnlocal.ParseSSHPolicyFileMode(*sshPolicyMode); err != nil {
+		log.SetFlags(0)
+		log.Fatalf("--ssh-policy-mode: %v", err)
+	} else {
+		args.sshPolicyMode = mode
+	}
+
 	if args.birdSocketPath != "" && createBIRDClient == nil {
 		log.SetFlags(0)
 		log.Fatalf("--bird-socket is not supported on %s", runtime.GOOS)
@@ -499,6 +510,9 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 		dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 			return ns.DialContextTCP(ctx, dst)
 		}
+		dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+			return ns.DialContextUDP(ctx, dst)
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		var addrs []string
@@ -535,6 +549,9 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 		return nil, fmt.Errorf("ipnlocal.NewLocalBackend: %w", err)
 	}
 	lb.SetVarRoot(opts.VarRoot)
+	if args.sshPolicyFile != "" {
+		lb.SetSSHPolicyFile(args.sshPolicyFile, args.sshPolicyMode)
+	}
 	if logPol != nil {
 		lb.SetLogFlusher(logPol.Logtail.StartFlush)
 	}
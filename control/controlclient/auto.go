@@ -69,6 +69,9 @@ type Auto struct {
 	liteMapUpdateCancel  context.CancelFunc // cancels a lite map update, may be nil
 	liteMapUpdateCancels int                // how many times we've canceled a lite map update
 	inSendStatus         int                // number of sendStatus calls currently in progress
+	controlFailures      int                // consecutive failed requests to the control server in use
+	failingOver          bool               // whether a failOver goroutine is running
+	failOverWG           sync.WaitGroup     // for the failOver goroutine
 	state                State
 
 	authCtx    context.Context // context used for auth requests
@@ -160,6 +163,7 @@ func (c *Auto) SetPaused(paused bool) {
 func (c *Auto) Start() {
 	go c.authRoutine()
 	go c.mapRoutine()
+	go c.failbackRoutine()
 }
 
 // sendNewMapRequest either sends a new OmitPeers, non-streaming map request
@@ -351,6 +355,7 @@ func (c *Auto) authRoutine() {
 			health.SetAuthRoutineInError(nil)
 			err := c.direct.TryLogout(ctx)
 			goal.sendLogoutError(err)
+			c.noteControlResult(ctx, err)
 			if err != nil {
 				report(err, "TryLogout")
 				bo.BackOff(ctx, err)
@@ -386,6 +391,7 @@ func (c *Auto) authRoutine() {
 				url, err = c.direct.TryLogin(ctx, goal.token, goal.flags)
 				f = "TryLogin"
 			}
+			c.noteControlResult(ctx, err)
 			if err != nil {
 				health.SetAuthRoutineInError(err)
 				report(err, f)
@@ -537,6 +543,7 @@ func (c *Auto) mapRoutine() {
 
 				c.synced = true
 				c.inPollNetMap = true
+				c.controlFailures = 0
 				if c.loggedIn {
 					c.state = StateSynchronized
 				}
@@ -568,6 +575,7 @@ func (c *Auto) mapRoutine() {
 				continue
 			}
 
+			c.noteControlResult(ctx, err)
 			if err != nil {
 				report(err, "PollNetMap")
 				bo.BackOff(ctx, err)
@@ -749,6 +757,7 @@ func (c *Auto) Shutdown() {
 		<-c.authDone
 		c.cancelMapUnsafely()
 		<-c.mapDone
+		c.failOverWG.Wait()
 		if direct != nil {
 			direct.Close()
 		}
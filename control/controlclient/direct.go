@@ -59,10 +59,9 @@
 
 // Direct is the client that connects to a tailcontrol server for a node.
 type Direct struct {
-	httpc                  *http.Client // HTTP client used to talk to tailcontrol
+	httpTestClient         *http.Client // or nil
 	dialer                 *tsdial.Dialer
 	dnsCache               *dnscache.Resolver
-	serverURL              string // URL of the tailcontrol server
 	timeNow                func() time.Time
 	lastPrintMap           time.Time
 	newDecompressor        func() (Decompressor, error)
@@ -86,6 +85,12 @@ type Direct struct {
 	serverKey      key.MachinePublic // original ("legacy") nacl crypto_box-based public key
 	serverNoiseKey key.MachinePublic
 
+	// servers are the control servers to use, in order of preference:
+	// Options.ServerURL, then Options.FailoverServerURLs. They share
+	// serverKey and serverNoiseKey. serverIdx is the one in use.
+	servers   []controlServer
+	serverIdx int
+
 	sfGroup     singleflight.Group[struct{}, *NoiseClient] // protects noiseClient creation.
 	noiseClient *NoiseClient
 
@@ -104,6 +109,7 @@ type Options struct {
 	Persist              persist.Persist                    // initial persistent data
 	GetMachinePrivateKey func() (key.MachinePrivate, error) // returns the machine key to use
 	ServerURL            string                             // URL of the tailcontrol server
+	FailoverServerURLs   []string                           // optional tailcontrol servers to fail over to, in order; they must share ServerURL's keys
 	AuthKey              string                             // optional node auth key for auto registration
 	TimeNow              func() time.Time                   // time.Now implementation used by Client
 	Hostinfo             *tailcfg.Hostinfo                  // non-nil passes ownership, nil means to use default using os.Hostname, etc
@@ -186,11 +192,6 @@ func NewDirect(opts Options) (*Direct, error) {
 	if opts.GetMachinePrivateKey == nil {
 		return nil, errors.New("controlclient.New: no GetMachinePrivateKey specified")
 	}
-	opts.ServerURL = strings.TrimRight(opts.ServerURL, "/")
-	serverURL, err := url.Parse(opts.ServerURL)
-	if err != nil {
-		return nil, err
-	}
 	if opts.TimeNow == nil {
 		opts.TimeNow = time.Now
 	}
@@ -208,33 +209,9 @@ func NewDirect(opts Options) (*Direct, error) {
 		NetMon:           opts.NetMon,
 	}
 
-	httpc := opts.HTTPTestClient
-	if httpc == nil && runtime.GOOS == "js" {
-		// In js/wasm, net/http.Transport (as of Go 1.18) will
-		// only use the browser's Fetch API if you're using
-		// the DefaultClient (or a client without dial hooks
-		// etc set).
-		httpc = http.DefaultClient
-	}
-	if httpc == nil {
-		tr := http.DefaultTransport.(*http.Transport).Clone()
-		tr.Proxy = tshttpproxy.ProxyFromEnvironment
-		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
-		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
-		tr.DialContext = dnscache.Dialer(opts.Dialer.SystemDial, dnsCache)
-		tr.DialTLSContext = dnscache.TLSDialer(opts.Dialer.SystemDial, dnsCache, tr.TLSClientConfig)
-		tr.ForceAttemptHTTP2 = true
-		// Disable implicit gzip compression; the various
-		// handlers (register, map, set-dns, etc) do their own
-		// zstd compression per naclbox.
-		tr.DisableCompression = true
-		httpc = &http.Client{Transport: tr}
-	}
-
 	c := &Direct{
-		httpc:                  httpc,
+		httpTestClient:         opts.HTTPTestClient,
 		getMachinePrivKey:      opts.GetMachinePrivateKey,
-		serverURL:              opts.ServerURL,
 		timeNow:                opts.TimeNow,
 		logf:                   opts.Logf,
 		newDecompressor:        opts.NewDecompressor,
@@ -255,6 +232,13 @@ func NewDirect(opts Options) (*Direct, error) {
 		dnsCache:               dnsCache,
 		dialPlan:               opts.DialPlan,
 	}
+	for _, u := range append([]string{opts.ServerURL}, opts.FailoverServerURLs...) {
+		s, err := c.newControlServer(u)
+		if err != nil {
+			return nil, err
+		}
+		c.servers = append(c.servers, s)
+	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
 	} else {
@@ -274,6 +258,59 @@ func NewDirect(opts Options) (*Direct, error) {
 	return c, nil
 }
 
+// controlServer is a control server that a Direct can use.
+type controlServer struct {
+	url   string       // with no trailing slash
+	httpc *http.Client // HTTP client used to talk to it
+}
+
+// newControlServer returns a controlServer for the control server at
+// serverURL.
+func (c *Direct) newControlServer(serverURL string) (controlServer, error) {
+	serverURL = strings.TrimRight(serverURL, "/")
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return controlServer{}, err
+	}
+	httpc := c.httpTestClient
+	if httpc == nil && runtime.GOOS == "js" {
+		// In js/wasm, net/http.Transport (as of Go 1.18) will
+		// only use the browser's Fetch API if you're using
+		// the DefaultClient (or a client without dial hooks
+		// etc set).
+		httpc = http.DefaultClient
+	}
+	if httpc == nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = tshttpproxy.ProxyFromEnvironment
+		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
+		tr.TLSClientConfig = tlsdial.Config(u.Hostname(), tr.TLSClientConfig)
+		tr.DialContext = dnscache.Dialer(c.dialer.SystemDial, c.dnsCache)
+		tr.DialTLSContext = dnscache.TLSDialer(c.dialer.SystemDial, c.dnsCache, tr.TLSClientConfig)
+		tr.ForceAttemptHTTP2 = true
+		// Disable implicit gzip compression; the various
+		// handlers (register, map, set-dns, etc) do their own
+		// zstd compression per naclbox.
+		tr.DisableCompression = true
+		httpc = &http.Client{Transport: tr}
+	}
+	return controlServer{url: serverURL, httpc: httpc}, nil
+}
+
+// serverLocked returns the control server in use.
+//
+// c.mu must be held.
+func (c *Direct) serverLocked() controlServer {
+	return c.servers[c.serverIdx]
+}
+
+// server returns the control server in use.
+func (c *Direct) server() controlServer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverLocked()
+}
+
 // Close closes the underlying Noise connection(s).
 func (c *Direct) Close() error {
 	c.mu.Lock()
@@ -429,6 +466,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	tryingNewKey := c.tryingNewKey
 	serverKey := c.serverKey
 	serverNoiseKey := c.serverNoiseKey
+	server := c.serverLocked()
 	authKey, isWrapped, wrappedSig, wrappedKey := decodeWrappedAuthkey(c.authKey, c.logf)
 	hi := c.hostInfoLocked()
 	backendLogID := hi.BackendLogID
@@ -460,11 +498,11 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 
 	c.logf("doLogin(regen=%v, hasUrl=%v)", regen, opt.URL != "")
 	if serverKey.IsZero() {
-		keys, err := loadServerPubKeys(ctx, c.httpc, c.serverURL)
+		keys, err := loadServerPubKeys(ctx, server.httpc, server.url)
 		if err != nil {
-			return regen, opt.URL, nil, err
+			return regen, opt.URL, nil, serverUnreachable(err)
 		}
-		c.logf("control server key from %s: ts2021=%s, legacy=%v", c.serverURL, keys.PublicKey.ShortString(), keys.LegacyPublicKey.ShortString())
+		c.logf("control server key from %s: ts2021=%s, legacy=%v", server.url, keys.PublicKey.ShortString(), keys.LegacyPublicKey.ShortString())
 
 		c.mu.Lock()
 		c.serverKey = keys.LegacyPublicKey
@@ -478,7 +516,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 		// We're not going to need it and it's nicer to the
 		// server.
 		if !serverNoiseKey.IsZero() {
-			c.httpc.CloseIdleConnections()
+			server.httpc.CloseIdleConnections()
 		}
 	}
 	var oldNodeKey key.NodePublic
@@ -561,7 +599,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	request.Auth.Provider = persist.Provider
 	request.Auth.LoginName = persist.LoginName
 	request.Auth.AuthKey = authKey
-	err = signRegisterRequest(&request, c.serverURL, c.serverKey, machinePrivKey.Public())
+	err = signRegisterRequest(&request, server.url, serverKey, machinePrivKey.Public())
 	if err != nil {
 		// If signing failed, clear all related fields
 		request.SignatureType = tailcfg.SignatureNone
@@ -584,15 +622,15 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	var url string
 	var httpc httpClient
 	if serverNoiseKey.IsZero() {
-		httpc = c.httpc
-		url = fmt.Sprintf("%s/machine/%s", c.serverURL, machinePrivKey.Public().UntypedHexString())
+		httpc = server.httpc
+		url = fmt.Sprintf("%s/machine/%s", server.url, machinePrivKey.Public().UntypedHexString())
 	} else {
 		request.Version = tailcfg.CurrentCapabilityVersion
 		httpc, err = c.getNoiseClient()
 		if err != nil {
 			return regen, opt.URL, nil, fmt.Errorf("getNoiseClient: %w", err)
 		}
-		url = fmt.Sprintf("%s/machine/register", c.serverURL)
+		url = fmt.Sprintf("%s/machine/register", server.url)
 		url = strings.Replace(url, "http:", "https:", 1)
 	}
 	bodyData, err := encode(request, serverKey, serverNoiseKey, machinePrivKey)
@@ -605,13 +643,17 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	}
 	res, err := httpc.Do(req)
 	if err != nil {
-		return regen, opt.URL, nil, fmt.Errorf("register request: %w", err)
+		return regen, opt.URL, nil, fmt.Errorf("register request: %w", serverUnreachable(err))
 	}
 	if res.StatusCode != 200 {
 		msg, _ := io.ReadAll(res.Body)
 		res.Body.Close()
-		return regen, opt.URL, nil, fmt.Errorf("register request: http %d: %.200s",
+		err := fmt.Errorf("register request: http %d: %.200s",
 			res.StatusCode, strings.TrimSpace(string(msg)))
+		if res.StatusCode >= 500 {
+			err = serverUnreachable(err)
+		}
+		return regen, opt.URL, nil, err
 	}
 	resp := tailcfg.RegisterResponse{}
 	if err := decode(res, &resp, serverKey, serverNoiseKey, machinePrivKey); err != nil {
@@ -811,7 +853,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 
 	c.mu.Lock()
 	persist := c.persist
-	serverURL := c.serverURL
+	server := c.serverLocked()
 	serverKey := c.serverKey
 	serverNoiseKey := c.serverNoiseKey
 	hi := c.hostInfoLocked()
@@ -910,14 +952,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 	var url string
 	var httpc httpClient
 	if serverNoiseKey.IsZero() {
-		httpc = c.httpc
-		url = fmt.Sprintf("%s/machine/%s/map", serverURL, machinePubKey.UntypedHexString())
+		httpc = server.httpc
+		url = fmt.Sprintf("%s/machine/%s/map", server.url, machinePubKey.UntypedHexString())
 	} else {
 		httpc, err = c.getNoiseClient()
 		if err != nil {
 			return fmt.Errorf("getNoiseClient: %w", err)
 		}
-		url = fmt.Sprintf("%s/machine/map", serverURL)
+		url = fmt.Sprintf("%s/machine/map", server.url)
 		url = strings.Replace(url, "http:", "https:", 1)
 	}
 
@@ -929,14 +971,18 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 	res, err := httpc.Do(req)
 	if err != nil {
 		vlogf("netmap: Do: %v", err)
-		return err
+		return serverUnreachable(err)
 	}
 	vlogf("netmap: Do = %v after %v", res.StatusCode, time.Since(t0).Round(time.Millisecond))
 	if res.StatusCode != 200 {
 		msg, _ := io.ReadAll(res.Body)
 		res.Body.Close()
-		return fmt.Errorf("initial fetch failed %d: %.200s",
+		err := fmt.Errorf("initial fetch failed %d: %.200s",
 			res.StatusCode, strings.TrimSpace(string(msg)))
+		if res.StatusCode >= 500 {
+			err = serverUnreachable(err)
+		}
+		return err
 	}
 	defer res.Body.Close()
 
@@ -994,14 +1040,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		var siz [4]byte
 		if _, err := io.ReadFull(res.Body, siz[:]); err != nil {
 			vlogf("netmap: size read error after %v: %v", time.Since(t0).Round(time.Millisecond), err)
-			return err
+			return serverUnreachable(err)
 		}
 		size := binary.LittleEndian.Uint32(siz[:])
 		vlogf("netmap: read size %v after %v", size, time.Since(t0).Round(time.Millisecond))
 		msg = append(msg[:0], make([]byte, size)...)
 		if _, err := io.ReadFull(res.Body, msg); err != nil {
 			vlogf("netmap: body read error: %v", err)
-			return err
+			return serverUnreachable(err)
 		}
 		vlogf("netmap: read body after %v", time.Since(t0).Round(time.Millisecond))
 
@@ -1086,7 +1132,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 				go logheap.LogHeap(resp.Debug.LogHeapURL)
 			}
 			if resp.Debug.GoroutineDumpURL != "" {
-				go dumpGoroutinesToURL(c.httpc, resp.Debug.GoroutineDumpURL)
+				go dumpGoroutinesToURL(server.httpc, resp.Debug.GoroutineDumpURL)
 			}
 			if sleep := time.Duration(resp.Debug.SleepSeconds * float64(time.Second)); sleep > 0 {
 				if err := sleepAsRequested(ctx, c.logf, timeoutReset, sleep); err != nil {
@@ -1353,7 +1399,7 @@ func (c *Direct) isUniquePingRequest(pr *tailcfg.PingRequest) bool {
 }
 
 func (c *Direct) answerPing(pr *tailcfg.PingRequest) {
-	httpc := c.httpc
+	httpc := c.server().httpc
 	useNoise := pr.URLIsNoise || pr.Types == "c2n" && c.noiseConfigured()
 	if useNoise {
 		nc, err := c.getNoiseClient()
@@ -1494,6 +1540,7 @@ func sleepAsRequested(ctx context.Context, logf logger.Logf, timeoutReset chan<-
 func (c *Direct) getNoiseClient() (*NoiseClient, error) {
 	c.mu.Lock()
 	serverNoiseKey := c.serverNoiseKey
+	serverURL := c.serverLocked().url
 	nc := c.noiseClient
 	c.mu.Unlock()
 	if serverNoiseKey.IsZero() {
@@ -1515,7 +1562,7 @@ func (c *Direct) getNoiseClient() (*NoiseClient, error) {
 		nc, err := NewNoiseClient(NoiseOpts{
 			PrivKey:      k,
 			ServerPubKey: serverNoiseKey,
-			ServerURL:    c.serverURL,
+			ServerURL:    serverURL,
 			Dialer:       c.dialer,
 			DNSCache:     c.dnsCache,
 			Logf:         c.logf,
@@ -1527,6 +1574,11 @@ func (c *Direct) getNoiseClient() (*NoiseClient, error) {
 		}
 		c.mu.Lock()
 		defer c.mu.Unlock()
+		if c.serverLocked().url != serverURL {
+			// Failed over to another server meanwhile.
+			nc.Close()
+			return nil, errors.New("control server changed")
+		}
 		c.noiseClient = nc
 		return nc, nil
 	})
@@ -1585,6 +1637,7 @@ func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) (err er
 	}
 	c.mu.Lock()
 	serverKey := c.serverKey
+	server := c.serverLocked()
 	c.mu.Unlock()
 
 	if serverKey.IsZero() {
@@ -1606,12 +1659,12 @@ func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) (err er
 	}
 	body := bytes.NewReader(bodyData)
 
-	u := fmt.Sprintf("%s/machine/%s/set-dns", c.serverURL, machinePrivKey.Public().UntypedHexString())
+	u := fmt.Sprintf("%s/machine/%s/set-dns", server.url, machinePrivKey.Public().UntypedHexString())
 	hreq, err := http.NewRequestWithContext(ctx, "POST", u, body)
 	if err != nil {
 		return err
 	}
-	res, err := c.httpc.Do(hreq)
+	res, err := server.httpc.Do(hreq)
 	if err != nil {
 		return err
 	}
@@ -38,8 +38,8 @@ func TestNewDirect(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if c.serverURL != opts.ServerURL {
-		t.Errorf("c.serverURL got %v want %v", c.serverURL, opts.ServerURL)
+	if got := c.ServerURL(); got != opts.ServerURL {
+		t.Errorf("c.ServerURL() got %v want %v", got, opts.ServerURL)
 	}
 
 	if !hi.Equal(c.hostinfo) {
@@ -138,7 +138,7 @@ func TestTsmpPing(t *testing.T) {
 		URL: ts.URL,
 	}
 
-	err = postPingResult(now, t.Logf, c.httpc, pr, pingRes)
+	err = postPingResult(now, t.Logf, c.server().httpc, pr, pingRes)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,307 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// controlFailoverAfter is how many consecutive requests to the control
+	// server in use must fail before failing over to the next one.
+	controlFailoverAfter = 3
+
+	// controlCheckTimeout is how long to wait for a control server to
+	// answer when checking whether it's usable.
+	controlCheckTimeout = 10 * time.Second
+)
+
+// controlFailbackInterval is how often, while using a failover control
+// server, the more preferred ones are checked so as to fail back to them.
+// It's a var so tests can change it.
+var controlFailbackInterval = time.Minute
+
+// unreachableError wraps an error from a request to a control server
+// which suggests that the server is unreachable or unhealthy, rather than
+// that the request was refused: a transport error, or a 5xx response.
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string { return e.err.Error() }
+func (e unreachableError) Unwrap() error { return e.err }
+
+// serverUnreachable returns err wrapped as an unreachableError, or nil if
+// err is nil.
+func serverUnreachable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return unreachableError{err}
+}
+
+// ServerURL returns the URL of the control server in use.
+func (c *Direct) ServerURL() string {
+	return c.server().url
+}
+
+// serverIndex returns the index of the control server in use, and the
+// number of control servers.
+func (c *Direct) serverIndex() (i, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverIdx, len(c.servers)
+}
+
+// checkServer reports why the control server at index i can't be failed
+// over to, or nil if it can: it must be reachable, and have the same keys
+// as the others.
+func (c *Direct) checkServer(ctx context.Context, i int) error {
+	c.mu.Lock()
+	if i >= len(c.servers) {
+		c.mu.Unlock()
+		return errors.New("no such control server")
+	}
+	s := c.servers[i]
+	serverKey := c.serverKey
+	serverNoiseKey := c.serverNoiseKey
+	c.mu.Unlock()
+
+	keys, err := loadServerPubKeys(ctx, s.httpc, s.url)
+	if err != nil {
+		return err
+	}
+	if !serverKey.IsZero() && (keys.LegacyPublicKey != serverKey || keys.PublicKey != serverNoiseKey) {
+		return fmt.Errorf("%s has different keys than the control server in use", s.url)
+	}
+	return nil
+}
+
+// useServer switches to the control server at index i, if it isn't the
+// one in use. It reports whether it switched.
+func (c *Direct) useServer(i int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i == c.serverIdx || i >= len(c.servers) {
+		return false
+	}
+	c.logf("switching control server from %s to %s", c.serverLocked().url, c.servers[i].url)
+	c.serverIdx = i
+	c.resetServerConnLocked()
+	return true
+}
+
+// resetServerConnLocked drops state specific to the control server that
+// was in use, after switching to another.
+//
+// c.mu must be held.
+func (c *Direct) resetServerConnLocked() {
+	if c.noiseClient != nil {
+		c.noiseClient.Close()
+		c.noiseClient = nil
+	}
+	if c.dialPlan != nil {
+		// A dial plan is for the server that sent it.
+		c.dialPlan.Store(nil)
+	}
+}
+
+// SetFailoverServerURLs replaces Options.FailoverServerURLs. If the
+// control server in use isn't among them, it switches back to
+// Options.ServerURL, and reports that it did.
+func (c *Direct) SetFailoverServerURLs(urls []string) (switched bool, err error) {
+	c.mu.Lock()
+	old := c.servers
+	c.mu.Unlock()
+
+	servers := []controlServer{old[0]}
+	for _, u := range urls {
+		s, err := c.newControlServer(u)
+		if err != nil {
+			return false, err
+		}
+		for _, o := range old {
+			if o.url == s.url {
+				s = o // keep its connections
+				break
+			}
+		}
+		servers = append(servers, s)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur := c.serverLocked().url
+	c.servers = servers
+	for i, s := range servers {
+		if s.url == cur {
+			c.serverIdx = i
+			return false, nil
+		}
+	}
+	c.logf("control server %s removed; switching to %s", cur, servers[0].url)
+	c.serverIdx = 0
+	c.resetServerConnLocked()
+	return true, nil
+}
+
+// ServerURL returns the URL of the control server in use, and whether
+// it's one of Options.FailoverServerURLs.
+func (c *Auto) ServerURL() (url string, failover bool) {
+	c.direct.mu.Lock()
+	defer c.direct.mu.Unlock()
+	return c.direct.serverLocked().url, c.direct.serverIdx > 0
+}
+
+// SetFailoverServerURLs replaces Options.FailoverServerURLs.
+func (c *Auto) SetFailoverServerURLs(urls []string) error {
+	switched, err := c.direct.SetFailoverServerURLs(urls)
+	if err != nil {
+		return err
+	}
+	if switched {
+		c.switchedServer()
+	}
+	return nil
+}
+
+// noteControlResult records the result of requests to the control server
+// in use, made with ctx. Once controlFailoverAfter requests in a row have
+// found it unreachable, it starts failing over to the next usable control
+// server, if there is one, in a new goroutine; checking the servers can
+// take a while, and the caller is the auth or map routine.
+func (c *Auto) noteControlResult(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return // canceled on purpose; says nothing about the server
+	}
+	var uerr unreachableError
+	if err != nil && !errors.As(err, &uerr) {
+		return // failed for some other reason; says nothing either
+	}
+
+	c.mu.Lock()
+	if err == nil {
+		c.controlFailures = 0
+		c.mu.Unlock()
+		return
+	}
+	c.controlFailures++
+	if c.controlFailures < controlFailoverAfter || c.failingOver || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.failingOver = true
+	c.failOverWG.Add(1)
+	c.mu.Unlock()
+
+	go c.failOver()
+}
+
+// failOver switches to the next usable control server after the one in
+// use, if there is one. It's run by noteControlResult.
+func (c *Auto) failOver() {
+	defer c.failOverWG.Done()
+	defer func() {
+		c.mu.Lock()
+		c.failingOver = false
+		c.controlFailures = 0
+		c.mu.Unlock()
+	}()
+
+	cur, n := c.direct.serverIndex()
+	for j := 1; j < n; j++ {
+		i := (cur + j) % n
+		ctx, cancel := c.checkContext()
+		err := c.direct.checkServer(ctx, i)
+		cancel()
+		if c.isQuitting() {
+			return
+		}
+		if err != nil {
+			c.logf("control server %d not usable for failover: %v", i, err)
+			continue
+		}
+		if c.direct.useServer(i) {
+			c.switchedServer()
+		}
+		return
+	}
+}
+
+// checkContext returns a context for checking a control server, which
+// times out after controlCheckTimeout, or is canceled when c shuts down.
+func (c *Auto) checkContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), controlCheckTimeout)
+	go func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isQuitting reports whether c is shutting down.
+func (c *Auto) isQuitting() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// switchedServer restarts any auth requests and the map poll after
+// switching control servers, so that they're made to the new one.
+func (c *Auto) switchedServer() {
+	c.mu.Lock()
+	c.controlFailures = 0
+	c.mu.Unlock()
+	c.cancelAuth()
+	// Unlike in cancelMapSafely, there's no earlier request to the new
+	// server for a new one to race with.
+	c.cancelMapUnsafely()
+}
+
+// failbackRoutine periodically checks whether the control servers more
+// preferred than the one in use are usable again, and if so switches
+// back to the most preferred of them.
+func (c *Auto) failbackRoutine() {
+	t := time.NewTicker(controlFailbackInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		paused := c.paused
+		c.mu.Unlock()
+		if paused {
+			continue
+		}
+		cur, _ := c.direct.serverIndex()
+		for i := 0; i < cur; i++ {
+			ctx, cancel := c.checkContext()
+			err := c.direct.checkServer(ctx, i)
+			cancel()
+			if c.isQuitting() {
+				return
+			}
+			if err != nil {
+				c.logf("[v1] control server %d still not usable: %v", i, err)
+				continue
+			}
+			if c.direct.useServer(i) {
+				c.switchedServer()
+			}
+			break
+		}
+	}
+}
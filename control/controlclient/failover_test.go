@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/hostinfo"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tstest"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+)
+
+// flakyControl is a testcontrol.Server which can be made unavailable.
+type flakyControl struct {
+	*testcontrol.Server
+	hs   *httptest.Server
+	down atomic.Bool
+}
+
+func newFlakyControl(t *testing.T) *flakyControl {
+	fc := &flakyControl{Server: &testcontrol.Server{Logf: t.Logf}}
+	fc.hs = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fc.down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fc.Server.ServeHTTP(w, r)
+	}))
+	fc.HTTPTestServer = fc.hs
+	t.Cleanup(fc.hs.Close)
+	return fc
+}
+
+func (fc *flakyControl) setDown(down bool) {
+	fc.down.Store(down)
+	if down {
+		fc.hs.CloseClientConnections()
+	}
+}
+
+func TestControlFailover(t *testing.T) {
+	defer func(d time.Duration) { controlFailbackInterval = d }(controlFailbackInterval)
+	controlFailbackInterval = 50 * time.Millisecond
+
+	primary := newFlakyControl(t)
+	failover := newFlakyControl(t)
+	failover.UseKeysOf(primary.Server)
+
+	var c *Auto
+	netMapsFrom := make(chan string, 100) // server URL in use when each netmap arrived
+	k := key.NewMachine()
+	hi := hostinfo.New()
+	hi.BackendLogID = "test"
+	c, err := NewNoStart(Options{
+		ServerURL:          primary.BaseURL(),
+		FailoverServerURLs: []string{failover.BaseURL()},
+		Hostinfo:           hi,
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return k, nil
+		},
+		Dialer: new(tsdial.Dialer),
+		Logf:   t.Logf,
+		Status: func(st Status) {
+			if st.NetMap != nil {
+				url, _ := c.ServerURL()
+				select {
+				case netMapsFrom <- url:
+				default:
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.Start()
+	c.Login(nil, LoginDefault)
+
+	// awaitNetMapFrom waits for the client to be using the control server
+	// at url, and then to get a netmap.
+	awaitNetMapFrom := func(url string, wantFailover bool) {
+		t.Helper()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			if got, failover := c.ServerURL(); got != url || failover != wantFailover {
+				return fmt.Errorf("using %s (failover %v); want %s (failover %v)", got, failover, url, wantFailover)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		timeout := time.After(20 * time.Second)
+		for {
+			select {
+			case from := <-netMapsFrom:
+				if from == url {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no netmap from %s", url)
+			}
+		}
+	}
+
+	awaitNetMapFrom(primary.BaseURL(), false)
+
+	// The control plane's replicas share their state; so copy the node
+	// registered with the primary to the failover server.
+	nodeKey := c.TestOnlyNodePublicKey()
+	failover.UpdateNode(primary.Node(nodeKey))
+
+	primary.setDown(true)
+	awaitNetMapFrom(failover.BaseURL(), true)
+
+	primary.setDown(false)
+	awaitNetMapFrom(primary.BaseURL(), false)
+}
+
+func TestControlFailoverKeyMismatch(t *testing.T) {
+	primary := newFlakyControl(t)
+	other := newFlakyControl(t) // doesn't share primary's keys
+
+	k := key.NewMachine()
+	hi := hostinfo.New()
+	hi.BackendLogID = "test"
+	d, err := NewDirect(Options{
+		ServerURL:          primary.BaseURL(),
+		FailoverServerURLs: []string{other.BaseURL()},
+		Hostinfo:           hi,
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return k, nil
+		},
+		Dialer: new(tsdial.Dialer),
+		Logf:   t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.TryLogin(ctx, nil, LoginDefault); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkServer(ctx, 0); err != nil {
+		t.Errorf("checking primary: %v", err)
+	}
+	if err := d.checkServer(ctx, 1); err == nil {
+		t.Error("server with different keys passed check")
+	}
+
+	primary.setDown(true)
+	if err := d.checkServer(ctx, 0); err == nil {
+		t.Error("unavailable server passed check")
+	}
+
+	switched, err := d.SetFailoverServerURLs(nil)
+	if err != nil || switched {
+		t.Errorf("SetFailoverServerURLs = %v, %v; want false, nil", switched, err)
+	}
+	if d.useServer(0) {
+		t.Error("useServer switched to the server in use")
+	}
+	if i, n := d.serverIndex(); i != 0 || n != 1 {
+		t.Errorf("serverIndex = %d, %d; want 0, 1", i, n)
+	}
+}
+
+func TestControlFailoverOffRoutine(t *testing.T) {
+	primary := newFlakyControl(t)
+
+	// A failover server which never answers, so checking it lasts until
+	// the check is canceled.
+	checking := make(chan struct{}, 1)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case checking <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hung.Close)
+
+	k := key.NewMachine()
+	hi := hostinfo.New()
+	hi.BackendLogID = "test"
+	c, err := NewNoStart(Options{
+		ServerURL:          primary.BaseURL(),
+		FailoverServerURLs: []string{hung.URL},
+		Hostinfo:           hi,
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return k, nil
+		},
+		Dialer: new(tsdial.Dialer),
+		Logf:   t.Logf,
+		Status: func(Status) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+
+	// Noting the failures which start a failover doesn't wait for the
+	// failover server to be checked.
+	start := time.Now()
+	for i := 0; i < controlFailoverAfter; i++ {
+		c.noteControlResult(context.Background(), serverUnreachable(errors.New("down")))
+	}
+	if d := time.Since(start); d > controlCheckTimeout/2 {
+		t.Errorf("noteControlResult took %v", d)
+	}
+	select {
+	case <-checking:
+	case <-time.After(controlCheckTimeout / 2):
+		t.Fatal("failover server not checked")
+	}
+
+	// Shutting down cancels the check in progress.
+	done := make(chan struct{})
+	go func() {
+		c.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(controlCheckTimeout / 2):
+		t.Fatal("Shutdown waited for the failover check")
+	}
+	if url, failover := c.ServerURL(); url != primary.BaseURL() || failover {
+		t.Errorf("using %s (failover %v); want %s", url, failover, primary.BaseURL())
+	}
+}
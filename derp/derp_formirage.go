@@ -67,35 +67,49 @@ func (s *Server) createHttpc(dialer *tsdial.Dialer) *http.Client {
 }
 
 // cgao6: 用以获取控制器的公钥
-func (s *Server) prepareNoiseClient() error {
+func (s *Server) fetchControlKey(httpc *http.Client) (key.MachinePublic, error) {
 	keyURL := fmt.Sprintf("%v/key?v=%d", s.ctrlURL, tailcfg.CurrentCapabilityVersion)
 	req, err := http.NewRequestWithContext(s.ctx, "GET", keyURL, nil)
 	if err != nil {
-		return fmt.Errorf("create control key request: %v", err)
+		return key.MachinePublic{}, fmt.Errorf("create control key request: %v", err)
 	}
-	dialer := &tsdial.Dialer{Logf: s.logf}
-	httpc := s.createHttpc(dialer)
 	res, err := httpc.Do(req)
 	if err != nil {
-		return fmt.Errorf("fetch control key: %v", err)
+		return key.MachinePublic{}, fmt.Errorf("fetch control key: %v", err)
 	}
 	defer res.Body.Close()
 	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
 	if err != nil {
-		return fmt.Errorf("fetch control key response: %v", err)
+		return key.MachinePublic{}, fmt.Errorf("fetch control key response: %v", err)
 	}
 	if res.StatusCode != 200 {
-		return fmt.Errorf("fetch control key: %d", res.StatusCode)
+		return key.MachinePublic{}, fmt.Errorf("fetch control key: %d", res.StatusCode)
 	}
 	var keys tailcfg.OverTLSPublicKeyResponse
 	jsonErr := json.Unmarshal(b, &keys)
 	if jsonErr != nil {
-		return fmt.Errorf("fetch control key response: %v", jsonErr)
+		return key.MachinePublic{}, fmt.Errorf("fetch control key response: %v", jsonErr)
 	}
 	if !keys.PublicKey.IsZero() {
 		httpc.CloseIdleConnections()
 	}
-	s.ctrlPubkey = keys.PublicKey
+	return keys.PublicKey, nil
+}
+
+func (s *Server) prepareNoiseClient() error {
+	dialer := &tsdial.Dialer{Logf: s.logf}
+	httpc := s.createHttpc(dialer)
+	ctrlPubkey, err := s.fetchControlKey(httpc)
+	if err != nil {
+		// 控制器不可达时，若已从快照恢复了控制器公钥则继续使用，
+		// noise客户端会在控制器恢复后按需重新建立连接
+		if !s.trustListLoaded || s.ctrlPubkey.IsZero() {
+			return err
+		}
+		s.logf("derp: %v; using control key from trust list snapshot", err)
+		ctrlPubkey = s.ctrlPubkey
+	}
+	s.ctrlPubkey = ctrlPubkey
 
 	s.dnsCache = &dnscache.Resolver{
 		Forward:          dnscache.Get().Forward, // use default cache's forwarder
@@ -110,7 +124,7 @@ func (s *Server) prepareNoiseClient() error {
 
 		nc, err := controlclient.NewNoiseClient(controlclient.NoiseOpts{
 			PrivKey:      s.naviPriKey,
-			ServerPubKey: keys.PublicKey,
+			ServerPubKey: ctrlPubkey,
 			ServerURL:    s.ctrlURL,
 			Dialer:       dialer,
 			DNSCache:     s.dnsCache,
@@ -149,6 +163,9 @@ func (s *Server) PrepareManaged(url, id string, naviKey key.MachinePrivate) erro
 	s.naviPriKey = naviKey
 	s.trustNodesCache = cache.New(0, 0)
 	s.Cronjob = cron.New()
+	if err := s.loadTrustList(); err != nil {
+		s.logf("derp: ignoring trust list snapshot: %v", err)
+	}
 	return s.prepareNoiseClient()
 }
 
@@ -173,6 +190,9 @@ type RegisterResponse struct {
 	NaviInfo   NaviNode
 	TrustNodes []string `json:"TrustNodes"`
 	Timestamp  *time.Time
+
+	DefaultPolicy *ClientPolicy           `json:",omitempty"` // 为空则沿用本地配置
+	NodePolicies  map[string]ClientPolicy `json:",omitempty"` // 按节点的限制策略
 }
 
 func (s *Server) TryLogin() (NaviNode, error) {
@@ -192,7 +212,7 @@ func (s *Server) TryLogin() (NaviNode, error) {
 
 	res, err := s.nc.Do(req)
 	if err != nil {
-		return NaviNode{}, fmt.Errorf("register request: %w", err)
+		return s.naviInfoFromSnapshot(fmt.Errorf("register request: %w", err))
 	}
 
 	if res.StatusCode != 200 {
@@ -207,17 +227,29 @@ func (s *Server) TryLogin() (NaviNode, error) {
 		return NaviNode{}, fmt.Errorf("register request: %v", err)
 	}
 
-	s.trustNodesCache.Flush()
-	s.trustNodesCache.Set("seqnum", 0, -1)
-	for _, nkey := range resp.TrustNodes {
-		s.trustNodesCache.Set(nkey, struct{}{}, -1)
-	}
+	s.trustListMu.Lock()
+	s.naviInfo = resp.NaviInfo
+	s.trustListMu.Unlock()
+	s.setNodePolicies(resp.DefaultPolicy, resp.NodePolicies)
+	s.replaceTrustNodes(0, resp.TrustNodes)
 
 	s.logf("register response: %v", resp)
 
 	return resp.NaviInfo, nil
 }
 
+// naviInfoFromSnapshot 在控制器不可达时返回快照中的Navi配置，
+// 没有可用快照时原样返回err。
+func (s *Server) naviInfoFromSnapshot(err error) (NaviNode, error) {
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	if !s.trustListLoaded || s.naviInfo.ID == "" {
+		return NaviNode{}, err
+	}
+	s.logf("derp: %v; using navi info from trust list snapshot", err)
+	return s.naviInfo, nil
+}
+
 func (s *Server) UpdateNaviInfo(
 	naviInfo NaviNode,
 	hostname, addr, setIPv4, setIPv6, dnsProvider, dnsID, dnsKey *string,
@@ -246,6 +278,10 @@ func (s *Server) UpdateNaviInfo(
 type PullNodesListResponse struct {
 	TrustNodes []string   `json:"TrustNodes"`
 	Timestamp  *time.Time `json:"Timestamp"`
+	SeqNum     int        `json:"SeqNum,omitempty"` // 列表对应的序列号，旧控制器不下发则为0
+
+	DefaultPolicy *ClientPolicy           `json:",omitempty"` // 为空则沿用本地配置
+	NodePolicies  map[string]ClientPolicy `json:",omitempty"` // 按节点的限制策略
 }
 
 func (s *Server) PullNodesList() error {
@@ -282,11 +318,8 @@ func (s *Server) PullNodesList() error {
 	}
 	s.logf("map response: %v", resp)
 
-	s.trustNodesCache.Flush()
-	s.trustNodesCache.Set("seqnum", 0, -1)
-	for _, nkey := range resp.TrustNodes {
-		s.trustNodesCache.Set(nkey, struct{}{}, -1)
-	}
+	s.setNodePolicies(resp.DefaultPolicy, resp.NodePolicies)
+	s.replaceTrustNodes(resp.SeqNum, resp.TrustNodes)
 
 	return nil
 }
@@ -352,6 +385,8 @@ func (s *Server) NoiseUpgradeHandler(
 	router.Use(ts2021App.NoiseAuthMiddleware)
 	router.HandleFunc("/ctrl/nodes", ts2021App.NoiseNodeChangeHandler).
 		Methods(http.MethodPost)
+	router.HandleFunc("/ctrl/v2/nodes", ts2021App.NoiseNodesDeltaHandler).
+		Methods(http.MethodPost)
 	router.Handle("/ctrl/vars", expvar.Handler())
 	router.Handle("/generate_204", http.HandlerFunc(serveNoContent))
 
@@ -402,19 +437,13 @@ func (t *ts2021App) NoiseNodeChangeHandler(
 
 	log.Trace().Caller().Msgf("node change: %+v", nodesChange)
 
-	sq, ok := t.navi.trustNodesCache.Get("seqnum")
-	if !ok {
-		log.Error().Msg("seqnum not found")
-		http.Error(w, "seqnum not found", http.StatusInternalServerError)
-		return
-	}
-	seqnum, ok := sq.(int)
-	if !ok {
-		log.Error().Msg("seqnum not int")
-		http.Error(w, "seqnum not int", http.StatusInternalServerError)
+	applied, err := t.navi.applyNodeChange(&nodesChange)
+	if err != nil {
+		log.Error().Err(err).Msg("error reading seqnum")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if nodesChange.SeqNum != seqnum+1 {
+	if !applied {
 		log.Warn().Msg("seqnum not match! Need to pull nodes list again ")
 		err := t.navi.PullNodesList()
 		if err != nil {
@@ -423,11 +452,121 @@ func (t *ts2021App) NoiseNodeChangeHandler(
 		}
 		return
 	}
-	t.navi.trustNodesCache.Set("seqnum", nodesChange.SeqNum, -1)
-	if nodesChange.AddNode != "" {
-		t.navi.trustNodesCache.Set(nodesChange.AddNode, struct{}{}, -1)
+}
+
+// applyNodeChange 在序列号连续时应用单个受信列表变更，并报告是否已应用。
+// 序列号的检查与应用在同一次加锁内完成，以免并发的变更都通过检查。
+func (s *Server) applyNodeChange(change *NodesChange) (applied bool, err error) {
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	seqnum, err := s.trustListSeq()
+	if err != nil {
+		return false, err
 	}
-	if nodesChange.RemoveNode != "" {
-		t.navi.trustNodesCache.Delete(nodesChange.RemoveNode)
+	if change.SeqNum != seqnum+1 {
+		return false, nil
+	}
+	s.trustNodesCache.Set(trustListSeqKey, change.SeqNum, -1)
+	s.addTrustNodeLocked(change.AddNode)
+	s.removeTrustNodeLocked(change.RemoveNode)
+	s.trustListTime = time.Now()
+	s.saveTrustListLocked()
+	return true, nil
+}
+
+// NodesDelta 是/ctrl/v2/nodes上控制器下发的一批受信列表变更。
+type NodesDelta struct {
+	SeqNum int      // 本批次的序列号，须为当前序列号+1
+	Add    []string // 新增的受信节点
+	Remove []string // 移除的受信节点
+	// Digest 是应用本批次后完整受信列表的TrustListDigest，
+	// 为空则不校验。
+	Digest string `json:",omitempty"`
+	// Policies 是本批次中变更的按节点限制策略，零值表示移除该节点的策略。
+	// 被移除的受信节点的策略会一并移除。
+	Policies map[string]ClientPolicy `json:",omitempty"`
+}
+
+// NodesDeltaResponse 是Navi对NodesDelta的应答，告知控制器处理后的状态。
+type NodesDeltaResponse struct {
+	SeqNum   int    // 处理后的序列号
+	Digest   string // 处理后受信列表的TrustListDigest
+	Resynced bool   // 是否因序列号或摘要不一致而重新全量拉取了列表
+}
+
+// NoiseNodesDeltaHandler 处理批量的受信列表变更。序列号不连续或应用后的
+// 摘要与控制器给出的不一致时，回退为一次全量的PullNodesList。
+func (t *ts2021App) NoiseNodesDeltaHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	log.Trace().Caller().Msg("noise nodes delta handler for controlserver " + r.RemoteAddr)
+
+	var delta NodesDelta
+	err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&delta)
+	if err != nil {
+		log.Error().Err(err).Msg("error decoding nodes delta")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Trace().Caller().Msgf("nodes delta: seqnum=%d add=%d remove=%d",
+		delta.SeqNum, len(delta.Add), len(delta.Remove))
+
+	resp, err := t.navi.applyNodesDelta(&delta)
+	if err != nil {
+		log.Error().Err(err).Msg("error applying nodes delta")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) applyNodesDelta(delta *NodesDelta) (*NodesDeltaResponse, error) {
+	s.trustListMu.Lock()
+	seqnum, err := s.trustListSeq()
+	if err != nil {
+		s.trustListMu.Unlock()
+		return nil, err
+	}
+	switch {
+	case delta.SeqNum == seqnum && (delta.Digest == "" || delta.Digest == s.trustListDigestLocked()):
+		// 控制器重试已应用过的批次，直接告知当前状态
+		resp := &NodesDeltaResponse{SeqNum: seqnum, Digest: s.trustListDigestLocked()}
+		s.trustListMu.Unlock()
+		return resp, nil
+	case delta.SeqNum == seqnum+1:
+		// 先算出应用后的摘要，一致时才应用，以免不一致的列表生效
+		digest := s.deltaDigestLocked(delta)
+		if delta.Digest == "" || delta.Digest == digest {
+			for _, nkey := range delta.Remove {
+				s.removeTrustNodeLocked(nkey)
+			}
+			for _, nkey := range delta.Add {
+				s.addTrustNodeLocked(nkey)
+			}
+			s.trustNodesCache.Set(trustListSeqKey, delta.SeqNum, -1)
+			s.updateNodePolicies(delta.Policies, delta.Remove)
+			s.trustListTime = time.Now()
+			s.saveTrustListLocked()
+			s.trustListMu.Unlock()
+			return &NodesDeltaResponse{SeqNum: delta.SeqNum, Digest: digest}, nil
+		}
+		s.logf("derp: trust list digest mismatch at seqnum %d (would have %s, want %s); pulling full list",
+			delta.SeqNum, digest, delta.Digest)
+	default:
+		s.logf("derp: trust list seqnum gap (have %d, got %d); pulling full list", seqnum, delta.SeqNum)
+	}
+	s.trustListMu.Unlock()
+
+	if err := s.PullNodesList(); err != nil {
+		return nil, err
+	}
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	seqnum, err = s.trustListSeq()
+	if err != nil {
+		return nil, err
 	}
+	return &NodesDeltaResponse{SeqNum: seqnum, Digest: s.trustListDigestLocked(), Resynced: true}, nil
 }
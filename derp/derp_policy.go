@@ -0,0 +1,208 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/types/key"
+)
+
+// ClientPolicy limits what a single node key may do through the server.
+// Zero values mean unlimited.
+type ClientPolicy struct {
+	BytesPerSec   float64 `json:",omitempty"` // 每秒允许中继的字节数
+	BytesBurst    int     `json:",omitempty"` // 字节突发上限，0则取一秒的量
+	PacketsPerSec float64 `json:",omitempty"` // 每秒允许中继的包数
+	PacketsBurst  int     `json:",omitempty"` // 包突发上限，0则取一秒的量
+	MaxConns      int     `json:",omitempty"` // 同一节点公钥的最大并发连接数
+}
+
+// IsZero reports whether p imposes no limits.
+func (p ClientPolicy) IsZero() bool { return p == ClientPolicy{} }
+
+func (p ClientPolicy) limits() (bytesLim, bytesBurst, pktsLim, pktsBurst float64) {
+	burst := func(perSec float64, b int) float64 {
+		if b > 0 {
+			return float64(b)
+		}
+		return math.Max(perSec, 1)
+	}
+	return p.BytesPerSec, burst(p.BytesPerSec, p.BytesBurst),
+		p.PacketsPerSec, burst(p.PacketsPerSec, p.PacketsBurst)
+}
+
+// clientLimiter is the token buckets shared by all connections of a node key.
+type clientLimiter struct {
+	refs  int // guarded by Server.policyMu
+	bytes *rate.Limiter
+	pkts  *rate.Limiter
+}
+
+func newClientLimiter(p ClientPolicy) *clientLimiter {
+	l := &clientLimiter{
+		bytes: rate.NewLimiter(rate.Inf, 0),
+		pkts:  rate.NewLimiter(rate.Inf, 0),
+	}
+	l.setPolicy(p)
+	return l
+}
+
+func (l *clientLimiter) setPolicy(p ClientPolicy) {
+	set := func(lim *rate.Limiter, perSec, burst float64) {
+		if perSec <= 0 {
+			lim.SetLimit(rate.Inf)
+			return
+		}
+		lim.SetBurst(int(burst))
+		lim.SetLimit(rate.Limit(perSec))
+	}
+	bytesLim, bytesBurst, pktsLim, pktsBurst := p.limits()
+	set(l.bytes, bytesLim, bytesBurst)
+	set(l.pkts, pktsLim, pktsBurst)
+}
+
+// allow reports whether a packet of n bytes may be relayed now. A packet
+// that's dropped takes nothing from either budget.
+func (l *clientLimiter) allow(n int) bool {
+	if l.bytes.Limit() != rate.Inf && n > l.bytes.Burst() {
+		// 大于突发上限的包永远无法通过AllowN，按突发上限计
+		n = l.bytes.Burst()
+	}
+	now := timeNow()
+	pr := l.pkts.ReserveN(now, 1)
+	if !pr.OK() || pr.DelayFrom(now) > 0 {
+		pr.CancelAt(now)
+		return false
+	}
+	br := l.bytes.ReserveN(now, n)
+	if !br.OK() || br.DelayFrom(now) > 0 {
+		br.CancelAt(now)
+		pr.CancelAt(now)
+		return false
+	}
+	return true
+}
+
+// SetDefaultClientPolicy sets the policy applied to clients that have no
+// per-node policy from the control server.
+func (s *Server) SetDefaultClientPolicy(p ClientPolicy) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.defaultPolicy = p
+	s.updateLimitersLocked()
+}
+
+// setNodePolicies replaces the per-node policies pushed by the control
+// server. A nil def leaves the default policy unchanged.
+func (s *Server) setNodePolicies(def *ClientPolicy, nodes map[string]ClientPolicy) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if def != nil {
+		s.defaultPolicy = *def
+	}
+	s.nodePolicies = nodes
+	s.updateLimitersLocked()
+}
+
+// updateNodePolicies merges per-node policy changes from a trust list delta.
+// A zero policy removes the node's override.
+func (s *Server) updateNodePolicies(nodes map[string]ClientPolicy, removed []string) {
+	if len(nodes) == 0 && len(removed) == 0 {
+		return
+	}
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	for _, nkey := range removed {
+		delete(s.nodePolicies, nkey)
+	}
+	for nkey, p := range nodes {
+		if p.IsZero() {
+			delete(s.nodePolicies, nkey)
+			continue
+		}
+		if s.nodePolicies == nil {
+			s.nodePolicies = make(map[string]ClientPolicy)
+		}
+		s.nodePolicies[nkey] = p
+	}
+	s.updateLimitersLocked()
+}
+
+// nodePoliciesCopy returns a copy of the per-node policies, for snapshots.
+func (s *Server) nodePoliciesCopy() (def ClientPolicy, nodes map[string]ClientPolicy) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if len(s.nodePolicies) > 0 {
+		nodes = make(map[string]ClientPolicy, len(s.nodePolicies))
+		for k, v := range s.nodePolicies {
+			nodes[k] = v
+		}
+	}
+	return s.defaultPolicy, nodes
+}
+
+// policyForLocked returns the policy for k. s.policyMu must be held.
+func (s *Server) policyForLocked(k key.NodePublic) ClientPolicy {
+	if p, ok := s.nodePolicies[strings.TrimPrefix(k.String(), "nodekey:")]; ok {
+		return p
+	}
+	return s.defaultPolicy
+}
+
+// updateLimitersLocked applies the current policies to the limiters of
+// connected clients. s.policyMu must be held.
+func (s *Server) updateLimitersLocked() {
+	for k, l := range s.clientLimiters {
+		l.setPolicy(s.policyForLocked(k))
+	}
+}
+
+// acquireLimiter returns the limiter shared by the connections of k,
+// creating it if needed. Each call must be paired with releaseLimiter.
+func (s *Server) acquireLimiter(k key.NodePublic) *clientLimiter {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	l, ok := s.clientLimiters[k]
+	if !ok {
+		l = newClientLimiter(s.policyForLocked(k))
+		if s.clientLimiters == nil {
+			s.clientLimiters = make(map[key.NodePublic]*clientLimiter)
+		}
+		s.clientLimiters[k] = l
+	}
+	l.refs++
+	return l
+}
+
+func (s *Server) releaseLimiter(k key.NodePublic) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	l, ok := s.clientLimiters[k]
+	if !ok {
+		return
+	}
+	if l.refs--; l.refs <= 0 {
+		delete(s.clientLimiters, k)
+	}
+}
+
+// checkConnLimitLocked returns an error if k already has as many
+// connections as its policy allows. s.mu must be held.
+func (s *Server) checkConnLimitLocked(k key.NodePublic) error {
+	s.policyMu.Lock()
+	maxConns := s.policyForLocked(k).MaxConns
+	s.policyMu.Unlock()
+	if maxConns <= 0 {
+		return nil
+	}
+	if set, ok := s.clients[k]; ok && set.Len() >= maxConns {
+		s.connsRejectedLimit.Add(1)
+		return fmt.Errorf("too many connections (max %d)", maxConns)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// setTestTime makes timeNow return the time pointed to by now, for the
+// duration of the test.
+func setTestTime(t *testing.T, now *time.Time) {
+	old := timeNow
+	timeNow = func() time.Time { return *now }
+	t.Cleanup(func() { timeNow = old })
+}
+
+func TestClientLimiterAllow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, &now)
+
+	t.Run("bytes_drop_keeps_packet_budget", func(t *testing.T) {
+		l := newClientLimiter(ClientPolicy{
+			BytesPerSec:   100,
+			PacketsPerSec: 0.001,
+			PacketsBurst:  2,
+		})
+		if !l.allow(100) {
+			t.Fatal("first packet dropped")
+		}
+		if l.allow(100) {
+			t.Fatal("packet over the byte budget allowed")
+		}
+		now = now.Add(time.Second)
+		if !l.allow(100) {
+			t.Error("packet dropped for bytes used up the packet budget")
+		}
+	})
+
+	t.Run("packet_drop_keeps_byte_budget", func(t *testing.T) {
+		l := newClientLimiter(ClientPolicy{
+			BytesPerSec:   0.001,
+			BytesBurst:    100,
+			PacketsPerSec: 1,
+		})
+		if !l.allow(50) {
+			t.Fatal("first packet dropped")
+		}
+		if l.allow(50) {
+			t.Fatal("packet over the packet budget allowed")
+		}
+		now = now.Add(time.Second)
+		if !l.allow(50) {
+			t.Error("packet dropped for the packet rate used up the byte budget")
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		l := newClientLimiter(ClientPolicy{BytesPerSec: 10})
+		if !l.allow(1000) {
+			t.Error("packet larger than the burst never allowed")
+		}
+		if l.allow(1) {
+			t.Error("oversized packet didn't use up the byte budget")
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := newClientLimiter(ClientPolicy{})
+		for i := 0; i < 1000; i++ {
+			if !l.allow(64 << 10) {
+				t.Fatal("packet dropped without limits")
+			}
+		}
+	})
+}
+
+func TestNodePolicies(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	nkey1 := k1.String()[len("nodekey:"):]
+
+	s.SetDefaultClientPolicy(ClientPolicy{MaxConns: 3})
+	s.setNodePolicies(nil, map[string]ClientPolicy{nkey1: {MaxConns: 1}})
+	policyFor := func(k key.NodePublic) ClientPolicy {
+		s.policyMu.Lock()
+		defer s.policyMu.Unlock()
+		return s.policyForLocked(k)
+	}
+	if got := policyFor(k1).MaxConns; got != 1 {
+		t.Errorf("k1 MaxConns = %d; want 1", got)
+	}
+	if got := policyFor(k2).MaxConns; got != 3 {
+		t.Errorf("k2 MaxConns = %d; want 3 (default)", got)
+	}
+
+	// Connected clients' limiters follow policy changes.
+	l := s.acquireLimiter(k1)
+	if l2 := s.acquireLimiter(k1); l2 != l {
+		t.Error("connections of one key got different limiters")
+	}
+	s.updateNodePolicies(map[string]ClientPolicy{nkey1: {PacketsPerSec: 5}}, nil)
+	if got := l.pkts.Limit(); got != 5 {
+		t.Errorf("packet limit after update = %v; want 5", got)
+	}
+	s.updateNodePolicies(nil, []string{nkey1})
+	if got := policyFor(k1).MaxConns; got != 3 {
+		t.Errorf("k1 MaxConns after removal = %d; want 3 (default)", got)
+	}
+
+	s.releaseLimiter(k1)
+	s.releaseLimiter(k1)
+	if _, ok := s.clientLimiters[k1]; ok {
+		t.Error("limiter kept after its last connection")
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetDefaultClientPolicy(ClientPolicy{MaxConns: 2})
+	k := key.NewNode().Public()
+
+	var port uint16
+	newClient := func(canMesh bool) *sclient {
+		port++
+		return &sclient{
+			s:            s,
+			key:          k,
+			logf:         t.Logf,
+			canMesh:      canMesh,
+			remoteIPPort: netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), port),
+		}
+	}
+
+	// Concurrent connections of one key can't get past the limit.
+	const n = 10
+	clients := make([]*sclient, n)
+	errs := make([]error, n)
+	for i := range clients {
+		clients[i] = newClient(false)
+	}
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *sclient) {
+			defer wg.Done()
+			errs[i] = s.registerClient(c)
+		}(i, c)
+	}
+	wg.Wait()
+	var registered []*sclient
+	for i, err := range errs {
+		if err == nil {
+			registered = append(registered, clients[i])
+		}
+	}
+	if len(registered) != 2 {
+		t.Fatalf("%d connections registered; want 2", len(registered))
+	}
+	if got := s.connsRejectedLimit.Value(); got != n-2 {
+		t.Errorf("connsRejectedLimit = %d; want %d", got, n-2)
+	}
+
+	// Mesh peers aren't limited.
+	mesh := newClient(true)
+	if err := s.registerClient(mesh); err != nil {
+		t.Errorf("mesh peer rejected: %v", err)
+	}
+	s.unregisterClient(mesh)
+
+	// Once one goes away, another may connect.
+	s.unregisterClient(registered[0])
+	if err := s.registerClient(newClient(false)); err != nil {
+		t.Errorf("connection under the limit rejected: %v", err)
+	}
+}
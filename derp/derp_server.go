@@ -110,6 +110,26 @@ type Server struct {
 	trustNodesCache *cache.Cache // 用于存储受信客户端信息
 	Cronjob         *cron.Cron   // 用于定时从控制器拉取受信客户端信息
 
+	trustListPath   string        // 受信列表快照文件路径，为空则不持久化
+	trustListMaxAge time.Duration // 启动时可接受的快照最大时长，0为不限
+	trustListMu     sync.Mutex    // 保护受信列表的整体替换及快照写入
+	trustListTime   time.Time     // 最后一次与控制器同步受信列表的时间
+	trustListLoaded bool          // 是否从磁盘快照恢复了受信列表
+	trustListDigest [32]byte      // 受信列表的增量摘要，见TrustListDigest
+
+	trustListSyncs        expvar.Int // 定时同步受信列表成功次数
+	trustListSyncFailures expvar.Int // 定时同步受信列表失败次数
+
+	policyMu       sync.Mutex                        // may be acquired while holding mu, not the reverse
+	defaultPolicy  ClientPolicy                      // 未单独配置的节点所用的限制策略
+	nodePolicies   map[string]ClientPolicy           // 控制器下发的按节点限制策略，键同trustNodesCache
+	clientLimiters map[key.NodePublic]*clientLimiter // 已连接节点的令牌桶
+
+	traffic               trafficStats // 按源/目的节点的流量统计，周期性上报给控制器
+	trafficReports        expvar.Int   // 流量统计上报成功次数
+	trafficReportFailures expvar.Int   // 流量统计上报失败次数
+	naviInfo              NaviNode     // 最近一次注册得到的Navi配置
+
 	// WriteTimeout, if non-zero, specifies how long to wait
 	// before failing when writing to a client.
 	WriteTimeout time.Duration
@@ -142,6 +162,7 @@ type Server struct {
 	packetsForwardedIn           expvar.Int
 	peerGoneDisconnectedFrames   expvar.Int // number of peer disconnected frames sent
 	peerGoneNotHereFrames        expvar.Int // number of peer not here frames sent
+	connsRejectedLimit           expvar.Int // number of connections rejected by ClientPolicy.MaxConns
 	gotPing                      expvar.Int // number of ping frames from client
 	sentPong                     expvar.Int // number of pong frames enqueued to client
 	accepts                      expvar.Int
@@ -337,6 +358,7 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		tcpRtt:               metrics.LabelMap{Label: "le"},
 		keyOfAddr:            map[netip.AddrPort]key.NodePublic{},
 	}
+	s.traffic.max = defaultMaxTrafficFlows
 
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -345,10 +367,11 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("unknown_dest"),
 		s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
 		s.packetsDroppedReason.Get("gone_disconnected"),
-		s.packetsDroppedReason.Get("gone_not_here"),
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -391,6 +414,9 @@ func (s *Server) Close() error {
 	if wasClosed {
 		return nil
 	}
+	if s.Cronjob != nil {
+		s.Cronjob.Stop()
+	}
 
 	var closedChs []chan struct{}
 
@@ -504,15 +530,23 @@ func (s *Server) initMetacert() {
 func (s *Server) MetaCert() []byte { return s.metaCert }
 
 // registerClient notes that client c is now authenticated and ready for packets.
+// It returns an error, and doesn't register c, if c.key already has as many
+// connections as its ClientPolicy allows.
 //
 // If c.key is connected more than once, the earlier connection(s) are
 // placed in a non-active state where we read from them (primarily to
 // observe EOFs/timeouts) but won't send them frames on the assumption
 // that they're dead.
-func (s *Server) registerClient(c *sclient) {
+func (s *Server) registerClient(c *sclient) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if !c.canMesh {
+		if err := s.checkConnLimitLocked(c.key); err != nil {
+			return err
+		}
+	}
+
 	set := s.clients[c.key]
 	switch set := set.(type) {
 	case nil:
@@ -550,6 +584,7 @@ func (s *Server) registerClient(c *sclient) {
 	s.keyOfAddr[c.remoteIPPort] = c.key
 	s.curClients.Add(1)
 	s.broadcastPeerStateChangeLocked(c.key, true)
+	return nil
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
@@ -696,6 +731,7 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	if err := s.verifyClient(clientKey, clientInfo); err != nil {
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
+	canMesh := clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey
 
 	// At this point we trust the client so we don't time out.
 	nc.SetDeadline(time.Time{})
@@ -721,12 +757,15 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan peerGoneMsg),
-		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		canMesh:        canMesh,
 		peerGoneLim:    rate.NewLimiter(rate.Every(time.Second), 3),
 	}
 
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		c.lim = s.acquireLimiter(clientKey)
+		defer s.releaseLimiter(clientKey)
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -735,7 +774,9 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		}
 	}
 
-	s.registerClient(c)
+	if err := s.registerClient(c); err != nil {
+		return fmt.Errorf("client %x rejected: %v", clientKey, err)
+	}
 	defer s.unregisterClient(c)
 
 	err = s.sendServerInfo(c.bw, clientKey)
@@ -958,6 +999,11 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	if c.lim != nil && !c.lim.allow(len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		c.debug("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), dropReasonRateLimited)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -978,6 +1024,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if dst == nil {
 		if fwd != nil {
 			s.packetsForwardedOut.Add(1)
+			s.traffic.note(c.key, dstKey, len(contents))
 			err := fwd.ForwardPacket(c.key, dstKey, contents)
 			c.debug("SendPacket for %s, forwarding via %s: %v", dstKey.ShortString(), fwd, err)
 			if err != nil {
@@ -997,6 +1044,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		return nil
 	}
 	c.debug("SendPacket for %s, sending directly", dstKey.ShortString())
+	s.traffic.note(c.key, dstKey, len(contents))
 
 	p := pkt{
 		bs:         contents,
@@ -1025,6 +1073,7 @@ func (c *sclient) debug(format string, v ...any) {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the source exceeded its ClientPolicy rate limits
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1135,7 +1184,6 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 			return fmt.Errorf("client %v not acceptable due to ctrl server", clientKey)
 		}
 	}
-	// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	return nil
 }
 
@@ -1354,6 +1402,10 @@ type sclient struct {
 	// client that it's trying to establish a direct connection
 	// through us with a peer we have no record of.
 	peerGoneLim *rate.Limiter
+
+	// lim enforces the ClientPolicy rate limits of the client's key.
+	// It is nil for mesh peers, which aren't limited.
+	lim *clientLimiter
 }
 
 // peerConnState represents whether a peer is connected to the server
@@ -1823,6 +1875,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("sent_pong", &s.sentPong)
 	m.Set("peer_gone_disconnected_frames", &s.peerGoneDisconnectedFrames)
 	m.Set("peer_gone_not_here_frames", &s.peerGoneNotHereFrames)
+	m.Set("counter_conns_rejected_limit", &s.connsRejectedLimit)
 	m.Set("packets_forwarded_out", &s.packetsForwardedOut)
 	m.Set("packets_forwarded_in", &s.packetsForwardedIn)
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
@@ -1832,6 +1885,11 @@ func (s *Server) ExpVar() expvar.Var {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
 	m.Set("counter_tcp_rtt", &s.tcpRtt)
+	m.Set("gauge_trust_list_sync_age_seconds", expvar.Func(func() any { return s.trustListSyncAge() }))
+	m.Set("counter_trust_list_syncs", &s.trustListSyncs)
+	m.Set("counter_trust_list_sync_failures", &s.trustListSyncFailures)
+	m.Set("counter_traffic_reports", &s.trafficReports)
+	m.Set("counter_traffic_report_failures", &s.trafficReportFailures)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long())
 	m.Set("version", &expvarVersion)
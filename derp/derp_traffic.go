@@ -0,0 +1,293 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"tailscale.com/types/key"
+)
+
+// defaultMaxTrafficFlows bounds the number of src/dst pairs tracked between
+// two traffic reports. Traffic of pairs beyond that is only counted in
+// TrafficReport.Overflow.
+const defaultMaxTrafficFlows = 100000
+
+// TrafficCounts are the packet and byte counters of relayed traffic.
+type TrafficCounts struct {
+	Packets int64
+	Bytes   int64
+}
+
+func (c *TrafficCounts) add(o TrafficCounts) {
+	c.Packets += o.Packets
+	c.Bytes += o.Bytes
+}
+
+// TrafficFlow is the traffic relayed from one node to another.
+type TrafficFlow struct {
+	Src string // 源节点公钥（不带nodekey:前缀）
+	Dst string // 目的节点公钥（不带nodekey:前缀）
+	TrafficCounts
+}
+
+// TrafficReport 是Navi周期性上报给控制器的按节点流量统计。
+// 每个包只在其进入区域的Navi上计数一次。
+type TrafficReport struct {
+	NaviID   string
+	Start    time.Time
+	End      time.Time
+	Flows    []TrafficFlow
+	Overflow TrafficCounts // 超出统计表容量而未能归属到节点的流量
+}
+
+type trafficKey struct {
+	src, dst key.NodePublic
+}
+
+// trafficStats accumulates per src/dst traffic counters between reports.
+type trafficStats struct {
+	mu       sync.Mutex
+	max      int // max len(flows)
+	start    time.Time
+	flows    map[trafficKey]*TrafficCounts
+	overflow TrafficCounts
+}
+
+func (t *trafficStats) note(src, dst key.NodePublic, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flows == nil {
+		t.flows = make(map[trafficKey]*TrafficCounts)
+		t.start = timeNow()
+	}
+	k := trafficKey{src, dst}
+	c, ok := t.flows[k]
+	if !ok {
+		if len(t.flows) >= t.max {
+			t.overflow.add(TrafficCounts{1, int64(n)})
+			return
+		}
+		c = new(TrafficCounts)
+		t.flows[k] = c
+	}
+	c.Packets++
+	c.Bytes += int64(n)
+}
+
+// take returns the accumulated counters and resets them.
+func (t *trafficStats) take() (start time.Time, flows map[trafficKey]*TrafficCounts, overflow TrafficCounts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start, flows, overflow = t.start, t.flows, t.overflow
+	t.flows = nil
+	t.overflow = TrafficCounts{}
+	return
+}
+
+// restore merges counters that failed to be reported back in, so they are
+// sent with the next report.
+func (t *trafficStats) restore(start time.Time, flows map[trafficKey]*TrafficCounts, overflow TrafficCounts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flows == nil {
+		t.flows = make(map[trafficKey]*TrafficCounts)
+	}
+	if !start.IsZero() && (t.start.IsZero() || start.Before(t.start)) {
+		t.start = start
+	}
+	t.overflow.add(overflow)
+	for k, c := range flows {
+		if cur, ok := t.flows[k]; ok {
+			cur.add(*c)
+		} else if len(t.flows) < t.max {
+			t.flows[k] = c
+		} else {
+			t.overflow.add(*c)
+		}
+	}
+}
+
+// top returns the n flows with the most bytes, and the totals per source.
+func (t *trafficStats) top(n int) (start time.Time, flows []TrafficFlow, bySrc []TrafficFlow, overflow TrafficCounts) {
+	t.mu.Lock()
+	srcs := map[key.NodePublic]*TrafficCounts{}
+	for k, c := range t.flows {
+		flows = append(flows, TrafficFlow{Src: nodeKeyString(k.src), Dst: nodeKeyString(k.dst), TrafficCounts: *c})
+		sc, ok := srcs[k.src]
+		if !ok {
+			sc = new(TrafficCounts)
+			srcs[k.src] = sc
+		}
+		sc.add(*c)
+	}
+	start, overflow = t.start, t.overflow
+	t.mu.Unlock()
+
+	for k, c := range srcs {
+		bySrc = append(bySrc, TrafficFlow{Src: nodeKeyString(k), TrafficCounts: *c})
+	}
+	byBytes := func(s []TrafficFlow) {
+		sort.Slice(s, func(i, j int) bool { return s[i].Bytes > s[j].Bytes })
+	}
+	byBytes(flows)
+	byBytes(bySrc)
+	if len(flows) > n {
+		flows = flows[:n]
+	}
+	if len(bySrc) > n {
+		bySrc = bySrc[:n]
+	}
+	return
+}
+
+// nodeKeyString returns k in the form the control server uses in the
+// trust list.
+func nodeKeyString(k key.NodePublic) string {
+	return strings.TrimPrefix(k.String(), "nodekey:")
+}
+
+// SetMaxTrafficFlows sets the maximum number of src/dst pairs tracked between
+// traffic reports, bounding the memory used for accounting.
+//
+// It must be called before serving begins.
+func (s *Server) SetMaxTrafficFlows(n int) {
+	s.traffic.max = n
+}
+
+// StartTrafficReport schedules uploading per-node traffic counters to the
+// control server every interval on s.Cronjob, and starts the Cronjob.
+//
+// It must be called after PrepareManaged.
+func (s *Server) StartTrafficReport(interval time.Duration) error {
+	if s.Cronjob == nil {
+		return errors.New("derp: StartTrafficReport called before PrepareManaged")
+	}
+	if interval < time.Second {
+		return fmt.Errorf("derp: traffic report interval %v too short", interval)
+	}
+	job := cron.NewChain(
+		cron.SkipIfStillRunning(cron.DiscardLogger),
+	).Then(cron.FuncJob(func() {
+		if err := s.ReportTraffic(); err != nil {
+			s.logf("derp: traffic report failed: %v", err)
+		}
+	}))
+	s.Cronjob.Schedule(cron.Every(interval), job)
+	s.Cronjob.Start()
+	return nil
+}
+
+// ReportTraffic uploads the traffic counted since the last report to the
+// control server. On failure the counters are kept for the next report.
+func (s *Server) ReportTraffic() error {
+	start, flows, overflow := s.traffic.take()
+	if len(flows) == 0 && overflow == (TrafficCounts{}) {
+		return nil
+	}
+	report := TrafficReport{
+		NaviID:   s.derpID,
+		Start:    start,
+		End:      timeNow(),
+		Flows:    make([]TrafficFlow, 0, len(flows)),
+		Overflow: overflow,
+	}
+	for k, c := range flows {
+		report.Flows = append(report.Flows, TrafficFlow{
+			Src:           nodeKeyString(k.src),
+			Dst:           nodeKeyString(k.dst),
+			TrafficCounts: *c,
+		})
+	}
+	if err := s.postTrafficReport(&report); err != nil {
+		s.traffic.restore(start, flows, overflow)
+		s.trafficReportFailures.Add(1)
+		return err
+	}
+	s.trafficReports.Add(1)
+	return nil
+}
+
+func (s *Server) postTrafficReport(report *TrafficReport) error {
+	url := fmt.Sprintf("%s/navi/traffic", s.ctrlURL)
+	url = strings.Replace(url, "http:", "https:", 1)
+	bodyData, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("traffic report: %w", err)
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "POST", url, bytes.NewReader(bodyData))
+	if err != nil {
+		return fmt.Errorf("traffic report: %w", err)
+	}
+	res, err := s.nc.Do(req)
+	if err != nil {
+		return fmt.Errorf("traffic report: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("traffic report: http %d: %.200s",
+			res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ServeDebugTopTalkers serves an HTML page of the nodes relaying the most
+// traffic since the last traffic report. With ?json=1 it serves JSON.
+func (s *Server) ServeDebugTopTalkers(w http.ResponseWriter, r *http.Request) {
+	n := 50
+	if v, err := strconv.Atoi(r.FormValue("n")); err == nil && v > 0 {
+		n = v
+	}
+	start, flows, bySrc, overflow := s.traffic.top(n)
+	if r.FormValue("json") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"Start":    start,
+			"Flows":    flows,
+			"Sources":  bySrc,
+			"Overflow": overflow,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><h1>DERP top talkers</h1>\n")
+	if start.IsZero() {
+		fmt.Fprintf(w, "<p>No traffic since last report.</p>\n")
+	} else {
+		fmt.Fprintf(w, "<p>Since %v (%v ago). Unattributed: %d packets, %d bytes.</p>\n",
+			start.Format(time.RFC3339), timeNow().Sub(start).Round(time.Second), overflow.Packets, overflow.Bytes)
+	}
+	table := func(title string, rows []TrafficFlow, withDst bool) {
+		fmt.Fprintf(w, "<h2>%s</h2>\n<table border=1 cellpadding=3><tr><th>src</th>", title)
+		if withDst {
+			fmt.Fprintf(w, "<th>dst</th>")
+		}
+		fmt.Fprintf(w, "<th>packets</th><th>bytes</th></tr>\n")
+		for _, f := range rows {
+			fmt.Fprintf(w, "<tr><td><code>%s</code></td>", html.EscapeString(f.Src))
+			if withDst {
+				fmt.Fprintf(w, "<td><code>%s</code></td>", html.EscapeString(f.Dst))
+			}
+			fmt.Fprintf(w, "<td>%d</td><td>%d</td></tr>\n", f.Packets, f.Bytes)
+		}
+		fmt.Fprintf(w, "</table>\n")
+	}
+	table("Sources", bySrc, false)
+	table("Flows", flows, true)
+	fmt.Fprintf(w, "</body></html>\n")
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"tailscale.com/types/key"
+)
+
+func TestTrafficStats(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	setTestTime(t, &now)
+	a, b, c := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+
+	ts := &trafficStats{max: 2}
+	ts.note(a, b, 100)
+	ts.note(a, b, 50)
+	ts.note(b, a, 10)
+	ts.note(a, c, 1000) // past max: only counted as overflow
+
+	start, flows, overflow := ts.take()
+	if !start.Equal(now) {
+		t.Errorf("start = %v; want %v", start, now)
+	}
+	if got, want := *flows[trafficKey{a, b}], (TrafficCounts{2, 150}); got != want {
+		t.Errorf("a->b = %+v; want %+v", got, want)
+	}
+	if got, want := *flows[trafficKey{b, a}], (TrafficCounts{1, 10}); got != want {
+		t.Errorf("b->a = %+v; want %+v", got, want)
+	}
+	if len(flows) != 2 {
+		t.Errorf("%d flows; want 2", len(flows))
+	}
+	if want := (TrafficCounts{1, 1000}); overflow != want {
+		t.Errorf("overflow = %+v; want %+v", overflow, want)
+	}
+	if _, flows2, _ := ts.take(); len(flows2) != 0 {
+		t.Errorf("take didn't reset: %d flows left", len(flows2))
+	}
+
+	// Counters that failed to be reported are merged into the new ones,
+	// keeping the earlier start and the table size limit.
+	now = now.Add(time.Minute)
+	ts.note(a, b, 1)
+	ts.note(c, a, 5)
+	ts.restore(start, flows, overflow)
+	start2, flows2, overflow2 := ts.take()
+	if !start2.Equal(start) {
+		t.Errorf("start after restore = %v; want %v", start2, start)
+	}
+	if got, want := *flows2[trafficKey{a, b}], (TrafficCounts{3, 151}); got != want {
+		t.Errorf("a->b after restore = %+v; want %+v", got, want)
+	}
+	if want := (TrafficCounts{2, 1010}); overflow2 != want {
+		t.Errorf("overflow after restore = %+v; want %+v", overflow2, want)
+	}
+}
+
+func TestTrafficStatsTop(t *testing.T) {
+	a, b, c := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	ts := &trafficStats{max: 100}
+	ts.note(a, b, 100)
+	ts.note(a, c, 300)
+	ts.note(b, c, 200)
+
+	_, flows, bySrc, _ := ts.top(2)
+	if len(flows) != 2 || flows[0].Bytes != 300 || flows[1].Bytes != 200 {
+		t.Errorf("top flows = %+v; want a->c, b->c", flows)
+	}
+	if len(bySrc) != 2 || bySrc[0].Src != nodeKeyString(a) || bySrc[0].Bytes != 400 {
+		t.Errorf("top sources = %+v; want a first with 400 bytes", bySrc)
+	}
+	if strings.HasPrefix(flows[0].Src, "nodekey:") {
+		t.Errorf("flow src %q has nodekey: prefix", flows[0].Src)
+	}
+}
+
+func TestReportTrafficFailure(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+
+	// Nothing to report doesn't contact the control server.
+	if err := s.ReportTraffic(); err != nil {
+		t.Fatalf("empty report: %v", err)
+	}
+
+	setUnreachableControl(t, s)
+	a, b := key.NewNode().Public(), key.NewNode().Public()
+	s.traffic.note(a, b, 100)
+	if err := s.ReportTraffic(); err == nil {
+		t.Fatal("report to unreachable control server succeeded")
+	}
+	if got := s.trafficReportFailures.Value(); got != 1 {
+		t.Errorf("report failures = %d; want 1", got)
+	}
+	_, flows, _ := s.traffic.take()
+	if c := flows[trafficKey{a, b}]; c == nil || *c != (TrafficCounts{1, 100}) {
+		t.Errorf("counters after failed report = %+v; want kept", c)
+	}
+}
+
+func TestStartTrafficReport(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if err := s.StartTrafficReport(time.Minute); err == nil {
+		t.Error("StartTrafficReport before PrepareManaged succeeded")
+	}
+	s.Cronjob = cron.New()
+	if err := s.StartTrafficReport(time.Millisecond); err == nil {
+		t.Error("StartTrafficReport with a too short interval succeeded")
+	}
+	if err := s.StartTrafficReport(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Cronjob.Entries()); got != 1 {
+		t.Errorf("%d cron entries; want 1", got)
+	}
+}
+
+func TestServeDebugTopTalkers(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	a, b := key.NewNode().Public(), key.NewNode().Public()
+	s.traffic.note(a, b, 42)
+
+	rec := httptest.NewRecorder()
+	s.ServeDebugTopTalkers(rec, httptest.NewRequest("GET", "/debug/traffic?json=1", nil))
+	var got struct {
+		Flows   []TrafficFlow
+		Sources []TrafficFlow
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Flows) != 1 || got.Flows[0].Src != nodeKeyString(a) || got.Flows[0].Dst != nodeKeyString(b) || got.Flows[0].Bytes != 42 {
+		t.Errorf("flows = %+v", got.Flows)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeDebugTopTalkers(rec, httptest.NewRequest("GET", "/debug/traffic", nil))
+	if body := rec.Body.String(); !strings.Contains(body, nodeKeyString(a)) || !strings.Contains(body, "<td>42</td>") {
+		t.Errorf("HTML page missing flow:\n%s", body)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"tailscale.com/atomicfile"
+	"tailscale.com/health"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/key"
+)
+
+// trustListSnapshot 是受管模式下受信客户端列表的磁盘快照格式。
+// 在控制器不可达时重启的Navi依靠它继续为已知节点提供中继。
+type trustListSnapshot struct {
+	Version    int               // 快照格式版本，目前为1
+	SeqNum     int               // 与控制器同步的序列号
+	Timestamp  time.Time         // 最后一次与控制器同步成功的时间
+	CtrlPubkey key.MachinePublic // 控制器的noise公钥
+	NaviInfo   NaviNode          // 最近一次注册得到的Navi配置
+	TrustNodes []string          // 受信节点公钥（不带nodekey:前缀）
+
+	DefaultPolicy ClientPolicy            // 默认限制策略
+	NodePolicies  map[string]ClientPolicy `json:",omitempty"` // 按节点的限制策略
+}
+
+const trustListSnapshotVersion = 1
+
+// trustListSeqKey 是trustNodesCache中保存序列号的键。
+const trustListSeqKey = "seqnum"
+
+// SetTrustListFile sets the path of the on-disk snapshot of the managed-mode
+// trust list, and the maximum age of a snapshot that is still accepted at
+// startup. A zero maxAge means snapshots never go stale.
+//
+// It must be called before PrepareManaged.
+func (s *Server) SetTrustListFile(path string, maxAge time.Duration) {
+	s.trustListPath = path
+	s.trustListMaxAge = maxAge
+}
+
+// trustListSeq returns the current trust list sequence number.
+func (s *Server) trustListSeq() (int, error) {
+	sq, ok := s.trustNodesCache.Get(trustListSeqKey)
+	if !ok {
+		return 0, errors.New("seqnum not found")
+	}
+	seqnum, ok := sq.(int)
+	if !ok {
+		return 0, errors.New("seqnum not int")
+	}
+	return seqnum, nil
+}
+
+// trustNodes returns the sorted list of trusted node keys.
+func (s *Server) trustNodes() []string {
+	items := s.trustNodesCache.Items()
+	nodes := make([]string, 0, len(items))
+	for k := range items {
+		if k == trustListSeqKey {
+			continue
+		}
+		nodes = append(nodes, k)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// TrustListDigest returns the digest of a set of trusted node keys, as
+// carried in NodesDelta.Digest. The digest is the XOR of the SHA-256 of each
+// distinct key, so it doesn't depend on order and can be updated
+// incrementally as keys are added and removed.
+func TrustListDigest(nodes []string) string {
+	var d [sha256.Size]byte
+	seen := make(map[string]bool, len(nodes))
+	for _, nkey := range nodes {
+		if seen[nkey] {
+			continue
+		}
+		seen[nkey] = true
+		xorTrustDigest(&d, nkey)
+	}
+	return hex.EncodeToString(d[:])
+}
+
+func xorTrustDigest(d *[sha256.Size]byte, nkey string) {
+	h := sha256.Sum256([]byte(nkey))
+	for i := range d {
+		d[i] ^= h[i]
+	}
+}
+
+// addTrustNodeLocked adds nkey to the trust list. s.trustListMu must be held.
+func (s *Server) addTrustNodeLocked(nkey string) {
+	if nkey == "" || nkey == trustListSeqKey {
+		return
+	}
+	if err := s.trustNodesCache.Add(nkey, struct{}{}, -1); err != nil {
+		return // 已存在
+	}
+	xorTrustDigest(&s.trustListDigest, nkey)
+}
+
+// removeTrustNodeLocked removes nkey from the trust list. s.trustListMu must be held.
+func (s *Server) removeTrustNodeLocked(nkey string) {
+	if nkey == "" || nkey == trustListSeqKey {
+		return
+	}
+	if _, ok := s.trustNodesCache.Get(nkey); !ok {
+		return
+	}
+	s.trustNodesCache.Delete(nkey)
+	xorTrustDigest(&s.trustListDigest, nkey)
+}
+
+// resetTrustNodesLocked replaces the whole trust list. s.trustListMu must be held.
+func (s *Server) resetTrustNodesLocked(seqnum int, nodes []string) {
+	s.trustNodesCache.Flush()
+	s.trustListDigest = [sha256.Size]byte{}
+	s.trustNodesCache.Set(trustListSeqKey, seqnum, -1)
+	for _, nkey := range nodes {
+		s.addTrustNodeLocked(nkey)
+	}
+}
+
+// trustListDigestLocked returns the hex digest of the current trust list.
+// s.trustListMu must be held.
+func (s *Server) trustListDigestLocked() string {
+	return hex.EncodeToString(s.trustListDigest[:])
+}
+
+// deltaDigestLocked returns the digest the trust list would have after
+// applying delta, without changing it. s.trustListMu must be held.
+func (s *Server) deltaDigestLocked(delta *NodesDelta) string {
+	d := s.trustListDigest
+	changed := make(map[string]bool) // nkey => present after the changes so far
+	present := func(nkey string) bool {
+		if p, ok := changed[nkey]; ok {
+			return p
+		}
+		_, ok := s.trustNodesCache.Get(nkey)
+		return ok
+	}
+	for _, nkey := range delta.Remove {
+		if nkey == "" || nkey == trustListSeqKey || !present(nkey) {
+			continue
+		}
+		changed[nkey] = false
+		xorTrustDigest(&d, nkey)
+	}
+	for _, nkey := range delta.Add {
+		if nkey == "" || nkey == trustListSeqKey || present(nkey) {
+			continue
+		}
+		changed[nkey] = true
+		xorTrustDigest(&d, nkey)
+	}
+	return hex.EncodeToString(d[:])
+}
+
+// replaceTrustNodes 用控制器下发的完整列表替换当前受信列表，并写入快照。
+func (s *Server) replaceTrustNodes(seqnum int, nodes []string) {
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	s.resetTrustNodesLocked(seqnum, nodes)
+	s.trustListTime = time.Now()
+	s.saveTrustListLocked()
+}
+
+// saveTrustListLocked writes the trust list snapshot to disk, if configured.
+// s.trustListMu must be held.
+func (s *Server) saveTrustListLocked() {
+	if s.trustListPath == "" {
+		return
+	}
+	seqnum, err := s.trustListSeq()
+	if err != nil {
+		s.logf("derp: not saving trust list: %v", err)
+		return
+	}
+	def, nodePolicies := s.nodePoliciesCopy()
+	snap := trustListSnapshot{
+		Version:       trustListSnapshotVersion,
+		SeqNum:        seqnum,
+		Timestamp:     s.trustListTime,
+		CtrlPubkey:    s.ctrlPubkey,
+		NaviInfo:      s.naviInfo,
+		TrustNodes:    s.trustNodes(),
+		DefaultPolicy: def,
+		NodePolicies:  nodePolicies,
+	}
+	b, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		s.logf("derp: encoding trust list: %v", err)
+		return
+	}
+	if err := atomicfile.WriteFile(s.trustListPath, b, 0600); err != nil {
+		s.logf("derp: saving trust list: %v", err)
+	}
+}
+
+// loadTrustList 在启动时从磁盘快照恢复受信列表。
+// 快照不存在时返回nil；快照过期时返回错误且不加载。
+func (s *Server) loadTrustList() error {
+	if s.trustListPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.trustListPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap trustListSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return fmt.Errorf("decoding %s: %w", s.trustListPath, err)
+	}
+	if snap.Version != trustListSnapshotVersion {
+		return fmt.Errorf("unsupported trust list snapshot version %d", snap.Version)
+	}
+	if age := time.Since(snap.Timestamp); s.trustListMaxAge > 0 && age > s.trustListMaxAge {
+		return fmt.Errorf("trust list snapshot is stale (%v old, max %v)", age.Round(time.Second), s.trustListMaxAge)
+	}
+
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	s.resetTrustNodesLocked(snap.SeqNum, snap.TrustNodes)
+	var def *ClientPolicy
+	if !snap.DefaultPolicy.IsZero() {
+		def = &snap.DefaultPolicy
+	}
+	s.setNodePolicies(def, snap.NodePolicies)
+	s.trustListTime = snap.Timestamp
+	s.ctrlPubkey = snap.CtrlPubkey
+	s.naviInfo = snap.NaviInfo
+	s.trustListLoaded = true
+	s.logf("derp: loaded %d trusted nodes from %s (seqnum %d, synced %v)",
+		len(snap.TrustNodes), s.trustListPath, snap.SeqNum, snap.Timestamp.Format(time.RFC3339))
+	return nil
+}
+
+// TrustListSyncTime returns the time the trust list was last synchronized
+// with the control server, either live or as recorded in a loaded snapshot.
+// It returns the zero time if the trust list was never synchronized.
+func (s *Server) TrustListSyncTime() time.Time {
+	s.trustListMu.Lock()
+	defer s.trustListMu.Unlock()
+	return s.trustListTime
+}
+
+// trustListSyncWarnable 在受信列表长时间未能与控制器同步时置为不健康。
+var trustListSyncWarnable = health.NewWarnable()
+
+// StartTrustListSync schedules a periodic full reconciliation of the trust
+// list with the control server on s.Cronjob, and starts the Cronjob.
+// Each run is delayed by a random duration in [0, jitter) so that a fleet of
+// relays doesn't hit the control server in lockstep; failed pulls are
+// retried with exponential backoff until they succeed or the run has taken
+// longer than interval.
+//
+// It must be called after PrepareManaged.
+func (s *Server) StartTrustListSync(interval, jitter time.Duration) error {
+	if s.Cronjob == nil {
+		return errors.New("derp: StartTrustListSync called before PrepareManaged")
+	}
+	if interval < time.Second {
+		return fmt.Errorf("derp: trust list sync interval %v too short", interval)
+	}
+	job := cron.NewChain(
+		cron.SkipIfStillRunning(cron.DiscardLogger),
+	).Then(cron.FuncJob(func() { s.syncTrustList(interval, jitter) }))
+	s.Cronjob.Schedule(cron.Every(interval), job)
+	s.Cronjob.Start()
+	return nil
+}
+
+// syncTrustList runs one scheduled reconciliation of the trust list.
+func (s *Server) syncTrustList(interval, jitter time.Duration) {
+	if jitter > 0 {
+		t := time.NewTimer(time.Duration(rand.Int63n(int64(jitter))))
+		select {
+		case <-s.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, interval)
+	defer cancel()
+	bo := backoff.NewBackoff("derp-trustlist", s.logf, interval/2)
+	for ctx.Err() == nil {
+		err := s.PullNodesList()
+		s.noteTrustListSync(err)
+		if err == nil {
+			return
+		}
+		bo.BackOff(ctx, err)
+	}
+}
+
+// noteTrustListSync records the result of an attempt to sync the trust list
+// for metrics and health reporting.
+func (s *Server) noteTrustListSync(err error) {
+	if err == nil {
+		s.trustListSyncs.Add(1)
+		trustListSyncWarnable.Set(nil)
+		return
+	}
+	s.trustListSyncFailures.Add(1)
+	s.logf("derp: trust list sync failed: %v", err)
+	if last := s.TrustListSyncTime(); last.IsZero() {
+		trustListSyncWarnable.Set(fmt.Errorf("trust list never synced with control server: %w", err))
+	} else {
+		trustListSyncWarnable.Set(fmt.Errorf("trust list last synced with control server %v ago: %w",
+			time.Since(last).Round(time.Second), err))
+	}
+}
+
+// trustListSyncAge returns the number of seconds since the trust list was
+// last synced with the control server, or -1 if it never was.
+func (s *Server) trustListSyncAge() float64 {
+	last := s.TrustListSyncTime()
+	if last.IsZero() {
+		return -1
+	}
+	return time.Since(last).Seconds()
+}
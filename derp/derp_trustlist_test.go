@@ -0,0 +1,358 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/robfig/cron/v3"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/types/key"
+)
+
+// newManagedTestServer returns a Server set up as PrepareManaged would,
+// without contacting a control server, and with its trust list snapshot
+// at path (if non-empty).
+func newManagedTestServer(t *testing.T, path string, maxAge time.Duration) *Server {
+	t.Helper()
+	s := NewServer(key.NewNode(), t.Logf)
+	t.Cleanup(func() { s.Close() })
+	s.ctx = context.Background()
+	s.trustNodesCache = cache.New(0, 0)
+	s.SetTrustListFile(path, maxAge)
+	return s
+}
+
+func TestTrustListSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trustlist.json")
+	ctrlKey := key.NewMachine().Public()
+	policy := ClientPolicy{BytesPerSec: 1000, MaxConns: 2}
+
+	s := newManagedTestServer(t, path, 0)
+	s.ctrlPubkey = ctrlKey
+	s.naviInfo = NaviNode{ID: "navi1", HostName: "derp.example.com", DERPPort: 443}
+	s.setNodePolicies(&ClientPolicy{MaxConns: 5}, map[string]ClientPolicy{"b": policy})
+	s.replaceTrustNodes(7, []string{"b", "a", "c"})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("snapshot not written: %v", err)
+	}
+
+	s2 := newManagedTestServer(t, path, time.Hour)
+	if err := s2.loadTrustList(); err != nil {
+		t.Fatal(err)
+	}
+	if !s2.trustListLoaded {
+		t.Error("trustListLoaded = false after load")
+	}
+	if got, want := s2.trustNodes(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("trust nodes = %q; want %q", got, want)
+	}
+	if seq, err := s2.trustListSeq(); err != nil || seq != 7 {
+		t.Errorf("seqnum = %v, %v; want 7", seq, err)
+	}
+	if got, want := s2.trustListDigestLocked(), TrustListDigest([]string{"a", "b", "c"}); got != want {
+		t.Errorf("digest = %s; want %s", got, want)
+	}
+	if s2.ctrlPubkey != ctrlKey {
+		t.Errorf("ctrlPubkey = %v; want %v", s2.ctrlPubkey, ctrlKey)
+	}
+	if s2.naviInfo != s.naviInfo {
+		t.Errorf("naviInfo = %+v; want %+v", s2.naviInfo, s.naviInfo)
+	}
+	def, nodes := s2.nodePoliciesCopy()
+	if def.MaxConns != 5 || !reflect.DeepEqual(nodes, map[string]ClientPolicy{"b": policy}) {
+		t.Errorf("policies = %+v, %+v", def, nodes)
+	}
+	if got := s2.TrustListSyncTime(); !got.Equal(s.TrustListSyncTime()) {
+		t.Errorf("sync time = %v; want %v", got, s.TrustListSyncTime())
+	}
+}
+
+func TestTrustListSnapshotRejected(t *testing.T) {
+	dir := t.TempDir()
+
+	// No snapshot is not an error.
+	s := newManagedTestServer(t, filepath.Join(dir, "missing.json"), 0)
+	if err := s.loadTrustList(); err != nil {
+		t.Errorf("missing snapshot: %v", err)
+	}
+	if s.trustListLoaded {
+		t.Error("missing snapshot marked loaded")
+	}
+
+	// A stale snapshot is refused.
+	path := filepath.Join(dir, "stale.json")
+	s = newManagedTestServer(t, path, 0)
+	s.replaceTrustNodes(1, []string{"a"})
+	s.trustListMu.Lock()
+	s.trustListTime = time.Now().Add(-2 * time.Hour)
+	s.saveTrustListLocked()
+	s.trustListMu.Unlock()
+	s2 := newManagedTestServer(t, path, time.Hour)
+	if err := s2.loadTrustList(); err == nil {
+		t.Error("stale snapshot loaded")
+	}
+	if s2.trustListLoaded || len(s2.trustNodes()) != 0 {
+		t.Error("stale snapshot applied")
+	}
+
+	// So is one of an unknown version, or a corrupt one.
+	for name, contents := range map[string]string{
+		"version.json": `{"Version": 99, "TrustNodes": ["a"]}`,
+		"corrupt.json": `{"Version": 1, "TrustNo`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s := newManagedTestServer(t, path, 0)
+		if err := s.loadTrustList(); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+		if s.trustListLoaded {
+			t.Errorf("%s: marked loaded", name)
+		}
+	}
+}
+
+func TestApplyNodeChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trustlist.json")
+	s := newManagedTestServer(t, path, 0)
+	s.replaceTrustNodes(3, []string{"a", "b"})
+
+	applied, err := s.applyNodeChange(&NodesChange{SeqNum: 4, AddNode: "c", RemoveNode: "a"})
+	if err != nil || !applied {
+		t.Fatalf("applyNodeChange = %v, %v; want true", applied, err)
+	}
+	if got, want := s.trustNodes(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("trust nodes = %q; want %q", got, want)
+	}
+
+	// Replays and gaps aren't applied.
+	for _, seq := range []int{4, 6} {
+		applied, err := s.applyNodeChange(&NodesChange{SeqNum: seq, AddNode: "x"})
+		if err != nil || applied {
+			t.Errorf("seqnum %d: applyNodeChange = %v, %v; want false", seq, applied, err)
+		}
+	}
+	if got, want := s.trustNodes(), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("trust nodes = %q; want %q", got, want)
+	}
+
+	// The change is persisted.
+	s2 := newManagedTestServer(t, path, 0)
+	if err := s2.loadTrustList(); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := s2.trustListSeq(); seq != 4 {
+		t.Errorf("saved seqnum = %d; want 4", seq)
+	}
+}
+
+func TestApplyNodeChangeConcurrent(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+	s.replaceTrustNodes(0, nil)
+
+	// Several changes claiming the same next seqnum: only one may apply.
+	const n = 10
+	var wg sync.WaitGroup
+	results := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			applied, err := s.applyNodeChange(&NodesChange{SeqNum: 1, AddNode: string(rune('a' + i))})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- applied
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	var applied int
+	for ok := range results {
+		if ok {
+			applied++
+		}
+	}
+	if applied != 1 {
+		t.Errorf("%d changes applied at seqnum 1; want 1", applied)
+	}
+	if got := len(s.trustNodes()); got != 1 {
+		t.Errorf("%d trust nodes; want 1", got)
+	}
+}
+
+// setUnreachableControl points s at a control server that refuses
+// connections, so that PullNodesList fails.
+func setUnreachableControl(t *testing.T, s *Server) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctrlURL = "http://" + ln.Addr().String()
+	ln.Close()
+	s.nc, err = controlclient.NewNoiseClient(controlclient.NoiseOpts{
+		PrivKey:      key.NewMachine(),
+		ServerPubKey: key.NewMachine().Public(),
+		ServerURL:    s.ctrlURL,
+		Dialer:       &tsdial.Dialer{Logf: t.Logf},
+		Logf:         t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.nc.Close() })
+}
+
+func TestApplyNodesDelta(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+	setUnreachableControl(t, s)
+	s.replaceTrustNodes(10, []string{"a", "b"})
+
+	// wantState checks the trust list and seqnum after a delta.
+	wantState := func(seq int, nodes ...string) {
+		t.Helper()
+		if got := s.trustNodes(); !reflect.DeepEqual(got, nodes) {
+			t.Errorf("trust nodes = %q; want %q", got, nodes)
+		}
+		if got, _ := s.trustListSeq(); got != seq {
+			t.Errorf("seqnum = %d; want %d", got, seq)
+		}
+		if got, want := s.trustListDigestLocked(), TrustListDigest(nodes); got != want {
+			t.Errorf("digest = %s; want %s", got, want)
+		}
+	}
+
+	// A delta with the matching digest is applied, and duplicate or
+	// redundant changes within it don't throw the digest off.
+	want := []string{"b", "c", "d"}
+	resp, err := s.applyNodesDelta(&NodesDelta{
+		SeqNum: 11,
+		Add:    []string{"c", "d", "c", "b"},
+		Remove: []string{"a", "a", "x"},
+		Digest: TrustListDigest(want),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SeqNum != 11 || resp.Digest != TrustListDigest(want) || resp.Resynced {
+		t.Errorf("response = %+v", resp)
+	}
+	wantState(11, want...)
+
+	// A replay of it is answered with the current state.
+	resp, err = s.applyNodesDelta(&NodesDelta{SeqNum: 11, Add: []string{"z"}, Digest: TrustListDigest(want)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.SeqNum != 11 || resp.Digest != TrustListDigest(want) || resp.Resynced {
+		t.Errorf("replay response = %+v", resp)
+	}
+	wantState(11, want...)
+
+	// A seqnum gap, a digest mismatch, or a replay with a different
+	// digest needs a full pull. While that fails, the verified list stays.
+	for name, delta := range map[string]*NodesDelta{
+		"gap":      {SeqNum: 13, Add: []string{"e"}},
+		"mismatch": {SeqNum: 12, Add: []string{"e"}, Digest: TrustListDigest([]string{"e"})},
+		"replay":   {SeqNum: 11, Digest: TrustListDigest([]string{"e"})},
+	} {
+		if _, err := s.applyNodesDelta(delta); err == nil {
+			t.Errorf("%s: no error from failed pull", name)
+		}
+		wantState(11, want...)
+	}
+}
+
+func TestTrustListSyncStatus(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+	defer trustListSyncWarnable.Set(nil)
+
+	if got := s.trustListSyncAge(); got != -1 {
+		t.Errorf("sync age before any sync = %v; want -1", got)
+	}
+	s.noteTrustListSync(errors.New("boom"))
+	if got := s.trustListSyncFailures.Value(); got != 1 {
+		t.Errorf("sync failures = %d; want 1", got)
+	}
+
+	s.replaceTrustNodes(1, []string{"a"})
+	s.noteTrustListSync(nil)
+	if got := s.trustListSyncs.Value(); got != 1 {
+		t.Errorf("syncs = %d; want 1", got)
+	}
+	if got := s.trustListSyncAge(); got < 0 || got > 60 {
+		t.Errorf("sync age = %v; want a few seconds at most", got)
+	}
+}
+
+func TestStartTrustListSync(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if err := s.StartTrustListSync(time.Minute, 0); err == nil {
+		t.Error("StartTrustListSync before PrepareManaged succeeded")
+	}
+	s.Cronjob = cron.New()
+	if err := s.StartTrustListSync(time.Millisecond, 0); err == nil {
+		t.Error("StartTrustListSync with a too short interval succeeded")
+	}
+	if err := s.StartTrustListSync(time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Cronjob.Entries()); got != 1 {
+		t.Errorf("%d cron entries; want 1", got)
+	}
+}
+
+func TestSyncTrustListRetries(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+	setUnreachableControl(t, s)
+	defer trustListSyncWarnable.Set(nil)
+
+	// Pulls are retried until the run has taken the interval.
+	const interval = 2 * time.Second
+	start := time.Now()
+	s.syncTrustList(interval, 0)
+	if d := time.Since(start); d < interval || d > 3*interval {
+		t.Errorf("sync run took %v; want about %v", d, interval)
+	}
+	if got := s.trustListSyncFailures.Value(); got < 2 {
+		t.Errorf("sync failures = %d; want retries", got)
+	}
+	if got := s.trustListSyncs.Value(); got != 0 {
+		t.Errorf("syncs = %d; want 0", got)
+	}
+}
+
+func TestSyncTrustListShutdown(t *testing.T) {
+	s := newManagedTestServer(t, "", 0)
+	setUnreachableControl(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	cancel()
+
+	// A run waiting out its jitter stops, without pulling, once the
+	// server is shutting down.
+	start := time.Now()
+	s.syncTrustList(time.Minute, time.Hour)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sync run took %v after shutdown", d)
+	}
+	if got := s.trustListSyncs.Value() + s.trustListSyncFailures.Value(); got != 0 {
+		t.Errorf("%d pulls after shutdown; want 0", got)
+	}
+}
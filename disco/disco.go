@@ -117,13 +117,17 @@ type Ping struct {
 	// netmap data to reduce the discokey:nodekey relation from 1:N to
 	// 1:1.
 	NodeKey key.NodePublic
+
+	// Padding is the number of zero bytes at the end of the message,
+	// used to probe the path MTU. It's only sent if NodeKey is set.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
 	dataLen := 12
 	hasKey := !m.NodeKey.IsZero()
 	if hasKey {
-		dataLen += key.NodePublicRawLen
+		dataLen += key.NodePublicRawLen + m.Padding
 	}
 	ret, d := appendMsgHeader(b, TypePing, v0, dataLen)
 	n := copy(d, m.TxID[:])
@@ -143,6 +147,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	// compatibility.
 	if len(p) >= key.NodePublicRawLen {
 		m.NodeKey = key.NodePublicFromRaw32(mem.B(p[:key.NodePublicRawLen]))
+		m.Padding = len(p) - key.NodePublicRawLen
 	}
 	return m, nil
 }
@@ -21,8 +21,11 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.ControlFailoverURLs = append(src.ControlFailoverURLs[:0:0], src.ControlFailoverURLs...)
+	dst.DNSBlocklists = append(src.DNSBlocklists[:0:0], src.DNSBlocklists...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.DERPAvoidRegions = append(src.DERPAvoidRegions[:0:0], src.DERPAvoidRegions...)
 	dst.Persist = src.Persist.Clone()
 	return dst
 }
@@ -30,12 +33,15 @@ func (src *Prefs) Clone() *Prefs {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsCloneNeedsRegeneration = Prefs(struct {
 	ControlURL             string
+	ControlFailoverURLs    []string
 	RouteAll               bool
 	AllowSingleHosts       bool
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netip.Addr
 	ExitNodeAllowLANAccess bool
 	CorpDNS                bool
+	DNSBlocklists          []string
+	DNSBlockPolicy         string
 	RunSSH                 bool
 	WantRunning            bool
 	LoggedOut              bool
@@ -50,6 +56,9 @@ func (src *Prefs) Clone() *Prefs {
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
 	ProfileName            string
+	DERPHomeRegion         int
+	DERPAvoidRegions       []int
+	DERPHomePeerAware      bool
 	Persist                *persist.Persist
 }{})
 
@@ -67,6 +76,12 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			dst.TCP[k] = v.Clone()
 		}
 	}
+	if dst.UDP != nil {
+		dst.UDP = map[uint16]*UDPPortHandler{}
+		for k, v := range src.UDP {
+			dst.UDP[k] = v.Clone()
+		}
+	}
 	if dst.Web != nil {
 		dst.Web = map[HostPort]*WebServerConfig{}
 		for k, v := range src.Web {
@@ -85,6 +100,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 }{})
@@ -107,6 +123,23 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	TerminateTLS string
 }{})
 
+// Clone makes a deep copy of UDPPortHandler.
+// The result aliases no memory with the original.
+func (src *UDPPortHandler) Clone() *UDPPortHandler {
+	if src == nil {
+		return nil
+	}
+	dst := new(UDPPortHandler)
+	*dst = *src
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerCloneNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward     string
+	IdleTimeoutSec int
+}{})
+
 // Clone makes a deep copy of HTTPHandler.
 // The result aliases no memory with the original.
 func (src *HTTPHandler) Clone() *HTTPHandler {
@@ -115,14 +148,35 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	if dst.SetRequestHeaders != nil {
+		dst.SetRequestHeaders = map[string]string{}
+		for k, v := range src.SetRequestHeaders {
+			dst.SetRequestHeaders[k] = v
+		}
+	}
+	dst.RemoveRequestHeaders = append(src.RemoveRequestHeaders[:0:0], src.RemoveRequestHeaders...)
+	if dst.SetResponseHeaders != nil {
+		dst.SetResponseHeaders = map[string]string{}
+		for k, v := range src.SetResponseHeaders {
+			dst.SetResponseHeaders[k] = v
+		}
+	}
+	dst.RemoveResponseHeaders = append(src.RemoveResponseHeaders[:0:0], src.RemoveResponseHeaders...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	StatusCode            int
+	NoDirList             bool
+	SetRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -16,7 +16,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,UDPPortHandler,HTTPHandler,WebServerConfig
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -63,13 +63,18 @@ func (v *PrefsView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v PrefsView) ControlURL() string                 { return v.ж.ControlURL }
+func (v PrefsView) ControlURL() string { return v.ж.ControlURL }
+func (v PrefsView) ControlFailoverURLs() views.Slice[string] {
+	return views.SliceOf(v.ж.ControlFailoverURLs)
+}
 func (v PrefsView) RouteAll() bool                     { return v.ж.RouteAll }
 func (v PrefsView) AllowSingleHosts() bool             { return v.ж.AllowSingleHosts }
 func (v PrefsView) ExitNodeID() tailcfg.StableNodeID   { return v.ж.ExitNodeID }
 func (v PrefsView) ExitNodeIP() netip.Addr             { return v.ж.ExitNodeIP }
 func (v PrefsView) ExitNodeAllowLANAccess() bool       { return v.ж.ExitNodeAllowLANAccess }
 func (v PrefsView) CorpDNS() bool                      { return v.ж.CorpDNS }
+func (v PrefsView) DNSBlocklists() views.Slice[string] { return views.SliceOf(v.ж.DNSBlocklists) }
+func (v PrefsView) DNSBlockPolicy() string             { return v.ж.DNSBlockPolicy }
 func (v PrefsView) RunSSH() bool                       { return v.ж.RunSSH }
 func (v PrefsView) WantRunning() bool                  { return v.ж.WantRunning }
 func (v PrefsView) LoggedOut() bool                    { return v.ж.LoggedOut }
@@ -86,17 +91,23 @@ func (v PrefsView) NoSNAT() bool                          { return v.ж.NoSNAT }
 func (v PrefsView) NetfilterMode() preftype.NetfilterMode { return v.ж.NetfilterMode }
 func (v PrefsView) OperatorUser() string                  { return v.ж.OperatorUser }
 func (v PrefsView) ProfileName() string                   { return v.ж.ProfileName }
+func (v PrefsView) DERPHomeRegion() int                   { return v.ж.DERPHomeRegion }
+func (v PrefsView) DERPAvoidRegions() views.Slice[int]    { return views.SliceOf(v.ж.DERPAvoidRegions) }
+func (v PrefsView) DERPHomePeerAware() bool               { return v.ж.DERPHomePeerAware }
 func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.View() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsViewNeedsRegeneration = Prefs(struct {
 	ControlURL             string
+	ControlFailoverURLs    []string
 	RouteAll               bool
 	AllowSingleHosts       bool
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netip.Addr
 	ExitNodeAllowLANAccess bool
 	CorpDNS                bool
+	DNSBlocklists          []string
+	DNSBlockPolicy         string
 	RunSSH                 bool
 	WantRunning            bool
 	LoggedOut              bool
@@ -111,6 +122,9 @@ func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
 	ProfileName            string
+	DERPHomeRegion         int
+	DERPAvoidRegions       []int
+	DERPHomePeerAware      bool
 	Persist                *persist.Persist
 }{})
 
@@ -165,6 +179,12 @@ func (v ServeConfigView) TCP() views.MapFn[uint16, *TCPPortHandler, TCPPortHandl
 	})
 }
 
+func (v ServeConfigView) UDP() views.MapFn[uint16, *UDPPortHandler, UDPPortHandlerView] {
+	return views.MapFnOf(v.ж.UDP, func(t *UDPPortHandler) UDPPortHandlerView {
+		return t.View()
+	})
+}
+
 func (v ServeConfigView) Web() views.MapFn[HostPort, *WebServerConfig, WebServerConfigView] {
 	return views.MapFnOf(v.ж.Web, func(t *WebServerConfig) WebServerConfigView {
 		return t.View()
@@ -178,6 +198,7 @@ func (v ServeConfigView) AllowFunnel() views.Map[HostPort, bool] {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
+	UDP         map[uint16]*UDPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
 }{})
@@ -238,6 +259,60 @@ func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
 	TerminateTLS string
 }{})
 
+// View returns a readonly view of UDPPortHandler.
+func (p *UDPPortHandler) View() UDPPortHandlerView {
+	return UDPPortHandlerView{ж: p}
+}
+
+// UDPPortHandlerView provides a read-only view over UDPPortHandler.
+//
+// Its methods should only be called if `Valid()` returns true.
+type UDPPortHandlerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *UDPPortHandler
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v UDPPortHandlerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v UDPPortHandlerView) AsStruct() *UDPPortHandler {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v UDPPortHandlerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *UDPPortHandlerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x UDPPortHandler
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v UDPPortHandlerView) UDPForward() string  { return v.ж.UDPForward }
+func (v UDPPortHandlerView) IdleTimeoutSec() int { return v.ж.IdleTimeoutSec }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerViewNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward     string
+	IdleTimeoutSec int
+}{})
+
 // View returns a readonly view of HTTPHandler.
 func (p *HTTPHandler) View() HTTPHandlerView {
 	return HTTPHandlerView{ж: p}
@@ -283,15 +358,39 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string     { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string    { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string     { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string { return v.ж.Redirect }
+func (v HTTPHandlerView) StatusCode() int  { return v.ж.StatusCode }
+func (v HTTPHandlerView) NoDirList() bool  { return v.ж.NoDirList }
+
+func (v HTTPHandlerView) SetRequestHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.SetRequestHeaders)
+}
+func (v HTTPHandlerView) RemoveRequestHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveRequestHeaders)
+}
+
+func (v HTTPHandlerView) SetResponseHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.SetResponseHeaders)
+}
+func (v HTTPHandlerView) RemoveResponseHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.RemoveResponseHeaders)
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	StatusCode            int
+	NoDirList             bool
+	SetRequestHeaders     map[string]string
+	RemoveRequestHeaders  []string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
 }{})
 
 // View returns a readonly view of WebServerConfig.
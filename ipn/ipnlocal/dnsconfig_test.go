@@ -9,8 +9,10 @@
 	"reflect"
 	"testing"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/ipn"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
@@ -145,6 +147,59 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "extra_records_other_types",
+			nm: &netmap.NetworkMap{
+				Name:      "myname.net",
+				Addresses: ipps("100.101.101.101"),
+				DNS: tailcfg.DNSConfig{
+					ExtraRecords: []tailcfg.DNSRecord{
+						{Name: "alias.myname.net", Type: "CNAME", Value: "myname.net"},
+						{Name: "_sip._udp.myname.net", Type: "SRV", Value: "10 5 5060 myname.net"},
+						{Name: "myname.net", Type: "TXT", Value: "hello"},
+						{Name: "myname.net", Type: "mx", Value: "10 mail.myname.net"},
+						{Name: "bad.myname.net", Type: "SRV", Value: "not a record"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{},
+			want: &dns.Config{
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+				Hosts: map[dnsname.FQDN][]netip.Addr{
+					"myname.net.": ips("100.101.101.101"),
+				},
+				Records: map[dnsname.FQDN][]resolver.Record{
+					"alias.myname.net.":     {{Type: dnsmessage.TypeCNAME, Target: "myname.net."}},
+					"_sip._udp.myname.net.": {{Type: dnsmessage.TypeSRV, Priority: 10, Weight: 5, Port: 5060, Target: "myname.net."}},
+					"myname.net.": {
+						{Type: dnsmessage.TypeTXT, TXT: []string{"hello"}},
+						{Type: dnsmessage.TypeMX, Priority: 10, Target: "mail.myname.net."},
+					},
+				},
+			},
+		},
+		{
+			name: "blocklists",
+			nm: &netmap.NetworkMap{
+				Name:      "myname.net",
+				Addresses: ipps("100.101.101.101"),
+			},
+			prefs: &ipn.Prefs{
+				DNSBlocklists:  []string{"/etc/ads.txt", "https://example.com/malware.txt"},
+				DNSBlockPolicy: "zeroip",
+			},
+			want: &dns.Config{
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+				Hosts: map[dnsname.FQDN][]netip.Addr{
+					"myname.net.": ips("100.101.101.101"),
+				},
+				Blocklists: []resolver.Blocklist{
+					{Source: "/etc/ads.txt"},
+					{Source: "https://example.com/malware.txt"},
+				},
+				BlockPolicy: resolver.BlockZeroIP,
+			},
+		},
 		{
 			name: "corp_dns_misc",
 			nm: &netmap.NetworkMap{
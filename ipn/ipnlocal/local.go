@@ -48,6 +48,7 @@
 	"tailscale.com/log/sockstatlog"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/interfaces"
@@ -108,6 +109,10 @@ type SSHServer interface {
 	// and closed if they'd no longer be accepted.
 	OnPolicyChange()
 
+	// ExplainPolicy reports how the SSH access policy would be
+	// evaluated for a connection from src as sshUser.
+	ExplainPolicy(src netip.Addr, sshUser string) (*apitype.SSHPolicyExplanation, error)
+
 	// Shutdown is called when tailscaled is shutting down.
 	Shutdown()
 }
@@ -121,6 +126,16 @@ func RegisterNewSSHServer(fn newSSHServerFunc) {
 	newSSHServer = fn
 }
 
+// loadSSHPolicyFile reads and validates a local SSH policy file, or is nil.
+var loadSSHPolicyFile func(path string) (*tailcfg.SSHPolicy, error)
+
+// RegisterSSHPolicyFileLoader lets the conditionally linked ssh/tailssh
+// package register how it loads local SSH policy files, so that the SSH
+// health check can tell whether one is usable.
+func RegisterSSHPolicyFileLoader(fn func(path string) (*tailcfg.SSHPolicy, error)) {
+	loadSSHPolicyFile = fn
+}
+
 // LocalBackend is the glue between the major pieces of the Tailscale
 // network software: the cloud control plane (via controlclient), the
 // network data plane (via wgengine), and the user-facing UIs and CLIs
@@ -150,9 +165,11 @@ type LocalBackend struct {
 	portpollOnce          sync.Once        // guards starting readPoller
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	newDecompressor       func() (controlclient.Decompressor, error)
-	varRoot               string         // or empty if SetVarRoot never called
-	logFlushFunc          func()         // or nil if SetLogFlusher wasn't called
-	em                    *expiryManager // non-nil
+	varRoot               string            // or empty if SetVarRoot never called
+	logFlushFunc          func()            // or nil if SetLogFlusher wasn't called
+	sshPolicyFile         string            // or empty if SetSSHPolicyFile never called
+	sshPolicyFileMode     SSHPolicyFileMode // how sshPolicyFile is used, if set
+	em                    *expiryManager    // non-nil
 	sshAtomicBool         atomic.Bool
 	shutdownCalled        bool // if Shutdown has been called
 	debugSink             *capture.Sink
@@ -181,6 +198,7 @@ type LocalBackend struct {
 	filterAtomic                 atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic      syncs.AtomicValue[func(netip.Addr) bool]
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
+	shouldInterceptUDPPortAtomic syncs.AtomicValue[func(uint16) bool]
 	numClientStatusCalls         atomic.Uint32
 
 	// The mutex protects the following elements.
@@ -220,6 +238,18 @@ type LocalBackend struct {
 	fileWaiters      set.HandleSet[context.CancelFunc] // of wake-up funcs
 	notifyWatchers   set.HandleSet[chan *ipn.Notify]
 	lastStatusTime   time.Time // status.AsOf value of the last processed status update
+	// netMapStale is whether netMap is from the netmap cache, and
+	// netMapCachedAt when control sent it. netMapCacheExpiryTimer drops
+	// its peers once it's too old.
+	netMapStale            bool
+	netMapCachedAt         time.Time
+	netMapCacheExpiryTimer *time.Timer
+	// netMapCachePending is the netmap to write to the netmap cache, under
+	// netMapCachePendingKey, when netMapCacheSaveTimer fires.
+	netMapCachePending    *cachedNetMap
+	netMapCachePendingKey ipn.StateKey
+	netMapCacheSaveTimer  *time.Timer
+	netMapCacheLastSave   time.Time
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
 	// intermediate buffered directory for "pick-up" later. If
@@ -242,6 +272,7 @@ type LocalBackend struct {
 
 	serveListeners     map[netip.AddrPort]*serveListener // addrPort => serveListener
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *httputil.ReverseProxy
+	serveUDPFlows      map[udpServeFlowKey]*udpServeFlow // NAT state of flows forwarded per ServeConfig.UDP
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -330,6 +361,7 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	b.setFilter(filter.NewAllowNone(logf, &netipx.IPSet{}))
 
 	b.setTCPPortsIntercepted(nil)
+	b.setUDPPortsIntercepted(nil)
 
 	b.statusChanged = sync.NewCond(&b.statusLock)
 	b.e.SetStatusCallback(b.setWgengineStatus)
@@ -467,6 +499,16 @@ func (b *LocalBackend) Dialer() *tsdial.Dialer {
 	return b.dialer
 }
 
+// DNSResolver returns the MagicDNS resolver, if the backend has a DNS
+// manager.
+func (b *LocalBackend) DNSResolver() (_ *resolver.Resolver, ok bool) {
+	dm, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, false
+	}
+	return dm.Resolver(), true
+}
+
 // SetDirectFileRoot sets the directory to download files to directly,
 // without buffering them through an intermediate daemon-owned
 // tailcfg.UserID-specific directory.
@@ -659,12 +701,17 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		if m := b.sshOnButUnusableHealthCheckMessageLocked(); m != "" {
 			s.Health = append(s.Health, m)
 		}
+		if b.ccAuto != nil {
+			s.ControlURL, s.ControlFailover = b.ccAuto.ServerURL()
+		}
 		/* cgao6: we are unstable, so pls dont check this
 		if version.IsUnstableBuild() {
 			s.Health = append(s.Health, "This is an unstable (development) version of Tailscale; frequent updates and bugs are likely")
 		} */
 		if b.netMap != nil {
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
+			s.NetMapStale = b.netMapStale
+			s.NetMapCachedAt = b.netMapCachedAt
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			if s.CurrentTailnet == nil {
 				s.CurrentTailnet = &ipnstate.TailnetStatus{}
@@ -1041,6 +1088,10 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		}
 		b.setNetMapLocked(st.NetMap)
 		b.updateFilterLocked(st.NetMap, prefs.View())
+		if b.stopUsingNetMapCacheLocked() {
+			b.logf("netmap cache: replaced by netmap from control")
+		}
+		b.saveNetMapCacheLocked(st.NetMap)
 	}
 	b.mu.Unlock()
 
@@ -1369,6 +1420,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.applyPrefsToHostinfoLocked(hostinfo, prefs)
 
 	b.setNetMapLocked(nil)
+	b.stopUsingNetMapCacheLocked()
 	persistv := prefs.Persist().AsStruct()
 	if persistv == nil {
 		persistv = new(persist.Persist)
@@ -1416,6 +1468,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		Logf:                 logger.WithPrefix(b.logf, "control: "),
 		Persist:              *persistv,
 		ServerURL:            serverURL,
+		FailoverServerURLs:   prefs.ControlFailoverURLs().AsSlice(),
 		AuthKey:              opts.AuthKey,
 		Hostinfo:             hostinfo,
 		KeepAlive:            true,
@@ -1472,6 +1525,11 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: &prefs})
 
+	if !loggedOut && wantRunning {
+		// Until control is reachable, reach the peers we knew of.
+		b.useNetMapCache()
+	}
+
 	if !loggedOut && b.hasNodeKey() {
 		// Even if !WantRunning, we should verify our key, if there
 		// is one. If you want tailscaled to be completely idle,
@@ -2239,6 +2297,19 @@ func (b *LocalBackend) migrateStateLocked(prefs *ipn.Prefs) (err error) {
 // efficient func for ShouldInterceptTCPPort to use, which is called on every
 // incoming packet.
 func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptTCPPortAtomic.Store(portSetFunc(ports))
+}
+
+// setUDPPortsIntercepted populates b.shouldInterceptUDPPortAtomic with an
+// efficient func for ShouldInterceptUDPPort to use, which is called on every
+// incoming packet.
+func (b *LocalBackend) setUDPPortsIntercepted(ports []uint16) {
+	b.shouldInterceptUDPPortAtomic.Store(portSetFunc(ports))
+}
+
+// portSetFunc returns an efficient func reporting whether a port is one of
+// ports.
+func portSetFunc(ports []uint16) func(uint16) bool {
 	slices.Sort(ports)
 	uniq.ModifySlice(&ports)
 	var f func(uint16) bool
@@ -2269,7 +2340,7 @@ func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
 			}
 		}
 	}
-	b.shouldInterceptTCPPortAtomic.Store(f)
+	return f
 }
 
 // setAtomicValuesFromPrefsLocked populates sshAtomicBool, containsViaIPFuncAtomic
@@ -2280,12 +2351,33 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nil))
 		b.setTCPPortsIntercepted(nil)
+		b.setUDPPortsIntercepted(nil)
 		b.lastServeConfJSON = mem.B(nil)
 		b.serveConfig = ipn.ServeConfigView{}
+		b.closeStaleServeUDPFlowsLocked()
 	} else {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(p.AdvertiseRoutes().Filter(tsaddr.IsViaPrefix)))
 		b.setTCPPortsInterceptedFromNetmapAndPrefsLocked(p)
 	}
+	b.setDERPHomePolicyLocked(p)
+}
+
+// setDERPHomePolicyLocked configures how magicsock picks the home DERP
+// region from the DERP prefs in p.
+func (b *LocalBackend) setDERPHomePolicyLocked(p ipn.PrefsView) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return
+	}
+	var policy magicsock.DERPHomePolicy
+	if p.Valid() {
+		policy = magicsock.DERPHomePolicy{
+			Pin:       p.DERPHomeRegion(),
+			Avoid:     p.DERPAvoidRegions().AsSlice(),
+			PeerAware: p.DERPHomePeerAware(),
+		}
+	}
+	mc.SetDERPHomePolicy(policy)
 }
 
 // State returns the backend state machine's current state.
@@ -2552,6 +2644,11 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 	if err := b.checkFunnelEnabledLocked(p); err != nil {
 		errs = append(errs, err)
 	}
+	switch resolver.BlockPolicy(p.DNSBlockPolicy) {
+	case "", resolver.BlockNXDomain, resolver.BlockZeroIP:
+	default:
+		errs = append(errs, fmt.Errorf("unknown DNS block policy %q", p.DNSBlockPolicy))
+	}
 	return multierr.New(errs...)
 }
 
@@ -2581,7 +2678,7 @@ func (b *LocalBackend) checkSSHPrefsLocked(p *ipn.Prefs) error {
 	if !envknob.CanSSHD() {
 		return errors.New("The Mirage SSH server has been administratively disabled.")
 	}
-	if envknob.SSHIgnoreTailnetPolicy() || envknob.SSHPolicyFile() != "" {
+	if envknob.SSHIgnoreTailnetPolicy() || envknob.SSHPolicyFile() != "" || b.sshPolicyFile != "" {
 		return nil
 	}
 	if b.netMap != nil {
@@ -2606,6 +2703,14 @@ func (b *LocalBackend) sshOnButUnusableHealthCheckMessageLocked() (healthMessage
 	if nm == nil {
 		return ""
 	}
+	if b.sshPolicyFile != "" {
+		if b.sshPolicyFileHasRules() {
+			return ""
+		}
+		if b.sshPolicyFileMode == SSHPolicyFileOverride {
+			return healthmsg.TailscaleSSHOnBut + "the local SSH policy file, which replaces access controls, doesn't allow anyone to access this device."
+		}
+	}
 	if nm.SSHPolicy != nil && len(nm.SSHPolicy.Rules) > 0 {
 		return ""
 	}
@@ -2621,6 +2726,17 @@ func (b *LocalBackend) sshOnButUnusableHealthCheckMessageLocked() (healthMessage
 	return healthmsg.TailscaleSSHOnBut + "access controls don't allow anyone to access this device." // Update your tailnet's ACLs at https://tailscale.com/s/ssh-policy"
 }
 
+// sshPolicyFileHasRules reports whether the local SSH policy file is
+// valid and has rules. Why it isn't is reported by the SSH server's own
+// health warning.
+func (b *LocalBackend) sshPolicyFileHasRules() bool {
+	if loadSSHPolicyFile == nil {
+		return false
+	}
+	pol, err := loadSSHPolicyFile(b.sshPolicyFile)
+	return err == nil && len(pol.Rules) > 0
+}
+
 func (b *LocalBackend) isDefaultServerLocked() bool {
 	prefs := b.pm.CurrentPrefs()
 	if !prefs.Valid() {
@@ -2742,6 +2858,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 	b.hostinfo = newHi
 	hostInfoChanged := !oldHi.Equal(newHi)
 	cc := b.cc
+	ccAuto := b.ccAuto
 
 	// [GRINDER STATS LINE] - please don't remove (used for log parsing)
 	if caller == "SetPrefs" {
@@ -2781,6 +2898,12 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
+	if ccAuto != nil && !slices.Equal(oldp.ControlFailoverURLs().AsSlice(), newp.ControlFailoverURLs) {
+		if err := ccAuto.SetFailoverServerURLs(newp.ControlFailoverURLs); err != nil {
+			b.logf("setting failover control URLs: %v", err)
+		}
+	}
+
 	if netMap != nil {
 		b.e.SetDERPMap(netMap.DERPMap)
 	}
@@ -3075,23 +3198,39 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs ipn.PrefsView, logf logger.
 		set(peer.Name, peer.Addresses)
 	}
 	for _, rec := range nm.DNS.ExtraRecords {
-		switch rec.Type {
+		fqdn, err := dnsname.ToFQDN(rec.Name)
+		if err != nil {
+			continue
+		}
+		switch strings.ToUpper(rec.Type) {
 		case "", "A", "AAAA":
 			// Treat these all the same for now: infer from the value
+			ip, err := netip.ParseAddr(rec.Value)
+			if err != nil {
+				// Ignore.
+				continue
+			}
+			dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
+		case "CNAME", "TXT", "MX", "SRV":
+			r, err := resolver.ParseRecord(rec.Type, rec.Value)
+			if err != nil {
+				logf("[unexpected] invalid %s ExtraRecord for %q: %v", rec.Type, rec.Name, err)
+				continue
+			}
+			mak.Set(&dcfg.Records, fqdn, append(dcfg.Records[fqdn], r))
 		default:
 			// TODO: more
-			continue
 		}
-		ip, err := netip.ParseAddr(rec.Value)
-		if err != nil {
-			// Ignore.
-			continue
-		}
-		fqdn, err := dnsname.ToFQDN(rec.Name)
-		if err != nil {
-			continue
-		}
-		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
+	}
+
+	// Blocklists apply to queries to quad-100 from this node, and to
+	// those from peers using it as an exit node, so they don't
+	// depend on CorpDNS either.
+	for _, src := range prefs.DNSBlocklists().AsSlice() {
+		dcfg.Blocklists = append(dcfg.Blocklists, resolver.Blocklist{Source: src})
+	}
+	if len(dcfg.Blocklists) > 0 {
+		dcfg.BlockPolicy = resolver.BlockPolicy(prefs.DNSBlockPolicy())
 	}
 
 	if !prefs.CorpDNS() {
@@ -3196,6 +3335,50 @@ func (b *LocalBackend) SetLogFlusher(flushFunc func()) {
 	b.logFlushFunc = flushFunc
 }
 
+// SSHPolicyFileMode is how a local SSH policy file is combined with the
+// SSH policy from the control plane.
+type SSHPolicyFileMode string
+
+const (
+	// SSHPolicyFileFallback uses the file's policy only when the control
+	// plane sends no SSH policy.
+	SSHPolicyFileFallback SSHPolicyFileMode = "fallback"
+	// SSHPolicyFileMerge evaluates the file's rules after the control
+	// plane's, so they can allow access the control plane's don't.
+	SSHPolicyFileMerge SSHPolicyFileMode = "merge"
+	// SSHPolicyFileOverride uses the file's policy and ignores the
+	// control plane's.
+	SSHPolicyFileOverride SSHPolicyFileMode = "override"
+)
+
+// ParseSSHPolicyFileMode parses an SSHPolicyFileMode. The empty string
+// is SSHPolicyFileFallback.
+func ParseSSHPolicyFileMode(s string) (SSHPolicyFileMode, error) {
+	switch m := SSHPolicyFileMode(s); m {
+	case "":
+		return SSHPolicyFileFallback, nil
+	case SSHPolicyFileFallback, SSHPolicyFileMerge, SSHPolicyFileOverride:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid SSH policy file mode %q; want %q, %q or %q", s, SSHPolicyFileFallback, SSHPolicyFileMerge, SSHPolicyFileOverride)
+}
+
+// SetSSHPolicyFile sets the path of a local file with an SSH policy, in
+// the JSON form of tailcfg.SSHPolicy, for the SSH server to use along
+// with the control plane's as per mode.
+//
+// It should only be called before the LocalBackend is used.
+func (b *LocalBackend) SetSSHPolicyFile(path string, mode SSHPolicyFileMode) {
+	b.sshPolicyFile = path
+	b.sshPolicyFileMode = mode
+}
+
+// SSHPolicyFile returns the path and mode set by SetSSHPolicyFile.
+// The path is empty if there is no local SSH policy file.
+func (b *LocalBackend) SSHPolicyFile() (path string, mode SSHPolicyFileMode) {
+	return b.sshPolicyFile, b.sshPolicyFileMode
+}
+
 // TryFlushLogs calls the log flush function. It returns false if a log flush
 // function was never initialized with SetLogFlusher.
 //
@@ -4037,8 +4220,15 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 		handlePorts = append(handlePorts, 22)
 	}
 
+	var udpPorts []uint16
 	b.reloadServeConfigLocked(prefs)
 	if b.serveConfig.Valid() {
+		b.serveConfig.UDP().Range(func(port uint16, _ ipn.UDPPortHandlerView) bool {
+			if port > 0 {
+				udpPorts = append(udpPorts, port)
+			}
+			return true
+		})
 		servePorts := make([]uint16, 0, 3)
 		b.serveConfig.TCP().Range(func(port uint16, _ ipn.TCPPortHandlerView) bool {
 			if port > 0 {
@@ -4063,6 +4253,8 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 	}
 
 	b.setTCPPortsIntercepted(handlePorts)
+	b.setUDPPortsIntercepted(udpPorts)
+	b.closeStaleServeUDPFlowsLocked()
 }
 
 // setServeProxyHandlersLocked ensures there is an http proxy handler for each
@@ -4662,6 +4854,16 @@ func checkSELinux() {
 	}
 }
 
+// ExplainSSHPolicy reports how the SSH server would evaluate its policy
+// for a connection from src as sshUser.
+func (b *LocalBackend) ExplainSSHPolicy(src netip.Addr, sshUser string) (*apitype.SSHPolicyExplanation, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	return s.ExplainPolicy(src, sshUser)
+}
+
 func (b *LocalBackend) HandleSSHConn(c net.Conn) (err error) {
 	s, err := b.sshServerOrInit()
 	if err != nil {
@@ -4832,6 +5034,13 @@ func (b *LocalBackend) ShouldInterceptTCPPort(port uint16) bool {
 	return b.shouldInterceptTCPPortAtomic.Load()(port)
 }
 
+// ShouldInterceptUDPPort reports whether the given UDP port number to a
+// Tailscale IP (not a subnet router, service IP, etc) should be intercepted by
+// Tailscaled and forwarded per the serve config.
+func (b *LocalBackend) ShouldInterceptUDPPort(port uint16) bool {
+	return b.shouldInterceptUDPPortAtomic.Load()(port)
+}
+
 // SwitchProfile switches to the profile with the given id.
 // It will restart the backend on success.
 // If the profile is not known, it returns an errProfileNotFound.
@@ -4897,6 +5106,7 @@ func (b *LocalBackend) initTKALocked() error {
 // resetForProfileChangeLockedOnEntry resets the backend for a profile change.
 func (b *LocalBackend) resetForProfileChangeLockedOnEntry() error {
 	b.setNetMapLocked(nil) // Reset netmap.
+	b.cancelNetMapCacheSaveLocked()
 	// Reset the NetworkMap in the engine
 	b.e.SetNetworkMap(new(netmap.NetworkMap))
 	if err := b.initTKALocked(); err != nil {
@@ -0,0 +1,357 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+	"tailscale.com/wgengine/filter"
+)
+
+const (
+	// netMapCacheVersion is the version of cachedNetMap. A cached netmap
+	// with any other version is ignored.
+	netMapCacheVersion = 1
+
+	// netMapCacheSaveInterval is the minimum time between writes of the
+	// netmap cache, which happen as new netmaps arrive.
+	netMapCacheSaveInterval = time.Minute
+
+	// defaultNetMapCacheMaxAge is how long a cached netmap can be used
+	// for. Past that, peers which may have been revoked since are dropped
+	// until the control plane is reachable again.
+	defaultNetMapCacheMaxAge = 72 * time.Hour
+)
+
+// netMapCacheMaxAge, if set, overrides defaultNetMapCacheMaxAge. A negative
+// value disables the netmap cache, for instance where the state store is
+// less protected than the netmap should be: see sealNetMapCache.
+var netMapCacheMaxAge = envknob.RegisterDuration("TS_NETMAP_CACHE_MAX_AGE")
+
+func netMapCacheMaxAgeOrDefault() time.Duration {
+	if d := netMapCacheMaxAge(); d != 0 {
+		return d
+	}
+	return defaultNetMapCacheMaxAge
+}
+
+// netMapCacheStateKey returns the StateKey under which the netmap cache of
+// the profile stored under profileKey is kept.
+func netMapCacheStateKey(profileKey ipn.StateKey) ipn.StateKey {
+	return profileKey + "-netmap-cache"
+}
+
+// cachedNetMap is the part of a netmap.NetworkMap which is saved in the
+// netmap cache: enough to configure the engine to reach peers known in an
+// earlier run, before the control plane is reachable.
+type cachedNetMap struct {
+	Version int
+	Saved   time.Time // when the netmap was received from control
+
+	SelfNode          *tailcfg.Node
+	NodeKey           key.NodePublic
+	Expiry            time.Time
+	Name              string
+	Addresses         []netip.Prefix
+	MachineStatus     tailcfg.MachineStatus
+	MachineKey        key.MachinePublic
+	Peers             []*tailcfg.Node
+	DNS               tailcfg.DNSConfig
+	Hostinfo          tailcfg.Hostinfo
+	PacketFilterRules []tailcfg.FilterRule
+	SSHPolicy         *tailcfg.SSHPolicy
+	CollectServices   bool
+	DERPMap           *tailcfg.DERPMap
+	TKAEnabled        bool
+	TKAHead           tka.AUMHash
+	User              tailcfg.UserID
+	Domain            string
+	DomainAuditLogID  string
+	UserProfiles      map[tailcfg.UserID]tailcfg.UserProfile
+}
+
+func newCachedNetMap(nm *netmap.NetworkMap, saved time.Time) *cachedNetMap {
+	return &cachedNetMap{
+		Version:           netMapCacheVersion,
+		Saved:             saved,
+		SelfNode:          nm.SelfNode,
+		NodeKey:           nm.NodeKey,
+		Expiry:            nm.Expiry,
+		Name:              nm.Name,
+		Addresses:         nm.Addresses,
+		MachineStatus:     nm.MachineStatus,
+		MachineKey:        nm.MachineKey,
+		Peers:             nm.Peers,
+		DNS:               nm.DNS,
+		Hostinfo:          nm.Hostinfo,
+		PacketFilterRules: nm.PacketFilterRules.AsSlice(),
+		SSHPolicy:         nm.SSHPolicy,
+		CollectServices:   nm.CollectServices,
+		DERPMap:           nm.DERPMap,
+		TKAEnabled:        nm.TKAEnabled,
+		TKAHead:           nm.TKAHead,
+		User:              nm.User,
+		Domain:            nm.Domain,
+		DomainAuditLogID:  nm.DomainAuditLogID,
+		UserProfiles:      nm.UserProfiles,
+	}
+}
+
+// netMap returns the cached netmap, for the node with the private key priv.
+func (c *cachedNetMap) netMap(priv key.NodePrivate) (*netmap.NetworkMap, error) {
+	packetFilter, err := filter.MatchesFromFilterRules(c.PacketFilterRules)
+	if err != nil {
+		return nil, fmt.Errorf("packet filter: %w", err)
+	}
+	return &netmap.NetworkMap{
+		SelfNode:          c.SelfNode,
+		NodeKey:           c.NodeKey,
+		PrivateKey:        priv,
+		Expiry:            c.Expiry,
+		Name:              c.Name,
+		Addresses:         c.Addresses,
+		MachineStatus:     c.MachineStatus,
+		MachineKey:        c.MachineKey,
+		Peers:             c.Peers,
+		DNS:               c.DNS,
+		Hostinfo:          c.Hostinfo,
+		PacketFilter:      packetFilter,
+		PacketFilterRules: views.SliceOf(c.PacketFilterRules),
+		SSHPolicy:         c.SSHPolicy,
+		CollectServices:   c.CollectServices,
+		DERPMap:           c.DERPMap,
+		TKAEnabled:        c.TKAEnabled,
+		TKAHead:           c.TKAHead,
+		User:              c.User,
+		Domain:            c.Domain,
+		DomainAuditLogID:  c.DomainAuditLogID,
+		UserProfiles:      c.UserProfiles,
+	}, nil
+}
+
+// sealNetMapCache encodes c and seals it with the machine key, so that a
+// cache from another machine, or from before the machine key changed, isn't
+// used.
+//
+// The machine key is kept in the same StateStore as the cache, so this only
+// obfuscates it: anyone who can read the state can read the cached netmap,
+// as they could the node and machine keys themselves.
+func sealNetMapCache(c *cachedNetMap, machineKey key.MachinePrivate) ([]byte, error) {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return machineKey.SealTo(machineKey.Public(), j), nil
+}
+
+// openNetMapCache opens and decodes a netmap cache sealed by
+// sealNetMapCache.
+func openNetMapCache(b []byte, machineKey key.MachinePrivate) (*cachedNetMap, error) {
+	j, ok := machineKey.OpenFrom(machineKey.Public(), b)
+	if !ok {
+		return nil, errors.New("can't open; machine key changed?")
+	}
+	c := new(cachedNetMap)
+	if err := json.Unmarshal(j, c); err != nil {
+		return nil, err
+	}
+	if c.Version != netMapCacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", c.Version)
+	}
+	return c, nil
+}
+
+// saveNetMapCacheLocked arranges for nm, just received from control, to be
+// written to the current profile's netmap cache. Writes are rate limited
+// to one per netMapCacheSaveInterval; the latest netmap is always written.
+//
+// b.mu must be held.
+func (b *LocalBackend) saveNetMapCacheLocked(nm *netmap.NetworkMap) {
+	if netMapCacheMaxAgeOrDefault() < 0 {
+		return
+	}
+	profileKey := b.pm.CurrentProfile().Key
+	if profileKey == "" || b.machinePrivKey.IsZero() {
+		return
+	}
+	b.netMapCachePending = newCachedNetMap(nm, time.Now())
+	b.netMapCachePendingKey = netMapCacheStateKey(profileKey)
+	if b.netMapCacheSaveTimer != nil {
+		return // already scheduled
+	}
+	delay := time.Until(b.netMapCacheLastSave.Add(netMapCacheSaveInterval))
+	if delay < 0 {
+		delay = 0
+	}
+	b.netMapCacheSaveTimer = time.AfterFunc(delay, b.writeNetMapCache)
+}
+
+// writeNetMapCache writes the netmap cache scheduled by
+// saveNetMapCacheLocked.
+func (b *LocalBackend) writeNetMapCache() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, stateKey := b.netMapCachePending, b.netMapCachePendingKey
+	b.netMapCachePending = nil
+	b.netMapCacheSaveTimer = nil
+	if c == nil {
+		return
+	}
+	b.netMapCacheLastSave = time.Now()
+	sealed, err := sealNetMapCache(c, b.machinePrivKey)
+	if err != nil {
+		b.logf("netmap cache: %v", err)
+		return
+	}
+	if err := b.pm.Store().WriteState(stateKey, sealed); err != nil {
+		b.logf("netmap cache: writing: %v", err)
+		return
+	}
+	b.logf("[v1] netmap cache: saved %d peers", len(c.Peers))
+}
+
+// cancelNetMapCacheSaveLocked cancels any pending write of the netmap
+// cache, such as when the profile it's for is going away.
+//
+// b.mu must be held.
+func (b *LocalBackend) cancelNetMapCacheSaveLocked() {
+	if b.netMapCacheSaveTimer != nil {
+		b.netMapCacheSaveTimer.Stop()
+		b.netMapCacheSaveTimer = nil
+	}
+	b.netMapCachePending = nil
+}
+
+// loadNetMapCacheLocked returns the current profile's cached netmap, if
+// there's a usable one.
+//
+// b.mu must be held.
+func (b *LocalBackend) loadNetMapCacheLocked(now time.Time) (_ *netmap.NetworkMap, saved time.Time, err error) {
+	maxAge := netMapCacheMaxAgeOrDefault()
+	if maxAge < 0 {
+		return nil, saved, errors.New("disabled")
+	}
+	prefs := b.pm.CurrentPrefs()
+	profileKey := b.pm.CurrentProfile().Key
+	if profileKey == "" || !prefs.Valid() || !prefs.Persist().Valid() || prefs.Persist().PrivateNodeKey().IsZero() {
+		return nil, saved, errors.New("not logged in")
+	}
+	if b.machinePrivKey.IsZero() {
+		return nil, saved, errors.New("no machine key")
+	}
+	sealed, err := b.pm.Store().ReadState(netMapCacheStateKey(profileKey))
+	if err != nil {
+		return nil, saved, err
+	}
+	if len(sealed) == 0 {
+		// Deleted, in a StateStore which keeps empty values.
+		return nil, saved, ipn.ErrStateNotExist
+	}
+	c, err := openNetMapCache(sealed, b.machinePrivKey)
+	if err != nil {
+		return nil, saved, err
+	}
+	priv := prefs.Persist().PrivateNodeKey()
+	if c.NodeKey != priv.Public() {
+		return nil, saved, errors.New("cached for a different node key")
+	}
+	if age := now.Sub(c.Saved); age > maxAge {
+		return nil, saved, fmt.Errorf("too old (%v)", age.Round(time.Minute))
+	}
+	if !c.Expiry.IsZero() && c.Expiry.Before(now) {
+		return nil, saved, errors.New("node key expired")
+	}
+	nm, err := c.netMap(priv)
+	if err != nil {
+		return nil, saved, err
+	}
+	return nm, c.Saved, nil
+}
+
+// useNetMapCache configures the engine with the current profile's cached
+// netmap, if there is a usable one and no netmap has yet been received from
+// control. The cached netmap is marked stale until one is.
+func (b *LocalBackend) useNetMapCache() {
+	now := time.Now()
+	b.mu.Lock()
+	if b.netMap != nil {
+		b.mu.Unlock()
+		return
+	}
+	nm, saved, err := b.loadNetMapCacheLocked(now)
+	if err != nil {
+		b.mu.Unlock()
+		if !errors.Is(err, ipn.ErrStateNotExist) {
+			b.logf("netmap cache: not using: %v", err)
+		}
+		return
+	}
+	b.logf("netmap cache: using netmap from %v with %d peers until control is reachable", saved.Format(time.RFC3339), len(nm.Peers))
+	b.em.flagExpiredPeers(nm, now)
+	if b.tka != nil && !envknob.TKASkipSignatureCheck() {
+		b.tkaFilterNetmapLocked(nm)
+	}
+	b.netMapStale = true
+	b.netMapCachedAt = saved
+	b.netMapCacheExpiryTimer = time.AfterFunc(saved.Add(netMapCacheMaxAgeOrDefault()).Sub(now), b.expireNetMapCache)
+	b.setNetMapLocked(nm)
+	b.updateFilterLocked(nm, b.pm.CurrentPrefs())
+	b.mu.Unlock()
+
+	b.e.SetNetworkMap(nm)
+	b.e.SetDERPMap(nm.DERPMap)
+	b.send(ipn.Notify{NetMap: nm})
+	b.authReconfig()
+}
+
+// expireNetMapCache drops the peers of a cached netmap which is still in
+// use once it's older than the netmap cache's max age, so that peers
+// which may have been revoked meanwhile aren't reachable indefinitely.
+func (b *LocalBackend) expireNetMapCache() {
+	b.mu.Lock()
+	if !b.netMapStale || b.netMap == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.logf("netmap cache: cached netmap expired; dropping peers until control is reachable")
+	nm := new(netmap.NetworkMap)
+	*nm = *b.netMap
+	nm.Peers = nil
+	nm.PacketFilter = nil
+	nm.PacketFilterRules = views.Slice[tailcfg.FilterRule]{}
+	b.setNetMapLocked(nm)
+	b.updateFilterLocked(nm, b.pm.CurrentPrefs())
+	b.mu.Unlock()
+
+	b.e.SetNetworkMap(nm)
+	b.send(ipn.Notify{NetMap: nm})
+	b.authReconfig()
+}
+
+// stopUsingNetMapCacheLocked marks the netmap in use as no longer being
+// from the netmap cache, such as when one arrives from control. It
+// reports whether it was.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopUsingNetMapCacheLocked() (wasUsing bool) {
+	if b.netMapCacheExpiryTimer != nil {
+		b.netMapCacheExpiryTimer.Stop()
+		b.netMapCacheExpiryTimer = nil
+	}
+	wasUsing = b.netMapStale
+	b.netMapStale = false
+	b.netMapCachedAt = time.Time{}
+	return wasUsing
+}
@@ -0,0 +1,329 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsd"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logid"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/views"
+	"tailscale.com/wgengine"
+)
+
+func TestNetMapCacheRoundTrip(t *testing.T) {
+	machineKey := key.NewMachine()
+	nodeKey := key.NewNode()
+	peerKey := key.NewNode().Public()
+	saved := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	nm := &netmap.NetworkMap{
+		NodeKey:    nodeKey.Public(),
+		PrivateKey: nodeKey,
+		Name:       "self.example.mirage.net.",
+		Addresses:  []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		MachineKey: machineKey.Public(),
+		Peers: []*tailcfg.Node{{
+			ID:        2,
+			Key:       peerKey,
+			Name:      "peer.example.mirage.net.",
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}},
+		PacketFilterRules: views.SliceOf([]tailcfg.FilterRule{{
+			SrcIPs:   []string{"100.64.0.2"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRangeAny}},
+		}}),
+	}
+
+	sealed, err := sealNetMapCache(newCachedNetMap(nm, saved), machineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openNetMapCache(sealed, key.NewMachine()); err == nil {
+		t.Error("opened netmap cache with a different machine key")
+	}
+	c, err := openNetMapCache(sealed, machineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Saved.Equal(saved) {
+		t.Errorf("Saved = %v; want %v", c.Saved, saved)
+	}
+
+	got, err := c.netMap(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NodeKey != nm.NodeKey || !got.PrivateKey.Equal(nodeKey) || got.Name != nm.Name {
+		t.Errorf("got node key %v, name %q; want %v, %q", got.NodeKey, got.Name, nm.NodeKey, nm.Name)
+	}
+	if len(got.Peers) != 1 || got.Peers[0].Key != peerKey {
+		t.Errorf("got peers %v; want just %v", got.Peers, peerKey)
+	}
+	if len(got.PacketFilter) != 1 || got.PacketFilterRules.Len() != 1 {
+		t.Errorf("got %d filter matches from %d rules; want 1 from 1", len(got.PacketFilter), got.PacketFilterRules.Len())
+	}
+}
+
+func TestNetMapCacheVersion(t *testing.T) {
+	machineKey := key.NewMachine()
+	c := newCachedNetMap(&netmap.NetworkMap{}, time.Now())
+	c.Version = netMapCacheVersion + 1
+	j, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := machineKey.SealTo(machineKey.Public(), j)
+	if _, err := openNetMapCache(sealed, machineKey); err == nil {
+		t.Error("opened netmap cache with an unsupported version")
+	}
+}
+
+// newNetMapCacheTestBackend returns a LocalBackend logged in with the node
+// key nodeKey, whose machine key is machineKey, and its control client,
+// which is created when the backend is started.
+func newNetMapCacheTestBackend(t *testing.T, machineKey key.MachinePrivate, nodeKey key.NodePrivate) (*LocalBackend, **mockControl) {
+	t.Helper()
+	logf := tstest.WhileTestRunningLogger(t)
+	store := new(mem.Store)
+	keyText, err := machineKey.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteState(ipn.MachineKeyStateKey, keyText); err != nil {
+		t.Fatal(err)
+	}
+	sys := new(tsd.System)
+	sys.Set(store)
+	e, err := wgengine.NewFakeUserspaceEngine(logf, sys.Set)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	sys.Set(e)
+
+	b, err := NewLocalBackend(logf, logid.PublicID{}, sys, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	cc := new(*mockControl)
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		*cc = newClient(t, opts)
+		return *cc, nil
+	})
+	err = b.pm.SetPrefs((&ipn.Prefs{
+		ControlURL:  ipn.DefaultControlURL,
+		WantRunning: true,
+		Persist: &persist.Persist{
+			PrivateNodeKey: nodeKey,
+			NodeID:         "nSelf",
+			UserProfile: tailcfg.UserProfile{
+				ID:        1,
+				LoginName: "alice@example.com",
+			},
+		},
+	}).View())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.pm.CurrentProfile().Key == "" {
+		t.Fatal("no profile key")
+	}
+	return b, cc
+}
+
+func testNetMapWithPeer(nodeKey key.NodePrivate, machineKey key.MachinePrivate) *netmap.NetworkMap {
+	return &netmap.NetworkMap{
+		NodeKey:       nodeKey.Public(),
+		PrivateKey:    nodeKey,
+		Name:          "self.example.mirage.net.",
+		Addresses:     []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		MachineStatus: tailcfg.MachineAuthorized,
+		MachineKey:    machineKey.Public(),
+		Peers: []*tailcfg.Node{{
+			ID:        2,
+			StableID:  "nPeer",
+			Key:       key.NewNode().Public(),
+			Name:      "peer.example.mirage.net.",
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}},
+	}
+}
+
+// writeTestNetMapCache writes nm, saved at saved, as b's netmap cache.
+func writeTestNetMapCache(t *testing.T, b *LocalBackend, machineKey key.MachinePrivate, nm *netmap.NetworkMap, saved time.Time) {
+	t.Helper()
+	sealed, err := sealNetMapCache(newCachedNetMap(nm, saved), machineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pm.Store().WriteState(netMapCacheStateKey(b.pm.CurrentProfile().Key), sealed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadNetMapCache(t *testing.T) {
+	machineKey := key.NewMachine()
+	nodeKey := key.NewNode()
+	b, _ := newNetMapCacheTestBackend(t, machineKey, nodeKey)
+	b.mu.Lock()
+	b.machinePrivKey = machineKey
+	b.mu.Unlock()
+
+	now := time.Now()
+	maxAge := netMapCacheMaxAgeOrDefault()
+	tests := []struct {
+		name    string
+		nodeKey key.NodePrivate // of the cached netmap
+		saved   time.Time
+		expiry  time.Time
+		wantErr string // substring; empty for success
+	}{
+		{
+			name:    "fresh",
+			nodeKey: nodeKey,
+			saved:   now.Add(-time.Hour),
+		},
+		{
+			name:    "just-under-max-age",
+			nodeKey: nodeKey,
+			saved:   now.Add(-maxAge + time.Minute),
+		},
+		{
+			name:    "too-old",
+			nodeKey: nodeKey,
+			saved:   now.Add(-maxAge - time.Minute),
+			wantErr: "too old",
+		},
+		{
+			name:    "other-node-key",
+			nodeKey: key.NewNode(),
+			saved:   now.Add(-time.Hour),
+			wantErr: "different node key",
+		},
+		{
+			name:    "node-key-expired",
+			nodeKey: nodeKey,
+			saved:   now.Add(-time.Hour),
+			expiry:  now.Add(-time.Minute),
+			wantErr: "expired",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := testNetMapWithPeer(tt.nodeKey, machineKey)
+			nm.Expiry = tt.expiry
+			writeTestNetMapCache(t, b, machineKey, nm, tt.saved)
+
+			b.mu.Lock()
+			got, saved, err := b.loadNetMapCacheLocked(now)
+			b.mu.Unlock()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !saved.Equal(tt.saved) {
+				t.Errorf("saved = %v; want %v", saved, tt.saved)
+			}
+			if len(got.Peers) != 1 || !got.PrivateKey.Equal(nodeKey) {
+				t.Errorf("got %d peers, private key %v", len(got.Peers), got.PrivateKey.Public())
+			}
+		})
+	}
+}
+
+func TestNetMapCacheStale(t *testing.T) {
+	machineKey := key.NewMachine()
+	nodeKey := key.NewNode()
+	b, cc := newNetMapCacheTestBackend(t, machineKey, nodeKey)
+	saved := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestNetMapCache(t, b, machineKey, testNetMapWithPeer(nodeKey, machineKey), saved)
+
+	// Starting before control is reachable uses the cached netmap,
+	// marked stale.
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	st := b.Status()
+	if !st.NetMapStale || !st.NetMapCachedAt.Equal(saved) {
+		t.Fatalf("NetMapStale = %v, NetMapCachedAt = %v; want true, %v", st.NetMapStale, st.NetMapCachedAt, saved)
+	}
+	if nm := b.NetMap(); nm == nil || len(nm.Peers) != 1 {
+		t.Fatalf("cached netmap not in use: %v", nm)
+	}
+
+	// A netmap from control replaces it, and is no longer stale.
+	fresh := testNetMapWithPeer(nodeKey, machineKey)
+	fresh.Peers = append(fresh.Peers, &tailcfg.Node{
+		ID:        3,
+		StableID:  "nPeer2",
+		Key:       key.NewNode().Public(),
+		Name:      "peer2.example.mirage.net.",
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+	})
+	(*cc).send(nil, "", false, fresh)
+	st = b.Status()
+	if st.NetMapStale || !st.NetMapCachedAt.IsZero() {
+		t.Errorf("after netmap from control, NetMapStale = %v, NetMapCachedAt = %v; want false, zero", st.NetMapStale, st.NetMapCachedAt)
+	}
+	b.mu.Lock()
+	timer := b.netMapCacheExpiryTimer
+	b.mu.Unlock()
+	if timer != nil {
+		t.Error("expiry timer still set after netmap from control")
+	}
+
+	// Expiring the cache once a fresh netmap is in use leaves it alone.
+	b.expireNetMapCache()
+	if nm := b.NetMap(); nm == nil || len(nm.Peers) != 2 {
+		t.Errorf("expireNetMapCache changed the netmap from control: %v", nm)
+	}
+}
+
+func TestNetMapCacheExpire(t *testing.T) {
+	machineKey := key.NewMachine()
+	nodeKey := key.NewNode()
+	b, _ := newNetMapCacheTestBackend(t, machineKey, nodeKey)
+	writeTestNetMapCache(t, b, machineKey, testNetMapWithPeer(nodeKey, machineKey), time.Now().Add(-time.Hour))
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if nm := b.NetMap(); nm == nil || len(nm.Peers) != 1 {
+		t.Fatalf("cached netmap not in use: %v", nm)
+	}
+
+	// Once the cached netmap is past its max age, its peers are dropped,
+	// but the node keeps its own addresses and stays marked stale.
+	b.expireNetMapCache()
+	nm := b.NetMap()
+	if nm == nil {
+		t.Fatal("no netmap after expiry")
+	}
+	if len(nm.Peers) != 0 || nm.PacketFilterRules.Len() != 0 {
+		t.Errorf("after expiry, %d peers and %d filter rules; want none", len(nm.Peers), nm.PacketFilterRules.Len())
+	}
+	if len(nm.Addresses) != 1 {
+		t.Errorf("after expiry, addresses = %v", nm.Addresses)
+	}
+	if !b.Status().NetMapStale {
+		t.Error("after expiry, NetMapStale = false; want true")
+	}
+}
@@ -654,12 +654,9 @@ func (b *LocalBackend) NetworkLockModify(addKeys, removeKeys []tka.Key) (err err
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	var ourNodeKey key.NodePublic
-	if p := b.pm.CurrentPrefs(); p.Valid() && p.Persist().Valid() && !p.Persist().PrivateNodeKey().IsZero() {
-		ourNodeKey = p.Persist().PublicNodeKey()
-	}
-	if ourNodeKey.IsZero() {
-		return errors.New("no node-key: is tailscale logged in?")
+	ourNodeKey, err := b.tkaNodeKeyLocked()
+	if err != nil {
+		return err
 	}
 
 	var nlPriv key.NLPrivate
@@ -676,32 +673,138 @@ func (b *LocalBackend) NetworkLockModify(addKeys, removeKeys []tka.Key) (err err
 		return errors.New("this node does not have a trusted tailnet lock key")
 	}
 
-	updater := b.tka.authority.NewUpdater(nlPriv)
+	aums, err := b.tkaBuildUpdatesLocked(addKeys, removeKeys, nlPriv)
+	if err != nil || len(aums) == 0 {
+		return err
+	}
+	return b.tkaSendUpdatesLocked(ourNodeKey, aums)
+}
+
+// NetworkLockPrepareModify returns the unsigned AUMs which would add and/or
+// remove keys in the tailnet's key authority, so they can be signed by a
+// trusted key held elsewhere. The signed AUMs are then submitted with
+// NetworkLockSubmitUpdates.
+//
+// Unlike NetworkLockModify, this node's own key need not be trusted.
+func (b *LocalBackend) NetworkLockPrepareModify(addKeys, removeKeys []tka.Key) ([]tka.AUM, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tka == nil {
+		return nil, errNetworkLockNotActive
+	}
+	aums, err := b.tkaBuildUpdatesLocked(addKeys, removeKeys, nil)
+	if err != nil {
+		return nil, fmt.Errorf("prepare network-lock update: %w", err)
+	}
+	return aums, nil
+}
+
+// NetworkLockSubmitUpdates submits AUMs prepared with NetworkLockPrepareModify
+// and signed elsewhere to the control plane, after checking that they
+// are correctly signed and apply to the current state of the authority.
+func (b *LocalBackend) NetworkLockSubmitUpdates(aums []tka.AUM) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("submit network-lock updates: %w", err)
+		}
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ourNodeKey, err := b.tkaNodeKeyLocked()
+	if err != nil {
+		return err
+	}
+	if b.tka == nil {
+		return errNetworkLockNotActive
+	}
+	if err := b.tka.authority.VerifyUpdates(aums); err != nil {
+		return err
+	}
+	return b.tkaSendUpdatesLocked(ourNodeKey, aums)
+}
+
+// NetworkLockSubmitSignature submits a node-key signature made elsewhere
+// to the control plane, after checking that it is made by a trusted key.
+func (b *LocalBackend) NetworkLockSubmitSignature(sig tkatype.MarshaledSignature) error {
+	ourNodeKey, err := func() (key.NodePublic, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		ourNodeKey, err := b.tkaNodeKeyLocked()
+		if err != nil {
+			return key.NodePublic{}, err
+		}
+		if b.tka == nil {
+			return key.NodePublic{}, errNetworkLockNotActive
+		}
+
+		var decoded tka.NodeKeySignature
+		if err := decoded.Unserialize(sig); err != nil {
+			return key.NodePublic{}, fmt.Errorf("decoding signature: %w", err)
+		}
+		var nodeKey key.NodePublic
+		if err := nodeKey.UnmarshalBinary(decoded.Pubkey); err != nil {
+			return key.NodePublic{}, fmt.Errorf("decoding signed node-key: %w", err)
+		}
+		if err := b.tka.authority.NodeKeyAuthorized(nodeKey, sig); err != nil {
+			return key.NodePublic{}, fmt.Errorf("signature does not authorize %v: %w", nodeKey, err)
+		}
+		return ourNodeKey, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.tkaSubmitSignature(ourNodeKey, sig); err != nil {
+		return err
+	}
+	return nil
+}
+
+// tkaNodeKeyLocked returns the node-key of this node, which is used to
+// authenticate network-lock RPCs to the control plane.
+//
+// b.mu must be held.
+func (b *LocalBackend) tkaNodeKeyLocked() (key.NodePublic, error) {
+	if p := b.pm.CurrentPrefs(); p.Valid() && p.Persist().Valid() && !p.Persist().PrivateNodeKey().IsZero() {
+		return p.Persist().PublicNodeKey(), nil
+	}
+	return key.NodePublic{}, errors.New("no node-key: is tailscale logged in?")
+}
+
+// tkaBuildUpdatesLocked returns the AUMs which add and/or remove the
+// given keys, signed by signer. If signer is nil, the AUMs are unsigned.
+//
+// b.mu must be held, and b.tka must be non-nil.
+func (b *LocalBackend) tkaBuildUpdatesLocked(addKeys, removeKeys []tka.Key, signer tka.Signer) ([]tka.AUM, error) {
+	updater := b.tka.authority.NewUpdater(signer)
 
 	for _, addKey := range addKeys {
 		if err := updater.AddKey(addKey); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	for _, removeKey := range removeKeys {
 		keyID, err := removeKey.ID()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if err := updater.RemoveKey(keyID); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	aums, err := updater.Finalize(b.tka.storage)
-	if err != nil {
-		return err
-	}
-
-	if len(aums) == 0 {
-		return nil
-	}
+	return updater.Finalize(b.tka.storage)
+}
 
+// tkaSendUpdatesLocked sends aums, which must build on the current head
+// of the authority, to the control plane.
+//
+// b.mu must be held, and is released while talking to control.
+func (b *LocalBackend) tkaSendUpdatesLocked(ourNodeKey key.NodePublic, aums []tka.AUM) error {
 	head := b.tka.authority.Head()
 	b.mu.Unlock()
 	resp, err := b.tkaDoSyncSend(ourNodeKey, head, aums, true)
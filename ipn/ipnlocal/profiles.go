@@ -385,6 +385,7 @@ func (pm *profileManager) DeleteProfile(id ipn.ProfileID) error {
 	if err := pm.store.WriteState(kp.Key, nil); err != nil {
 		return err
 	}
+	pm.store.WriteState(netMapCacheStateKey(kp.Key), nil) // best effort
 	delete(pm.knownProfiles, id)
 	return pm.writeKnownProfiles()
 }
@@ -401,6 +402,7 @@ func (pm *profileManager) DeleteAllProfiles() error {
 			pm.writeKnownProfiles()
 			return err
 		}
+		pm.store.WriteState(netMapCacheStateKey(kp.Key), nil) // best effort
 		delete(pm.knownProfiles, kp.ID)
 	}
 	pm.NewProfile()
@@ -17,6 +17,7 @@
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -41,6 +42,10 @@ type serveHTTPContext struct {
 	DestPort uint16
 }
 
+// serveHandlerContextKey is the context.Value key for the ipn.HTTPHandlerView
+// of a proxied request whose handler has response header rules.
+type serveHandlerContextKey struct{}
+
 // serveListener is the state of host-level net.Listen for a specific (Tailscale IP, serve port)
 // combination. If there are two TailscaleIPs (v4 and v6) and three ports being served,
 // then there will be six of these active and looping in their Run method.
@@ -229,6 +234,9 @@ func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig) error {
 	if nm.SelfNode == nil {
 		return errors.New("netMap SelfNode is nil")
 	}
+	if err := config.CheckValid(); err != nil {
+		return fmt.Errorf("invalid serve config: %w", err)
+	}
 	profileID := b.pm.CurrentProfile().ID
 	confKey := ipn.ServeConfigKey(profileID)
 
@@ -451,6 +459,17 @@ func (b *LocalBackend) proxyHandlerForBackend(backend string) (*httputil.Reverse
 				r.Out.Header.Set("X-Forwarded-For", c.SrcAddr.Addr().String())
 			}
 		},
+		ModifyResponse: func(res *http.Response) error {
+			// The headers of a protocol switch are written to the
+			// hijacked connection, bypassing responseHeaderRewriter.
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				return nil
+			}
+			if h, ok := res.Request.Context().Value(serveHandlerContextKey{}).(ipn.HTTPHandlerView); ok {
+				rewriteResponseHeaders(res.Header, h)
+			}
+			return nil
+		},
 		Transport: &http.Transport{
 			DialContext: b.dialer.SystemDial,
 			TLSClientConfig: &tls.Config{
@@ -473,12 +492,31 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if h.SetResponseHeaders().Len() > 0 || h.RemoveResponseHeaders().Len() > 0 {
+		w = &responseHeaderRewriter{ResponseWriter: w, h: h}
+		r = r.WithContext(context.WithValue(r.Context(), serveHandlerContextKey{}, h))
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if code := h.StatusCode(); code != 0 {
+			w.WriteHeader(code)
+		}
 		io.WriteString(w, s)
 		return
 	}
+	if v := h.Redirect(); v != "" {
+		code := h.StatusCode()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, v, code)
+		return
+	}
 	if v := h.Path(); v != "" {
+		if h.NoDirList() {
+			b.serveFileOrDirectoryNoList(w, r, v, mountPoint)
+			return
+		}
 		b.serveFileOrDirectory(w, r, v, mountPoint)
 		return
 	}
@@ -488,6 +526,7 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
+		rewriteRequestHeaders(r, h)
 		h := p.(http.Handler)
 		// Trim the mount point from the URL path before proxying. (#6571)
 		if r.URL.Path != "/" {
@@ -496,10 +535,89 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		h.ServeHTTP(w, r)
 		return
 	}
+	if code := h.StatusCode(); code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
 
 	http.Error(w, "empty handler", 500)
 }
 
+// rewriteRequestHeaders applies the request header rules of h to r before
+// it's proxied.
+func rewriteRequestHeaders(r *http.Request, h ipn.HTTPHandlerView) {
+	for i := 0; i < h.RemoveRequestHeaders().Len(); i++ {
+		r.Header.Del(h.RemoveRequestHeaders().At(i))
+	}
+	h.SetRequestHeaders().Range(func(k, v string) bool {
+		r.Header.Set(k, v)
+		return true
+	})
+}
+
+// rewriteResponseHeaders applies the response header rules of h to hdr.
+func rewriteResponseHeaders(hdr http.Header, h ipn.HTTPHandlerView) {
+	for i := 0; i < h.RemoveResponseHeaders().Len(); i++ {
+		hdr.Del(h.RemoveResponseHeaders().At(i))
+	}
+	h.SetResponseHeaders().Range(func(k, v string) bool {
+		hdr.Set(k, v)
+		return true
+	})
+}
+
+// responseHeaderRewriter is an http.ResponseWriter wrapper that, upon
+// flushing HTTP headers, applies the response header rules of an HTTPHandler.
+type responseHeaderRewriter struct {
+	http.ResponseWriter
+	h       ipn.HTTPHandlerView
+	fixOnce sync.Once // guards call to fix
+}
+
+func (w *responseHeaderRewriter) fix() {
+	rewriteResponseHeaders(w.ResponseWriter.Header(), w.h)
+}
+
+// Unwrap returns the underlying ResponseWriter, so http.ResponseController
+// can reach its Hijack method for proxied protocol upgrades.
+func (w *responseHeaderRewriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseHeaderRewriter) WriteHeader(code int) {
+	w.fixOnce.Do(w.fix)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseHeaderRewriter) Write(p []byte) (int, error) {
+	w.fixOnce.Do(w.fix)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, so proxied streaming responses keep working.
+func (w *responseHeaderRewriter) Flush() {
+	w.fixOnce.Do(w.fix)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveFileOrDirectoryNoList is like serveFileOrDirectory but responds
+// 404 for directories that have no index.html, rather than listing them.
+func (b *LocalBackend) serveFileOrDirectoryNoList(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		rel := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(mountPoint, "/"))
+		dir := filepath.Join(fileOrDir, filepath.FromSlash(path.Clean("/"+rel)))
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+	}
+	b.serveFileOrDirectory(w, r, fileOrDir, mountPoint)
+}
+
 func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
@@ -4,18 +4,25 @@
 package ipnlocal
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn"
+	"tailscale.com/net/tsdial"
 )
 
 func TestExpandProxyArg(t *testing.T) {
@@ -251,3 +258,214 @@ func TestServeFileOrDirectory(t *testing.T) {
 		}
 	}
 }
+
+// newServeTestBackend returns a LocalBackend serving handlers on
+// example.ts.net:443, with proxies set up for its Proxy handlers.
+func newServeTestBackend(t *testing.T, handlers map[string]*ipn.HTTPHandler) *LocalBackend {
+	t.Helper()
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: handlers},
+		},
+	}
+	b := &LocalBackend{
+		serveConfig: conf.View(),
+		logf:        t.Logf,
+		dialer:      &tsdial.Dialer{Logf: t.Logf},
+	}
+	t.Cleanup(func() { b.dialer.Close() })
+	for _, h := range handlers {
+		if h.Proxy == "" {
+			continue
+		}
+		p, err := b.proxyHandlerForBackend(h.Proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.serveProxyHandlers.Store(h.Proxy, p)
+	}
+	return b
+}
+
+// serveTestHandler returns an http.Handler that serves requests as b does
+// for example.ts.net:443.
+func serveTestHandler(b *LocalBackend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+		r = r.WithContext(context.WithValue(r.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+			SrcAddr:  netip.MustParseAddrPort("100.64.0.1:1234"),
+			DestPort: 443,
+		}))
+		b.serveWebHandler(w, r)
+	})
+}
+
+func TestServeWebHandlerProxyHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.Header().Set("X-Backend", "secret")
+			io.WriteString(w, "not upgraded")
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("backend hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: echo\r\nConnection: Upgrade\r\nX-Backend: secret\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		io.WriteString(brw, line)
+		brw.Flush()
+	}))
+	defer backend.Close()
+
+	b := newServeTestBackend(t, map[string]*ipn.HTTPHandler{
+		"/": {
+			Proxy:                 backend.URL,
+			SetResponseHeaders:    map[string]string{"X-Served-By": "mirage"},
+			RemoveResponseHeaders: []string{"X-Backend"},
+		},
+	})
+	front := httptest.NewServer(serveTestHandler(b))
+	defer front.Close()
+
+	checkHeaders := func(what string, hdr http.Header) {
+		t.Helper()
+		if got := hdr.Get("X-Served-By"); got != "mirage" {
+			t.Errorf("%s: X-Served-By = %q; want mirage", what, got)
+		}
+		if got := hdr.Get("X-Backend"); got != "" {
+			t.Errorf("%s: X-Backend = %q; want removed", what, got)
+		}
+	}
+
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "not upgraded" {
+		t.Errorf("body = %q", body)
+	}
+	checkHeaders("plain response", res.Header)
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, _ := http.NewRequest("GET", front.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	res, err = http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %v; want 101", res.Status)
+	}
+	checkHeaders("upgrade response", res.Header)
+	io.WriteString(conn, "hello\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("echo over upgraded conn = %q, %v", line, err)
+	}
+}
+
+func TestServeWebHandlerRedirect(t *testing.T) {
+	b := newServeTestBackend(t, map[string]*ipn.HTTPHandler{
+		"/old":   {Redirect: "/new", StatusCode: http.StatusMovedPermanently},
+		"/away/": {Redirect: "https://example.com/", SetResponseHeaders: map[string]string{"Cache-Control": "no-store"}},
+		"/gone":  {StatusCode: http.StatusGone},
+		"/teapot": {Text: "short and stout", StatusCode: http.StatusTeapot,
+			SetResponseHeaders: map[string]string{"X-Frame-Options": "DENY"}},
+	})
+	h := serveTestHandler(b)
+
+	tests := []struct {
+		path         string
+		wantCode     int
+		wantLocation string
+		wantHeader   [2]string // name, value
+	}{
+		{"/old", http.StatusMovedPermanently, "/new", [2]string{}},
+		{"/away/x", http.StatusFound, "https://example.com/", [2]string{"Cache-Control", "no-store"}},
+		{"/gone", http.StatusGone, "", [2]string{}},
+		{"/teapot", http.StatusTeapot, "", [2]string{"X-Frame-Options", "DENY"}},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d; want %d", tt.path, rec.Code, tt.wantCode)
+		}
+		if got := rec.Header().Get("Location"); got != tt.wantLocation {
+			t.Errorf("%s: Location = %q; want %q", tt.path, got, tt.wantLocation)
+		}
+		if k := tt.wantHeader[0]; k != "" {
+			if got := rec.Header().Get(k); got != tt.wantHeader[1] {
+				t.Errorf("%s: %s = %q; want %q", tt.path, k, got, tt.wantHeader[1])
+			}
+		}
+	}
+}
+
+func TestServeWebHandlerNoDirList(t *testing.T) {
+	td := t.TempDir()
+	for name, contents := range map[string]string{
+		"file":             "this is file",
+		"sub/file-a":       "this is A",
+		"site/index.html":  "this is the index",
+		"site/other.html":  "this is other",
+		"site/empty/.keep": "",
+	} {
+		name = filepath.FromSlash(name)
+		if err := os.MkdirAll(filepath.Join(td, filepath.Dir(name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(td, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := newServeTestBackend(t, map[string]*ipn.HTTPHandler{
+		"/":      {Path: td, NoDirList: true},
+		"/list/": {Path: td},
+	})
+	h := serveTestHandler(b)
+
+	tests := []struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"/", http.StatusNotFound, "404 page not found"},
+		{"/sub/", http.StatusNotFound, "404 page not found"},
+		{"/site/empty/", http.StatusNotFound, "404 page not found"},
+		{"/sub/file-a", http.StatusOK, "this is A"},
+		{"/file", http.StatusOK, "this is file"},
+		{"/site/", http.StatusOK, "this is the index"},
+		{"/site/other.html", http.StatusOK, "this is other"},
+		{"/list/sub/", http.StatusOK, "file-a"}, // listing still on without NoDirList
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d; want %d", tt.path, rec.Code, tt.wantCode)
+		}
+		if !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: body = %q; want it to contain %q", tt.path, rec.Body.String(), tt.wantBody)
+		}
+		if tt.wantCode == http.StatusNotFound && strings.Contains(rec.Body.String(), "file-a") {
+			t.Errorf("%s: directory listed", tt.path)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/mak"
+)
+
+// maxServeUDPFlows bounds the number of UDP flows forwarded at once per
+// ServeConfig.UDP, and thus the number of local sockets used for them.
+// Datagrams of new flows beyond that are dropped.
+const maxServeUDPFlows = 1024
+
+// maxServeUDPPacketSize is the largest datagram forwarded in either
+// direction.
+const maxServeUDPPacketSize = 64 << 10
+
+// udpServeFlowKey identifies a forwarded UDP flow.
+type udpServeFlowKey struct {
+	src  netip.AddrPort // the peer's IP:port
+	port uint16         // the serve port it sent to
+}
+
+// udpServeFlow is the NAT state of a forwarded UDP flow: the netstack conn
+// to the peer and the local socket connected to the backend. Replies the
+// backend sends to that socket go back to the peer.
+type udpServeFlow struct {
+	backDst string        // UDPPortHandler.UDPForward when the flow started
+	idle    time.Duration // idle timeout when the flow started
+	client  nettype.ConnPacketConn
+	back    net.Conn
+	timer   *time.Timer // closes the flow after idle without traffic
+
+	closeOnce sync.Once
+}
+
+func (f *udpServeFlow) close() {
+	f.closeOnce.Do(func() {
+		f.timer.Stop()
+		f.client.Close()
+		f.back.Close()
+	})
+}
+
+// copy copies datagrams from src to dst until either fails, extending the
+// flow's idle timeout with each datagram.
+func (f *udpServeFlow) copy(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, maxServeUDPPacketSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
+		}
+		f.timer.Reset(f.idle)
+	}
+}
+
+// HandleInterceptedUDPFlow forwards the datagrams of the UDP flow c, from
+// srcAddr to the Tailscale IP port dport, as configured in ServeConfig.UDP.
+// It takes ownership of c and returns once the flow is closed, which
+// happens after it has been idle for the handler's idle timeout or when
+// the port's configuration changes.
+func (b *LocalBackend) HandleInterceptedUDPFlow(dport uint16, srcAddr netip.AddrPort, c nettype.ConnPacketConn) {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+
+	if !sc.Valid() {
+		b.logf("[unexpected] localbackend: got UDP flow w/o serveConfig; from %v to port %v", srcAddr, dport)
+		c.Close()
+		return
+	}
+	udph, ok := sc.UDP().GetOk(dport)
+	if !ok {
+		b.logf("[unexpected] localbackend: got UDP flow without UDP config for port %v; from %v", dport, srcAddr)
+		c.Close()
+		return
+	}
+
+	backDst := udph.UDPForward()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	back, err := b.dialer.SystemDial(ctx, "udp", backDst)
+	cancel()
+	if err != nil {
+		b.logf("localbackend: failed to UDP proxy port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
+		c.Close()
+		return
+	}
+	f := &udpServeFlow{
+		backDst: backDst,
+		idle:    udph.IdleTimeout(),
+		client:  c,
+		back:    back,
+	}
+
+	k := udpServeFlowKey{srcAddr, dport}
+	b.mu.Lock()
+	if len(b.serveUDPFlows) >= maxServeUDPFlows {
+		b.mu.Unlock()
+		b.logf("[v1] localbackend: too many UDP flows; dropping flow from %v to port %v", srcAddr, dport)
+		c.Close()
+		back.Close()
+		return
+	}
+	if old, ok := b.serveUDPFlows[k]; ok {
+		// netstack only starts a new flow for the same peer once the old
+		// one's endpoint is gone, so this one is on its way out.
+		old.close()
+	}
+	f.timer = time.AfterFunc(f.idle, f.close)
+	mak.Set(&b.serveUDPFlows, k, f)
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.serveUDPFlows[k] == f {
+			delete(b.serveUDPFlows, k)
+		}
+	}()
+	defer f.close()
+
+	errc := make(chan error, 2)
+	go func() { errc <- f.copy(back, c) }()
+	go func() { errc <- f.copy(c, back) }()
+	if err := <-errc; err != nil && !errors.Is(err, net.ErrClosed) {
+		b.logf("[v2] localbackend: UDP flow from %v to port %v ended: %v", srcAddr, dport, err)
+	}
+}
+
+// closeStaleServeUDPFlowsLocked closes the forwarded UDP flows whose port
+// is no longer served, or is now served differently, so that their peers'
+// next datagrams start new flows under the current config.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeStaleServeUDPFlowsLocked() {
+	for k, f := range b.serveUDPFlows {
+		if !b.serveConfig.Valid() {
+			f.close()
+			continue
+		}
+		h, ok := b.serveConfig.UDP().GetOk(k.port)
+		if !ok || h.UDPForward() != f.backDst || h.IdleTimeout() != f.idle {
+			f.close()
+		}
+	}
+}
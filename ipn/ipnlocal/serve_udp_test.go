@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/tsdial"
+)
+
+func TestHandleInterceptedUDPFlow(t *testing.T) {
+	netns.SetEnabled(false)
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	// An echo server standing in for the local backend.
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	conf := &ipn.ServeConfig{
+		UDP: map[uint16]*ipn.UDPPortHandler{
+			53: {UDPForward: backend.LocalAddr().String(), IdleTimeoutSec: 1},
+		},
+	}
+	b := &LocalBackend{
+		logf:        t.Logf,
+		dialer:      new(tsdial.Dialer),
+		serveConfig: conf.View(),
+	}
+
+	// A connected pair of UDP sockets stands in for the netstack flow:
+	// peer is the remote node, flow is what netstack hands to the backend.
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	flow, err := net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := netip.MustParseAddrPort("100.64.1.2:40000")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.HandleInterceptedUDPFlow(53, src, flow)
+	}()
+
+	if _, err := peer.WriteTo([]byte("hello"), flow.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if got, want := buf[:n], []byte("echo:hello"); !bytes.Equal(got, want) {
+		t.Errorf("reply = %q; want %q", got, want)
+	}
+
+	b.mu.Lock()
+	nflows := len(b.serveUDPFlows)
+	b.mu.Unlock()
+	if nflows != 1 {
+		t.Errorf("got %d flows; want 1", nflows)
+	}
+
+	// Removing the port from the config closes its flows.
+	b.mu.Lock()
+	b.serveConfig = (&ipn.ServeConfig{}).View()
+	b.closeStaleServeUDPFlowsLocked()
+	b.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not closed after config change")
+	}
+	b.mu.Lock()
+	nflows = len(b.serveUDPFlows)
+	b.mu.Unlock()
+	if nflows != 0 {
+		t.Errorf("got %d flows after close; want 0", nflows)
+	}
+}
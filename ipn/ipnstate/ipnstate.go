@@ -69,6 +69,22 @@ type Status struct {
 	// trailing periods, and without any "_acme-challenge." prefix.
 	CertDomains []string
 
+	// NetMapStale is whether the network map in use was loaded from the
+	// offline cache at startup, the control plane not having sent a fresh
+	// one since. Peers may have changed since NetMapCachedAt.
+	NetMapStale bool `json:",omitempty"`
+
+	// NetMapCachedAt is when the control plane sent the network map in
+	// use, if NetMapStale.
+	NetMapCachedAt time.Time `json:",omitempty"`
+
+	// ControlURL is the URL of the coordination server in use.
+	ControlURL string `json:",omitempty"`
+
+	// ControlFailover is whether ControlURL is one of the failover
+	// coordination servers, the preferred one not being reachable.
+	ControlFailover bool `json:",omitempty"`
+
 	Peer map[key.NodePublic]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
 }
@@ -211,6 +227,20 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PathMTU is the largest packet size, in bytes, that can be sent
+	// through the tunnel to the peer on CurAddr, as found by path MTU
+	// discovery. It's zero if unknown.
+	PathMTU int `json:",omitempty"`
+
+	// CurInterface is the local network interface that packets to
+	// CurAddr are sent through, if one was picked over the one the
+	// routing table says. It's empty otherwise.
+	CurInterface string `json:",omitempty"`
+
+	// InterfacePaths are the paths to CurAddr through each of the local
+	// network interfaces, if there's more than one.
+	InterfacePaths []*PeerInterfacePath `json:",omitempty"`
+
 	RxBytes        int64
 	TxBytes        int64
 	Created        time.Time // time registered with tailcontrol
@@ -402,6 +432,15 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PathMTU; v != 0 {
+		e.PathMTU = v
+	}
+	if v := st.CurInterface; v != "" {
+		e.CurInterface = v
+	}
+	if v := st.InterfacePaths; v != nil {
+		e.InterfacePaths = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -595,6 +634,23 @@ func osEmoji(os string) string {
 	return "👽"
 }
 
+// PeerInterfacePath is a path to a peer's endpoint through one of the
+// local network interfaces.
+type PeerInterfacePath struct {
+	Interface string // local network interface name
+	Addr      string // peer's ip:port
+
+	// LatencySeconds is the latest round-trip time of a disco ping on
+	// the path, or zero if none got a reply yet.
+	LatencySeconds float64 `json:",omitempty"`
+
+	// Down is whether recent pings on the path got no reply.
+	Down bool `json:",omitempty"`
+
+	// Active is whether the path is the one in use.
+	Active bool `json:",omitempty"`
+}
+
 // PingResult contains response information for the "tailscale ping" subcommand,
 // saying how Tailscale can reach a Tailscale IP or subnet-routed IP.
 // See tailcfg.PingResponse for a related response that is sent back to control
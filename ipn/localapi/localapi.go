@@ -39,10 +39,12 @@
 	"tailscale.com/net/portmapper"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
+	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/ptr"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/httpm"
 	"tailscale.com/util/mak"
@@ -72,6 +74,7 @@
 	"debug-packet-filter-matches": (*Handler).serveDebugPacketFilterMatches,
 	"debug-packet-filter-rules":   (*Handler).serveDebugPacketFilterRules,
 	"debug-portmap":               (*Handler).serveDebugPortmap,
+	"debug-ssh-policy":            (*Handler).serveDebugSSHPolicy,
 	"debug-peer-endpoint-changes": (*Handler).serveDebugPeerEndpointChanges,
 	"debug-capture":               (*Handler).serveDebugCapture,
 	"debug-log":                   (*Handler).serveDebugLog,
@@ -85,6 +88,7 @@
 
 	"set-push-device-token":   (*Handler).serveSetPushDeviceToken,
 	"dial":                    (*Handler).serveDial,
+	"dns-query-log":           (*Handler).serveDNSQueryLog,
 	"file-targets":            (*Handler).serveFileTargets,
 	"goroutines":              (*Handler).serveGoroutines,
 	"id-token":                (*Handler).serveIDToken,
@@ -104,7 +108,10 @@
 	"tka/init":                (*Handler).serveTKAInit,
 	"tka/log":                 (*Handler).serveTKALog,
 	"tka/modify":              (*Handler).serveTKAModify,
+	"tka/prepare-modify":      (*Handler).serveTKAPrepareModify,
 	"tka/sign":                (*Handler).serveTKASign,
+	"tka/submit-signature":    (*Handler).serveTKASubmitSignature,
+	"tka/submit-updates":      (*Handler).serveTKASubmitUpdates,
 	"tka/status":              (*Handler).serveTKAStatus,
 	"tka/disable":             (*Handler).serveTKADisable,
 	"tka/force-local-disable": (*Handler).serveTKALocalDisable,
@@ -514,6 +521,64 @@ func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	clientmetric.WritePrometheusExpositionFormat(w)
+	if res, ok := h.b.DNSResolver(); ok {
+		res.WritePrometheus(w)
+	}
+}
+
+// serveDNSQueryLog streams the queries handled by the MagicDNS resolver to
+// the client as JSON dnstype.QueryLogEntry values, one per line, starting
+// with the recently logged ones. With "follow=false", it returns only the
+// recent queries.
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Require write access (~root) as the queried names are sensitive.
+	if !h.PermitWrite {
+		http.Error(w, "DNS query log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	res, ok := h.b.DNSResolver()
+	if !ok {
+		http.Error(w, "no DNS resolver", http.StatusServiceUnavailable)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	entc := make(chan dnstype.QueryLogEntry, 64)
+	backlog, unreg := res.WatchQueryLog(entc)
+	defer unreg()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, e := range backlog {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	f.Flush()
+	if r.FormValue("follow") == "false" {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-entc:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
 }
 
 func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
@@ -647,6 +712,34 @@ func (h *Handler) serveDebugPacketFilterRules(w http.ResponseWriter, r *http.Req
 	enc.Encode(nm.PacketFilterRules)
 }
 
+// serveDebugSSHPolicy explains how the SSH server's access policy applies
+// to a connection from the "src" IP as the "user" SSH user.
+func (h *Handler) serveDebugSSHPolicy(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	src, err := netip.ParseAddr(r.FormValue("src"))
+	if err != nil {
+		http.Error(w, "invalid 'src' parameter", 400)
+		return
+	}
+	user := r.FormValue("user")
+	if user == "" {
+		http.Error(w, "missing 'user' parameter", 400)
+		return
+	}
+	res, err := h.b.ExplainSSHPolicy(src, user)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(res)
+}
+
 func (h *Handler) serveDebugPacketFilterMatches(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "debug access denied", http.StatusForbidden)
@@ -1629,6 +1722,101 @@ type modifyRequest struct {
 	w.WriteHeader(204)
 }
 
+func (h *Handler) serveTKAPrepareModify(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type modifyRequest struct {
+		AddKeys    []tka.Key
+		RemoveKeys []tka.Key
+	}
+	var req modifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	aums, err := h.b.NetworkLockPrepareModify(req.AddKeys, req.RemoveKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updates := make([]tkatype.MarshaledAUM, len(aums))
+	for i := range aums {
+		updates[i] = aums[i].Serialize()
+	}
+
+	j, err := json.MarshalIndent(updates, "", "\t")
+	if err != nil {
+		http.Error(w, "JSON encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func (h *Handler) serveTKASubmitUpdates(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var updates []tkatype.MarshaledAUM
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	aums := make([]tka.AUM, len(updates))
+	for i, u := range updates {
+		if err := aums[i].Unserialize(u); err != nil {
+			http.Error(w, fmt.Sprintf("decoding update %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.b.NetworkLockSubmitUpdates(aums); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveTKASubmitSignature(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "lock status access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != httpm.POST {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type submitRequest struct {
+		Signature tkatype.MarshaledSignature
+	}
+	var req submitRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 12*1024)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.b.NetworkLockSubmitSignature(req.Signature); err != nil {
+		http.Error(w, "submitting signature failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (h *Handler) serveTKAWrapPreauthKey(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "network-lock modify access denied", http.StatusForbidden)
@@ -16,6 +16,7 @@
 	"runtime"
 	"strings"
 
+	"golang.org/x/exp/slices"
 	"tailscale.com/atomicfile"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netaddr"
@@ -62,6 +63,11 @@ type Prefs struct {
 	// calling Backend.Start().
 	ControlURL string
 
+	// ControlFailoverURLs are the URLs of control servers to fail over to,
+	// in order of preference, when ControlURL's isn't reachable. They
+	// must be replicas of the same control plane, sharing its keys.
+	ControlFailoverURLs []string `json:",omitempty"`
+
 	// RouteAll specifies whether to accept subnets advertised by
 	// other nodes on the Tailscale network. Note that this does not
 	// include default routes (0.0.0.0/0 and ::/0), those are
@@ -106,6 +112,17 @@ type Prefs struct {
 	// DNS configuration, if it exists.
 	CorpDNS bool
 
+	// DNSBlocklists are file paths or http(s) URLs of lists of domains
+	// that MagicDNS answers itself according to DNSBlockPolicy, rather
+	// than resolving them. Lists are in hosts file format or have one
+	// domain per line.
+	DNSBlocklists []string `json:",omitempty"`
+
+	// DNSBlockPolicy is how MagicDNS answers queries for domains in
+	// DNSBlocklists: "nxdomain" (the default if empty), or "zeroip" to
+	// answer with 0.0.0.0 or ::.
+	DNSBlockPolicy string `json:",omitempty"`
+
 	// RunSSH bool is whether this node should run an SSH
 	// server, permitting access to peers according to the
 	// policies as configured by the Tailnet's admin(s).
@@ -195,6 +212,21 @@ type Prefs struct {
 	// and CLI.
 	ProfileName string `json:",omitempty"`
 
+	// DERPHomeRegion, if non-zero, is the ID of the DERP region to
+	// always use as this node's home, overriding the one picked by
+	// latency. It's ignored if the region isn't in the DERP map.
+	DERPHomeRegion int `json:",omitempty"`
+
+	// DERPAvoidRegions are the IDs of DERP regions never to use as this
+	// node's home, unless there's no other.
+	DERPAvoidRegions []int `json:",omitempty"`
+
+	// DERPHomePeerAware specifies whether to prefer the DERP regions
+	// that the most active peers use as their home over ones with
+	// slightly lower latency, so that traffic relayed between them
+	// doesn't have to cross regions.
+	DERPHomePeerAware bool `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -208,12 +240,15 @@ type MaskedPrefs struct {
 	Prefs
 
 	ControlURLSet             bool `json:",omitempty"`
+	ControlFailoverURLsSet    bool `json:",omitempty"`
 	RouteAllSet               bool `json:",omitempty"`
 	AllowSingleHostsSet       bool `json:",omitempty"`
 	ExitNodeIDSet             bool `json:",omitempty"`
 	ExitNodeIPSet             bool `json:",omitempty"`
 	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
 	CorpDNSSet                bool `json:",omitempty"`
+	DNSBlocklistsSet          bool `json:",omitempty"`
+	DNSBlockPolicySet         bool `json:",omitempty"`
 	RunSSHSet                 bool `json:",omitempty"`
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
@@ -228,6 +263,9 @@ type MaskedPrefs struct {
 	NetfilterModeSet          bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
 	ProfileNameSet            bool `json:",omitempty"`
+	DERPHomeRegionSet         bool `json:",omitempty"`
+	DERPAvoidRegionsSet       bool `json:",omitempty"`
+	DERPHomePeerAwareSet      bool `json:",omitempty"`
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -318,6 +356,12 @@ func (p *Prefs) pretty(goos string) string {
 		sb.WriteString("mesh=false ")
 	}
 	fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	if len(p.DNSBlocklists) > 0 {
+		fmt.Fprintf(&sb, "dnsblock=%q ", p.DNSBlocklists)
+		if p.DNSBlockPolicy != "" {
+			fmt.Fprintf(&sb, "dnsblockpolicy=%s ", p.DNSBlockPolicy)
+		}
+	}
 	if p.RunSSH {
 		sb.WriteString("ssh=true ")
 	}
@@ -353,12 +397,24 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ControlURL != "" && p.ControlURL != DefaultControlURL {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
 	}
+	if len(p.ControlFailoverURLs) > 0 {
+		fmt.Fprintf(&sb, "failover=%q ", p.ControlFailoverURLs)
+	}
 	if p.Hostname != "" {
 		fmt.Fprintf(&sb, "host=%q ", p.Hostname)
 	}
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if p.DERPHomeRegion != 0 {
+		fmt.Fprintf(&sb, "derphome=%d ", p.DERPHomeRegion)
+	}
+	if len(p.DERPAvoidRegions) > 0 {
+		fmt.Fprintf(&sb, "derpavoid=%v ", p.DERPAvoidRegions)
+	}
+	if p.DERPHomePeerAware {
+		sb.WriteString("derppeers=true ")
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -394,12 +450,15 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
+		compareStrings(p.ControlFailoverURLs, p2.ControlFailoverURLs) &&
 		p.RouteAll == p2.RouteAll &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
 		p.CorpDNS == p2.CorpDNS &&
+		compareStrings(p.DNSBlocklists, p2.DNSBlocklists) &&
+		p.DNSBlockPolicy == p2.DNSBlockPolicy &&
 		p.RunSSH == p2.RunSSH &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
@@ -413,7 +472,10 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist) &&
-		p.ProfileName == p2.ProfileName
+		p.ProfileName == p2.ProfileName &&
+		p.DERPHomeRegion == p2.DERPHomeRegion &&
+		slices.Equal(p.DERPAvoidRegions, p2.DERPAvoidRegions) &&
+		p.DERPHomePeerAware == p2.DERPHomePeerAware
 }
 
 func compareIPNets(a, b []netip.Prefix) bool {
@@ -36,12 +36,15 @@ func TestPrefsEqual(t *testing.T) {
 
 	prefsHandles := []string{
 		"ControlURL",
+		"ControlFailoverURLs",
 		"RouteAll",
 		"AllowSingleHosts",
 		"ExitNodeID",
 		"ExitNodeIP",
 		"ExitNodeAllowLANAccess",
 		"CorpDNS",
+		"DNSBlocklists",
+		"DNSBlockPolicy",
 		"RunSSH",
 		"WantRunning",
 		"LoggedOut",
@@ -56,6 +59,9 @@ func TestPrefsEqual(t *testing.T) {
 		"NetfilterMode",
 		"OperatorUser",
 		"ProfileName",
+		"DERPHomeRegion",
+		"DERPAvoidRegions",
+		"DERPHomePeerAware",
 		"Persist",
 	}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
@@ -103,6 +109,21 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{ControlURL: "https://controlplane.tailscale.com"},
 			true,
 		},
+		{
+			&Prefs{ControlFailoverURLs: []string{"https://b.example.com", "https://c.example.com"}},
+			&Prefs{ControlFailoverURLs: []string{"https://c.example.com", "https://b.example.com"}},
+			false,
+		},
+		{
+			&Prefs{ControlFailoverURLs: []string{"https://b.example.com"}},
+			&Prefs{ControlFailoverURLs: []string{"https://b.example.com"}},
+			true,
+		},
+		{
+			&Prefs{DNSBlocklists: []string{"/etc/ads.txt"}},
+			&Prefs{DNSBlocklists: []string{"/etc/ads.txt"}, DNSBlockPolicy: "zeroip"},
+			false,
+		},
 
 		{
 			&Prefs{RouteAll: true},
@@ -282,6 +303,26 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{ProfileName: "home"},
 			false,
 		},
+		{
+			&Prefs{DERPHomeRegion: 1},
+			&Prefs{DERPHomeRegion: 2},
+			false,
+		},
+		{
+			&Prefs{DERPAvoidRegions: []int{1, 2}},
+			&Prefs{DERPAvoidRegions: []int{1, 2}},
+			true,
+		},
+		{
+			&Prefs{DERPAvoidRegions: []int{1, 2}},
+			&Prefs{DERPAvoidRegions: []int{1}},
+			false,
+		},
+		{
+			&Prefs{DERPHomePeerAware: true},
+			&Prefs{DERPHomePeerAware: false},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equals(tt.b)
@@ -408,6 +449,23 @@ func TestPrefsPretty(t *testing.T) {
 			"darwin",
 			`Prefs{ra=false dns=false want=true tags=tag:foo,tag:bar url="http://localhost:1234" Persist=nil}`,
 		},
+		{
+			Prefs{
+				ControlURL:          "https://a.example.com",
+				ControlFailoverURLs: []string{"https://b.example.com"},
+			},
+			"darwin",
+			`Prefs{ra=false mesh=false dns=false want=false url="https://a.example.com" failover=["https://b.example.com"] Persist=nil}`,
+		},
+		{
+			Prefs{
+				CorpDNS:        true,
+				DNSBlocklists:  []string{"https://example.com/ads.txt"},
+				DNSBlockPolicy: "zeroip",
+			},
+			"darwin",
+			`Prefs{ra=false mesh=false dns=true want=false dnsblock=["https://example.com/ads.txt"] dnsblockpolicy=zeroip Persist=nil}`,
+		},
 		{
 			Prefs{
 				Persist: &persist.Persist{},
@@ -460,6 +518,15 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false routes=[] nf=off host="foo" Persist=nil}`,
 		},
+		{
+			Prefs{
+				DERPHomeRegion:    2,
+				DERPAvoidRegions:  []int{3, 4},
+				DERPHomePeerAware: true,
+			},
+			"windows",
+			`Prefs{ra=false mesh=false dns=false want=false derphome=2 derpavoid=[3 4] derppeers=true Persist=nil}`,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.p.pretty(tt.os)
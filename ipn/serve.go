@@ -11,6 +11,7 @@
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 	"tailscale.com/tailcfg"
@@ -29,6 +30,11 @@ type ServeConfig struct {
 	// the Tailscale IP addresses. (not subnet routers, etc)
 	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
 
+	// UDP are the list of UDP port numbers that tailscaled should handle
+	// for the Tailscale IP addresses, forwarding their datagrams to a
+	// local server.
+	UDP map[uint16]*UDPPortHandler `json:",omitempty"`
+
 	// Web maps from "$SNI_NAME:$PORT" to a set of HTTP handlers
 	// keyed by mount point ("/", "/foo", etc)
 	Web map[HostPort]*WebServerConfig `json:",omitempty"`
@@ -90,7 +96,54 @@ type TCPPortHandler struct {
 	TerminateTLS string `json:",omitempty"`
 }
 
-// HTTPHandler is either a path or a proxy to serve.
+// DefaultUDPIdleTimeout is how long a forwarded UDP flow may go without
+// traffic in either direction before it's closed, unless overridden by
+// UDPPortHandler.IdleTimeoutSec.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// UDPPortHandler describes what to do when handling UDP datagrams sent to
+// a port.
+type UDPPortHandler struct {
+	// UDPForward is the IP:port to forward datagrams to. Each peer
+	// IP:port sending to the port gets its own local socket, so the
+	// server's replies go back to the peer that sent the datagram.
+	UDPForward string `json:",omitempty"`
+
+	// IdleTimeoutSec, if positive, is the number of seconds a flow may go
+	// without traffic in either direction before its state is discarded.
+	// Zero means DefaultUDPIdleTimeout.
+	IdleTimeoutSec int `json:",omitempty"`
+}
+
+// IdleTimeout returns how long a flow forwarded by h may be idle.
+func (h *UDPPortHandler) IdleTimeout() time.Duration {
+	if h.IdleTimeoutSec > 0 {
+		return time.Duration(h.IdleTimeoutSec) * time.Second
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// IdleTimeout returns how long a flow forwarded by h may be idle.
+//
+// View version of UDPPortHandler.IdleTimeout.
+func (v UDPPortHandlerView) IdleTimeout() time.Duration { return v.ж.IdleTimeout() }
+
+// Check reports whether h is a valid handler.
+func (h *UDPPortHandler) Check() error {
+	ap, err := netip.ParseAddrPort(h.UDPForward)
+	if err != nil {
+		return fmt.Errorf("invalid UDPForward %q: want ip:port", h.UDPForward)
+	}
+	if ap.Port() == 0 {
+		return fmt.Errorf("invalid UDPForward %q: port must be non-zero", h.UDPForward)
+	}
+	if h.IdleTimeoutSec < 0 {
+		return fmt.Errorf("invalid IdleTimeoutSec %d", h.IdleTimeoutSec)
+	}
+	return nil
+}
+
+// HTTPHandler is either a path, a proxy, text or a redirect to serve.
 type HTTPHandler struct {
 	// Exactly one of the following may be set.
 
@@ -99,8 +152,158 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
-	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	Redirect string `json:",omitempty"` // URL or absolute path to redirect to
+
+	// StatusCode, if non-zero, is the HTTP status code that Text and
+	// Redirect handlers respond with. It defaults to 200 for Text and to
+	// 302 (Found) for Redirect, which only accepts 3xx codes.
+	// A handler with only a StatusCode responds with that code and its
+	// standard status text, e.g. to mark a mount point as gone (410).
+	StatusCode int `json:",omitempty"`
+
+	// NoDirList, if true, disables directory listings for a Path that is
+	// a directory. Files within it, including a directory's index.html,
+	// are still served.
+	NoDirList bool `json:",omitempty"`
+
+	// SetRequestHeaders are headers to set on requests sent to the Proxy
+	// backend, replacing any values sent by the client. The X-Forwarded-*
+	// headers are set by the proxy itself, and can't be set or removed.
+	SetRequestHeaders map[string]string `json:",omitempty"`
+
+	// RemoveRequestHeaders are headers to remove from requests sent to
+	// the Proxy backend.
+	RemoveRequestHeaders []string `json:",omitempty"`
+
+	// SetResponseHeaders are headers to set on responses, for any kind
+	// of handler.
+	SetResponseHeaders map[string]string `json:",omitempty"`
+
+	// RemoveResponseHeaders are headers to remove from responses, for
+	// any kind of handler.
+	RemoveResponseHeaders []string `json:",omitempty"`
+
+	// TODO(bradfitz): TTL on mapping for temporary ones?
+}
+
+// Check reports whether h is a valid handler.
+func (h *HTTPHandler) Check() error {
+	n := 0
+	for _, v := range []string{h.Path, h.Proxy, h.Text, h.Redirect} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of Path, Proxy, Text or Redirect may be set")
+	}
+	if n == 0 && h.StatusCode == 0 {
+		return errors.New("empty handler")
+	}
+	if h.StatusCode != 0 {
+		if h.StatusCode < 200 || h.StatusCode > 599 {
+			return fmt.Errorf("invalid status code %d", h.StatusCode)
+		}
+		if h.Path != "" || h.Proxy != "" {
+			return errors.New("status code only applies to Text and Redirect handlers")
+		}
+		if h.Redirect != "" && (h.StatusCode < 300 || h.StatusCode > 399) {
+			return fmt.Errorf("status code %d is not a redirect", h.StatusCode)
+		}
+	}
+	if h.NoDirList && h.Path == "" {
+		return errors.New("NoDirList only applies to Path handlers")
+	}
+	if (len(h.SetRequestHeaders) > 0 || len(h.RemoveRequestHeaders) > 0) && h.Proxy == "" {
+		return errors.New("request headers only apply to Proxy handlers")
+	}
+	for k, v := range h.SetRequestHeaders {
+		if err := checkRequestHeader(k, v); err != nil {
+			return err
+		}
+	}
+	for k, v := range h.SetResponseHeaders {
+		if err := checkHeader(k, v); err != nil {
+			return err
+		}
+	}
+	for _, k := range h.RemoveRequestHeaders {
+		if err := checkRequestHeader(k, ""); err != nil {
+			return err
+		}
+	}
+	for _, k := range h.RemoveResponseHeaders {
+		if err := checkHeader(k, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeader reports whether k and v are a valid HTTP header name and value.
+func checkHeader(k, v string) error {
+	if k == "" {
+		return errors.New("empty header name")
+	}
+	for _, r := range k {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+	}
+	if strings.ContainsAny(v, "\r\n\x00") {
+		return fmt.Errorf("invalid value for header %q", k)
+	}
+	return nil
+}
+
+// proxyForwardedHeaders are the request headers set by the Proxy handler
+// itself, which would override any rules for them.
+var proxyForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// checkRequestHeader is like checkHeader, for a request header rule, which
+// mustn't be for one of proxyForwardedHeaders.
+func checkRequestHeader(k, v string) error {
+	if err := checkHeader(k, v); err != nil {
+		return err
+	}
+	for _, f := range proxyForwardedHeaders {
+		if strings.EqualFold(k, f) {
+			return fmt.Errorf("header %q is set by the proxy and can't be changed", k)
+		}
+	}
+	return nil
+}
+
+// CheckValid reports whether sc is a valid ServeConfig.
+func (sc *ServeConfig) CheckValid() error {
+	if sc == nil {
+		return nil
+	}
+	for port, h := range sc.UDP {
+		if h == nil {
+			continue
+		}
+		if port == 0 {
+			return errors.New("UDP port must be non-zero")
+		}
+		if err := h.Check(); err != nil {
+			return fmt.Errorf("UDP handler for port %d: %w", port, err)
+		}
+	}
+	for hp, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if h == nil {
+				continue
+			}
+			if err := h.Check(); err != nil {
+				return fmt.Errorf("handler for %s%s: %w", hp, mount, err)
+			}
+		}
+	}
+	return nil
 }
 
 // WebHandlerExists checks if the ServeConfig Web handler exists for
@@ -128,6 +331,21 @@ func (sc *ServeConfig) GetTCPPortHandler(port uint16) *TCPPortHandler {
 	return sc.TCP[port]
 }
 
+// GetUDPPortHandler returns the UDPPortHandler for the given port.
+// If the port is not configured, nil is returned.
+func (sc *ServeConfig) GetUDPPortHandler(port uint16) *UDPPortHandler {
+	if sc == nil {
+		return nil
+	}
+	return sc.UDP[port]
+}
+
+// IsUDPForwardingOnPort checks if ServeConfig is currently forwarding
+// UDP datagrams on the given port.
+func (sc *ServeConfig) IsUDPForwardingOnPort(port uint16) bool {
+	return sc.GetUDPPortHandler(port) != nil
+}
+
 // IsTCPForwardingAny checks if ServeConfig is currently forwarding
 // in TCPForward mode on any port.
 // This is exclusive of Web/HTTPS serving.
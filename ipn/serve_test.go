@@ -38,3 +38,77 @@ func TestCheckFunnelAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPHandlerCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       HTTPHandler
+		wantErr bool
+	}{
+		{"empty", HTTPHandler{}, true},
+		{"text", HTTPHandler{Text: "hi"}, false},
+		{"text-status", HTTPHandler{Text: "gone", StatusCode: 410}, false},
+		{"status-only", HTTPHandler{StatusCode: 404}, false},
+		{"bad-status", HTTPHandler{StatusCode: 42}, true},
+		{"informational-status", HTTPHandler{Text: "hi", StatusCode: 101}, true},
+		{"status-600", HTTPHandler{StatusCode: 600}, true},
+		{"status-599", HTTPHandler{StatusCode: 599}, false},
+		{"two-sources", HTTPHandler{Text: "hi", Proxy: "http://127.0.0.1:3000"}, true},
+		{"redirect", HTTPHandler{Redirect: "https://example.com/"}, false},
+		{"redirect-301", HTTPHandler{Redirect: "/new", StatusCode: 301}, false},
+		{"redirect-200", HTTPHandler{Redirect: "/new", StatusCode: 200}, true},
+		{"proxy-status", HTTPHandler{Proxy: "http://127.0.0.1:3000", StatusCode: 200}, true},
+		{"path-no-list", HTTPHandler{Path: "/srv", NoDirList: true}, false},
+		{"text-no-list", HTTPHandler{Text: "hi", NoDirList: true}, true},
+		{"proxy-req-headers", HTTPHandler{
+			Proxy:                "http://127.0.0.1:3000",
+			SetRequestHeaders:    map[string]string{"X-Auth": "secret"},
+			RemoveRequestHeaders: []string{"Cookie"},
+		}, false},
+		{"proxy-set-forwarded-for", HTTPHandler{
+			Proxy:             "http://127.0.0.1:3000",
+			SetRequestHeaders: map[string]string{"X-Forwarded-For": "1.2.3.4"},
+		}, true},
+		{"proxy-set-forwarded-proto", HTTPHandler{
+			Proxy:             "http://127.0.0.1:3000",
+			SetRequestHeaders: map[string]string{"x-forwarded-proto": "https"},
+		}, true},
+		{"proxy-remove-forwarded-host", HTTPHandler{
+			Proxy:                "http://127.0.0.1:3000",
+			RemoveRequestHeaders: []string{"X-Forwarded-Host"},
+		}, true},
+		{"text-req-headers", HTTPHandler{Text: "hi", SetRequestHeaders: map[string]string{"X-Auth": "secret"}}, true},
+		{"resp-headers", HTTPHandler{Text: "hi", SetResponseHeaders: map[string]string{"Cache-Control": "no-store"}}, false},
+		{"bad-header-name", HTTPHandler{Text: "hi", SetResponseHeaders: map[string]string{"Bad Name": "x"}}, true},
+		{"bad-header-value", HTTPHandler{Text: "hi", SetResponseHeaders: map[string]string{"X-Foo": "a\nb"}}, true},
+	}
+	for _, tt := range tests {
+		err := tt.h.Check()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeConfigCheckValidUDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		udp     map[uint16]*UDPPortHandler
+		wantErr bool
+	}{
+		{"ok", map[uint16]*UDPPortHandler{53: {UDPForward: "127.0.0.1:5353"}}, false},
+		{"ok-v6", map[uint16]*UDPPortHandler{53: {UDPForward: "[::1]:5353", IdleTimeoutSec: 30}}, false},
+		{"port-zero", map[uint16]*UDPPortHandler{0: {UDPForward: "127.0.0.1:5353"}}, true},
+		{"no-port", map[uint16]*UDPPortHandler{53: {UDPForward: "127.0.0.1"}}, true},
+		{"dst-port-zero", map[uint16]*UDPPortHandler{53: {UDPForward: "127.0.0.1:0"}}, true},
+		{"hostname", map[uint16]*UDPPortHandler{53: {UDPForward: "localhost:5353"}}, true},
+		{"negative-timeout", map[uint16]*UDPPortHandler{53: {UDPForward: "127.0.0.1:5353", IdleTimeoutSec: -1}}, true},
+	}
+	for _, tt := range tests {
+		sc := &ServeConfig{UDP: tt.udp}
+		err := sc.CheckValid()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: CheckValid() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -41,6 +41,15 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// Records maps DNS FQDNs to their CNAME, TXT, MX and SRV records.
+	// Like Hosts, they're answered locally by 100.100.100.100, and
+	// need appropriate Routes to resolve.
+	Records map[dnsname.FQDN][]resolver.Record
+	// Blocklists are lists of names that 100.100.100.100 answers
+	// according to BlockPolicy instead of forwarding upstream.
+	Blocklists []resolver.Blocklist
+	// BlockPolicy is how queries for names in Blocklists are answered.
+	BlockPolicy resolver.BlockPolicy
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
@@ -64,6 +73,12 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if len(c.Records) > 0 {
+		fmt.Fprintf(w, " Records:%v", len(c.Records))
+	}
+	if len(c.Blocklists) > 0 {
+		fmt.Fprintf(w, " Blocklists:%v", len(c.Blocklists))
+	}
 	w.WriteString("}")
 }
 
@@ -92,8 +107,8 @@ func (c Config) hasDefaultIPResolversOnly() bool {
 	return true
 }
 
-// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host entries
-// that aren't covered by a SplitDNS route suffix.
+// hasHostsWithoutSplitDNSRoutes reports whether c contains any Host or
+// Records entries that aren't covered by a SplitDNS route suffix.
 func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 	// TODO(bradfitz): this could be more efficient, but we imagine
 	// the number of SplitDNS routes and/or hosts will be small.
@@ -102,6 +117,11 @@ func (c Config) hasHostsWithoutSplitDNSRoutes() bool {
 			return true
 		}
 	}
+	for host := range c.Records {
+		if !c.hasSplitDNSRouteForHost(host) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -158,6 +158,9 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.Records = cfg.Records
+	rcfg.Blocklists = cfg.Blocklists
+	rcfg.BlockPolicy = cfg.BlockPolicy
 	routes := map[dnsname.FQDN][]*dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -180,13 +183,14 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 		// case where cfg is entirely zero, in which case these
 		// configs clear all Tailscale DNS settings.
 		return rcfg, ocfg, nil
-	case cfg.hasDefaultIPResolversOnly() && !cfg.hasHostsWithoutSplitDNSRoutes():
+	case cfg.hasDefaultIPResolversOnly() && !cfg.hasHostsWithoutSplitDNSRoutes() && len(cfg.Blocklists) == 0:
 		// Trivial CorpDNS configuration, just override the OS resolver.
 		//
 		// If there are hosts (ExtraRecords) that are not covered by an existing
 		// SplitDNS route, then we don't go into this path so that we fall into
 		// the next case and send the extra record hosts queries through
-		// 100.100.100.100 instead where we can answer them.
+		// 100.100.100.100 instead where we can answer them. Likewise if
+		// there are blocklists, which only 100.100.100.100 applies.
 		//
 		// TODO: for OSes that support it, pass IP:port and DoH
 		// addresses directly to OS.
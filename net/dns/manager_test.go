@@ -220,6 +220,25 @@ func TestManager(t *testing.T) {
 				Routes: upstreams(".", "1.1.1.1", "9.9.9.9"),
 			},
 		},
+		{
+			// Blocklists are applied by 100.100.100.100, so global DNS
+			// servers go via it too.
+			name:  "blocklists-with-global-dns-uses-quad100",
+			split: true,
+			in: Config{
+				DefaultResolvers: mustRes("1.1.1.1"),
+				Blocklists:       []resolver.Blocklist{{Source: "/blocked"}},
+				BlockPolicy:      resolver.BlockZeroIP,
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes:      upstreams(".", "1.1.1.1"),
+				Blocklists:  []resolver.Blocklist{{Source: "/blocked"}},
+				BlockPolicy: resolver.BlockZeroIP,
+			},
+		},
 		{
 			// This is the above hosts-with-global-dns-uses-quad100 test but
 			// verifying that if global DNS servers aren't set (the 1.1.1.1 and
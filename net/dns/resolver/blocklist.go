@@ -0,0 +1,421 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slices"
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/multierr"
+)
+
+const (
+	// blocklistRefreshInterval is how often blocklists are reloaded
+	// from their sources.
+	blocklistRefreshInterval = 6 * time.Hour
+
+	// blocklistFetchTimeout bounds fetching a blocklist URL.
+	blocklistFetchTimeout = time.Minute
+
+	// maxBlocklistBytes bounds the size of a blocklist.
+	maxBlocklistBytes = 64 << 20
+)
+
+// BlockPolicy is how the resolver answers queries for blocked names.
+type BlockPolicy string
+
+const (
+	// BlockNXDomain answers queries for blocked names with NXDOMAIN.
+	BlockNXDomain BlockPolicy = "nxdomain"
+	// BlockZeroIP answers A and AAAA queries for blocked names with the
+	// unspecified address (0.0.0.0 or ::), and other queries with no
+	// records.
+	BlockZeroIP BlockPolicy = "zeroip"
+)
+
+// Blocklist is a list of domains whose queries the resolver answers
+// itself, according to a BlockPolicy, rather than forwarding them.
+// Subdomains of listed domains are blocked too.
+type Blocklist struct {
+	// Name names the list in logs and metrics. If empty, it's derived
+	// from Source.
+	Name string
+
+	// Source is the path of a file, or an http or https URL, containing
+	// the list. It's either in hosts file format ("0.0.0.0 example.com")
+	// or has one domain per line. Comments start with '#'.
+	Source string
+}
+
+func (b Blocklist) isURL() bool {
+	return strings.HasPrefix(b.Source, "http://") || strings.HasPrefix(b.Source, "https://")
+}
+
+// name returns b.Name, or a name derived from b.Source, with characters
+// that aren't valid in a metric name replaced by underscores.
+func (b Blocklist) name() string {
+	name := b.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(b.Source), filepath.Ext(b.Source))
+	}
+	return strings.Map(func(r rune) rune {
+		if isIllegalBlocklistNameRune(r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func isIllegalBlocklistNameRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' ||
+		r >= 'A' && r <= 'Z' ||
+		r >= '0' && r <= '9' ||
+		r == '_')
+}
+
+// loadedBlocklist is a Blocklist and the domains loaded from it.
+type loadedBlocklist struct {
+	Blocklist
+	domains map[string]bool // lowercase, without trailing dot
+	hits    *clientmetric.Metric
+}
+
+// blockState is the immutable state of a blocker.
+type blockState struct {
+	policy BlockPolicy
+	lists  []*loadedBlocklist
+}
+
+// blocker matches DNS names against blocklists.
+type blocker struct {
+	logf  logger.Logf
+	httpc *http.Client // for fetching lists from URLs
+
+	state atomic.Pointer[blockState]
+
+	// gen is incremented each time new blocklists are requested. Loads
+	// of lists superseded by a later request are skipped.
+	gen atomic.Int64
+
+	mu          sync.Mutex // serializes loads
+	refreshOnce sync.Once
+}
+
+// active reports whether any blocklists are set.
+func (b *blocker) active() bool {
+	st := b.state.Load()
+	return st != nil && len(st.lists) > 0
+}
+
+// lookup returns the list blocking name and the policy to apply, or nil
+// if name isn't blocked. name is a DNS name, with or without trailing dot.
+func (b *blocker) lookup(name string) (*loadedBlocklist, BlockPolicy) {
+	st := b.state.Load()
+	if st == nil || len(st.lists) == 0 {
+		return nil, ""
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		for _, l := range st.lists {
+			if l.domains[name] {
+				return l, st.policy
+			}
+		}
+		_, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			return nil, ""
+		}
+		name = rest
+	}
+}
+
+// set loads lists and makes them the active blocklists, unless blocklists
+// newer than generation gen were requested meanwhile. Lists that fail to
+// load are kept with the domains previously loaded for the same source,
+// if any.
+func (b *blocker) set(ctx context.Context, gen int64, policy BlockPolicy, lists []Blocklist) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.gen.Load() != gen {
+		return nil
+	}
+	return b.setLocked(ctx, policy, lists)
+}
+
+func (b *blocker) setLocked(ctx context.Context, policy BlockPolicy, lists []Blocklist) error {
+	old := map[Blocklist]*loadedBlocklist{}
+	if st := b.state.Load(); st != nil {
+		for _, l := range st.lists {
+			old[l.Blocklist] = l
+		}
+	}
+	var errs []error
+	st := &blockState{policy: policy}
+	for _, bl := range lists {
+		domains, err := loadBlocklist(ctx, b.httpc, bl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("blocklist %q: %w", bl.name(), err))
+			if l, ok := old[bl]; ok {
+				st.lists = append(st.lists, l)
+			}
+			continue
+		}
+		st.lists = append(st.lists, &loadedBlocklist{
+			Blocklist: bl,
+			domains:   domains,
+			hits:      blocklistHitsMetric(bl.name()),
+		})
+		b.logf("loaded blocklist %q: %d domains", bl.name(), len(domains))
+	}
+	b.state.Store(st)
+	return multierr.New(errs...)
+}
+
+// refresh reloads the active blocklists.
+func (b *blocker) refresh(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.state.Load()
+	if st == nil || len(st.lists) == 0 {
+		return
+	}
+	lists := make([]Blocklist, len(st.lists))
+	for i, l := range st.lists {
+		lists[i] = l.Blocklist
+	}
+	if err := b.setLocked(ctx, st.policy, lists); err != nil {
+		b.logf("refreshing blocklists: %v", err)
+	}
+}
+
+var (
+	blocklistMetricsMu sync.Mutex
+	blocklistMetrics   = map[string]*clientmetric.Metric{}
+)
+
+// blocklistHitsMetric returns the counter of queries blocked by the
+// blocklist named name. Metrics can't be unpublished, so they're shared
+// by all lists with the same name.
+func blocklistHitsMetric(name string) *clientmetric.Metric {
+	blocklistMetricsMu.Lock()
+	defer blocklistMetricsMu.Unlock()
+	m, ok := blocklistMetrics[name]
+	if !ok {
+		m = clientmetric.NewCounter("dns_blocklist_hits_" + name)
+		blocklistMetrics[name] = m
+	}
+	return m
+}
+
+// loadBlocklist reads and parses the blocklist bl from its source,
+// fetching it with httpc if it's a URL.
+func loadBlocklist(ctx context.Context, httpc *http.Client, bl Blocklist) (map[string]bool, error) {
+	if bl.isURL() {
+		ctx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", bl.Source, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := httpc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %v", bl.Source, res.Status)
+		}
+		return parseBlocklist(res.Body)
+	}
+	f, err := os.Open(bl.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBlocklist(f)
+}
+
+// hostsFileNames are names in hosts format blocklists that aren't to be
+// blocked, as they're usually there only for the hosts file to work.
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseBlocklist parses a blocklist in hosts file format, or with one
+// domain per line. Invalid names are ignored.
+func parseBlocklist(r io.Reader) (map[string]bool, error) {
+	domains := map[string]bool{}
+	s := bufio.NewScanner(io.LimitReader(r, maxBlocklistBytes))
+	s.Buffer(nil, 64<<10)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(f[0]); err == nil {
+			f = f[1:] // hosts file format
+		}
+		for _, name := range f {
+			name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+			if hostsFileNames[name] || !validBlocklistName(name) {
+				continue
+			}
+			domains[name] = true
+		}
+	}
+	return domains, s.Err()
+}
+
+// validBlocklistName reports whether name is a plausible DNS name of at
+// least two labels.
+func validBlocklistName(name string) bool {
+	if len(name) > 253 || !strings.Contains(name, ".") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newBlocklistHTTPClient returns the client to fetch blocklists with. It
+// dials like the forwarder does for DoH upstreams, so that fetching a list
+// doesn't depend on the system's resolver, which may be this one.
+func newBlocklistHTTPClient(f *forwarder) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         f.upstreamDialer("", nil),
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     dohTransportTimeout,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// setBlocklistConfig sets the blocklists of a Config, if they changed
+// since the last one. Loading them may involve fetching URLs, so it's
+// done in the background.
+func (r *Resolver) setBlocklistConfig(policy BlockPolicy, lists []Blocklist) {
+	r.mu.Lock()
+	changed := policy != r.blockPolicy || !slices.Equal(lists, r.blocklists)
+	r.blockPolicy = policy
+	r.blocklists = lists
+	r.mu.Unlock()
+	if !changed {
+		return
+	}
+	gen := r.blocker.gen.Add(1)
+	r.goUnlessClosed(func() {
+		if err := r.loadBlocklists(gen, policy, lists); err != nil {
+			r.logf("setting blocklists: %v", err)
+		}
+	})
+}
+
+// setBlocklists loads lists and starts blocking the names in them with
+// policy, replacing any previously set blocklists.
+func (r *Resolver) setBlocklists(policy BlockPolicy, lists []Blocklist) error {
+	return r.loadBlocklists(r.blocker.gen.Add(1), policy, lists)
+}
+
+// loadBlocklists loads lists and makes them the active blocklists, unless
+// newer ones than generation gen were requested meanwhile. Lists from URLs
+// are refreshed periodically.
+//
+// Lists that fail to load are reported in the returned error; the others
+// are used regardless.
+func (r *Resolver) loadBlocklists(gen int64, policy BlockPolicy, lists []Blocklist) error {
+	switch policy {
+	case BlockNXDomain, BlockZeroIP:
+	case "":
+		policy = BlockNXDomain
+	default:
+		return fmt.Errorf("unknown block policy %q", policy)
+	}
+	err := r.blocker.set(r.ctx, gen, policy, lists)
+	for _, bl := range lists {
+		if bl.isURL() {
+			r.blocker.refreshOnce.Do(r.startBlocklistRefresh)
+			break
+		}
+	}
+	return err
+}
+
+func (r *Resolver) startBlocklistRefresh() {
+	r.goUnlessClosed(func() {
+		t := time.NewTicker(blocklistRefreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.closed:
+				return
+			case <-t.C:
+				r.blocker.refresh(r.ctx)
+			}
+		}
+	})
+}
+
+// blockedResponse returns the response to the query resp if its name is
+// blocked.
+func (r *Resolver) blockedResponse(resp *response) ([]byte, bool) {
+	l, policy := r.blocker.lookup(resp.Question.Name.String())
+	if l == nil {
+		return nil, false
+	}
+	metricDNSBlocked.Add(1)
+	l.hits.Add(1)
+	switch policy {
+	case BlockZeroIP:
+		switch resp.Question.Type {
+		case dns.TypeA:
+			resp.IP = netip.IPv4Unspecified()
+		case dns.TypeAAAA:
+			resp.IP = netip.IPv6Unspecified()
+		}
+	default:
+		resp.Header.RCode = dns.RCodeNameError
+	}
+	res, err := marshalResponse(resp)
+	if err != nil {
+		r.logf("marshaling blocked response: %v", err)
+		return nil, false
+	}
+	r.queryLog.add(newQueryLogEntry(time.Now(), resolutionBlocked, resp.Question, res))
+	return res, true
+}
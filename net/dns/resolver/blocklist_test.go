@@ -0,0 +1,269 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	const list = `# A hosts file
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com tracker.example.net # trailing comment
+0.0.0.0 Upper.Example.ORG.
+
+# A domain list
+malware.example
+*.wild.example
+not_a..domain
+tld
+`
+	got, err := parseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"ads.example.com":     true,
+		"tracker.example.net": true,
+		"upper.example.org":   true,
+		"malware.example":     true,
+		"wild.example":        true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBlocklist = %v; want %v", got, want)
+	}
+}
+
+func TestBlocklistName(t *testing.T) {
+	tests := []struct {
+		bl   Blocklist
+		want string
+	}{
+		{Blocklist{Source: "/etc/tailscale/ads.txt"}, "ads"},
+		{Blocklist{Source: "https://example.com/lists/malware-domains.hosts"}, "malware_domains"},
+		{Blocklist{Name: "my list", Source: "/x"}, "my_list"},
+	}
+	for _, tt := range tests {
+		if got := tt.bl.name(); got != tt.want {
+			t.Errorf("%+v.name() = %q; want %q", tt.bl, got, tt.want)
+		}
+	}
+}
+
+func TestBlocklists(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "testfile.txt")
+	if err := os.WriteFile(file, []byte("0.0.0.0 ads.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("malware.example\n"))
+	}))
+	defer srv.Close()
+
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+
+	lists := []Blocklist{
+		{Source: file},
+		{Name: "testurl", Source: srv.URL + "/list"},
+	}
+	if err := r.setBlocklists(BlockNXDomain, lists); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name dnsname.FQDN, typ dns.Type) dns.Message {
+		t.Helper()
+		res, err := r.Query(context.Background(), dnspacket(name, typ, noEdns), netip.AddrPort{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	fileHits := blocklistHitsMetric("testfile")
+	urlHits := blocklistHitsMetric("testurl")
+	fileHits0, urlHits0 := fileHits.Value(), urlHits.Value()
+
+	for _, name := range []dnsname.FQDN{"ads.example.com.", "x.ADS.example.com.", "malware.example."} {
+		if msg := query(name, dns.TypeA); msg.Header.RCode != dns.RCodeNameError {
+			t.Errorf("%v: rcode = %v; want NXDOMAIN", name, msg.Header.RCode)
+		}
+	}
+	if got := fileHits.Value() - fileHits0; got != 2 {
+		t.Errorf("file list hits = %d; want 2", got)
+	}
+	if got := urlHits.Value() - urlHits0; got != 1 {
+		t.Errorf("URL list hits = %d; want 1", got)
+	}
+
+	// MagicDNS names are never blocked.
+	if msg := query("test1.ipn.dev.", dns.TypeA); msg.Header.RCode != dns.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Errorf("MagicDNS name: rcode = %v, %d answers; want one answer", msg.Header.RCode, len(msg.Answers))
+	}
+
+	if err := r.setBlocklists(BlockZeroIP, lists); err != nil {
+		t.Fatal(err)
+	}
+	msg := query("ads.example.com.", dns.TypeA)
+	if msg.Header.RCode != dns.RCodeSuccess || len(msg.Answers) != 1 {
+		t.Fatalf("zeroip A: rcode = %v, %d answers; want one answer", msg.Header.RCode, len(msg.Answers))
+	}
+	if a, ok := msg.Answers[0].Body.(*dns.AResource); !ok || a.A != [4]byte{} {
+		t.Errorf("zeroip A answer = %v; want 0.0.0.0", msg.Answers[0].GoString())
+	}
+	msg = query("ads.example.com.", dns.TypeAAAA)
+	if a, ok := msg.Answers[0].Body.(*dns.AAAAResource); !ok || a.AAAA != [16]byte{} {
+		t.Errorf("zeroip AAAA answer = %v; want ::", msg.Answers[0].GoString())
+	}
+	if msg := query("ads.example.com.", dns.TypeTXT); msg.Header.RCode != dns.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("zeroip TXT: rcode = %v, %d answers; want NOERROR without answers", msg.Header.RCode, len(msg.Answers))
+	}
+
+	// A list that fails to load keeps its previous contents.
+	os.Remove(file)
+	if err := r.setBlocklists(BlockNXDomain, lists); err == nil {
+		t.Error("missing file didn't cause an error")
+	}
+	if l, _ := r.blocker.lookup("ads.example.com."); l == nil {
+		t.Error("list that failed to reload was dropped")
+	}
+
+	if err := r.setBlocklists(BlockNXDomain, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.blocker.active() {
+		t.Error("blocker active after clearing blocklists")
+	}
+
+	if err := r.setBlocklists("bogus", lists); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestHandleExitNodeDNSQueryBlocked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "exitlist")
+	if err := os.WriteFile(file, []byte("blocked.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := newResolver(t)
+	defer r.Close()
+	if err := r.setBlocklists(BlockNXDomain, []Blocklist{{Source: file}}); err != nil {
+		t.Fatal(err)
+	}
+	allowAll := func(string) bool { return true }
+	res, err := r.HandleExitNodeDNSQuery(context.Background(), dnspacket("www.blocked.example.", dns.TypeA, noEdns), netip.AddrPort{}, allowAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.RCode != dns.RCodeNameError {
+		t.Errorf("rcode = %v; want NXDOMAIN", msg.Header.RCode)
+	}
+}
+
+func TestBlocklistsFromConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cfglist")
+	if err := os.WriteFile(file, []byte("blocked.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := newResolver(t)
+	defer r.Close()
+
+	waitActive := func(want bool) {
+		t.Helper()
+		for i := 0; r.blocker.active() != want; i++ {
+			if i == 500 {
+				t.Fatalf("blocker active = %v; want %v", !want, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	cfg := dnsCfg
+	cfg.Blocklists = []Blocklist{{Source: file}}
+	r.SetConfig(cfg)
+	waitActive(true)
+	if l, policy := r.blocker.lookup("www.blocked.example."); l == nil || policy != BlockNXDomain {
+		t.Errorf("lookup = %v, %q; want blocked with the default policy", l, policy)
+	}
+
+	// An unchanged config doesn't reload the lists.
+	gen := r.blocker.gen.Load()
+	r.SetConfig(cfg)
+	if got := r.blocker.gen.Load(); got != gen {
+		t.Errorf("blocklists reloaded for an unchanged config")
+	}
+
+	r.SetConfig(dnsCfg)
+	waitActive(false)
+}
+
+func TestBlocklistsCloseDuringFetch(t *testing.T) {
+	fetching := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetching <- true
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	r := newResolver(t)
+	cfg := dnsCfg
+	cfg.Blocklists = []Blocklist{{Source: srv.URL}}
+	r.SetConfig(cfg)
+	<-fetching
+
+	done := make(chan bool)
+	go func() {
+		r.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't stop the blocklist fetch")
+	}
+}
+
+func TestBlocklistsSetConfigDuringClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cfglist")
+	if err := os.WriteFile(file, []byte("blocked.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		r := newResolver(t)
+		cfg := dnsCfg
+		cfg.Blocklists = []Blocklist{{Source: file}}
+		done := make(chan bool)
+		go func() {
+			r.SetConfig(cfg)
+			close(done)
+		}()
+		r.Close()
+		<-done
+		// No blocklist load is started once Close is waiting for them.
+		r.wg.Wait()
+	}
+}
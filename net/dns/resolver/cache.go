@@ -0,0 +1,310 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxCacheEntries bounds the number of forwarded responses kept in
+	// the cache.
+	maxCacheEntries = 4096
+
+	// maxCacheTTL caps how long a positive response is cached,
+	// regardless of the TTLs of its records.
+	maxCacheTTL = time.Hour
+
+	// maxNegativeCacheTTL caps how long a negative response is cached.
+	// RFC 2308, section 5 suggests one to three hours, but we'd rather
+	// notice new names sooner.
+	maxNegativeCacheTTL = 5 * time.Minute
+
+	// cachePrefetchHits is the number of hits after which a cached
+	// response is considered hot and refreshed from upstream shortly
+	// before it expires.
+	cachePrefetchHits = 3
+
+	// cachePrefetchPercent is how much of its TTL a hot response has left
+	// when it's refreshed.
+	cachePrefetchPercent = 10
+)
+
+// cacheKey identifies a cacheable DNS query.
+type cacheKey struct {
+	route string // upstreams the query is forwarded to; see routeKey
+	name  string // lowercase question name
+	typ   dns.Type
+	class dns.Class
+	edns  bool // whether the query has an OPT record
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	res         []byte // the response as received from upstream
+	added       time.Time
+	ttl         time.Duration
+	hits        int
+	prefetching bool
+}
+
+func (e *cacheEntry) expires() time.Time { return e.added.Add(e.ttl) }
+
+// responseCache is an LRU cache of responses from upstream resolvers,
+// honoring the TTLs of positive responses and, per RFC 2308, the SOA
+// TTLs of negative ones.
+//
+// The zero value is an empty cache ready for use.
+type responseCache struct {
+	mu  sync.Mutex
+	lru list.List // of *cacheEntry, most recently used first
+	m   map[cacheKey]*list.Element
+}
+
+// get returns the cached response for k along with how long ago it was
+// received. The returned slice must not be modified.
+//
+// If prefetch is true, the response is hot and about to expire; the
+// caller should refresh it from upstream. Only one caller is told to do
+// so per response.
+func (c *responseCache) get(k cacheKey, now time.Time) (res []byte, age time.Duration, prefetch, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.m[k]
+	if !ok {
+		return nil, 0, false, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires()) {
+		c.lru.Remove(el)
+		delete(c.m, k)
+		return nil, 0, false, false
+	}
+	c.lru.MoveToFront(el)
+	e.hits++
+	if e.hits >= cachePrefetchHits && !e.prefetching && e.expires().Sub(now) < e.ttl*cachePrefetchPercent/100 {
+		e.prefetching = true
+		prefetch = true
+	}
+	return e.res, now.Sub(e.added), prefetch, true
+}
+
+// add caches the upstream response res for k, if it's cacheable. It
+// reports whether it was. The cache takes ownership of res.
+func (c *responseCache) add(k cacheKey, res []byte, now time.Time) bool {
+	ttl, ok := cacheTTL(res)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.m[k]; ok {
+		// A refresh of a response; keep it as hot as it was.
+		e := el.Value.(*cacheEntry)
+		e.res, e.added, e.ttl, e.prefetching = res, now, ttl, false
+		c.lru.MoveToFront(el)
+		return true
+	}
+	if c.m == nil {
+		c.m = make(map[cacheKey]*list.Element)
+	}
+	c.m[k] = c.lru.PushFront(&cacheEntry{key: k, res: res, added: now, ttl: ttl})
+	for c.lru.Len() > maxCacheEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.m, el.Value.(*cacheEntry).key)
+	}
+	return true
+}
+
+// flush removes all cached responses.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.m = nil
+}
+
+// len returns the number of cached responses, including expired ones
+// not yet removed.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// routeKey returns a string identifying the set of upstreams resolvers,
+// so that responses from different upstreams for the same question are
+// cached separately.
+func routeKey(resolvers []resolverAndDelay) string {
+	var sb strings.Builder
+	for i, rr := range resolvers {
+		if i > 0 {
+			sb.WriteByte('|')
+		}
+		sb.WriteString(upstreamKey(rr.name))
+	}
+	return sb.String()
+}
+
+// cacheKeyFor returns the cache key of the DNS query packet q forwarded
+// to the route identified by route. It reports false if q isn't a
+// standard query with exactly one question.
+func cacheKeyFor(q []byte, route string) (cacheKey, bool) {
+	var p dns.Parser
+	h, err := p.Start(q)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return cacheKey{}, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return cacheKey{}, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return cacheKey{}, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return cacheKey{}, false
+	}
+	k := cacheKey{
+		route: route,
+		name:  strings.ToLower(qs[0].Name.String()),
+		typ:   qs[0].Type,
+		class: qs[0].Class,
+	}
+	for {
+		ah, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return cacheKey{}, false
+		}
+		if ah.Type == dns.TypeOPT {
+			k.edns = true
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return cacheKey{}, false
+		}
+	}
+	return k, true
+}
+
+// cacheTTL returns how long the upstream response res may be cached.
+//
+// Positive responses are cached for the smallest TTL of their answers.
+// Negative responses (NXDOMAIN, or NOERROR without answers) are cached
+// for the smaller of the TTL and MINIMUM field of the SOA record in their
+// authority section, per RFC 2308, section 5; without one they aren't
+// cached. Truncated responses and other errors, notably SERVFAIL, are
+// never cached.
+func cacheTTL(res []byte) (ttl time.Duration, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil || !h.Response || h.Truncated {
+		return 0, false
+	}
+	if h.RCode != dns.RCodeSuccess && h.RCode != dns.RCodeNameError {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	var minTTL uint32
+	var numAnswers int
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, false
+		}
+		if numAnswers == 0 || ah.TTL < minTTL {
+			minTTL = ah.TTL
+		}
+		numAnswers++
+		if err := p.SkipAnswer(); err != nil {
+			return 0, false
+		}
+	}
+	if h.RCode == dns.RCodeSuccess && numAnswers > 0 {
+		return capTTL(minTTL, maxCacheTTL), minTTL > 0
+	}
+
+	for {
+		ah, err := p.AuthorityHeader()
+		if err != nil {
+			return 0, false
+		}
+		if ah.Type != dns.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0, false
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0, false
+		}
+		ttl := ah.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return capTTL(ttl, maxNegativeCacheTTL), ttl > 0
+	}
+}
+
+// capTTL returns the DNS TTL ttl, in seconds, as a duration no longer
+// than max.
+func capTTL(ttl uint32, max time.Duration) time.Duration {
+	if d := time.Duration(ttl) * time.Second; d < max {
+		return d
+	}
+	return max
+}
+
+// cachedResponse returns the cached response res, received age ago, as a
+// response to the DNS query packet q: with q's ID and question, and
+// with TTLs reduced by age.
+func cachedResponse(res, q []byte, age time.Duration) ([]byte, error) {
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		return nil, err
+	}
+	var p dns.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	msg.Header.ID = h.ID
+	msg.Questions = []dns.Question{question} // preserve the query's case
+
+	elapsed := uint32(age / time.Second)
+	for _, rrs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			rh := &rrs[i].Header
+			if rh.Type == dns.TypeOPT {
+				// The TTL of an OPT record holds the extended RCODE and
+				// flags (RFC 6891, section 6.1.3).
+				continue
+			}
+			if rh.TTL > elapsed {
+				rh.TTL -= elapsed
+			} else {
+				rh.TTL = 0
+			}
+		}
+	}
+	return msg.Pack()
+}
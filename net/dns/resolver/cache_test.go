@@ -0,0 +1,315 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+// testResponse describes a DNS response for the cache tests.
+type testResponse struct {
+	rcode     dnsmessage.RCode
+	truncated bool
+	answerTTL []uint32 // one A record per TTL
+	soaTTL    uint32   // if non-zero, an SOA record in the authority section
+	soaMinTTL uint32
+	edns      bool
+}
+
+func (tr testResponse) build(t testing.TB, id uint16, name string) []byte {
+	t.Helper()
+	n := dnsmessage.MustNewName(name)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:        id,
+		Response:  true,
+		RCode:     tr.rcode,
+		Truncated: tr.truncated,
+	})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	for i, ttl := range tr.answerTTL {
+		b.AResource(dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: ttl},
+			dnsmessage.AResource{A: [4]byte{1, 2, 3, byte(i)}})
+	}
+	b.StartAuthorities()
+	if tr.soaTTL != 0 {
+		b.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: tr.soaTTL},
+			dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example.com."),
+				MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+				MinTTL: tr.soaMinTTL,
+			})
+	}
+	b.StartAdditionals()
+	if tr.edns {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		res  testResponse
+		want time.Duration // or 0 for not cacheable
+	}{
+		{"positive", testResponse{answerTTL: []uint32{60}}, 60 * time.Second},
+		{"positive_min", testResponse{answerTTL: []uint32{300, 30, 60}}, 30 * time.Second},
+		{"positive_capped", testResponse{answerTTL: []uint32{86400}}, maxCacheTTL},
+		{"positive_zero_ttl", testResponse{answerTTL: []uint32{60, 0}}, 0},
+		{"nxdomain_soa", testResponse{rcode: dnsmessage.RCodeNameError, soaTTL: 300, soaMinTTL: 30}, 30 * time.Second},
+		{"nxdomain_soa_ttl", testResponse{rcode: dnsmessage.RCodeNameError, soaTTL: 20, soaMinTTL: 30}, 20 * time.Second},
+		{"nxdomain_capped", testResponse{rcode: dnsmessage.RCodeNameError, soaTTL: 86400, soaMinTTL: 3600}, maxNegativeCacheTTL},
+		{"nxdomain_no_soa", testResponse{rcode: dnsmessage.RCodeNameError}, 0},
+		{"nodata_soa", testResponse{soaTTL: 60, soaMinTTL: 60}, 60 * time.Second},
+		{"nodata_no_soa", testResponse{}, 0},
+		{"servfail", testResponse{rcode: dnsmessage.RCodeServerFailure, soaTTL: 60, soaMinTTL: 60}, 0},
+		{"refused", testResponse{rcode: dnsmessage.RCodeRefused}, 0},
+		{"truncated", testResponse{truncated: true, answerTTL: []uint32{60}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheTTL(tt.res.build(t, 1, "foo.example.com."))
+			if !ok {
+				got = 0
+			}
+			if got != tt.want {
+				t.Errorf("cacheTTL = %v, %v; want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var c responseCache
+	now := time.Now()
+	k := cacheKey{route: "8.8.8.8", name: "foo.example.com.", typ: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	res := testResponse{answerTTL: []uint32{100}}.build(t, 1, "foo.example.com.")
+
+	if _, _, _, ok := c.get(k, now); ok {
+		t.Fatal("hit in empty cache")
+	}
+	if c.add(k, testResponse{rcode: dnsmessage.RCodeServerFailure}.build(t, 1, "foo.example.com."), now) {
+		t.Fatal("SERVFAIL was cached")
+	}
+	if !c.add(k, res, now) {
+		t.Fatal("response wasn't cached")
+	}
+	if _, _, _, ok := c.get(cacheKey{route: "1.1.1.1", name: k.name, typ: k.typ, class: k.class}, now); ok {
+		t.Error("hit for a different route")
+	}
+	got, age, prefetch, ok := c.get(k, now.Add(10*time.Second))
+	if !ok || string(got) != string(res) || age != 10*time.Second || prefetch {
+		t.Errorf("get = _, %v, %v, %v; want hit aged 10s without prefetch", age, prefetch, ok)
+	}
+
+	// Once hot, the response is prefetched once, shortly before expiry.
+	for i := 1; i < cachePrefetchHits; i++ {
+		if _, _, prefetch, _ := c.get(k, now.Add(50*time.Second)); prefetch {
+			t.Fatal("prefetch requested long before expiry")
+		}
+	}
+	if _, _, prefetch, _ := c.get(k, now.Add(95*time.Second)); !prefetch {
+		t.Error("hot response about to expire wasn't prefetched")
+	}
+	if _, _, prefetch, _ := c.get(k, now.Add(96*time.Second)); prefetch {
+		t.Error("prefetch requested twice")
+	}
+
+	// A refresh replaces the response and allows another prefetch.
+	refreshed := now.Add(97 * time.Second)
+	c.add(k, res, refreshed)
+	if _, _, prefetch, _ := c.get(k, refreshed.Add(95*time.Second)); !prefetch {
+		t.Error("refreshed hot response wasn't prefetched")
+	}
+
+	if _, _, _, ok := c.get(k, refreshed.Add(100*time.Second)); ok {
+		t.Error("hit after expiry")
+	}
+	if n := c.len(); n != 0 {
+		t.Errorf("expired response not removed; len = %d", n)
+	}
+
+	c.add(k, res, now)
+	c.flush()
+	if _, _, _, ok := c.get(k, now); ok {
+		t.Error("hit after flush")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	var c responseCache
+	now := time.Now()
+	res := testResponse{answerTTL: []uint32{100}}.build(t, 1, "foo.example.com.")
+	key := func(i int) cacheKey {
+		return cacheKey{name: fmt.Sprintf("%d.example.com.", i), typ: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	}
+	for i := 0; i < maxCacheEntries; i++ {
+		c.add(key(i), res, now)
+	}
+	c.get(key(0), now) // make it recently used
+	c.add(key(maxCacheEntries), res, now)
+
+	if n := c.len(); n != maxCacheEntries {
+		t.Errorf("len = %d; want %d", n, maxCacheEntries)
+	}
+	if _, _, _, ok := c.get(key(0), now); !ok {
+		t.Error("recently used response was evicted")
+	}
+	if _, _, _, ok := c.get(key(1), now); ok {
+		t.Error("least recently used response wasn't evicted")
+	}
+}
+
+func TestCacheKeyFor(t *testing.T) {
+	q := func(name string, typ dnsmessage.Type, edns bool) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+		b.StartAdditionals()
+		if edns {
+			var rh dnsmessage.ResourceHeader
+			rh.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+			b.OPTResource(rh, dnsmessage.OPTResource{})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	k1, ok := cacheKeyFor(q("Foo.Example.COM.", dnsmessage.TypeA, false), "r")
+	if !ok {
+		t.Fatal("query not cacheable")
+	}
+	want := cacheKey{route: "r", name: "foo.example.com.", typ: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+	if k1 != want {
+		t.Errorf("key = %+v; want %+v", k1, want)
+	}
+	if k2, _ := cacheKeyFor(q("foo.example.com.", dnsmessage.TypeA, true), "r"); k2 == k1 || !k2.edns {
+		t.Errorf("EDNS query key = %+v; want distinct with edns", k2)
+	}
+	if k3, _ := cacheKeyFor(q("foo.example.com.", dnsmessage.TypeAAAA, false), "r"); k3 == k1 {
+		t.Error("AAAA query has the same key as A query")
+	}
+	if _, ok := cacheKeyFor(testResponse{}.build(t, 1, "foo.example.com."), "r"); ok {
+		t.Error("response is cacheable as a query")
+	}
+}
+
+func TestCachedResponse(t *testing.T) {
+	res := testResponse{
+		rcode:     dnsmessage.RCodeNameError,
+		soaTTL:    300,
+		soaMinTTL: 30,
+		edns:      true,
+	}.build(t, 1, "foo.example.com.")
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 4321, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("FOO.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cachedResponse(res, query, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 4321 || msg.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("header = %+v; want ID 4321 and NXDOMAIN", msg.Header)
+	}
+	if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != "FOO.example.com." {
+		t.Errorf("questions = %v; want the query's", msg.Questions)
+	}
+	if len(msg.Authorities) != 1 || msg.Authorities[0].Header.TTL != 290 {
+		t.Errorf("authorities = %v; want SOA with TTL 290", msg.Authorities)
+	}
+	if len(msg.Additionals) != 1 || msg.Additionals[0].Header.TTL != optTTL(t, res) {
+		t.Errorf("OPT record modified: %v", msg.Additionals)
+	}
+}
+
+// optTTL returns the TTL field of the OPT record in res.
+func optTTL(t *testing.T, res []byte) uint32 {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return rr.Header.TTL
+		}
+	}
+	t.Fatal("no OPT record")
+	return 0
+}
+
+func TestForwarderCache(t *testing.T) {
+	var queries atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		queries.Add(1)
+		w.Header().Set("Content-Type", dohType)
+		w.Write(answerQuery(t, q))
+	}))
+	defer srv.Close()
+	f := newTestForwarder(t, srv)
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	rr := resolverAndDelay{name: &dnstype.Resolver{
+		Addr:                fmt.Sprintf("https://example.com:%d/dns-query", port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}}
+	forward := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ch := make(chan packet, 1)
+		if err := f.forwardWithDestChan(ctx, packet{bs: someDNSQuestion(t)}, ch, rr); err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, (<-ch).bs)
+	}
+
+	forward()
+	forward()
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries; want 1", n)
+	}
+
+	f.setRoutes(nil)
+	forward()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("after setRoutes, upstream got %d queries; want 2", n)
+	}
+}
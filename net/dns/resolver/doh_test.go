@@ -5,12 +5,27 @@
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/net/dns/publicdns"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
 )
 
 var testDoH = flag.Bool("test-doh", false, "do real DoH tests against the network")
@@ -97,3 +112,342 @@ func TestDoHV6Fallback(t *testing.T) {
 		}
 	}
 }
+
+// answerQuery returns a response to the DNS query q with a single A
+// record of 1.2.3.4.
+func answerQuery(t testing.TB, q []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   60,
+	}, dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}})
+	res, err := b.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return res
+}
+
+func checkAnswer(t testing.TB, res []byte) {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ID != someDNSID {
+		t.Errorf("response DNS ID = %v; want %v", h.ID, someDNSID)
+	}
+	p.SkipAllQuestions()
+	aa, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aa) != 1 {
+		t.Fatalf("got %d answers; want 1", len(aa))
+	}
+	if a, ok := aa[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{1, 2, 3, 4} {
+		t.Errorf("answer = %v; want A 1.2.3.4", aa[0].GoString())
+	}
+}
+
+// newTestForwarder returns a forwarder trusting the certificate of the
+// httptest TLS server srv.
+func newTestForwarder(t *testing.T, srv *httptest.Server) *forwarder {
+	netns.SetEnabled(false)
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	t.Cleanup(func() { f.Close() })
+	f.tlsRoots = x509.NewCertPool()
+	f.tlsRoots.AddCert(srv.Certificate())
+	return f
+}
+
+func sendTestQuery(t *testing.T, f *forwarder, r *dnstype.Resolver) ([]byte, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fq := &forwardQuery{
+		txid:           someDNSID,
+		packet:         someDNSQuestion(t),
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+	return f.send(ctx, fq, resolverAndDelay{name: r})
+}
+
+// newDoHServer returns a DNS-over-HTTPS server at /dns-query answering
+// with answerQuery. Its certificate is for example.com.
+func newDoHServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(answerQuery(t, q))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDoHBootstrap(t *testing.T) {
+	srv := newDoHServer(t)
+	f := newTestForwarder(t, srv)
+
+	// The test server's certificate is for example.com; reaching it
+	// requires using the bootstrap resolution.
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("https://example.com:%d/dns-query", port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	for i := 0; i < 2; i++ {
+		res, err := sendTestQuery(t, f, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, res)
+	}
+}
+
+// dotServer is a DNS-over-TLS stand-in answering with answerQuery.
+type dotServer struct {
+	t     *testing.T
+	ln    net.Listener
+	conns atomic.Int32 // accepted so far
+}
+
+func newDoTServer(t *testing.T, srv *httptest.Server) *dotServer {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &dotServer{t: t, ln: ln}
+	go s.serve()
+	return s
+}
+
+func (s *dotServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Add(1)
+		go func() {
+			defer c.Close()
+			for {
+				var lenBuf [2]byte
+				if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				res := answerQuery(s.t, q)
+				out := binary.BigEndian.AppendUint16(nil, uint16(len(res)))
+				if _, err := c.Write(append(out, res...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestDoT(t *testing.T) {
+	// The httptest server only provides the TLS config and certificate.
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	f := newTestForwarder(t, srv)
+	dot := newDoTServer(t, srv)
+
+	port := dot.ln.Addr().(*net.TCPAddr).Port
+	r := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://example.com:%d", port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	for i := 0; i < 3; i++ {
+		res, err := sendTestQuery(t, f, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, res)
+	}
+	if n := dot.conns.Load(); n != 1 {
+		t.Errorf("server accepted %d connections; want 1 reused", n)
+	}
+
+	// An upstream whose certificate doesn't match isn't used.
+	r = &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://wrong.example.net:%d", port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	if _, err := sendTestQuery(t, f, r); err == nil {
+		t.Error("query to upstream with mismatched certificate succeeded")
+	}
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	f := newTestForwarder(t, srv)
+
+	// Nothing is listening on the upstream's port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	r := &dnstype.Resolver{Addr: fmt.Sprintf("tls://127.0.0.1:%d", port)}
+
+	for i := 0; i < upstreamMaxFailures; i++ {
+		if _, err := sendTestQuery(t, f, r); err == nil {
+			t.Fatal("query to closed port succeeded")
+		}
+	}
+	h := f.upstreamHealth(r)
+	if err := h.check(time.Now()); err == nil {
+		t.Fatalf("upstream healthy after %d failures", upstreamMaxFailures)
+	}
+	if _, err := sendTestQuery(t, f, r); err == nil || !strings.Contains(err.Error(), "unhealthy") {
+		t.Errorf("query to unhealthy upstream = %v; want unhealthy error", err)
+	}
+
+	// After the backoff, the upstream is tried again, and one success
+	// makes it healthy.
+	later := time.Now().Add(upstreamUnhealthyBackoff)
+	if err := h.check(later); err != nil {
+		t.Errorf("upstream still skipped after backoff: %v", err)
+	}
+	if got := h.record(nil, later); got != healthRecovered {
+		t.Errorf("record(nil) = %v; want healthRecovered", got)
+	}
+	if err := h.check(later); err != nil {
+		t.Errorf("upstream skipped after success: %v", err)
+	}
+}
+
+func TestDoHResolvedViaPlainUpstream(t *testing.T) {
+	srv := newDoHServer(t)
+	f := newTestForwarder(t, srv)
+
+	// Without BootstrapResolution, the DoH server's name is resolved by
+	// the plain upstream of the default route, not the system resolver.
+	dnsSrv := serveDNS(t, "127.0.0.1:0", "example.com.", dnsHandler(netip.MustParseAddr("127.0.0.1")))
+	defer dnsSrv.Shutdown()
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: dnsSrv.PacketConn.LocalAddr().String()}},
+	})
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	r := &dnstype.Resolver{Addr: fmt.Sprintf("https://example.com:%d/dns-query", port)}
+	res, err := sendTestQuery(t, f, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, res)
+}
+
+func TestBootstrapUpstreams(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {
+			{Addr: "100.100.100.100"},
+			{Addr: "192.0.2.53"},
+			{Addr: "https://dns.example/dns-query"},
+		},
+		"corp.example.": {{Addr: "10.0.0.53"}},
+	})
+	want := netip.MustParseAddrPort("192.0.2.53:53")
+	got := f.bootstrapUpstreams()
+	if len(got) == 0 || got[0] != want {
+		t.Fatalf("bootstrapUpstreams = %v; want %v first", got, want)
+	}
+	for _, ipp := range got {
+		if ipp.Addr() == netip.MustParseAddr("100.100.100.100") || ipp.Addr() == netip.MustParseAddr("10.0.0.53") {
+			t.Errorf("bootstrapUpstreams = %v; want no MagicDNS or split DNS upstreams", got)
+		}
+	}
+}
+
+func TestUnhealthyFallback(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	f := newTestForwarder(t, srv)
+	dot := newDoTServer(t, srv)
+
+	port := dot.ln.Addr().(*net.TCPAddr).Port
+	up := &dnstype.Resolver{
+		Addr:                fmt.Sprintf("tls://example.com:%d", port),
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}
+	other := &dnstype.Resolver{Addr: "tls://192.0.2.1"}
+	plain := &dnstype.Resolver{Addr: "192.0.2.53"}
+	markUnhealthy := func(r *dnstype.Resolver, at time.Time) {
+		h := f.upstreamHealth(r)
+		for i := 0; i < upstreamMaxFailures; i++ {
+			h.record(errors.New("boom"), at)
+		}
+	}
+	now := time.Now()
+	markUnhealthy(up, now.Add(-time.Second))
+	markUnhealthy(other, now)
+
+	rs := func(rs ...*dnstype.Resolver) (ret []resolverAndDelay) {
+		for _, r := range rs {
+			ret = append(ret, resolverAndDelay{name: r})
+		}
+		return ret
+	}
+	if got := f.unhealthyFallback(rs(up, other), now); got != up {
+		t.Errorf("unhealthyFallback = %v; want the least recently failed", got)
+	}
+	if got := f.unhealthyFallback(rs(up, plain), now); got != nil {
+		t.Errorf("unhealthyFallback with a plain upstream = %v; want nil", got)
+	}
+	if got := f.unhealthyFallback(rs(up, &dnstype.Resolver{Addr: "tls://192.0.2.2"}), now); got != nil {
+		t.Errorf("unhealthyFallback with a healthy upstream = %v; want nil", got)
+	}
+
+	// A query whose only upstream is unhealthy still gets an answer
+	// from it, rather than SERVFAIL.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resc := make(chan packet, 1)
+	if err := f.forward(ctx, packet{bs: someDNSQuestion(t)}, resc, false, rs(up)...); err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, (<-resc).bs)
+	if err := f.upstreamHealth(up).check(time.Now()); err != nil {
+		t.Errorf("upstream still unhealthy after answering: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/types/dnstype"
+)
+
+const (
+	// dotDefaultPort is the port of DNS-over-TLS servers whose tls://
+	// address doesn't specify one (RFC 7858, section 3.1).
+	dotDefaultPort = "853"
+
+	// dotIdleTimeout is how long to keep idle connections open to
+	// DNS-over-TLS servers. Like dohTransportTimeout, it's arbitrary.
+	dotIdleTimeout = 30 * time.Second
+
+	// dotMaxIdleConns is the number of idle connections kept per
+	// DNS-over-TLS server.
+	dotMaxIdleConns = 4
+
+	// dotQueryTimeout bounds a DNS-over-TLS exchange when the caller's
+	// context has no deadline.
+	dotQueryTimeout = 10 * time.Second
+)
+
+// dotHostPort returns the host and host:port of the DNS-over-TLS resolver
+// address addr, of the form "tls://host[:port]".
+func dotHostPort(addr string) (host, hostPort string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "tls" || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid DNS-over-TLS address %q", addr)
+	}
+	port := u.Port()
+	if port == "" {
+		port = dotDefaultPort
+	}
+	return u.Hostname(), net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// dotPool is a pool of idle connections to a DNS-over-TLS server, so
+// that consecutive queries needn't each pay for a TCP and TLS handshake.
+// Each connection carries one query at a time.
+type dotPool struct {
+	hostPort string
+	dial     dnscache.DialContextFunc
+	tlsConf  *tls.Config
+
+	mu     sync.Mutex
+	idle   []*dotConn // most recently used last
+	closed bool
+}
+
+type dotConn struct {
+	*tls.Conn
+	idleSince time.Time
+}
+
+// getDoTPool returns the connection pool for the DNS-over-TLS resolver r,
+// creating it if needed.
+func (f *forwarder) getDoTPool(r *dnstype.Resolver) (*dotPool, error) {
+	host, hostPort, err := dotHostPort(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	key := upstreamKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.dotPools[key]; ok {
+		return p, nil
+	}
+	p := &dotPool{
+		hostPort: hostPort,
+		dial:     f.upstreamDialer(host, r.BootstrapResolution),
+		tlsConf: &tls.Config{
+			ServerName: host,
+			RootCAs:    f.tlsRoots,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	if f.dotPools == nil {
+		f.dotPools = map[string]*dotPool{}
+	}
+	f.dotPools[key] = p
+	return p, nil
+}
+
+// get returns an idle connection, or dials a new one. It reports whether
+// the connection was reused.
+func (p *dotPool) get(ctx context.Context) (c *dotConn, reused bool, err error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(c.idleSince) < dotIdleTimeout {
+			p.mu.Unlock()
+			return c, true, nil
+		}
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	nc, err := p.dial(ctx, "tcp", p.hostPort)
+	if err != nil {
+		return nil, false, err
+	}
+	tc := tls.Client(nc, p.tlsConf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, false, err
+	}
+	return &dotConn{Conn: tc}, false, nil
+}
+
+// put returns c to the pool of idle connections.
+func (p *dotPool) put(c *dotConn) {
+	c.SetDeadline(time.Time{})
+	c.idleSince = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= dotMaxIdleConns {
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// close closes the idle connections and stops the pool from keeping any
+// more. Queries in progress are unaffected.
+func (p *dotPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+}
+
+// exchange sends the DNS query packet over a pooled connection and
+// returns the response. Connections in use are added to closeOnCtxDone.
+func (p *dotPool) exchange(ctx context.Context, packet []byte, closeOnCtxDone *closePool) ([]byte, error) {
+	for {
+		c, reused, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		closeOnCtxDone.Add(c)
+		res, err := c.exchange(ctx, packet)
+		closeOnCtxDone.Remove(c)
+		if err == nil {
+			p.put(c)
+			return res, nil
+		}
+		c.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+		// The server may have closed the connection while it was idle;
+		// try again on another one.
+	}
+}
+
+var errDoTTxID = errors.New("DNS-over-TLS response txid doesn't match")
+
+// exchange writes the DNS query packet to c, prefixed with its length as
+// with DNS over TCP, and reads the response.
+func (c *dotConn) exchange(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) > 0xffff {
+		return nil, errors.New("DNS query too large")
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dotQueryTimeout)
+	}
+	c.SetDeadline(deadline)
+
+	req := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(req, uint16(len(packet)))
+	copy(req[2:], packet)
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(c, res); err != nil {
+		return nil, err
+	}
+	if getTxID(res) != getTxID(packet) {
+		return nil, errDoTTxID
+	}
+	return res, nil
+}
+
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, r *dnstype.Resolver) ([]byte, error) {
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	metricDNSFwdDoT.Add(1)
+	p, err := f.getDoTPool(r)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+	res, err := p.exchange(ctx, fq.packet, fq.closeOnCtxDone)
+	if err != nil {
+		metricDNSFwdDoTError.Add(1)
+		return nil, err
+	}
+	if truncatedFlagSet(res) {
+		metricDNSFwdTruncated.Add(1)
+	}
+	clampEDNSSize(res, maxResponseBytes)
+	return res, nil
+}
@@ -6,6 +6,8 @@
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -24,10 +26,13 @@
 	"tailscale.com/envknob"
 	"tailscale.com/net/dns/publicdns"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/dnsfallback"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/neterror"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/sockstats"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/logger"
@@ -183,9 +188,23 @@ type forwarder struct {
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
+	// cache holds responses from upstream resolvers. It's flushed when
+	// the routes or the network change.
+	cache          responseCache
+	unregisterLink func() // unregisters the netMon callback, if any
+
+	// queryLog, if non-nil, is where forwarded queries are logged.
+	queryLog *queryLog
+
 	mu sync.Mutex // guards following
 
-	dohClient map[string]*http.Client // urlBase -> client
+	dohClient map[string]*http.Client    // upstreamKey -> client
+	dotPools  map[string]*dotPool        // upstreamKey -> pool
+	health    map[string]*upstreamHealth // upstreamKey -> health of DoH and DoT upstreams
+
+	// tlsRoots, if non-nil, are the roots trusted for DoH and DoT
+	// upstreams instead of the system's. It's only set by tests.
+	tlsRoots *x509.CertPool
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -214,14 +233,29 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 		dialer:  dialer,
 	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
+	if netMon != nil {
+		f.unregisterLink = netMon.RegisterChangeCallback(f.onLinkChange)
+	}
 	return f
 }
 
 func (f *forwarder) Close() error {
+	if f.unregisterLink != nil {
+		f.unregisterLink()
+	}
 	f.ctxCancel()
 	return nil
 }
 
+// onLinkChange flushes the response cache when the network changes, as
+// answers may differ on the new network (split-horizon DNS, captive
+// portals, etc).
+func (f *forwarder) onLinkChange(changed bool, _ *interfaces.State) {
+	if changed {
+		f.cache.flush()
+	}
+}
+
 // resolversWithDelays maps from a set of DNS server names to a slice of a type
 // that included a startDelay, upgrading any well-known DoH (DNS-over-HTTP)
 // servers in the process, insert a DoH lookup first before UDP fallbacks.
@@ -342,6 +376,42 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	defer f.mu.Unlock()
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
+	f.pruneUpstreamsLocked()
+	f.cache.flush()
+}
+
+// pruneUpstreamsLocked forgets the clients, connection pools and health of
+// DoH and DoT upstreams that are no longer in use, closing their idle
+// connections.
+//
+// f.mu must be held.
+func (f *forwarder) pruneUpstreamsLocked() {
+	inUse := map[string]bool{}
+	for _, r := range f.routes {
+		for _, rr := range r.Resolvers {
+			inUse[upstreamKey(rr.name)] = true
+		}
+	}
+	for _, rr := range f.cloudHostFallback {
+		inUse[upstreamKey(rr.name)] = true
+	}
+	for k, c := range f.dohClient {
+		if !inUse[k] {
+			c.CloseIdleConnections()
+			delete(f.dohClient, k)
+		}
+	}
+	for k, p := range f.dotPools {
+		if !inUse[k] {
+			p.close()
+			delete(f.dotPools, k)
+		}
+	}
+	for k := range f.health {
+		if !inUse[k] {
+			delete(f.health, k)
+		}
+	}
 }
 
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
@@ -361,6 +431,129 @@ func (f *forwarder) packetListener(ip netip.Addr) (nettype.PacketListenerWithNet
 	return nettype.MakePacketListenerWithNetIP(lc), nil
 }
 
+// upstreamKey returns the key of the DoH or DoT upstream r in the
+// forwarder's per-upstream state. Upstreams with the same address but a
+// different BootstrapResolution are dialed differently, so their keys
+// differ.
+func upstreamKey(r *dnstype.Resolver) string {
+	if len(r.BootstrapResolution) == 0 {
+		return r.Addr
+	}
+	var sb strings.Builder
+	sb.WriteString(r.Addr)
+	for _, ip := range r.BootstrapResolution {
+		sb.WriteByte(' ')
+		sb.WriteString(ip.String())
+	}
+	return sb.String()
+}
+
+// upstreamDialer returns a func to dial TCP connections to the DoH or DoT
+// server host. It dials bootstrap if non-empty, and otherwise host as
+// resolved by bootstrapResolver, or failing that by dnsfallback.
+//
+// The system's DNS resolver isn't used: when MagicDNS is the system's
+// resolver, that would loop back to this forwarder.
+func (f *forwarder) upstreamDialer(host string, bootstrap []netip.Addr) dnscache.DialContextFunc {
+	nsDialer := netns.NewDialer(f.logf, f.netMon)
+	r := &dnscache.Resolver{
+		Forward:          f.bootstrapResolver(),
+		LookupIPFallback: dnsfallback.MakeLookupFunc(f.logf, f.netMon),
+		Logf:             f.logf,
+		NetMon:           f.netMon,
+		UseLastGood:      true,
+	}
+	if len(bootstrap) > 0 {
+		r.SingleHost = host
+		r.SingleHostStaticResult = bootstrap
+	}
+	dial := dnscache.Dialer(nsDialer.DialContext, r)
+	return func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(netw, "tcp") {
+			return nil, fmt.Errorf("unexpected network %q", netw)
+		}
+		return dial(ctx, netw, addr)
+	}
+}
+
+var errNoBootstrapUpstreams = errors.New("no plain DNS upstreams to resolve DoH or DoT upstreams with")
+
+// bootstrapResolver returns a resolver that sends its queries to the plain
+// DNS upstreams of the default route (see bootstrapUpstreams) rather than
+// to the system's resolver.
+func (f *forwarder) bootstrapResolver() *net.Resolver {
+	nsDialer := netns.NewDialer(f.logf, f.netMon)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			ups := f.bootstrapUpstreams()
+			if len(ups) == 0 {
+				return nil, errNoBootstrapUpstreams
+			}
+			return nsDialer.DialContext(ctx, network, ups[rand.Intn(len(ups))].String())
+		},
+	}
+}
+
+// bootstrapUpstreams returns the plain DNS upstreams of the default route
+// and the cloud host's resolvers. With MagicDNS as the system's resolver,
+// these are typically the OS's resolvers from before it took over.
+func (f *forwarder) bootstrapUpstreams() []netip.AddrPort {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ret []netip.AddrPort
+	add := func(rs []resolverAndDelay) {
+		for _, rr := range rs {
+			ipp, ok := rr.name.IPPort()
+			if !ok || ipp.Addr() == tsaddr.TailscaleServiceIP() || ipp.Addr() == tsaddr.TailscaleServiceIPv6() {
+				continue
+			}
+			ret = append(ret, ipp)
+		}
+	}
+	for _, r := range f.routes {
+		if r.Suffix == "." {
+			add(r.Resolvers)
+		}
+	}
+	add(f.cloudHostFallback)
+	return ret
+}
+
+// getDoHClient returns an HTTP client for the DoH upstream r.
+//
+// Well-known providers are dialed at the IPs the publicdns package knows
+// for them. Other servers are dialed at r.BootstrapResolution or, if
+// that's empty, at what upstreamDialer resolves them to.
+func (f *forwarder) getDoHClient(r *dnstype.Resolver) (*http.Client, error) {
+	if c, ok := f.getKnownDoHClientForProvider(r.Addr); ok {
+		return c, nil
+	}
+	u, err := url.Parse(r.Addr)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DNS-over-HTTPS URL %q", r.Addr)
+	}
+	key := upstreamKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.dohClient[key]; ok {
+		return c, nil
+	}
+	c := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   dohTransportTimeout,
+			DialContext:       f.upstreamDialer(u.Hostname(), r.BootstrapResolution),
+			TLSClientConfig:   &tls.Config{RootCAs: f.tlsRoots},
+		},
+	}
+	if f.dohClient == nil {
+		f.dohClient = map[string]*http.Client{}
+	}
+	f.dohClient[key] = c
+	return c, nil
+}
+
 // getKnownDoHClientForProvider returns an HTTP client for a specific DoH
 // provider named by its DoH base URL (like "https://dns.google/dns-query").
 //
@@ -458,29 +651,171 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 	if strings.HasPrefix(rr.name.Addr, "http://") {
 		return f.sendDoH(ctx, rr.name.Addr, f.dialer.PeerAPIHTTPClient(), fq.packet)
 	}
-	if strings.HasPrefix(rr.name.Addr, "https://") {
-		// Only known DoH providers are supported currently. Specifically, we
-		// only support DoH providers where we can TCP connect to them on port
-		// 443 at the same IP address they serve normal UDP DNS from (1.1.1.1,
-		// 8.8.8.8, 9.9.9.9, etc.) That's why OpenDNS and custom DoH providers
-		// aren't currently supported. There's no backup DNS resolution path for
-		// them.
-		urlBase := rr.name.Addr
-		if hc, ok := f.getKnownDoHClientForProvider(urlBase); ok {
-			return f.sendDoH(ctx, urlBase, hc, fq.packet)
+	if isEncryptedUpstream(rr.name) {
+		return f.sendEncrypted(ctx, fq, rr.name)
+	}
+
+	return f.sendUDP(ctx, fq, rr)
+}
+
+// sendEncrypted sends packet to the DoH or DoT upstream r, unless r has
+// been failing, in which case it fails fast so the query's other upstreams
+// answer without waiting on it. If all of them have been failing, the one
+// picked by unhealthyFallback is tried anyway.
+func (f *forwarder) sendEncrypted(ctx context.Context, fq *forwardQuery, r *dnstype.Resolver) ([]byte, error) {
+	h := f.upstreamHealth(r)
+	if err := h.check(time.Now()); err != nil && fq.retryUnhealthy != r {
+		metricDNSFwdErrorUnhealthy.Add(1)
+		return nil, err
+	}
+
+	var res []byte
+	var err error
+	if strings.HasPrefix(r.Addr, "tls://") {
+		res, err = f.sendDoT(ctx, fq, r)
+	} else {
+		var hc *http.Client
+		hc, err = f.getDoHClient(r)
+		if err != nil {
+			metricDNSFwdErrorType.Add(1)
+			return nil, err
 		}
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
+		res, err = f.sendDoH(ctx, r.Addr, hc, fq.packet)
 	}
-	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+	if err != nil && ctx.Err() != nil {
+		// Another upstream answered first, or the query was abandoned;
+		// that says nothing about this upstream.
+		return nil, err
 	}
+	switch h.record(err, time.Now()) {
+	case healthBecameUnhealthy:
+		f.logf("upstream %s unhealthy, skipping it for %v: %v", r.Addr, upstreamUnhealthyBackoff, err)
+	case healthRecovered:
+		f.logf("upstream %s healthy again", r.Addr)
+	}
+	return res, err
+}
 
-	return f.sendUDP(ctx, fq, rr)
+// isEncryptedUpstream reports whether r is a DoH or DoT upstream, whose
+// health is tracked.
+func isEncryptedUpstream(r *dnstype.Resolver) bool {
+	return strings.HasPrefix(r.Addr, "https://") || strings.HasPrefix(r.Addr, "tls://")
+}
+
+// unhealthyFallback returns the upstream to query despite it being
+// unhealthy, if all of resolvers are unhealthy DoH or DoT upstreams at
+// now: the one that failed least recently. Otherwise it returns nil, as
+// there's a healthy upstream to answer.
+func (f *forwarder) unhealthyFallback(resolvers []resolverAndDelay, now time.Time) *dnstype.Resolver {
+	var pick *dnstype.Resolver
+	var pickUntil time.Time
+	for _, rr := range resolvers {
+		if !isEncryptedUpstream(rr.name) {
+			return nil
+		}
+		until := f.upstreamHealth(rr.name).unhealthyUntil(now)
+		if until.IsZero() {
+			return nil
+		}
+		if pick == nil || until.Before(pickUntil) {
+			pick, pickUntil = rr.name, until
+		}
+	}
+	return pick
+}
+
+// upstreamHealth returns the health of the DoH or DoT upstream r.
+func (f *forwarder) upstreamHealth(r *dnstype.Resolver) *upstreamHealth {
+	key := upstreamKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.health[key]
+	if !ok {
+		h = new(upstreamHealth)
+		if f.health == nil {
+			f.health = map[string]*upstreamHealth{}
+		}
+		f.health[key] = h
+	}
+	return h
+}
+
+const (
+	// upstreamMaxFailures is the number of consecutive failed queries
+	// after which a DoH or DoT upstream is considered unhealthy.
+	upstreamMaxFailures = 3
+
+	// upstreamUnhealthyBackoff is how long an unhealthy upstream is
+	// skipped before it's tried again.
+	upstreamUnhealthyBackoff = 30 * time.Second
+)
+
+// upstreamHealth tracks the recent failures of a DoH or DoT upstream, so
+// that a broken one doesn't slow down every query it's raced in.
+type upstreamHealth struct {
+	mu        sync.Mutex
+	failures  int // consecutive
+	lastErr   error
+	skipUntil time.Time
+}
+
+type healthChange uint8
+
+const (
+	healthUnchanged healthChange = iota
+	healthBecameUnhealthy
+	healthRecovered
+)
+
+// check returns an error if the upstream should be skipped at now.
+func (h *upstreamHealth) check(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Before(h.skipUntil) {
+		return fmt.Errorf("upstream unhealthy after %d consecutive failures: %w", h.failures, h.lastErr)
+	}
+	return nil
+}
+
+// unhealthyUntil returns when the upstream stops being skipped, or the
+// zero time if it isn't skipped at now.
+func (h *upstreamHealth) unhealthyUntil(now time.Time) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Before(h.skipUntil) {
+		return h.skipUntil
+	}
+	return time.Time{}
+}
+
+// record records the result of a query to the upstream at now.
+func (h *upstreamHealth) record(err error, now time.Time) healthChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		wasUnhealthy := h.failures >= upstreamMaxFailures
+		h.failures = 0
+		h.lastErr = nil
+		h.skipUntil = time.Time{}
+		if wasUnhealthy {
+			return healthRecovered
+		}
+		return healthUnchanged
+	}
+	h.failures++
+	h.lastErr = err
+	if h.failures < upstreamMaxFailures {
+		return healthUnchanged
+	}
+	h.skipUntil = now.Add(upstreamUnhealthyBackoff)
+	if h.failures == upstreamMaxFailures {
+		return healthBecameUnhealthy
+	}
+	return healthUnchanged
 }
 
 var errServerFailure = errors.New("response code indicates server issue")
+var errNoUpstreams = errors.New("no upstream resolvers set")
 
 func (f *forwarder) sendUDP(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) (ret []byte, err error) {
 	ipp, ok := rr.name.IPPort()
@@ -577,18 +912,23 @@ func (f *forwarder) sendUDP(ctx context.Context, fq *forwardQuery, rr resolverAn
 	return out, nil
 }
 
-// resolvers returns the resolvers to use for domain.
-func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+// routeCloudFallback is the route of queries forwarded to
+// forwarder.cloudHostFallback.
+const routeCloudFallback = "cloud-fallback"
+
+// resolvers returns the resolvers to use for domain, and the suffix of
+// the route they're from.
+func (f *forwarder) resolvers(domain dnsname.FQDN) (route string, _ []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	cloudHostFallback := f.cloudHostFallback
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix.WithTrailingDot(), route.Resolvers
 		}
 	}
-	return cloudHostFallback // or nil if no fallback
+	return routeCloudFallback, cloudHostFallback // or nil if no fallback
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
@@ -610,6 +950,10 @@ type forwardQuery struct {
 	// goroutine/memory cost.
 	closeOnCtxDone *closePool
 
+	// retryUnhealthy, if non-nil, is the DoH or DoT upstream to query
+	// even though it's unhealthy, as all of the query's upstreams are.
+	retryUnhealthy *dnstype.Resolver
+
 	// TODO(bradfitz): add race delay state:
 	// mu sync.Mutex
 	// ...
@@ -624,13 +968,28 @@ type forwardQuery struct {
 // If resolvers is non-empty, it's used explicitly (notably, for exit
 // node DNS proxy queries), otherwise f.resolvers is used.
 func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, responseChan chan<- packet, resolvers ...resolverAndDelay) error {
+	return f.forward(ctx, query, responseChan, true, resolvers...)
+}
+
+// forward is forwardWithDestChan, optionally bypassing the response cache.
+// Responses received from upstream are cached either way.
+func (f *forwarder) forward(ctx context.Context, query packet, responseChan chan<- packet, useCache bool, resolvers ...resolverAndDelay) error {
 	metricDNSFwd.Add(1)
+	start := time.Now()
 	domain, err := nameFromQuery(query.bs)
 	if err != nil {
 		metricDNSFwdErrorName.Add(1)
 		return err
 	}
 
+	// Prefetches aren't logged, as no client asked for them.
+	route := routeExplicit
+	logQuery := func(resolution, upstream string, res []byte, err error) {
+		if useCache {
+			f.queryLog.logQuery(start, query.bs, resolution, route, upstream, res, err)
+		}
+	}
+
 	// Guarantee that the ctx we use below is done when this function returns.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -663,7 +1022,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	clampEDNSSize(query.bs, maxResponseBytes)
 
 	if len(resolvers) == 0 {
-		resolvers = f.resolvers(domain)
+		route, resolvers = f.resolvers(domain)
 		if len(resolvers) == 0 {
 			metricDNSFwdErrorNoUpstream.Add(1)
 			f.logf("no upstream resolvers set, returning SERVFAIL")
@@ -674,24 +1033,45 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				// nothing we can do if parsing failed. Just drop the packet.
 				return nil
 			}
+			logQuery(resolutionForwarded, "", res.bs, errNoUpstreams)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case responseChan <- res:
+				return nil
+			}
+		}
+	}
+
+	ck, cacheable := cacheKeyFor(query.bs, routeKey(resolvers))
+	if cacheable && useCache {
+		if res, ok := f.cachedResponse(ck, query, resolvers); ok {
+			logQuery(resolutionCached, "", res.bs, nil)
 			select {
 			case <-ctx.Done():
+				metricDNSFwdErrorContext.Add(1)
 				return ctx.Err()
 			case responseChan <- res:
 				return nil
 			}
 		}
+		metricDNSFwdCacheMiss.Add(1)
 	}
 
 	fq := &forwardQuery{
 		txid:           getTxID(query.bs),
 		packet:         query.bs,
 		closeOnCtxDone: new(closePool),
+		retryUnhealthy: f.unhealthyFallback(resolvers, time.Now()),
 	}
 	defer fq.closeOnCtxDone.Close()
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
-	errc := make(chan error, 1)  // it's fine buffered or not too
+	type upstreamResponse struct {
+		bs       []byte
+		upstream string // address of the resolver that sent bs
+	}
+	resc := make(chan upstreamResponse, 1) // it's fine buffered or not
+	errc := make(chan error, 1)            // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
 			if rr.startDelay > 0 {
@@ -712,7 +1092,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- upstreamResponse{resb, rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -722,7 +1102,12 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	var numErr int
 	for {
 		select {
-		case v := <-resc:
+		case r := <-resc:
+			v := r.bs
+			if cacheable {
+				f.cache.add(ck, bytes.Clone(v), time.Now())
+			}
+			logQuery(resolutionForwarded, r.upstream, v, nil)
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
@@ -737,6 +1122,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 			}
 			numErr++
 			if numErr == len(resolvers) {
+				logQuery(resolutionForwarded, "", nil, firstErr)
 				if firstErr == errServerFailure {
 					res, err := servfailResponse(query)
 					if err != nil {
@@ -757,8 +1143,10 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 			metricDNSFwdErrorContext.Add(1)
 			if firstErr != nil {
 				metricDNSFwdErrorContextGotError.Add(1)
+				logQuery(resolutionForwarded, "", nil, firstErr)
 				return firstErr
 			}
+			logQuery(resolutionForwarded, "", nil, ctx.Err())
 			return ctx.Err()
 		}
 	}
@@ -766,6 +1154,37 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 
 var initListenConfig func(_ *net.ListenConfig, _ *netmon.Monitor, tunName string) error
 
+// cachedResponse returns the cached response to query, if any. If the
+// response is hot and about to expire, it also starts refreshing it from
+// resolvers in the background.
+func (f *forwarder) cachedResponse(k cacheKey, query packet, resolvers []resolverAndDelay) (res packet, ok bool) {
+	cached, age, prefetch, ok := f.cache.get(k, time.Now())
+	if !ok {
+		return packet{}, false
+	}
+	bs, err := cachedResponse(cached, query.bs, age)
+	if err != nil {
+		f.logf("building cached response: %v", err)
+		return packet{}, false
+	}
+	metricDNSFwdCacheHit.Add(1)
+	if prefetch {
+		metricDNSFwdCachePrefetch.Add(1)
+		go f.prefetch(packet{bytes.Clone(query.bs), query.addr}, resolvers)
+	}
+	return packet{bs, query.addr}, true
+}
+
+// prefetch forwards query to resolvers, bypassing the cache, to refresh
+// its cached response before it expires.
+func (f *forwarder) prefetch(query packet, resolvers []resolverAndDelay) {
+	ctx, cancel := context.WithTimeout(f.ctx, dnsQueryTimeout)
+	defer cancel()
+	if err := f.forward(ctx, query, make(chan packet, 1), false, resolvers...); err != nil {
+		f.logf("[v1] prefetching response: %v", err)
+	}
+}
+
 // nameFromQuery extracts the normalized query name from bs.
 func nameFromQuery(bs []byte) (dnsname.FQDN, error) {
 	var parser dns.Parser
@@ -0,0 +1,250 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/ringbuffer"
+	"tailscale.com/util/set"
+)
+
+// queryLogSize is the number of recent queries kept in the query log.
+const queryLogSize = 1000
+
+// Resolutions of queries in the query log. See dnstype.QueryLogEntry.
+const (
+	resolutionLocal     = "local"
+	resolutionBlocked   = "blocked"
+	resolutionCached    = "cached"
+	resolutionForwarded = "forwarded"
+)
+
+// routeExplicit is the route of queries forwarded to resolvers chosen by
+// the caller, such as the OS resolver for exit node DNS queries, rather
+// than by the configured routes.
+const routeExplicit = "explicit"
+
+// queryLog is a log of recent DNS queries, with per-route statistics of
+// forwarded ones. The zero value is ready for use.
+type queryLog struct {
+	mu       sync.Mutex
+	ents     *ringbuffer.RingBuffer[dnstype.QueryLogEntry] // lazily created
+	watchers set.Set[chan<- dnstype.QueryLogEntry]
+	routes   map[string]*routeStats // by route suffix
+}
+
+// add adds e to the log and sends it to watchers, dropping it for those
+// that aren't keeping up.
+func (q *queryLog) add(e dnstype.QueryLogEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ents == nil {
+		q.ents = ringbuffer.New[dnstype.QueryLogEntry](queryLogSize)
+	}
+	q.ents.Add(e)
+	if e.Resolution == resolutionForwarded {
+		rs, ok := q.routes[e.Route]
+		if !ok {
+			rs = &routeStats{rcodes: map[string]int64{}}
+			if q.routes == nil {
+				q.routes = map[string]*routeStats{}
+			}
+			q.routes[e.Route] = rs
+		}
+		rs.add(e)
+	}
+	for ch := range q.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watch returns the logged queries and registers ch to receive new ones
+// until unregister is called.
+func (q *queryLog) watch(ch chan<- dnstype.QueryLogEntry) (backlog []dnstype.QueryLogEntry, unregister func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.watchers == nil {
+		q.watchers = set.Set[chan<- dnstype.QueryLogEntry]{}
+	}
+	q.watchers.Add(ch)
+	return q.ents.GetAll(), func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.watchers, ch)
+	}
+}
+
+// latencyBuckets are the upper bounds of the buckets of the per-route
+// latency histograms.
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// routeStats are statistics of the queries forwarded with a route.
+type routeStats struct {
+	buckets [len(latencyBuckets)]int64 // non-cumulative
+	count   int64
+	sum     time.Duration
+	rcodes  map[string]int64 // by RCode, or "error" if none
+}
+
+func (rs *routeStats) add(e dnstype.QueryLogEntry) {
+	rs.count++
+	rs.sum += e.Latency
+	for i, b := range latencyBuckets {
+		if e.Latency <= b {
+			rs.buckets[i]++
+			break
+		}
+	}
+	rcode := e.RCode
+	if e.Err != "" || rcode == "" {
+		rcode = "error"
+	}
+	rs.rcodes[rcode]++
+}
+
+// writePrometheus writes the per-route latency histograms and response
+// counts to w in the Prometheus text exposition format.
+func (q *queryLog) writePrometheus(w io.Writer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.routes) == 0 {
+		return
+	}
+	routes := make([]string, 0, len(q.routes))
+	for r := range q.routes {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+
+	io.WriteString(w, "# TYPE dns_fwd_route_latency_seconds histogram\n")
+	for _, r := range routes {
+		rs := q.routes[r]
+		var cum int64
+		for i, b := range latencyBuckets {
+			cum += rs.buckets[i]
+			fmt.Fprintf(w, "dns_fwd_route_latency_seconds_bucket{route=%q,le=%q} %d\n", r, strconv.FormatFloat(b.Seconds(), 'f', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "dns_fwd_route_latency_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", r, rs.count)
+		fmt.Fprintf(w, "dns_fwd_route_latency_seconds_sum{route=%q} %v\n", r, rs.sum.Seconds())
+		fmt.Fprintf(w, "dns_fwd_route_latency_seconds_count{route=%q} %d\n", r, rs.count)
+	}
+	io.WriteString(w, "# TYPE dns_fwd_route_responses counter\n")
+	for _, r := range routes {
+		rs := q.routes[r]
+		rcodes := make([]string, 0, len(rs.rcodes))
+		for rc := range rs.rcodes {
+			rcodes = append(rcodes, rc)
+		}
+		sort.Strings(rcodes)
+		for _, rc := range rcodes {
+			fmt.Fprintf(w, "dns_fwd_route_responses{route=%q,rcode=%q} %d\n", r, rc, rs.rcodes[rc])
+		}
+	}
+}
+
+// WatchQueryLog returns the recent DNS queries handled by r, oldest
+// first, and registers ch to receive queries handled from now on until
+// unregister is called. Queries are dropped rather than blocking if ch
+// isn't ready to receive.
+func (r *Resolver) WatchQueryLog(ch chan<- dnstype.QueryLogEntry) (backlog []dnstype.QueryLogEntry, unregister func()) {
+	return r.queryLog.watch(ch)
+}
+
+// WritePrometheus writes r's per-route latency histograms and response
+// counts of forwarded queries to w in the Prometheus text exposition
+// format.
+func (r *Resolver) WritePrometheus(w io.Writer) {
+	r.queryLog.writePrometheus(w)
+}
+
+// logQuery logs query, received at start and answered with the response
+// res or failed with err. It does nothing if q is nil.
+func (q *queryLog) logQuery(start time.Time, query []byte, resolution, route, upstream string, res []byte, err error) {
+	if q == nil {
+		return
+	}
+	var p dns.Parser
+	if _, perr := p.Start(query); perr != nil {
+		return
+	}
+	question, perr := p.Question()
+	if perr != nil {
+		return
+	}
+	e := newQueryLogEntry(start, resolution, question, res)
+	e.Route = route
+	e.Upstream = upstream
+	if err != nil {
+		e.Err = err.Error()
+	}
+	q.add(e)
+}
+
+// newQueryLogEntry returns a query log entry for the query q, received at
+// start and answered with the response res, if any.
+func newQueryLogEntry(start time.Time, resolution string, q dns.Question, res []byte) dnstype.QueryLogEntry {
+	e := dnstype.QueryLogEntry{
+		Time:       start,
+		Name:       q.Name.String(),
+		Type:       typeString(q.Type),
+		Resolution: resolution,
+		Latency:    time.Since(start),
+	}
+	if len(res) >= headerBytes {
+		e.RCode = rcodeString(getRCode(res))
+	}
+	return e
+}
+
+// typeString returns the name of the DNS type t, as in zone files.
+func typeString(t dns.Type) string {
+	if s, ok := strings.CutPrefix(t.String(), "Type"); ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// rcodeString returns the conventional name of the DNS response code rc.
+func rcodeString(rc dns.RCode) string {
+	switch rc {
+	case dns.RCodeSuccess:
+		return "NOERROR"
+	case dns.RCodeFormatError:
+		return "FORMERR"
+	case dns.RCodeServerFailure:
+		return "SERVFAIL"
+	case dns.RCodeNameError:
+		return "NXDOMAIN"
+	case dns.RCodeNotImplemented:
+		return "NOTIMP"
+	case dns.RCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(rc))
+}
@@ -0,0 +1,147 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+func TestQueryLogLocal(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+
+	ch := make(chan dnstype.QueryLogEntry, 1)
+	backlog, unregister := r.WatchQueryLog(ch)
+	defer unregister()
+	if len(backlog) != 0 {
+		t.Fatalf("backlog = %v; want empty", backlog)
+	}
+
+	if _, err := r.Query(context.Background(), dnspacket("test1.ipn.dev.", dns.TypeA, noEdns), netip.AddrPort{}); err != nil {
+		t.Fatal(err)
+	}
+	e := <-ch
+	if e.Name != "test1.ipn.dev." || e.Type != "A" || e.Resolution != resolutionLocal || e.RCode != "NOERROR" || e.Route != "" {
+		t.Errorf("entry = %+v; want local NOERROR A query for test1.ipn.dev.", e)
+	}
+
+	// Local queries aren't in the per-route metrics.
+	var sb strings.Builder
+	r.WritePrometheus(&sb)
+	if sb.Len() != 0 {
+		t.Errorf("metrics = %q; want none", sb.String())
+	}
+}
+
+func TestQueryLogForwarded(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(answerQuery(t, q))
+	}))
+	defer srv.Close()
+	f := newTestForwarder(t, srv)
+	f.queryLog = new(queryLog)
+
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	addr := fmt.Sprintf("https://example.com:%d/dns-query", port)
+	rr := resolverAndDelay{name: &dnstype.Resolver{
+		Addr:                addr,
+		BootstrapResolution: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+	}}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ch := make(chan packet, 1)
+		err := f.forwardWithDestChan(ctx, packet{bs: someDNSQuestion(t)}, ch, rr)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backlog, unregister := f.queryLog.watch(make(chan dnstype.QueryLogEntry))
+	unregister()
+	if len(backlog) != 2 {
+		t.Fatalf("got %d entries; want 2", len(backlog))
+	}
+	if e := backlog[0]; e.Name != "tailscale.com." || e.Resolution != resolutionForwarded || e.Route != routeExplicit || e.Upstream != addr || e.RCode != "NOERROR" {
+		t.Errorf("first entry = %+v; want forwarded to %s", e, addr)
+	}
+	if e := backlog[1]; e.Resolution != resolutionCached || e.Upstream != "" || e.RCode != "NOERROR" {
+		t.Errorf("second entry = %+v; want cached", e)
+	}
+
+	var sb strings.Builder
+	f.queryLog.writePrometheus(&sb)
+	for _, want := range []string{
+		"# TYPE dns_fwd_route_latency_seconds histogram\n",
+		`dns_fwd_route_latency_seconds_bucket{route="explicit",le="+Inf"} 1` + "\n",
+		`dns_fwd_route_latency_seconds_count{route="explicit"} 1` + "\n",
+		`dns_fwd_route_responses{route="explicit",rcode="NOERROR"} 1` + "\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("metrics missing %q; got:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestQueryLogRouteStats(t *testing.T) {
+	var q queryLog
+	q.add(dnstype.QueryLogEntry{Resolution: resolutionForwarded, Route: ".", RCode: "NOERROR", Latency: 3 * time.Millisecond})
+	q.add(dnstype.QueryLogEntry{Resolution: resolutionForwarded, Route: ".", RCode: "NXDOMAIN", Latency: 30 * time.Millisecond})
+	q.add(dnstype.QueryLogEntry{Resolution: resolutionForwarded, Route: ".", Err: "timeout", Latency: 20 * time.Second})
+	q.add(dnstype.QueryLogEntry{Resolution: resolutionCached, Route: "."})
+
+	var sb strings.Builder
+	q.writePrometheus(&sb)
+	for _, want := range []string{
+		`dns_fwd_route_latency_seconds_bucket{route=".",le="0.001"} 0`,
+		`dns_fwd_route_latency_seconds_bucket{route=".",le="0.005"} 1`,
+		`dns_fwd_route_latency_seconds_bucket{route=".",le="0.05"} 2`,
+		`dns_fwd_route_latency_seconds_bucket{route=".",le="10"} 2`,
+		`dns_fwd_route_latency_seconds_bucket{route=".",le="+Inf"} 3`,
+		`dns_fwd_route_latency_seconds_sum{route="."} 20.033`,
+		`dns_fwd_route_responses{route=".",rcode="NOERROR"} 1`,
+		`dns_fwd_route_responses{route=".",rcode="NXDOMAIN"} 1`,
+		`dns_fwd_route_responses{route=".",rcode="error"} 1`,
+	} {
+		if !strings.Contains(sb.String(), want+"\n") {
+			t.Errorf("metrics missing %q; got:\n%s", want, sb.String())
+		}
+	}
+}
+
+func TestQueryLogSize(t *testing.T) {
+	var q queryLog
+	ch := make(chan dnstype.QueryLogEntry) // never ready; entries are dropped
+	_, unregister := q.watch(ch)
+	defer unregister()
+	for i := 0; i < queryLogSize+10; i++ {
+		q.add(dnstype.QueryLogEntry{Name: fmt.Sprint(i)})
+	}
+	backlog, unregister2 := q.watch(make(chan dnstype.QueryLogEntry))
+	unregister2()
+	if len(backlog) != queryLogSize {
+		t.Fatalf("got %d entries; want %d", len(backlog), queryLogSize)
+	}
+	if backlog[0].Name != "10" {
+		t.Errorf("oldest entry = %q; want %q", backlog[0].Name, "10")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+// maxCNAMEChain is the maximum number of local CNAME records followed
+// when answering a query, to bound the work done on CNAME loops.
+const maxCNAMEChain = 8
+
+// Record is a DNS record, other than A or AAAA, that the resolver
+// answers authoritatively. The fields used depend on Type.
+type Record struct {
+	// Type is the record type: dns.TypeCNAME, dns.TypeTXT, dns.TypeMX
+	// or dns.TypeSRV.
+	Type dns.Type
+
+	// Target is the canonical name of a CNAME record, the mail
+	// exchange of an MX record, or the target host of an SRV record.
+	Target dnsname.FQDN
+
+	// TXT is the text of a TXT record, as character strings of at most
+	// 255 bytes each.
+	TXT []string
+
+	// Priority is the preference of an MX record or the priority of an
+	// SRV record.
+	Priority uint16
+
+	// Weight and Port are the weight and port of an SRV record.
+	Weight uint16
+	Port   uint16
+}
+
+// String returns r in DNS zone file presentation format, without owner
+// name, TTL or class.
+func (r Record) String() string {
+	switch r.Type {
+	case dns.TypeCNAME:
+		return "CNAME " + r.Target.WithTrailingDot()
+	case dns.TypeTXT:
+		var sb strings.Builder
+		sb.WriteString("TXT")
+		for _, s := range r.TXT {
+			sb.WriteByte(' ')
+			sb.WriteString(strconv.Quote(s))
+		}
+		return sb.String()
+	case dns.TypeMX:
+		return fmt.Sprintf("MX %d %s", r.Priority, r.Target.WithTrailingDot())
+	case dns.TypeSRV:
+		return fmt.Sprintf("SRV %d %d %d %s", r.Priority, r.Weight, r.Port, r.Target.WithTrailingDot())
+	}
+	return fmt.Sprintf("%v", r.Type)
+}
+
+// ParseRecord parses a record of type typ ("CNAME", "TXT", "MX" or "SRV",
+// case insensitive) from its value, which is in the format of the record
+// data in a zone file:
+//
+//	CNAME: target
+//	TXT:   text (not quoted; values over 255 bytes are split)
+//	MX:    preference exchange
+//	SRV:   priority weight port target
+func ParseRecord(typ, value string) (Record, error) {
+	switch strings.ToUpper(typ) {
+	case "CNAME":
+		target, err := dnsname.ToFQDN(value)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid CNAME target: %w", err)
+		}
+		return Record{Type: dns.TypeCNAME, Target: target}, nil
+	case "TXT":
+		r := Record{Type: dns.TypeTXT}
+		for len(value) > 255 {
+			r.TXT = append(r.TXT, value[:255])
+			value = value[255:]
+		}
+		r.TXT = append(r.TXT, value)
+		return r, nil
+	case "MX":
+		f := strings.Fields(value)
+		if len(f) != 2 {
+			return Record{}, fmt.Errorf("invalid MX record %q; want \"preference exchange\"", value)
+		}
+		pref, err := strconv.ParseUint(f[0], 10, 16)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid MX preference %q", f[0])
+		}
+		target, err := dnsname.ToFQDN(f[1])
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid MX exchange: %w", err)
+		}
+		return Record{Type: dns.TypeMX, Priority: uint16(pref), Target: target}, nil
+	case "SRV":
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return Record{}, fmt.Errorf("invalid SRV record %q; want \"priority weight port target\"", value)
+		}
+		var nums [3]uint16
+		for i, s := range f[:3] {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return Record{}, fmt.Errorf("invalid SRV record %q: bad number %q", value, s)
+			}
+			nums[i] = uint16(n)
+		}
+		target, err := dnsname.ToFQDN(f[3])
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid SRV target: %w", err)
+		}
+		return Record{Type: dns.TypeSRV, Priority: nums[0], Weight: nums[1], Port: nums[2], Target: target}, nil
+	}
+	return Record{}, fmt.Errorf("unsupported record type %q", typ)
+}
+
+// localAnswer is a resource record in a response to a query for a name
+// in Config.Records.
+type localAnswer struct {
+	name dnsname.FQDN
+	rec  Record     // if ip is invalid
+	ip   netip.Addr // for A and AAAA records
+}
+
+// resolveRecords returns the answers to a query of type typ for domain,
+// if domain has records in Config.Records. It reports false otherwise,
+// in which case the query should be resolved as usual.
+//
+// A CNAME record for domain is returned for queries of any type, followed
+// by the answers for its target if those are known locally.
+func (r *Resolver) resolveRecords(domain dnsname.FQDN, typ dns.Type) ([]localAnswer, bool) {
+	r.mu.Lock()
+	hosts := r.hostToIP
+	records := r.records
+	r.mu.Unlock()
+
+	if _, ok := records[domain]; !ok {
+		return nil, false
+	}
+	metricDNSResolveLocalRecords.Add(1)
+
+	var answers []localAnswer
+	name := domain
+	for hops := 0; ; hops++ {
+		recs := records[name]
+		if typ != dns.TypeCNAME {
+			if i := indexRecordType(recs, dns.TypeCNAME); i >= 0 {
+				// A CNAME record excludes all others for the name
+				// (RFC 1034, section 3.6.2).
+				answers = append(answers, localAnswer{name: name, rec: recs[i]})
+				if hops == maxCNAMEChain {
+					break
+				}
+				name = recs[i].Target
+				continue
+			}
+		}
+		for _, rec := range recs {
+			if rec.Type == typ || typ == dns.TypeALL {
+				answers = append(answers, localAnswer{name: name, rec: rec})
+			}
+		}
+		for _, ip := range hosts[name] {
+			if (typ == dns.TypeA && ip.Is4()) || (typ == dns.TypeAAAA && ip.Is6()) || typ == dns.TypeALL {
+				answers = append(answers, localAnswer{name: name, ip: ip})
+			}
+		}
+		break
+	}
+	return answers, true
+}
+
+func indexRecordType(recs []Record, typ dns.Type) int {
+	for i, rec := range recs {
+		if rec.Type == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// marshalLocalAnswer serializes a into an active builder.
+// The caller may continue using the builder following the call.
+func marshalLocalAnswer(a localAnswer, builder *dns.Builder) error {
+	name, err := dns.NewName(a.name.WithTrailingDot())
+	if err != nil {
+		return err
+	}
+	if a.ip.IsValid() {
+		return marshalIP(name, a.ip, builder)
+	}
+	h := dns.ResourceHeader{
+		Name:  name,
+		Type:  a.rec.Type,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	var target dns.Name
+	if a.rec.Type != dns.TypeTXT {
+		target, err = dns.NewName(a.rec.Target.WithTrailingDot())
+		if err != nil {
+			return err
+		}
+	}
+	switch a.rec.Type {
+	case dns.TypeCNAME:
+		return builder.CNAMEResource(h, dns.CNAMEResource{CNAME: target})
+	case dns.TypeTXT:
+		return builder.TXTResource(h, dns.TXTResource{TXT: a.rec.TXT})
+	case dns.TypeMX:
+		return builder.MXResource(h, dns.MXResource{Pref: a.rec.Priority, MX: target})
+	case dns.TypeSRV:
+		return builder.SRVResource(h, dns.SRVResource{
+			Priority: a.rec.Priority,
+			Weight:   a.rec.Weight,
+			Port:     a.rec.Port,
+			Target:   target,
+		})
+	}
+	return fmt.Errorf("unsupported record type %v", a.rec.Type)
+}
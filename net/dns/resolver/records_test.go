@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseRecord(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		typ, value string
+		want       Record
+		wantErr    bool
+	}{
+		{typ: "CNAME", value: "host.ipn.dev", want: Record{Type: dns.TypeCNAME, Target: "host.ipn.dev."}},
+		{typ: "cname", value: "host.ipn.dev.", want: Record{Type: dns.TypeCNAME, Target: "host.ipn.dev."}},
+		{typ: "TXT", value: "v=spf1 -all", want: Record{Type: dns.TypeTXT, TXT: []string{"v=spf1 -all"}}},
+		{typ: "TXT", value: "", want: Record{Type: dns.TypeTXT, TXT: []string{""}}},
+		{typ: "TXT", value: long, want: Record{Type: dns.TypeTXT, TXT: []string{long[:255], long[255:]}}},
+		{typ: "MX", value: "10 mail.ipn.dev", want: Record{Type: dns.TypeMX, Priority: 10, Target: "mail.ipn.dev."}},
+		{typ: "SRV", value: "10 5 5060 sip.ipn.dev", want: Record{Type: dns.TypeSRV, Priority: 10, Weight: 5, Port: 5060, Target: "sip.ipn.dev."}},
+		{typ: "MX", value: "mail.ipn.dev", wantErr: true},
+		{typ: "MX", value: "100000 mail.ipn.dev", wantErr: true},
+		{typ: "SRV", value: "10 5 sip.ipn.dev", wantErr: true},
+		{typ: "SRV", value: "10 5 70000 sip.ipn.dev", wantErr: true},
+		{typ: "CNAME", value: "bad..name", wantErr: true},
+		{typ: "NS", value: "ns.ipn.dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRecord(tt.typ, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRecord(%q, %q) error = %v; wantErr %v", tt.typ, tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRecord(%q, %q) = %+v; want %+v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRecords(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+
+	mustRecord := func(typ, value string) Record {
+		rec, err := ParseRecord(typ, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	r.SetConfig(Config{
+		Hosts: map[dnsname.FQDN][]netip.Addr{
+			"test1.ipn.dev.": {testipv4, testipv6},
+			"mail.ipn.dev.":  {testipv4},
+		},
+		Records: map[dnsname.FQDN][]Record{
+			"test1.ipn.dev.":        {mustRecord("TXT", "hello")},
+			"alias.ipn.dev.":        {mustRecord("CNAME", "test1.ipn.dev")},
+			"alias2.ipn.dev.":       {mustRecord("CNAME", "alias.ipn.dev")},
+			"external.ipn.dev.":     {mustRecord("CNAME", "example.com")},
+			"loop.ipn.dev.":         {mustRecord("CNAME", "loop.ipn.dev")},
+			"ipn.dev.":              {mustRecord("MX", "10 mail.ipn.dev"), mustRecord("MX", "20 backup.ipn.dev")},
+			"_sip._udp.ipn.dev.":    {mustRecord("SRV", "10 5 5060 test1.ipn.dev")},
+			"records-only.ipn.dev.": {mustRecord("TXT", "only")},
+		},
+		LocalDomains: []dnsname.FQDN{"ipn.dev."},
+	})
+
+	tests := []struct {
+		name  string
+		qname dnsname.FQDN
+		qtype dns.Type
+		want  []string // answers as "owner type data"
+	}{
+		{"txt", "test1.ipn.dev.", dns.TypeTXT, []string{"test1.ipn.dev. TXT hello"}},
+		{"a_with_txt", "test1.ipn.dev.", dns.TypeA, []string{"test1.ipn.dev. A 1.2.3.4"}},
+		{"aaaa_with_txt", "test1.ipn.dev.", dns.TypeAAAA, []string{"test1.ipn.dev. AAAA 1:203:405:607:809:a0b:c0d:e0f"}},
+		{"nodata", "test1.ipn.dev.", dns.TypeMX, nil},
+		{"records_only_a", "records-only.ipn.dev.", dns.TypeA, nil},
+		{"cname", "alias.ipn.dev.", dns.TypeCNAME, []string{"alias.ipn.dev. CNAME test1.ipn.dev."}},
+		{"cname_chase", "alias2.ipn.dev.", dns.TypeA, []string{
+			"alias2.ipn.dev. CNAME alias.ipn.dev.",
+			"alias.ipn.dev. CNAME test1.ipn.dev.",
+			"test1.ipn.dev. A 1.2.3.4",
+		}},
+		{"cname_chase_txt", "alias.ipn.dev.", dns.TypeTXT, []string{
+			"alias.ipn.dev. CNAME test1.ipn.dev.",
+			"test1.ipn.dev. TXT hello",
+		}},
+		{"cname_external", "external.ipn.dev.", dns.TypeA, []string{"external.ipn.dev. CNAME example.com."}},
+		{"mx", "ipn.dev.", dns.TypeMX, []string{"ipn.dev. MX 10 mail.ipn.dev.", "ipn.dev. MX 20 backup.ipn.dev."}},
+		{"srv", "_sip._udp.ipn.dev.", dns.TypeSRV, []string{"_sip._udp.ipn.dev. SRV 10 5 5060 test1.ipn.dev."}},
+		{"upper", "_SIP._udp.IPN.dev.", dns.TypeSRV, []string{"_sip._udp.ipn.dev. SRV 10 5 5060 test1.ipn.dev."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := syncRespond(r, dnspacket(tt.qname, tt.qtype, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(res); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Header.RCode != dns.RCodeSuccess || !msg.Header.Authoritative {
+				t.Errorf("header = %+v; want authoritative NOERROR", msg.Header)
+			}
+			var got []string
+			for _, a := range msg.Answers {
+				got = append(got, formatAnswer(a))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// CNAME loops are cut short.
+	res, err := syncRespond(r, dnspacket("loop.ipn.dev.", dns.TypeA, noEdns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(msg.Answers); n != maxCNAMEChain+1 {
+		t.Errorf("CNAME loop got %d answers; want %d", n, maxCNAMEChain+1)
+	}
+}
+
+func formatAnswer(a dns.Resource) string {
+	var data string
+	switch b := a.Body.(type) {
+	case *dns.AResource:
+		data = netip.AddrFrom4(b.A).String()
+	case *dns.AAAAResource:
+		data = netip.AddrFrom16(b.AAAA).String()
+	case *dns.CNAMEResource:
+		data = b.CNAME.String()
+	case *dns.TXTResource:
+		data = strings.Join(b.TXT, " ")
+	case *dns.MXResource:
+		return a.Header.Name.String() + " " + Record{Type: dns.TypeMX, Priority: b.Pref, Target: dnsname.FQDN(b.MX.String())}.String()
+	case *dns.SRVResource:
+		return a.Header.Name.String() + " " + Record{Type: dns.TypeSRV, Priority: b.Priority, Weight: b.Weight, Port: b.Port, Target: dnsname.FQDN(b.Target.String())}.String()
+	}
+	return a.Header.Name.String() + " " + strings.TrimPrefix(a.Header.Type.String(), "Type") + " " + data
+}
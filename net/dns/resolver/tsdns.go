@@ -71,9 +71,18 @@ type Config struct {
 	Routes map[dnsname.FQDN][]*dnstype.Resolver
 	// LocalHosts is a map of FQDNs to corresponding IPs.
 	Hosts map[dnsname.FQDN][]netip.Addr
+	// Records is a map of FQDNs to their records of types other than
+	// A and AAAA, which are in Hosts.
+	Records map[dnsname.FQDN][]Record
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// Blocklists are lists of names whose queries are answered
+	// according to BlockPolicy rather than forwarded upstream.
+	Blocklists []Blocklist
+	// BlockPolicy is how queries for names in Blocklists are answered.
+	// If empty, BlockNXDomain is used.
+	BlockPolicy BlockPolicy
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -81,7 +90,7 @@ type Config struct {
 func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("{Routes:")
 	WriteRoutes(w, c.Routes)
-	fmt.Fprintf(w, " Hosts:%v LocalDomains:[", len(c.Hosts))
+	fmt.Fprintf(w, " Hosts:%v Records:%v LocalDomains:[", len(c.Hosts), len(c.Records))
 	space := false
 	arpa := 0
 	for _, d := range c.LocalDomains {
@@ -99,6 +108,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	if arpa > 0 {
 		fmt.Fprintf(w, "+%darpa", arpa)
 	}
+	if len(c.Blocklists) > 0 {
+		fmt.Fprintf(w, " Blocklists:%v policy=%v", len(c.Blocklists), c.BlockPolicy)
+	}
 	if c := cloudenv.Get(); c != "" {
 		fmt.Fprintf(w, ", cloud=%q", string(c))
 	}
@@ -184,9 +196,17 @@ type Resolver struct {
 	saveConfigForTests func(cfg Config) // used in tests to capture resolver config
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// blocker answers queries for names in blocklists.
+	blocker blocker
+	// queryLog logs recent queries.
+	queryLog queryLog
 
-	// closed signals all goroutines to stop.
+	// closed signals all goroutines to stop. It's closed with mu held,
+	// so that goroutines aren't added to wg once Close waits on it.
 	closed chan struct{}
+	// ctx is canceled when the resolver is closed.
+	ctx       context.Context
+	ctxCancel context.CancelFunc
 	// wg signals when all goroutines have stopped.
 	wg sync.WaitGroup
 
@@ -195,6 +215,9 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	records      map[dnsname.FQDN][]Record
+	blocklists   []Blocklist
+	blockPolicy  BlockPolicy
 }
 
 type ForwardLinkSelector interface {
@@ -219,6 +242,10 @@ func New(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkSelector,
 		dialer:   dialer,
 	}
 	r.forwarder = newForwarder(r.logf, netMon, linkSel, dialer)
+	r.forwarder.queryLog = &r.queryLog
+	r.blocker.logf = r.logf
+	r.blocker.httpc = newBlocklistHTTPClient(r.forwarder)
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
 	return r
 }
 
@@ -238,27 +265,52 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	}
 
 	r.forwarder.setRoutes(cfg.Routes)
+	r.setBlocklistConfig(cfg.BlockPolicy, cfg.Blocklists)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.records = cfg.Records
 	return nil
 }
 
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
+	r.mu.Lock()
 	select {
 	case <-r.closed:
+		r.mu.Unlock()
 		return
 	default:
 		// continue
 	}
 	close(r.closed)
+	r.mu.Unlock()
+	r.ctxCancel()
 
 	r.forwarder.Close()
+	r.wg.Wait()
+	r.blocker.httpc.CloseIdleConnections()
+}
+
+// goUnlessClosed runs f in a new goroutine which Close waits for, unless
+// r is already closed.
+func (r *Resolver) goUnlessClosed(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
 }
 
 // dnsQueryTimeout is not intended to be user-visible (the users
@@ -275,7 +327,18 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, from netip.AddrPort) ([
 	default:
 	}
 
+	start := time.Now()
 	out, err := r.respond(bs)
+	if err == nil {
+		r.queryLog.logQuery(start, bs, resolutionLocal, "", "", out, nil)
+	}
+	if err == errNotOurName && r.blocker.active() {
+		if resp := parseExitNodeQuery(bs); resp != nil {
+			if res, ok := r.blockedResponse(resp); ok {
+				return res, nil
+			}
+		}
+	}
 	if err == errNotOurName {
 		responses := make(chan packet, 1)
 		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
@@ -337,6 +400,9 @@ func (r *Resolver) HandleExitNodeDNSQuery(ctx context.Context, q []byte, from ne
 		resp.Header.RCode = dns.RCodeRefused
 		return marshalResponse(resp)
 	}
+	if res, ok := r.blockedResponse(resp); ok {
+		return res, nil
+	}
 
 	switch runtime.GOOS {
 	default:
@@ -808,6 +874,10 @@ type response struct {
 
 	// NSs are the responses to an NS query.
 	NSs []*net.NS
+
+	// Records are the responses to a query for a name in
+	// Config.Records, of any type.
+	Records []localAnswer
 }
 
 var dnsParserPool = &sync.Pool{
@@ -1003,7 +1073,7 @@ func marshalResponse(resp *response) ([]byte, error) {
 	// before, but for now (2021-12-09) enable it at least when
 	// there's more than 1 record (which was never the case
 	// before), where it really helps.
-	if len(resp.IPs) > 1 {
+	if len(resp.IPs) > 1 || len(resp.Records) > 0 {
 		builder.EnableCompression()
 	}
 
@@ -1031,6 +1101,12 @@ func marshalResponse(resp *response) ([]byte, error) {
 		return nil, err
 	}
 
+	for _, a := range resp.Records {
+		if err := marshalLocalAnswer(a, &builder); err != nil {
+			return nil, err
+		}
+	}
+
 	switch resp.Question.Type {
 	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
 		if err := marshalIP(resp.Question.Name, resp.IP, &builder); err != nil {
@@ -1229,6 +1305,12 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 		return r.respondReverse(query, name, parser.response())
 	}
 
+	if answers, ok := r.resolveRecords(name, parser.Question.Type); ok {
+		resp := parser.response()
+		resp.Records = answers
+		return marshalResponse(resp)
+	}
+
 	ip, rcode := r.resolveLocal(name, parser.Question.Type)
 	if rcode == dns.RCodeRefused {
 		return nil, errNotOurName // sentinel error return value: it requests forwarding
@@ -1286,6 +1368,8 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSExitProxyErrorForward    = clientmetric.NewCounter("dns_exit_node_error_forward")
 	metricDNSExitProxyErrorResolvConf = clientmetric.NewCounter("dns_exit_node_error_resolvconf")
 
+	metricDNSBlocked = clientmetric.NewCounter("dns_query_blocked")
+
 	metricDNSFwd                     = clientmetric.NewCounter("dns_query_fwd")
 	metricDNSFwdDropBonjour          = clientmetric.NewCounter("dns_query_fwd_drop_bonjour")
 	metricDNSFwdErrorName            = clientmetric.NewCounter("dns_query_fwd_error_name")
@@ -1312,6 +1396,15 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT      = clientmetric.NewCounter("dns_query_fwd_dot")
+	metricDNSFwdDoTError = clientmetric.NewCounter("dns_query_fwd_dot_error")
+
+	metricDNSFwdErrorUnhealthy = clientmetric.NewCounter("dns_query_fwd_error_unhealthy")
+
+	metricDNSFwdCacheHit      = clientmetric.NewCounter("dns_query_fwd_cache_hit")
+	metricDNSFwdCacheMiss     = clientmetric.NewCounter("dns_query_fwd_cache_miss")
+	metricDNSFwdCachePrefetch = clientmetric.NewCounter("dns_query_fwd_cache_prefetch")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
@@ -1319,6 +1412,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSResolveLocalOKA          = clientmetric.NewCounter("dns_resolve_local_ok_a")
 	metricDNSResolveLocalOKAAAA       = clientmetric.NewCounter("dns_resolve_local_ok_aaaa")
 	metricDNSResolveLocalOKAll        = clientmetric.NewCounter("dns_resolve_local_ok_all")
+	metricDNSResolveLocalRecords      = clientmetric.NewCounter("dns_resolve_local_records")
 	metricDNSResolveLocalNoA          = clientmetric.NewCounter("dns_resolve_local_no_a")
 	metricDNSResolveLocalNoAAAA       = clientmetric.NewCounter("dns_resolve_local_no_aaaa")
 	metricDNSResolveLocalNoAll        = clientmetric.NewCounter("dns_resolve_local_no_all")
@@ -467,6 +467,30 @@ func UseAllInterfaces(i Interface, ips []netip.Prefix) bool { return true }
 // UseAllIPs is an IPFilter that includes all IPs.
 func UseAllIPs(ips netip.Addr) bool { return true }
 
+// UsableAddrs returns the addresses of the interface named ifName that
+// could conceivably be used to get Internet connectivity. It returns nil if
+// the interface is down, a loopback or problematic one, or Tailscale's own.
+func (s *State) UsableAddrs(ifName string) []netip.Addr {
+	if s == nil {
+		return nil
+	}
+	iface, ok := s.Interface[ifName]
+	if !ok || iface.Interface == nil || !iface.IsUp() || iface.IsLoopback() || isProblematicInterface(iface.Interface) {
+		return nil
+	}
+	pfxs := s.InterfaceIPs[ifName]
+	if isTailscaleInterface(ifName, pfxs) {
+		return nil
+	}
+	var addrs []netip.Addr
+	for _, pfx := range pfxs {
+		if ip := pfx.Addr(); isUsableV4(ip) || isUsableV6(ip) {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
 func (s *State) HasPAC() bool { return s != nil && s.PAC != "" }
 
 // AnyInterfaceUp reports whether any interface seems like it has Internet access.
@@ -628,6 +652,37 @@ func LikelyHomeRouterIP() (gateway, myIP netip.Addr, ok bool) {
 	return gateway, myIP, myIP.IsValid()
 }
 
+var likelyHomeRouterIPv6 func() (netip.Addr, bool)
+
+// LikelyHomeRouterIPv6 is like LikelyHomeRouterIP, but for IPv6. It returns
+// the IPv6 default gateway, usually a link-local address with the name of
+// its interface as zone, if it can be found on this platform, and a global
+// unicast IPv6 address of the current machine, on the gateway's interface
+// if known, to which inbound connections can be allowed through the
+// router's firewall.
+// The ok result reports whether myIP is valid; gateway may still not be.
+// This is used to create IPv6 firewall pinholes with PCP and UPnP.
+func LikelyHomeRouterIPv6() (gateway, myIP netip.Addr, ok bool) {
+	if likelyHomeRouterIPv6 != nil {
+		gateway, _ = likelyHomeRouterIPv6()
+	}
+	ForeachInterface(func(i Interface, pfxs []netip.Prefix) {
+		if !i.IsUp() || myIP.IsValid() || isTailscaleInterface(i.Name, pfxs) {
+			return
+		}
+		if gateway.Zone() != "" && i.Name != gateway.Zone() {
+			return
+		}
+		for _, pfx := range pfxs {
+			if ip := pfx.Addr(); ip.Is6() && v6Global1.Contains(ip) {
+				myIP = ip
+				return
+			}
+		}
+	})
+	return gateway, myIP, myIP.IsValid()
+}
+
 // isUsableV4 reports whether ip is a usable IPv4 address which could
 // conceivably be used to get Internet connectivity. Globally routable and
 // private IPv4 addresses are always Usable, and link local 169.254.x.x
@@ -6,6 +6,7 @@
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -28,6 +29,7 @@
 
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPLinux
+	likelyHomeRouterIPv6 = likelyHomeRouterIPv6Linux
 }
 
 var procNetRouteErr atomic.Bool
@@ -116,6 +118,57 @@ func likelyHomeRouterIPLinux() (ret netip.Addr, ok bool) {
 	return netip.Addr{}, false
 }
 
+var procNetIPv6RoutePath = "/proc/net/ipv6_route"
+
+/*
+Parse fe80::1%eth0 out of:
+
+$ cat /proc/net/ipv6_route
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+*/
+func likelyHomeRouterIPv6Linux() (ret netip.Addr, ok bool) {
+	lineNum := 0
+	var f []mem.RO
+	err := lineread.File(procNetIPv6RoutePath, func(line []byte) error {
+		lineNum++
+		if lineNum > maxProcNetRouteRead {
+			return errStopReading
+		}
+		f = mem.AppendFields(f[:0], mem.B(line))
+		if len(f) < 10 {
+			return nil
+		}
+		dst, dstBits, gwHex, flagsHex := f[0], f[1], f[4], f[8]
+		if !dstBits.EqualString("00") || mem.TrimLeftCutset(dst, mem.S("0")).Len() != 0 {
+			return nil
+		}
+		flags, err := mem.ParseUint(flagsHex, 16, 32)
+		if err != nil {
+			return nil // ignore error, skip line and keep going
+		}
+		if flags&(unix.RTF_UP|unix.RTF_GATEWAY) != unix.RTF_UP|unix.RTF_GATEWAY {
+			return nil
+		}
+		b, err := hex.DecodeString(gwHex.StringCopy())
+		if err != nil || len(b) != 16 {
+			return nil
+		}
+		ip := netip.AddrFrom16([16]byte(b))
+		if ip.IsUnspecified() {
+			return nil
+		}
+		if ip.IsLinkLocalUnicast() {
+			ip = ip.WithZone(f[9].StringCopy())
+		}
+		ret = ip
+		return errStopReading
+	})
+	if errors.Is(err, errStopReading) {
+		err = nil
+	}
+	return ret, err == nil && ret.IsValid()
+}
+
 // Android apps don't have permission to read /proc/net/route, at
 // least on Google devices and the Android emulator.
 func likelyHomeRouterIPAndroid() (ret netip.Addr, ok bool) {
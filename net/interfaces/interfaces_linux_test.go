@@ -7,6 +7,7 @@
 	"errors"
 	"fmt"
 	"io/fs"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"testing"
@@ -114,3 +115,18 @@ func TestRouteLinuxNetlink(t *testing.T) {
 	}
 	t.Logf("Got: %+v", d)
 }
+
+func TestLikelyHomeRouterIPv6Linux(t *testing.T) {
+	dir := t.TempDir()
+	tstest.Replace(t, &procNetIPv6RoutePath, filepath.Join(dir, "ipv6_route"))
+	buf := []byte("fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0\n")
+	if err := os.WriteFile(procNetIPv6RoutePath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := likelyHomeRouterIPv6Linux()
+	if want := netip.MustParseAddr("fe80::1%eth0"); !ok || got != want {
+		t.Errorf("got %v, %v; want %v, true", got, ok, want)
+	}
+}
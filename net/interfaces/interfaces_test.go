@@ -7,6 +7,7 @@
 	"encoding/json"
 	"net"
 	"net/netip"
+	"reflect"
 	"testing"
 
 	"tailscale.com/tstest"
@@ -254,3 +255,35 @@ func TestStateString(t *testing.T) {
 		})
 	}
 }
+
+func TestStateUsableAddrs(t *testing.T) {
+	s := &State{
+		Interface: map[string]Interface{
+			"eth0":       {Interface: &net.Interface{Name: "eth0", Flags: net.FlagUp}},
+			"wlan0":      {Interface: &net.Interface{Name: "wlan0"}},
+			"lo":         {Interface: &net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}},
+			"tailscale0": {Interface: &net.Interface{Name: "tailscale0", Flags: net.FlagUp}},
+		},
+		InterfaceIPs: map[string][]netip.Prefix{
+			"eth0": {
+				netip.MustParsePrefix("10.0.0.2/8"),
+				netip.MustParsePrefix("169.254.1.2/16"), // link local unicast
+				netip.MustParsePrefix("2001:db8::2/64"),
+				netip.MustParsePrefix("fe80::2/64"), // link local unicast
+			},
+			"wlan0":      {netip.MustParsePrefix("192.168.1.2/24")},
+			"lo":         {netip.MustParsePrefix("127.0.0.1/8")},
+			"tailscale0": {netip.MustParsePrefix("100.64.0.1/32")},
+		},
+	}
+	got := s.UsableAddrs("eth0")
+	want := []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UsableAddrs(eth0) = %v; want %v", got, want)
+	}
+	for _, name := range []string{"wlan0", "lo", "tailscale0", "nonexistent"} {
+		if got := s.UsableAddrs(name); got != nil {
+			t.Errorf("UsableAddrs(%s) = %v; want nil", name, got)
+		}
+	}
+}
@@ -18,6 +18,7 @@
 	"net"
 	"net/netip"
 	"sync/atomic"
+	"syscall"
 
 	"tailscale.com/net/netknob"
 	"tailscale.com/net/netmon"
@@ -64,6 +65,19 @@ func Listener(logf logger.Logf, netMon *netmon.Monitor) *net.ListenConfig {
 	return &net.ListenConfig{Control: control(logf, netMon)}
 }
 
+// ListenerOnInterface returns a new net.ListenConfig whose sockets are
+// bound to the network interface with the given name and index, so that
+// their packets go out through it, whatever the routing table says.
+// It's used to find paths to peers through each of the machine's
+// interfaces, so unlike Listener it binds even if netns is disabled.
+func ListenerOnInterface(logf logger.Logf, ifName string, ifIndex int) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return bindToInterface(logf, c, network, ifName, ifIndex)
+		},
+	}
+}
+
 // NewDialer returns a new Dialer using a net.Dialer with its Control
 // hook func initialized as necessary to run in a logical network
 // namespace that doesn't route back into Tailscale. It also handles
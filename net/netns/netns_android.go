@@ -6,6 +6,7 @@
 package netns
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"syscall"
@@ -73,3 +74,9 @@ func controlC(network, address string, c syscall.RawConn) error {
 	}
 	return sockErr
 }
+
+// bindToInterface returns an error; Android doesn't let apps bind their
+// sockets to a specific network interface.
+func bindToInterface(logf logger.Logf, c syscall.RawConn, network, ifName string, ifIndex int) error {
+	return errors.New("binding to an interface not supported on Android")
+}
@@ -240,6 +240,11 @@ func SetListenConfigInterfaceIndex(lc *net.ListenConfig, ifIndex int) error {
 	return nil
 }
 
+// bindToInterface binds c to the interface with index ifIndex.
+func bindToInterface(logf logger.Logf, c syscall.RawConn, network, ifName string, ifIndex int) error {
+	return bindConnToInterface(c, network, "", ifIndex, logf)
+}
+
 func bindConnToInterface(c syscall.RawConn, network, address string, ifIndex int, logf logger.Logf) error {
 	v6 := strings.Contains(address, "]:") || strings.HasSuffix(network, "6") // hacky test for v6
 	proto := unix.IPPROTO_IP
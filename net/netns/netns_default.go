@@ -6,6 +6,7 @@
 package netns
 
 import (
+	"errors"
 	"syscall"
 
 	"tailscale.com/net/netmon"
@@ -20,3 +21,9 @@ func control(logger.Logf, *netmon.Monitor) func(network, address string, c sysca
 func controlC(network, address string, c syscall.RawConn) error {
 	return nil
 }
+
+// bindToInterface returns an error; binding sockets to an interface isn't
+// supported on this OS.
+func bindToInterface(logf logger.Logf, c syscall.RawConn, network, ifName string, ifIndex int) error {
+	return errors.New("binding to an interface not supported on this OS")
+}
@@ -125,6 +125,27 @@ func setBypassMark(fd uintptr) error {
 	return nil
 }
 
+// bindToInterface binds c to the interface ifName with SO_BINDTODEVICE,
+// also setting the bypass mark if in use so that its packets skip the
+// Tailscale routes.
+func bindToInterface(logf logger.Logf, c syscall.RawConn, network, ifName string, ifIndex int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if UseSocketMark() {
+			if sockErr = setBypassMark(fd); sockErr != nil {
+				return
+			}
+		}
+		if err := unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName); err != nil {
+			sockErr = fmt.Errorf("setting SO_BINDTODEVICE to %q: %w", ifName, err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("RawConn.Control on %T: %w", c, err)
+	}
+	return sockErr
+}
+
 func bindToDevice(fd uintptr) error {
 	ifc, err := interfaces.DefaultRouteInterface()
 	if err != nil {
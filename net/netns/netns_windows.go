@@ -74,6 +74,14 @@ func controlC(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+// bindToInterface binds c to the interface with index ifIndex.
+func bindToInterface(logf logger.Logf, c syscall.RawConn, network, ifName string, ifIndex int) error {
+	if strings.HasSuffix(network, "6") {
+		return bindSocket6(c, uint32(ifIndex))
+	}
+	return bindSocket4(c, uint32(ifIndex))
+}
+
 // sockoptBoundInterface is the value of IP_UNICAST_IF and IPV6_UNICAST_IF.
 //
 // See https://docs.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
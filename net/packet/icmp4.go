@@ -46,6 +46,10 @@ func (t ICMP4Type) String() string {
 
 const (
 	ICMP4NoCode ICMP4Code = 0
+
+	// ICMP4FragmentationNeeded is the ICMP4Unreachable code for packets
+	// that are too big for the next hop and have DF set.
+	ICMP4FragmentationNeeded ICMP4Code = 4
 )
 
 // ICMP4Header is an IPv4+ICMPv4 header.
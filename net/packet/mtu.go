@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"encoding/binary"
+
+	"tailscale.com/types/ipproto"
+)
+
+const (
+	// tcpOptionMSS is the TCP maximum segment size option kind.
+	tcpOptionMSS = 2
+
+	// icmp4ErrorMaxLen is the maximum length of the ICMPv4 errors
+	// generated by TooBig (RFC 1812, section 4.3.2.3).
+	icmp4ErrorMaxLen = 576
+
+	// icmp6ErrorMaxLen is the maximum length of the ICMPv6 errors
+	// generated by TooBig (RFC 4443, section 2.4).
+	icmp6ErrorMaxLen = 1280
+)
+
+// Len returns the total length of the packet, according to its IP
+// header.
+func (q *Parsed) Len() int {
+	return q.length
+}
+
+// DontFragment reports whether q may not be fragmented on its path: it's
+// IPv6, or IPv4 with the DF bit set.
+func (q *Parsed) DontFragment() bool {
+	switch q.IPVersion {
+	case 4:
+		return len(q.b) >= ip4HeaderLength && binary.BigEndian.Uint16(q.b[6:8])&0x4000 != 0
+	case 6:
+		return true
+	}
+	return false
+}
+
+// ClampTCPMSS lowers the maximum segment size option of the TCP SYN or
+// SYN-ACK packet q to mss, if it's larger, and updates the TCP checksum.
+// It reports whether q was modified.
+func (q *Parsed) ClampTCPMSS(mss uint16) bool {
+	if q.IPProto != ipproto.TCP || q.TCPFlags&TCPSyn == 0 {
+		return false
+	}
+	if q.dataofs > q.length || q.dataofs-q.subofs < tcpHeaderLength {
+		return false
+	}
+	tcp := q.b[q.subofs:q.dataofs]
+	opts := tcp[tcpHeaderLength:]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of options
+			return false
+		case 1: // no-op
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+		if opts[0] == tcpOptionMSS && opts[1] == 4 {
+			if binary.BigEndian.Uint16(opts[2:4]) <= mss {
+				return false
+			}
+			var v [2]byte
+			binary.BigEndian.PutUint16(v[:], mss)
+			// The option isn't necessarily 16-bit aligned within the
+			// header, in which case its bytes straddle checksum words.
+			if off := len(tcp) - len(opts) + 2; off%2 == 0 {
+				updateV4Checksum(tcp[16:18], opts[2:4], v[:])
+			} else {
+				updateV4Checksum(tcp[16:18], tcp[off-1:off+3], []byte{tcp[off-1], v[0], v[1], tcp[off+2]})
+			}
+			copy(opts[2:4], v[:])
+			return true
+		}
+		opts = opts[opts[1]:]
+	}
+	return false
+}
+
+// TooBig returns the ICMP error that a router whose next hop has the given
+// MTU would send back to the source of q, a packet too big for it: an
+// ICMPv4 "fragmentation needed" or an ICMPv6 "packet too big" message. It
+// returns nil if q isn't IPv4 or IPv6.
+func TooBig(q *Parsed, mtu int) []byte {
+	orig := q.b[:q.length]
+	switch q.IPVersion {
+	case 4:
+		h := ICMP4Header{
+			IP4Header: IP4Header{
+				IPID: ^q.IP4Header().IPID,
+				Src:  q.Dst.Addr(),
+				Dst:  q.Src.Addr(),
+			},
+			Type: ICMP4Unreachable,
+			Code: ICMP4FragmentationNeeded,
+		}
+		if n := icmp4ErrorMaxLen - h.Len() - 4; len(orig) > n {
+			orig = orig[:n]
+		}
+		payload := make([]byte, 4+len(orig)) // unused(2), next-hop MTU(2), original packet
+		binary.BigEndian.PutUint16(payload[2:4], uint16(mtu))
+		copy(payload[4:], orig)
+		return Generate(h, payload)
+	case 6:
+		h := ICMP6Header{
+			IP6Header: IP6Header{
+				Src: q.Dst.Addr(),
+				Dst: q.Src.Addr(),
+			},
+			Type: ICMP6PacketTooBig,
+		}
+		if n := icmp6ErrorMaxLen - h.Len() - 4; len(orig) > n {
+			orig = orig[:n]
+		}
+		payload := make([]byte, 4+len(orig)) // MTU(4), original packet
+		binary.BigEndian.PutUint32(payload[0:4], uint32(mtu))
+		copy(payload[4:], orig)
+		return Generate(h, payload)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// tcp4Syn returns an IPv4 TCP SYN packet with the given TCP options
+// (whose length must be a multiple of 4) and a valid TCP checksum.
+func tcp4Syn(opts []byte) []byte {
+	b := make([]byte, 20+20+len(opts))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[6] = 0x40 // DF
+	b[8] = 64
+	b[9] = byte(TCP)
+	copy(b[12:16], []byte{100, 64, 0, 1})
+	copy(b[16:20], []byte{100, 64, 0, 2})
+	tcp := b[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 12345)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	tcp[12] = byte((20 + len(opts)) / 4 << 4)
+	tcp[13] = byte(TCPSyn)
+	copy(tcp[20:], opts)
+	binary.BigEndian.PutUint16(tcp[16:18], tcp4Checksum(b))
+	return b
+}
+
+// tcp4Checksum returns the TCP checksum of the IPv4 TCP packet b, treating
+// its checksum field as zero.
+func tcp4Checksum(b []byte) uint16 {
+	tcp := b[20:]
+	var s uint32
+	for i := 12; i < 20; i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	s += uint32(TCP) + uint32(len(tcp))
+	for i := 0; i < len(tcp); i += 2 {
+		if i != 16 {
+			s += uint32(binary.BigEndian.Uint16(tcp[i:]))
+		}
+	}
+	for s>>16 > 0 {
+		s = s&0xFFFF + s>>16
+	}
+	return ^uint16(s)
+}
+
+func TestClampTCPMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []byte
+		mss     uint16
+		want    bool
+		wantMSS uint16
+		mssOff  int // offset of the MSS value in the TCP header
+	}{
+		{"aligned", []byte{2, 4, 0x05, 0xb4}, 1200, true, 1200, 22},
+		{"unaligned", []byte{1, 2, 4, 0x05, 0xb4, 1, 1, 1}, 1200, true, 1200, 23},
+		{"already_smaller", []byte{2, 4, 0x04, 0x00}, 1200, false, 1024, 22},
+		{"no_mss", []byte{1, 1, 1, 0}, 1200, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tcp4Syn(tt.opts)
+			var p Parsed
+			p.Decode(b)
+			if got := p.ClampTCPMSS(tt.mss); got != tt.want {
+				t.Fatalf("ClampTCPMSS = %v; want %v", got, tt.want)
+			}
+			if tt.mssOff != 0 {
+				if got := binary.BigEndian.Uint16(b[20+tt.mssOff:]); got != tt.wantMSS {
+					t.Errorf("MSS = %d; want %d", got, tt.wantMSS)
+				}
+			}
+			if got, want := binary.BigEndian.Uint16(b[36:38]), tcp4Checksum(b); got != want {
+				t.Errorf("checksum = %#04x; want %#04x", got, want)
+			}
+		})
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	b := make([]byte, 1400)
+	copy(b, tcp4Syn(nil))
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	var p Parsed
+	p.Decode(b)
+	if !p.DontFragment() || p.Len() != 1400 {
+		t.Fatalf("DontFragment, Len = %v, %d; want true, 1400", p.DontFragment(), p.Len())
+	}
+
+	res := TooBig(&p, 1300)
+	if len(res) != icmp4ErrorMaxLen {
+		t.Errorf("len = %d; want %d", len(res), icmp4ErrorMaxLen)
+	}
+	var q Parsed
+	q.Decode(res)
+	if q.IPProto != ICMPv4 || q.Src.Addr() != netip.MustParseAddr("100.64.0.2") || q.Dst.Addr() != netip.MustParseAddr("100.64.0.1") {
+		t.Fatalf("got %v; want ICMPv4 from 100.64.0.2 to 100.64.0.1", &q)
+	}
+	h := q.ICMP4Header()
+	if h.Type != ICMP4Unreachable || h.Code != ICMP4FragmentationNeeded {
+		t.Errorf("type, code = %v, %v; want unreachable, fragmentation needed", h.Type, h.Code)
+	}
+	if mtu := binary.BigEndian.Uint16(q.Payload()[2:4]); mtu != 1300 {
+		t.Errorf("MTU = %d; want 1300", mtu)
+	}
+	if xsum := ip4Checksum(res[20:]); xsum != 0 {
+		t.Errorf("bad ICMP checksum")
+	}
+}
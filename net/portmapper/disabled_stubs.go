@@ -26,3 +26,7 @@ func (c *Client) getUPnPPortMapping(
 ) (external netip.AddrPort, ok bool) {
 	return netip.AddrPort{}, false
 }
+
+func (c *Client) getUPnPPinhole(ctx context.Context, internal netip.AddrPort) (external netip.AddrPort, ok bool) {
+	return netip.AddrPort{}, false
+}
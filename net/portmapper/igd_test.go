@@ -6,10 +6,12 @@
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -23,6 +25,7 @@
 type TestIGD struct {
 	upnpConn net.PacketConn // for UPnP discovery
 	pxpConn  net.PacketConn // for NAT-PMP and/or PCP
+	pxpConn6 net.PacketConn // for PCP over IPv6, on pxpConn's port; nil if IPv6 is unavailable
 	ts       *httptest.Server
 	logf     logger.Logf
 	closed   atomic.Bool
@@ -57,6 +60,11 @@ type igdCounters struct {
 	numPMPPublicAddrRecv int32
 	numPMPBogusRecv      int32
 
+	numUPnPAddPinholeRecv    int32
+	numUPnPUpdatePinholeRecv int32
+	numUPnPDeletePinholeRecv int32
+	numUPnPOtherSOAPRecv     int32
+
 	numFailedWrites  int32
 	invalidPCPMapPkt int32
 }
@@ -83,9 +91,15 @@ func NewTestIGD(logf logger.Logf, t TestIGDOptions) (*TestIGD, error) {
 		d.upnpConn.Close()
 		return nil, err
 	}
+	// IPv6 may not be available where tests run; the tests of
+	// pinholes over PCP skip themselves then.
+	d.pxpConn6, _ = net.ListenPacket("udp6", fmt.Sprintf("[::1]:%d", d.TestPxPPort()))
 	d.ts = httptest.NewServer(http.HandlerFunc(d.serveUPnPHTTP))
 	go d.serveUPnPDiscovery()
-	go d.servePxP()
+	go d.servePxP(d.pxpConn)
+	if d.pxpConn6 != nil {
+		go d.servePxP(d.pxpConn6)
+	}
 	return d, nil
 }
 
@@ -105,11 +119,21 @@ func testIPAndGateway() (gw, ip netip.Addr, ok bool) {
 	return netaddr.IPv4(127, 0, 0, 1), netaddr.IPv4(1, 2, 3, 4), true
 }
 
+// testIPv6 is the global IPv6 address test clients open pinholes for.
+var testIPv6 = netip.MustParseAddr("2001:db8::1234")
+
+func testIPAndGateway6() (gw, ip netip.Addr, ok bool) {
+	return netip.IPv6Loopback(), testIPv6, true
+}
+
 func (d *TestIGD) Close() error {
 	d.closed.Store(true)
 	d.ts.Close()
 	d.upnpConn.Close()
 	d.pxpConn.Close()
+	if d.pxpConn6 != nil {
+		d.pxpConn6.Close()
+	}
 	return nil
 }
 
@@ -125,8 +149,63 @@ func (d *TestIGD) stats() igdCounters {
 	return d.counters
 }
 
+// testRootDescXML is the description of the test IGD, an IGDv2 with
+// WANIPConnection:2 and WANIPv6FirewallControl:1 services.
+const testRootDescXML = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:2</deviceType><friendlyName>Test IGD</friendlyName><manufacturer>Tailscale</manufacturer><UDN>uuid:bee7052b-49e8-3597-b545-55a1e38ac11</UDN><deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:2</deviceType><friendlyName>WANDevice</friendlyName><UDN>uuid:bee7052b-49e8-3597-b545-55a1e38ac12</UDN><deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:2</deviceType><friendlyName>WANConnectionDevice</friendlyName><UDN>uuid:bee7052b-49e8-3597-b545-55a1e38ac13</UDN><serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:2</serviceType><serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId><controlURL>/ctl/IPConn</controlURL><eventSubURL>/evt/IPConn</eventSubURL><SCPDURL>/WANIPCn.xml</SCPDURL></service><service><serviceType>urn:schemas-upnp-org:service:WANIPv6FirewallControl:1</serviceType><serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId><controlURL>/ctl/IP6FCtl</controlURL><eventSubURL>/evt/IP6FCtl</eventSubURL><SCPDURL>/WANIP6FC.xml</SCPDURL></service></serviceList></device></deviceList></device></deviceList></device></root>`
+
+// testPinholeID is the ID of the pinholes the test IGD opens.
+const testPinholeID = 42
+
 func (d *TestIGD) serveUPnPHTTP(w http.ResponseWriter, r *http.Request) {
-	http.NotFound(w, r) // TODO
+	d.inc(&d.counters.numUPnPHTTPRecv)
+	if !d.doUPnP {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/rootDesc.xml":
+		io.WriteString(w, testRootDescXML)
+	case "/ctl/IP6FCtl":
+		d.serveUPnPFirewallControl(w, r)
+	default:
+		// TODO: WANIPConnection
+		d.inc(&d.counters.numUPnPOtherSOAPRecv)
+		http.NotFound(w, r)
+	}
+}
+
+// serveUPnPFirewallControl serves the SOAP actions of the
+// WANIPv6FirewallControl service.
+func (d *TestIGD) serveUPnPFirewallControl(w http.ResponseWriter, r *http.Request) {
+	urn, action, _ := strings.Cut(strings.Trim(r.Header.Get("Soapaction"), `"`), "#")
+	body, _ := io.ReadAll(r.Body)
+	var resp string
+	switch action {
+	case "AddPinhole":
+		d.inc(&d.counters.numUPnPAddPinholeRecv)
+		if !bytes.Contains(body, []byte("<Protocol>17</Protocol>")) {
+			d.logf("AddPinhole for a protocol other than UDP: %s", body)
+			http.Error(w, "bad protocol", http.StatusInternalServerError)
+			return
+		}
+		resp = fmt.Sprintf("<UniqueID>%d</UniqueID>", testPinholeID)
+	case "UpdatePinhole":
+		d.inc(&d.counters.numUPnPUpdatePinholeRecv)
+	case "DeletePinhole":
+		d.inc(&d.counters.numUPnPDeletePinholeRecv)
+	default:
+		d.inc(&d.counters.numUPnPOtherSOAPRecv)
+		http.NotFound(w, r)
+		return
+	}
+	if action != "AddPinhole" && !bytes.Contains(body, fmt.Appendf(nil, "<UniqueID>%d</UniqueID>", testPinholeID)) {
+		d.logf("%s for an unknown pinhole: %s", action, body)
+		http.Error(w, "no such entry", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`, action, urn, resp, action)
 }
 
 func (d *TestIGD) serveUPnPDiscovery() {
@@ -155,11 +234,11 @@ func (d *TestIGD) serveUPnPDiscovery() {
 	}
 }
 
-// servePxP serves NAT-PMP and PCP, which share a port number.
-func (d *TestIGD) servePxP() {
+// servePxP serves NAT-PMP and PCP, which share a port number, on conn.
+func (d *TestIGD) servePxP(conn net.PacketConn) {
 	buf := make([]byte, 1500)
 	for {
-		n, a, err := d.pxpConn.ReadFrom(buf)
+		n, a, err := conn.ReadFrom(buf)
 		if err != nil {
 			if !d.closed.Load() {
 				d.logf("servePxP failed: %v", err)
@@ -181,7 +260,7 @@ func (d *TestIGD) servePxP() {
 		case pmpVersion:
 			d.handlePMPQuery(pkt, src)
 		case pcpVersion:
-			d.handlePCPQuery(pkt, src)
+			d.handlePCPQuery(conn, pkt, src)
 		}
 	}
 }
@@ -204,7 +283,7 @@ func (d *TestIGD) handlePMPQuery(pkt []byte, src netip.AddrPort) {
 	// TODO
 }
 
-func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
+func (d *TestIGD) handlePCPQuery(conn net.PacketConn, pkt []byte, src netip.AddrPort) {
 	d.inc(&d.counters.numPCPRecv)
 	if len(pkt) < 24 {
 		return
@@ -225,7 +304,7 @@ func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
 			return
 		}
 		resp := buildPCPDiscoResponse(pkt)
-		if _, err := d.pxpConn.WriteTo(resp, net.UDPAddrFromAddrPort(src)); err != nil {
+		if _, err := conn.WriteTo(resp, net.UDPAddrFromAddrPort(src)); err != nil {
 			d.inc(&d.counters.numFailedWrites)
 		}
 	case pcpOpMap:
@@ -239,7 +318,7 @@ func (d *TestIGD) handlePCPQuery(pkt []byte, src netip.AddrPort) {
 			return
 		}
 		resp := buildPCPMapResponse(pkt)
-		d.pxpConn.WriteTo(resp, net.UDPAddrFromAddrPort(src))
+		conn.WriteTo(resp, net.UDPAddrFromAddrPort(src))
 	default:
 		// unknown op code, ignore it for now.
 		d.inc(&d.counters.numPCPOtherRecv)
@@ -256,5 +335,6 @@ func newTestClient(t *testing.T, igd *TestIGD) *Client {
 	c.testPxPPort = igd.TestPxPPort()
 	c.testUPnPPort = igd.TestUPnPPort()
 	c.SetGatewayLookupFunc(testIPAndGateway)
+	c.SetGatewayLookupFunc6(testIPAndGateway6)
 	return c
 }
@@ -62,7 +62,12 @@ func (p *pcpMapping) GoodUntil() time.Time     { return p.goodUntil }
 func (p *pcpMapping) RenewAfter() time.Time    { return p.renewAfter }
 func (p *pcpMapping) External() netip.AddrPort { return p.external }
 func (p *pcpMapping) Release(ctx context.Context) {
-	uc, err := p.c.listenPacket(ctx, "udp4", ":0")
+	network := "udp4"
+	if p.gw.Addr().Is6() {
+		// An IPv6 pinhole; see pinhole.go.
+		network = "udp6"
+	}
+	uc, err := p.c.listenPacket(ctx, network, ":0")
 	if err != nil {
 		return
 	}
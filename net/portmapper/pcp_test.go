@@ -53,6 +53,14 @@ func buildPCPMapResponse(req []byte) []byte {
 	// copy nonce, protocol and internal port
 	copy(mapResp[:13], mapReq[:13])
 	copy(mapResp[16:18], mapReq[16:18])
+	clientIP := netip.AddrFrom16([16]byte(req[8:24]))
+	if !clientIP.Is4In6() {
+		// Act as a firewall for IPv6 clients, opening a pinhole
+		// to their internal address and port, as suggested.
+		copy(mapResp[18:20], mapReq[16:18])
+		copy(mapResp[20:36], mapReq[20:36])
+		return out
+	}
 	// assign external port
 	binary.BigEndian.PutUint16(mapResp[18:20], 4242)
 	assignedIP := netaddr.IPv4(127, 0, 0, 1)
@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package portmapper
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/neterror"
+)
+
+// IPv6 addresses aren't translated, but home routers usually run a stateful
+// firewall that drops inbound IPv6 packets that aren't replies to outbound
+// ones, so peers can't reach us directly over IPv6 until we've sent to them
+// first. A pinhole opens the firewall to inbound UDP to our IPv6 socket.
+// It's requested with a PCP MAP sent to the router over IPv6, whose
+// internal and suggested external addresses are both ours (RFC 6887,
+// section 11.3), or else with the AddPinhole action of UPnP IGDv2's
+// WANIPv6FirewallControl service (see upnp_pinhole.go).
+//
+// Pinholes are kept separately from the IPv4 mapping: they're opened for
+// a different socket and may be offered by a different service.
+
+// ErrNoGlobalIPv6 is returned, wrapped in a NoMappingError, when there's
+// no global IPv6 address to open a pinhole for.
+var ErrNoGlobalIPv6 = errors.New("skipping pinhole; no global IPv6 address")
+
+// SetGatewayLookupFunc6 sets the func that returns the machine's default IPv6
+// gateway, which may be invalid if unknown, and the global IPv6 address to
+// open pinholes for. It must be called before the client is used.
+// If not called, interfaces.LikelyHomeRouterIPv6 is used.
+func (c *Client) SetGatewayLookupFunc6(f func() (gw, myIP netip.Addr, ok bool)) {
+	c.ipAndGateway6 = f
+}
+
+// SetLocalPort6 updates the local port number of the IPv6 socket to which
+// we want to open a pinhole for inbound UDP traffic.
+func (c *Client) SetLocalPort6(localPort uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort6 == localPort {
+		return
+	}
+	c.localPort6 = localPort
+	c.invalidatePinholeLocked(true)
+}
+
+func (c *Client) gatewayAndSelfIP6() (gw, myIP netip.Addr, ok bool) {
+	gw, myIP, ok = c.ipAndGateway6()
+	if !ok {
+		gw = netip.Addr{}
+		myIP = netip.Addr{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gw != c.lastGW6 || myIP != c.lastMyIP6 || !ok {
+		c.lastMyIP6 = myIP
+		c.lastGW6 = gw
+		c.invalidatePinholeLocked(true)
+	}
+	return
+}
+
+func (c *Client) invalidatePinholeLocked(releaseOld bool) {
+	if c.pinhole != nil {
+		if releaseOld {
+			c.pinhole.Release(context.Background())
+		}
+		c.pinhole = nil
+	}
+}
+
+// HavePinhole reports whether we have a current valid IPv6 pinhole.
+func (c *Client) HavePinhole() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pinhole != nil && c.pinhole.GoodUntil().After(time.Now())
+}
+
+// GetCachedPinholeOrStartCreatingOne is like GetCachedMappingOrStartCreatingOne,
+// but for an IPv6 firewall pinhole to the port set by SetLocalPort6. The
+// returned external address is the one peers can reach us at through it.
+func (c *Client) GetCachedPinholeOrStartCreatingOne() (external netip.AddrPort, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort6 == 0 || c.closed {
+		return netip.AddrPort{}, false
+	}
+
+	now := time.Now()
+	if m := c.pinhole; m != nil {
+		if now.Before(m.GoodUntil()) {
+			if now.After(m.RenewAfter()) {
+				c.maybeStartPinholeLocked()
+			}
+			return m.External(), true
+		}
+	}
+
+	c.maybeStartPinholeLocked()
+	return netip.AddrPort{}, false
+}
+
+// maybeStartPinholeLocked starts a createPinhole goroutine up, if one isn't
+// already running.
+//
+// c.mu must be held.
+func (c *Client) maybeStartPinholeLocked() {
+	if !c.runningCreate6 {
+		c.runningCreate6 = true
+		go c.createPinhole()
+	}
+}
+
+func (c *Client) createPinhole() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.runningCreate6 = false
+	}()
+
+	if _, err := c.createOrGetPinhole(ctx); err == nil && c.onChange != nil {
+		go c.onChange()
+	} else if err != nil && !IsNoMappingError(err) {
+		c.logf("createOrGetPinhole: %v", err)
+	}
+}
+
+// createOrGetPinhole either opens a new IPv6 pinhole, renews the current
+// one if it's due, or returns the current one.
+//
+// If no pinhole is available, the error will be of type NoMappingError;
+// see IsNoMappingError.
+func (c *Client) createOrGetPinhole(ctx context.Context) (external netip.AddrPort, err error) {
+	if c.debug.DisableUPnP && c.debug.DisablePCP {
+		return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+	}
+	gw, myIP, ok := c.gatewayAndSelfIP6()
+	if !ok {
+		return netip.AddrPort{}, NoMappingError{ErrNoGlobalIPv6}
+	}
+
+	c.mu.Lock()
+	internal := netip.AddrPortFrom(myIP, c.localPort6)
+	if m := c.pinhole; m != nil && time.Now().Before(m.RenewAfter()) {
+		defer c.mu.Unlock()
+		return m.External(), nil
+	}
+	c.mu.Unlock()
+
+	// PCP is tried first, as it doesn't need UPnP discovery to have
+	// happened, and renews with a single packet.
+	if !c.debug.DisablePCP && gw.IsValid() {
+		m, err := c.getPCPPinhole(ctx, gw, internal)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.pinhole = m
+			return m.external, nil
+		}
+		if c.debug.VerboseLogs {
+			c.logf("PCP pinhole: %v", err)
+		}
+	}
+	if external, ok := c.getUPnPPinhole(ctx, internal); ok {
+		return external, nil
+	}
+	return netip.AddrPort{}, NoMappingError{ErrNoPortMappingServices}
+}
+
+// getPCPPinhole asks the PCP server on the IPv6 gateway gw for a pinhole
+// to internal.
+func (c *Client) getPCPPinhole(ctx context.Context, gw netip.Addr, internal netip.AddrPort) (*pcpMapping, error) {
+	uc, err := c.listenPacket(ctx, "udp6", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+
+	uc.SetReadDeadline(time.Now().Add(portMapServiceTimeout))
+	defer closeCloserOnContextDone(ctx, uc)()
+
+	pxpAddr := netip.AddrPortFrom(gw, c.pxpPort())
+	pkt := buildPCPRequestMappingPacket(internal.Addr(), internal.Port(), internal.Port(), pcpMapLifetimeSec, internal.Addr())
+	metricPCPPinholeSent.Add(1)
+	if _, err := uc.WriteToUDPAddrPort(pkt, pxpAddr); err != nil {
+		if neterror.TreatAsLostUDP(err) {
+			err = NoMappingError{ErrNoPortMappingServices}
+		}
+		return nil, err
+	}
+
+	res := make([]byte, 1500)
+	for {
+		n, src, err := uc.ReadFromUDPAddrPort(res)
+		if err != nil {
+			return nil, err
+		}
+		// The zone of a link-local gateway may be named differently
+		// than the one the packet arrived on is reported as.
+		if src.Addr().WithZone("") != gw.WithZone("") || src.Port() != pxpAddr.Port() {
+			continue
+		}
+		m, err := parsePCPMapResponse(res[:n])
+		if err != nil {
+			metricPCPPinholeErr.Add(1)
+			return nil, err
+		}
+		if !m.external.Addr().Is6() || m.external.Addr().IsUnspecified() {
+			// Some firewalls leave the external address out, as
+			// it's always ours.
+			m.external = netip.AddrPortFrom(internal.Addr(), m.external.Port())
+		}
+		if m.external.Port() == 0 {
+			m.external = internal
+		}
+		m.c = c
+		m.gw = pxpAddr
+		m.internal = internal
+		metricPCPPinholeOK.Add(1)
+		return m, nil
+	}
+}
@@ -62,10 +62,13 @@ type Client struct {
 	logf         logger.Logf
 	netMon       *netmon.Monitor // optional; nil means interfaces will be looked up on-demand
 	ipAndGateway func() (gw, ip netip.Addr, ok bool)
-	onChange     func() // or nil
-	debug        DebugKnobs
-	testPxPPort  uint16 // if non-zero, pxpPort to use for tests
-	testUPnPPort uint16 // if non-zero, uPnPPort to use for tests
+	// ipAndGateway6 is like ipAndGateway, for the IPv6 gateway and
+	// global IPv6 address pinholes are opened for.
+	ipAndGateway6 func() (gw, ip netip.Addr, ok bool)
+	onChange      func() // or nil
+	debug         DebugKnobs
+	testPxPPort   uint16 // if non-zero, pxpPort to use for tests
+	testUPnPPort  uint16 // if non-zero, uPnPPort to use for tests
 
 	mu sync.Mutex // guards following, and all fields thereof
 
@@ -93,6 +96,16 @@ type Client struct {
 	localPort uint16
 
 	mapping mapping // non-nil if we have a mapping
+
+	// runningCreate6 is whether a createPinhole goroutine is running.
+	runningCreate6 bool
+
+	lastMyIP6 netip.Addr
+	lastGW6   netip.Addr
+
+	localPort6 uint16
+
+	pinhole mapping // non-nil if we have an IPv6 firewall pinhole
 }
 
 // mapping represents a created port-mapping over some protocol.  It specifies a lease duration,
@@ -166,10 +179,11 @@ func (m *pmpMapping) Release(ctx context.Context) {
 // it doesn't make a callback.
 func NewClient(logf logger.Logf, netMon *netmon.Monitor, debug *DebugKnobs, onChange func()) *Client {
 	ret := &Client{
-		logf:         logf,
-		netMon:       netMon,
-		ipAndGateway: interfaces.LikelyHomeRouterIP,
-		onChange:     onChange,
+		logf:          logf,
+		netMon:        netMon,
+		ipAndGateway:  interfaces.LikelyHomeRouterIP,
+		ipAndGateway6: interfaces.LikelyHomeRouterIPv6,
+		onChange:      onChange,
 	}
 	if debug != nil {
 		ret.debug = *debug
@@ -192,6 +206,7 @@ func (c *Client) NoteNetworkDown() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.invalidateMappingsLocked(false)
+	c.invalidatePinholeLocked(false)
 }
 
 func (c *Client) Close() error {
@@ -202,6 +217,7 @@ func (c *Client) Close() error {
 	}
 	c.closed = true
 	c.invalidateMappingsLocked(true)
+	c.invalidatePinholeLocked(true)
 	// TODO: close some future ever-listening UDP socket(s),
 	// waiting for multicast announcements from router.
 	return nil
@@ -361,7 +377,7 @@ func IsNoMappingError(err error) bool {
 var (
 	ErrNoPortMappingServices = errors.New("no port mapping services were found")
 	ErrGatewayRange          = errors.New("skipping portmap; gateway range likely lacks support")
-	ErrGatewayIPv6           = errors.New("skipping portmap; no IPv6 support for portmapping")
+	ErrGatewayIPv6           = errors.New("skipping portmap; IPv6 gateways get pinholes, not mappings")
 )
 
 // GetCachedMappingOrStartCreatingOne quickly returns with our current cached portmapping, if any.
@@ -1013,3 +1029,26 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	// we received a UPnP response with a new meta.
 	metricUPnPUpdatedMeta = clientmetric.NewCounter("portmap_upnp_updated_meta")
 )
+
+// IPv6 pinhole metrics
+var (
+	// metricPCPPinholeSent counts the number of times we sent a PCP
+	// request for an IPv6 pinhole.
+	metricPCPPinholeSent = clientmetric.NewCounter("portmap_pinhole_pcp_sent")
+
+	// metricPCPPinholeOK counts the number of times
+	// we got an IPv6 pinhole over PCP.
+	metricPCPPinholeOK = clientmetric.NewCounter("portmap_pinhole_pcp_ok")
+
+	// metricPCPPinholeErr counts the number of times
+	// a PCP server refused us an IPv6 pinhole.
+	metricPCPPinholeErr = clientmetric.NewCounter("portmap_pinhole_pcp_err")
+
+	// metricUPnPPinholeOK counts the number of times
+	// we opened an IPv6 pinhole over UPnP.
+	metricUPnPPinholeOK = clientmetric.NewCounter("portmap_pinhole_upnp_ok")
+
+	// metricUPnPPinholeErr counts the number of times
+	// a UPnP device refused us an IPv6 pinhole.
+	metricUPnPPinholeErr = clientmetric.NewCounter("portmap_pinhole_upnp_err")
+)
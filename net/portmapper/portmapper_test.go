@@ -5,6 +5,7 @@
 
 import (
 	"context"
+	"net/netip"
 	"os"
 	"reflect"
 	"strconv"
@@ -122,3 +123,76 @@ func TestPCPIntegration(t *testing.T) {
 		t.Errorf("got nil mapping after successful createOrGetMapping")
 	}
 }
+
+func TestPCPPinholeIntegration(t *testing.T) {
+	igd, err := NewTestIGD(t.Logf, TestIGDOptions{PCP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igd.Close()
+	if igd.pxpConn6 == nil {
+		t.Skip("no IPv6 loopback")
+	}
+
+	c := newTestClient(t, igd)
+	defer c.Close()
+	c.SetLocalPort6(1234)
+
+	external, err := c.createOrGetPinhole(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get pinhole: %v", err)
+	}
+	if want := netip.AddrPortFrom(testIPv6, 1234); external != want {
+		t.Errorf("external = %v; want %v", external, want)
+	}
+	if !c.HavePinhole() {
+		t.Errorf("no pinhole after successful createOrGetPinhole")
+	}
+	if c.HaveMapping() {
+		t.Errorf("pinhole counted as an IPv4 mapping")
+	}
+	if got := igd.stats().numPCPMapRecv; got != 1 {
+		t.Errorf("PCP MAP requests = %d; want 1", got)
+	}
+}
+
+func TestUPnPPinholeIntegration(t *testing.T) {
+	igd, err := NewTestIGD(t.Logf, TestIGDOptions{UPnP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igd.Close()
+
+	c := newTestClient(t, igd)
+	defer c.Close()
+	c.SetLocalPort6(1234)
+	if res, err := c.Probe(context.Background()); err != nil || !res.UPnP {
+		t.Fatalf("Probe = %+v, %v; want UPnP", res, err)
+	}
+
+	want := netip.AddrPortFrom(testIPv6, 1234)
+	external, err := c.createOrGetPinhole(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get pinhole: %v", err)
+	}
+	if external != want {
+		t.Errorf("external = %v; want %v", external, want)
+	}
+
+	// Make the pinhole due for renewal.
+	c.mu.Lock()
+	p := *c.pinhole.(*upnpPinhole)
+	p.renewAfter = time.Now().Add(-time.Second)
+	c.pinhole = &p
+	c.mu.Unlock()
+	if external, err = c.createOrGetPinhole(context.Background()); err != nil || external != want {
+		t.Errorf("renewing = %v, %v; want %v", external, err, want)
+	}
+
+	c.Close()
+	st := igd.stats()
+	if st.numUPnPAddPinholeRecv != 1 || st.numUPnPUpdatePinholeRecv != 1 || st.numUPnPDeletePinholeRecv != 1 {
+		t.Errorf("pinholes added %d, updated %d, deleted %d times; want once each",
+			st.numUPnPAddPinholeRecv, st.numUPnPUpdatePinholeRecv, st.numUPnPDeletePinholeRecv)
+	}
+}
@@ -170,27 +170,62 @@ func addAnyPortMapping(
 // The provided ctx is not retained in the returned upnpClient, but
 // its associated HTTP client is (if set via goupnp.WithHTTPClient).
 func getUPnPClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw netip.Addr, meta uPnPDiscoResponse) (client upnpClient, err error) {
+	root, u, err := getUPnPRootDevice(ctx, logf, debug, gw, meta)
+	if root == nil || err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if client == nil {
+			return
+		}
+		logf("saw UPnP type %v at %v; %v (%v)",
+			strings.TrimPrefix(fmt.Sprintf("%T", client), "*internetgateway2."),
+			meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
+	}()
+
+	// These parts don't do a network fetch.
+	// Pick the best service type available.
+	if cc, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	if cc, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	if cc, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
+		return cc[0], nil
+	}
+	return nil, nil
+}
+
+// getUPnPRootDevice fetches the description of the Internet Gateway Device
+// found by UPnP discovery, returning it and the URL it was fetched from.
+// It returns a nil root device if UPnP is disabled or wasn't discovered.
+//
+// If gw is valid and differs from the device's address, the device is
+// assumed to be reachable at gw instead.
+func getUPnPRootDevice(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw netip.Addr, meta uPnPDiscoResponse) (root *goupnp.RootDevice, u *url.URL, err error) {
 	if controlknobs.DisableUPnP() || debug.DisableUPnP {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if meta.Location == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if debug.VerboseLogs {
 		logf("fetching %v", meta.Location)
 	}
-	u, err := url.Parse(meta.Location)
+	u, err = url.Parse(meta.Location)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ipp, err := netip.ParseAddrPort(u.Host)
 	if err != nil {
-		return nil, fmt.Errorf("unexpected host %q in %q", u.Host, meta.Location)
+		return nil, nil, fmt.Errorf("unexpected host %q in %q", u.Host, meta.Location)
 	}
-	if ipp.Addr() != gw {
+	if gw.IsValid() && ipp.Addr() != gw {
 		// https://github.com/tailscale/tailscale/issues/5502
 		logf("UPnP discovered root %q does not match gateway IP %v; repointing at gateway which is assumed to be floating",
 			meta.Location, gw)
@@ -205,32 +240,11 @@ func getUPnPClient(ctx context.Context, logf logger.Logf, debug DebugKnobs, gw n
 	defer cancel()
 
 	// This part does a network fetch.
-	root, err := goupnp.DeviceByURL(ctx, u)
+	root, err = goupnp.DeviceByURL(ctx, u)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	defer func() {
-		if client == nil {
-			return
-		}
-		logf("saw UPnP type %v at %v; %v (%v)",
-			strings.TrimPrefix(fmt.Sprintf("%T", client), "*internetgateway2."),
-			meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
-	}()
-
-	// These parts don't do a network fetch.
-	// Pick the best service type available.
-	if cc, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	if cc, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	if cc, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(ctx, root, u); len(cc) > 0 {
-		return cc[0], nil
-	}
-	return nil, nil
+	return root, u, nil
 }
 
 func (c *Client) upnpHTTPClientLocked() *http.Client {
@@ -0,0 +1,207 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !js
+
+package portmapper
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/tailscale/goupnp"
+	"github.com/tailscale/goupnp/soap"
+	"tailscale.com/control/controlknobs"
+)
+
+// References:
+//
+// WANIPv6FirewallControl v1: http://upnp.org/specs/gw/UPnP-gw-WANIPv6FirewallControl-v1-Service.pdf
+
+// urnWANIPv6FirewallControl1 is the service type of UPnP IGDv2's IPv6
+// firewall control, which goupnp has no generated client for.
+const urnWANIPv6FirewallControl1 = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+
+// upnpProtocolNumberUDP is the IANA protocol number of UDP, which is how
+// WANIPv6FirewallControl names protocols, unlike WANIPConnection.
+const upnpProtocolNumberUDP = 17
+
+// upnpFirewallClient is a client of a WANIPv6FirewallControl service.
+type upnpFirewallClient struct {
+	goupnp.ServiceClient
+}
+
+// AddPinhole opens a pinhole from any remote host and port to internal for
+// UDP, returning the pinhole's ID.
+func (client *upnpFirewallClient) AddPinhole(ctx context.Context, internal netip.AddrPort, leaseTime time.Duration) (uniqueID uint16, err error) {
+	request := &struct {
+		RemoteHost     string
+		RemotePort     string
+		InternalClient string
+		InternalPort   string
+		Protocol       string
+		LeaseTime      string
+	}{}
+	// An empty RemoteHost and a zero RemotePort are wildcards.
+	if request.RemotePort, err = soap.MarshalUi2(0); err != nil {
+		return
+	}
+	if request.InternalClient, err = soap.MarshalString(internal.Addr().String()); err != nil {
+		return
+	}
+	if request.InternalPort, err = soap.MarshalUi2(internal.Port()); err != nil {
+		return
+	}
+	if request.Protocol, err = soap.MarshalUi2(upnpProtocolNumberUDP); err != nil {
+		return
+	}
+	if request.LeaseTime, err = soap.MarshalUi4(uint32(leaseTime.Seconds())); err != nil {
+		return
+	}
+
+	response := &struct {
+		UniqueID string
+	}{}
+	if err = client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "AddPinhole", request, response); err != nil {
+		return
+	}
+	return soap.UnmarshalUi2(response.UniqueID)
+}
+
+// UpdatePinhole extends the lease of the pinhole uniqueID to leaseTime
+// from now.
+func (client *upnpFirewallClient) UpdatePinhole(ctx context.Context, uniqueID uint16, leaseTime time.Duration) (err error) {
+	request := &struct {
+		UniqueID     string
+		NewLeaseTime string
+	}{}
+	if request.UniqueID, err = soap.MarshalUi2(uniqueID); err != nil {
+		return
+	}
+	if request.NewLeaseTime, err = soap.MarshalUi4(uint32(leaseTime.Seconds())); err != nil {
+		return
+	}
+	return client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "UpdatePinhole", request, nil)
+}
+
+// DeletePinhole closes the pinhole uniqueID.
+func (client *upnpFirewallClient) DeletePinhole(ctx context.Context, uniqueID uint16) (err error) {
+	request := &struct {
+		UniqueID string
+	}{}
+	if request.UniqueID, err = soap.MarshalUi2(uniqueID); err != nil {
+		return
+	}
+	return client.SOAPClient.PerformAction(ctx, urnWANIPv6FirewallControl1, "DeletePinhole", request, nil)
+}
+
+// upnpPinhole is an IPv6 firewall pinhole opened over UPnP. After being
+// created it is immutable, but the client field may be shared across
+// pinholes.
+type upnpPinhole struct {
+	internal   netip.AddrPort
+	uniqueID   uint16
+	goodUntil  time.Time
+	renewAfter time.Time
+
+	client *upnpFirewallClient
+}
+
+func (u *upnpPinhole) GoodUntil() time.Time  { return u.goodUntil }
+func (u *upnpPinhole) RenewAfter() time.Time { return u.renewAfter }
+
+// External returns the internal address, as pinholes don't translate.
+func (u *upnpPinhole) External() netip.AddrPort { return u.internal }
+
+func (u *upnpPinhole) Release(ctx context.Context) {
+	u.client.DeletePinhole(ctx, u.uniqueID)
+}
+
+// getUPnPFirewallClient returns a client of the WANIPv6FirewallControl
+// service of the Internet Gateway Device described by meta, or nil if it
+// has none. The gw is the detected IPv4 gateway, if any.
+func getUPnPFirewallClient(ctx context.Context, c *Client, gw netip.Addr, meta uPnPDiscoResponse) (*upnpFirewallClient, error) {
+	root, u, err := getUPnPRootDevice(ctx, c.logf, c.debug, gw, meta)
+	if root == nil || err != nil {
+		return nil, err
+	}
+	cc, err := goupnp.NewServiceClientsFromRootDevice(ctx, root, u, urnWANIPv6FirewallControl1)
+	if err != nil || len(cc) == 0 {
+		return nil, err
+	}
+	c.logf("saw UPnP IPv6 firewall control at %v; %v (%v)", meta.Location, root.Device.FriendlyName, root.Device.Manufacturer)
+	return &upnpFirewallClient{cc[0]}, nil
+}
+
+// getUPnPPinhole attempts to open, or renew, an IPv6 pinhole to internal
+// over UPnP. It depends on Probe having discovered a UPnP IGD over IPv4,
+// as dual-stack home routers only answer discovery there. On success, it
+// returns the address the pinhole can be reached at.
+func (c *Client) getUPnPPinhole(ctx context.Context, internal netip.AddrPort) (external netip.AddrPort, ok bool) {
+	if controlknobs.DisableUPnP() || c.debug.DisableUPnP {
+		return netip.AddrPort{}, false
+	}
+
+	c.mu.Lock()
+	old, _ := c.pinhole.(*upnpPinhole)
+	meta := c.uPnPMeta
+	gw := c.lastGW
+	httpClient := c.upnpHTTPClientLocked()
+	c.mu.Unlock()
+
+	lease := time.Duration(pmpMapLifetimeSec) * time.Second
+	now := time.Now()
+	if old != nil && old.internal == internal {
+		err := old.client.UpdatePinhole(ctx, old.uniqueID, lease)
+		if c.debug.VerboseLogs {
+			c.logf("UpdatePinhole(%v): %v", old.uniqueID, err)
+		}
+		if err == nil {
+			p := *old
+			p.goodUntil = now.Add(lease)
+			p.renewAfter = now.Add(lease / 2)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.pinhole = &p
+			return internal, true
+		}
+		// The router may have forgotten it, such as by rebooting.
+		// Open a new one.
+	}
+
+	var client *upnpFirewallClient
+	if old != nil {
+		client = old.client
+	} else {
+		var err error
+		client, err = getUPnPFirewallClient(goupnp.WithHTTPClient(ctx, httpClient), c, gw, meta)
+		if c.debug.VerboseLogs {
+			c.logf("getUPnPFirewallClient: %v, %v", client != nil, err)
+		}
+		if client == nil {
+			return netip.AddrPort{}, false
+		}
+	}
+
+	id, err := client.AddPinhole(ctx, internal, lease)
+	if c.debug.VerboseLogs {
+		c.logf("AddPinhole: %v, err=%v", id, err)
+	}
+	if err != nil {
+		metricUPnPPinholeErr.Add(1)
+		return netip.AddrPort{}, false
+	}
+	metricUPnPPinholeOK.Add(1)
+	p := &upnpPinhole{
+		internal:   internal,
+		uniqueID:   id,
+		goodUntil:  now.Add(lease),
+		renewAfter: now.Add(lease / 2),
+		client:     client,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinhole = p
+	return internal, true
+}
@@ -92,6 +92,18 @@ type Server struct {
 	// Username and Password, if set, are the credential clients must provide.
 	Username string
 	Password string
+
+	// UDPIdleTimeout optionally specifies how long a UDP association may go
+	// without datagrams in either direction before it's torn down.
+	// If zero, two minutes is used.
+	UDPIdleTimeout time.Duration
+}
+
+func (s *Server) udpIdleTimeout() time.Duration {
+	if s.UDPIdleTimeout > 0 {
+		return s.UDPIdleTimeout
+	}
+	return 2 * time.Minute
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -177,6 +189,10 @@ func (c *Conn) handleRequest() error {
 		c.clientConn.Write(buf)
 		return err
 	}
+	if req.command == udpAssociate {
+		c.request = req
+		return c.handleUDPAssociate()
+	}
 	if req.command != connect {
 		res := &response{reply: commandNotSupported}
 		buf, _ := res.marshal()
@@ -205,19 +221,9 @@ func (c *Conn) handleRequest() error {
 	}
 	serverPort, _ := strconv.Atoi(serverPortStr)
 
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
-		}
-	} else {
-		bindAddrType = domainName
-	}
 	res := &response{
 		reply:        success,
-		bindAddrType: bindAddrType,
+		bindAddrType: addrTypeOf(serverAddr),
 		bindAddr:     serverAddr,
 		bindPort:     uint16(serverPort),
 	}
@@ -315,52 +321,59 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
 
-	var destination string
-	var port uint16
+	destination, port, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
 
-	if destAddrType == ipv4 {
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
+
+// parseAddr reads an address of type typ and a port, in the format of the
+// DST.ADDR and DST.PORT fields of RFC 1928.
+func parseAddr(r io.Reader, typ addrType) (addr string, port uint16, err error) {
+	switch typ {
+	case ipv4:
 		var ip [4]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else if destAddrType == domainName {
+		addr = net.IP(ip[:]).String()
+	case domainName:
 		var dstSizeByte [1]byte
 		_, err = io.ReadFull(r, dstSizeByte[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
 		_, err = io.ReadFull(r, domainName)
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
-		destination = string(domainName)
-	} else if destAddrType == ipv6 {
+		addr = string(domainName)
+	case ipv6:
 		var ip [16]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
-		destination = net.IP(ip[:]).String()
-	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		addr = net.IP(ip[:]).String()
+	default:
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
 	_, err = io.ReadFull(r, portBytes[:])
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return "", 0, fmt.Errorf("could not read port")
 	}
-	port = binary.BigEndian.Uint16(portBytes[:])
-
-	return &request{
-		command:      commandType(cmd),
-		destination:  destination,
-		port:         port,
-		destAddrType: destAddrType,
-	}, nil
+	return addr, binary.BigEndian.Uint16(portBytes[:]), nil
 }
 
 // response contains the contents of
@@ -386,32 +399,48 @@ func (res *response) marshal() ([]byte, error) {
 	if res.reply != success {
 		return pkt, nil
 	}
+	return appendAddr(pkt, res.bindAddrType, res.bindAddr, res.bindPort)
+}
 
-	var addr []byte
-	switch res.bindAddrType {
+// appendAddr appends addr of type typ and port to pkt, in the format of
+// the BND.ADDR and BND.PORT fields of RFC 1928.
+func appendAddr(pkt []byte, typ addrType, addr string, port uint16) ([]byte, error) {
+	var b []byte
+	switch typ {
 	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
+		b = net.ParseIP(addr).To4()
+		if b == nil {
 			return nil, fmt.Errorf("invalid IPv4 address for binding")
 		}
 	case domainName:
-		if len(res.bindAddr) > 255 {
+		if len(addr) > 255 {
 			return nil, fmt.Errorf("invalid domain name for binding")
 		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
+		b = make([]byte, 0, len(addr)+1)
+		b = append(b, byte(len(addr)))
+		b = append(b, []byte(addr)...)
 	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
+		b = net.ParseIP(addr).To16()
+		if b == nil {
 			return nil, fmt.Errorf("invalid IPv6 address for binding")
 		}
 	default:
 		return nil, fmt.Errorf("unsupported address type")
 	}
 
-	pkt = append(pkt, addr...)
-	pkt = binary.BigEndian.AppendUint16(pkt, uint16(res.bindPort))
-
+	pkt = append(pkt, b...)
+	pkt = binary.BigEndian.AppendUint16(pkt, port)
 	return pkt, nil
 }
+
+// addrTypeOf returns the address type to use for host, which is either an
+// IP literal or a domain name.
+func addrTypeOf(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
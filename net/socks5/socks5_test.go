@@ -4,11 +4,16 @@
 package socks5
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"os"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -152,3 +157,198 @@ func TestReadPassword(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func udpEchoServer(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(buf[:n], addr)
+	}
+}
+
+// startUDPAssociation starts s, and requests a UDP association from it. It
+// returns the association's TCP connection and relay address.
+func startUDPAssociation(t *testing.T, s *Server) (ctrl net.Conn, relayAddr netip.AddrPort) {
+	t.Helper()
+	socks5ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socks5ln.Close() })
+	go func() {
+		err := s.Serve(socks5ln)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			panic(err)
+		}
+	}()
+
+	// Negotiate the association over TCP.
+	ctrl, err = net.Dial("tcp", socks5ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ctrl.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, buf[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if replyCode(buf[1]) != success || addrType(buf[3]) != ipv4 {
+		t.Fatalf("bad UDP ASSOCIATE response: %v", buf[:10])
+	}
+	return ctrl, netip.AddrPortFrom(netip.AddrFrom4([4]byte(buf[4:8])), binary.BigEndian.Uint16(buf[8:10]))
+}
+
+func TestUDPAssociate(t *testing.T) {
+	// backend server which we'll use SOCKS5 to send datagrams to
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go udpEchoServer(backend)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	ctrl, relayAddr := startUDPAssociation(t, &Server{UDPIdleTimeout: 500 * time.Millisecond})
+	buf := make([]byte, 1500)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	hdr, err := appendAddr([]byte{0, 0, 0, byte(ipv4)}, ipv4, backendAddr.Addr().String(), backendAddr.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(frag byte, payload string) {
+		t.Helper()
+		pkt := append([]byte(nil), hdr...)
+		pkt[2] = frag
+		pkt = append(pkt, payload...)
+		if _, err := client.WriteToUDPAddrPort(pkt, relayAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(0, "hello")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frag, src, payload, err := parseUDPRequest(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag != 0 || src != backendAddr.String() || string(payload) != "hello" {
+		t.Errorf("got frag=%d src=%q payload=%q; want 0, %q, %q", frag, src, payload, backendAddr, "hello")
+	}
+
+	// Fragments are dropped.
+	send(1, "fragment")
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFromUDPAddrPort(buf); err == nil {
+		t.Errorf("got reply to fragmented datagram; want none")
+	}
+
+	// After the idle timeout, the server closes the association's TCP
+	// connection.
+	if _, err := ctrl.Read(buf); err == nil {
+		t.Errorf("TCP connection still open after idle timeout")
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("association not closed after idle timeout")
+	}
+}
+
+func TestUDPAssociateSlowDestination(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go udpEchoServer(backend)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// Dialing slowAddr blocks until release is closed.
+	const slowAddr = "192.0.2.1:9"
+	release := make(chan struct{})
+	slowConns := make(chan net.Conn, 1)
+	var d net.Dialer
+	s := &Server{
+		UDPIdleTimeout: 10 * time.Second,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != slowAddr {
+				return d.DialContext(ctx, network, addr)
+			}
+			<-release
+			c, err := d.DialContext(ctx, network, backendAddr.String())
+			if err == nil {
+				slowConns <- c
+			}
+			return c, err
+		},
+	}
+	ctrl, relayAddr := startUDPAssociation(t, s)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(host string, port uint16, payload string) {
+		t.Helper()
+		pkt, err := appendAddr([]byte{0, 0, 0, byte(ipv4)}, ipv4, host, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt = append(pkt, payload...)
+		if _, err := client.WriteToUDPAddrPort(pkt, relayAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// While a destination is being dialed, datagrams to others are
+	// still relayed.
+	send("192.0.2.1", 9, "slow")
+	send(backendAddr.Addr().String(), backendAddr.Port(), "hello")
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatalf("no reply while another destination is dialed: %v", err)
+	}
+	if _, _, payload, err := parseUDPRequest(buf[:n]); err != nil || string(payload) != "hello" {
+		t.Errorf("got payload %q, %v; want %q", payload, err, "hello")
+	}
+
+	// A dial which finishes after the association ends is closed.
+	ctrl.Close()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	c := <-slowConns
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := c.Write([]byte("x")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("conn dialed after the association ended is still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
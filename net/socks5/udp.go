@@ -0,0 +1,301 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxUDPTargets bounds the number of destinations a single UDP association
+// may send to, and so the number of outgoing sockets it uses.
+const maxUDPTargets = 256
+
+// maxUDPPending bounds the number of datagrams queued for a destination
+// while it's being dialed. Any more are dropped.
+const maxUDPPending = 16
+
+// udpDialTimeout is how long dialing a destination may take.
+const udpDialTimeout = 5 * time.Second
+
+// maxUDPPacketSize is the largest UDP datagram relayed in either direction.
+const maxUDPPacketSize = 64 << 10
+
+// udpHeaderLen is the length of a UDP request header without its address.
+const udpHeaderLen = 4
+
+// handleUDPAssociate handles a UDP ASSOCIATE request, as described in
+// RFC 1928, section 7. It relays datagrams between a UDP socket it opens
+// for the client and the destinations the client addresses them to, until
+// the client closes its TCP connection or the association is idle for
+// Server.UDPIdleTimeout.
+func (c *Conn) handleUDPAssociate() error {
+	fail := func(err error) error {
+		res := &response{reply: generalFailure}
+		buf, _ := res.marshal()
+		c.clientConn.Write(buf)
+		return err
+	}
+
+	// Open the relay socket on the IP the client reached us on, so it's
+	// reachable by the client too.
+	localHost, _, err := net.SplitHostPort(c.clientConn.LocalAddr().String())
+	if err != nil {
+		return fail(err)
+	}
+	localIP, err := netip.ParseAddr(localHost)
+	if err != nil {
+		return fail(fmt.Errorf("relay address: %w", err))
+	}
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localIP.Unmap(), 0)))
+	if err != nil {
+		return fail(err)
+	}
+	defer relay.Close()
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr).AddrPort()
+	res := &response{
+		reply:        success,
+		bindAddrType: addrTypeOf(relayAddr.Addr().String()),
+		bindAddr:     relayAddr.Addr().String(),
+		bindPort:     relayAddr.Port(),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := c.clientConn.Write(buf); err != nil {
+		return err
+	}
+
+	a := &udpAssociation{
+		srv:     c.srv,
+		relay:   relay,
+		idle:    c.srv.udpIdleTimeout(),
+		targets: make(map[string]net.Conn),
+	}
+	a.client, err = c.udpClientAddr()
+	if err != nil {
+		return err
+	}
+	return a.run(c.clientConn)
+}
+
+// udpClientAddr returns the address datagrams from the client are expected
+// to come from. Per RFC 1928, the request's DST.ADDR and DST.PORT are
+// where the client will send from; zero values mean they aren't known yet.
+// Without an address, the client's TCP connection IP is used.
+func (c *Conn) udpClientAddr() (netip.AddrPort, error) {
+	var ip netip.Addr
+	if c.request.destAddrType != domainName {
+		ip, _ = netip.ParseAddr(c.request.destination)
+	}
+	if !ip.IsValid() || ip.IsUnspecified() {
+		host, _, err := net.SplitHostPort(c.clientConn.RemoteAddr().String())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		ip, err = netip.ParseAddr(host)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("client address: %w", err)
+		}
+	}
+	return netip.AddrPortFrom(ip.Unmap(), c.request.port), nil
+}
+
+// udpAssociation is the state of a UDP ASSOCIATE request.
+type udpAssociation struct {
+	srv   *Server
+	relay *net.UDPConn
+	idle  time.Duration
+	timer *time.Timer // ends the association after idle without datagrams
+
+	// client is where datagrams from the client come from. Its port is
+	// zero until the first datagram is received, after which it's fixed
+	// for the life of the association and replies are sent to it.
+	client netip.AddrPort
+
+	mu      sync.Mutex
+	closed  bool                // whether closeTargets has been called
+	targets map[string]net.Conn // by destination host:port as sent by the client
+	dialing map[string][][]byte // datagrams queued for destinations being dialed
+}
+
+// run relays datagrams until ctrl, the client's TCP connection, is closed
+// or the association times out.
+func (a *udpAssociation) run(ctrl net.Conn) error {
+	a.timer = time.AfterFunc(a.idle, func() { ctrl.Close() })
+	defer a.timer.Stop()
+	defer a.closeTargets()
+
+	// The association lasts as long as the TCP connection it was
+	// requested on. Nothing more is expected to be read from it.
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		a.relay.Close()
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, src, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return nil // relay closed
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if !a.fromClient(src) {
+			continue
+		}
+		frag, dst, payload, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			a.srv.logf("udp: dropping bad datagram from %v: %v", src, err)
+			continue
+		}
+		if frag != 0 {
+			// Fragmentation is optional in RFC 1928; drop fragments.
+			continue
+		}
+		a.timer.Reset(a.idle)
+		if err := a.send(dst, payload); err != nil {
+			a.srv.logf("udp: %v", err)
+		}
+	}
+}
+
+// fromClient reports whether a datagram from src belongs to the
+// association, and locks in the client's port on the first datagram.
+func (a *udpAssociation) fromClient(src netip.AddrPort) bool {
+	if src.Addr() != a.client.Addr() {
+		return false
+	}
+	if a.client.Port() == 0 {
+		a.client = src
+		return true
+	}
+	return src.Port() == a.client.Port()
+}
+
+// send sends payload to the destination dst. If dst hasn't been sent to
+// before, it's dialed in the background, so that a slow destination doesn't
+// hold up the others, and payload is queued until that's done.
+func (a *udpAssociation) send(dst string, payload []byte) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return errors.New("association closed")
+	}
+	if c, ok := a.targets[dst]; ok {
+		a.mu.Unlock()
+		_, err := c.Write(payload)
+		return err
+	}
+	if q, ok := a.dialing[dst]; ok {
+		defer a.mu.Unlock()
+		if len(q) >= maxUDPPending {
+			return fmt.Errorf("still dialing; dropping datagram to %s", dst)
+		}
+		a.dialing[dst] = append(q, bytes.Clone(payload))
+		return nil
+	}
+	if len(a.targets)+len(a.dialing) >= maxUDPTargets {
+		a.mu.Unlock()
+		return fmt.Errorf("too many destinations; dropping datagram to %s", dst)
+	}
+	if a.dialing == nil {
+		a.dialing = make(map[string][][]byte)
+	}
+	a.dialing[dst] = [][]byte{bytes.Clone(payload)}
+	a.mu.Unlock()
+
+	go a.dialTarget(dst)
+	return nil
+}
+
+// dialTarget dials the destination dst, and sends it the datagrams queued
+// meanwhile. The conn is closed instead if the association was closed
+// during the dial.
+func (a *udpAssociation) dialTarget(dst string) {
+	ctx, cancel := context.WithTimeout(context.Background(), udpDialTimeout)
+	defer cancel()
+	c, err := a.srv.dial(ctx, "udp", dst)
+
+	a.mu.Lock()
+	queued := a.dialing[dst]
+	delete(a.dialing, dst)
+	if err != nil {
+		a.mu.Unlock()
+		a.srv.logf("udp: dialing %s: %v", dst, err)
+		return
+	}
+	if a.closed {
+		a.mu.Unlock()
+		c.Close()
+		return
+	}
+	a.targets[dst] = c
+	a.mu.Unlock()
+
+	go a.relayReplies(c, dst)
+	for _, p := range queued {
+		c.Write(p)
+	}
+}
+
+// relayReplies sends the datagrams received from the destination dst on c
+// back to the client, until c is closed.
+func (a *udpAssociation) relayReplies(c net.Conn, dst string) {
+	host, portStr, _ := net.SplitHostPort(dst)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	typ := addrTypeOf(host)
+	hdr, err := appendAddr([]byte{0, 0, 0, byte(typ)}, typ, host, uint16(port))
+	if err != nil {
+		return
+	}
+
+	pkt := make([]byte, len(hdr)+maxUDPPacketSize)
+	copy(pkt, hdr)
+	for {
+		n, err := c.Read(pkt[len(hdr):])
+		if err != nil {
+			return
+		}
+		a.timer.Reset(a.idle)
+		a.relay.WriteToUDPAddrPort(pkt[:len(hdr)+n], a.client)
+	}
+}
+
+func (a *udpAssociation) closeTargets() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for _, c := range a.targets {
+		c.Close()
+	}
+}
+
+// parseUDPRequest parses the header of a datagram sent by the client to
+// the relay, as described in RFC 1928, section 7. It returns the
+// fragment number, the destination host:port and the payload.
+func parseUDPRequest(pkt []byte) (frag byte, dst string, payload []byte, err error) {
+	if len(pkt) < udpHeaderLen {
+		return 0, "", nil, fmt.Errorf("short packet")
+	}
+	if pkt[0] != 0 || pkt[1] != 0 {
+		return 0, "", nil, fmt.Errorf("non-zero reserved field")
+	}
+	r := bytes.NewReader(pkt[udpHeaderLen:])
+	host, port, err := parseAddr(r, addrType(pkt[3]))
+	if err != nil {
+		return 0, "", nil, err
+	}
+	payload = pkt[len(pkt)-r.Len():]
+	return pkt[2], net.JoinHostPort(host, strconv.Itoa(int(port))), payload, nil
+}
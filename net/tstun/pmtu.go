@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"net/netip"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tstun/table"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+var (
+	metricPacketOutDropTooBig = clientmetric.NewCounter("tstun_out_to_wg_drop_too_big")
+	metricTCPMSSClamped       = clientmetric.NewCounter("tstun_out_to_wg_tcp_mss_clamped")
+	metricTCPMSSClampedIn     = clientmetric.NewCounter("tstun_in_from_wg_tcp_mss_clamped")
+)
+
+// SetPeerPathMTU sets the largest packet size, in bytes, that can be sent
+// through the tunnel to peer, as found by path MTU discovery. A zero mtu
+// means that it's unknown.
+//
+// The MSS of TCP connections through the peer is clamped, in both
+// directions, to fit its path MTU, and larger packets to it that can't be
+// fragmented are dropped, answered with an ICMP error injected back into
+// the TUN as a router would, so the sender lowers its own path MTU.
+func (t *Wrapper) SetPeerPathMTU(peer key.NodePublic, mtu int) {
+	t.peerPathMTUMu.Lock()
+	defer t.peerPathMTUMu.Unlock()
+	old := t.peerPathMTU.Load()
+	if cur, ok := old[peer]; cur == mtu && (ok || mtu == 0) {
+		return
+	}
+	m := make(map[key.NodePublic]int, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if mtu == 0 {
+		delete(m, peer)
+	} else {
+		m[peer] = mtu
+	}
+	t.peerPathMTU.Store(m)
+}
+
+// peerRoutesFromWGConfig returns the routing table of the peers in wcfg.
+func peerRoutesFromWGConfig(wcfg *wgcfg.Config) *table.RoutingTable {
+	if wcfg == nil {
+		return nil
+	}
+	var rt table.RoutingTableBuilder
+	for _, p := range wcfg.Peers {
+		rt.InsertOrReplace(p.PublicKey, p.AllowedIPs...)
+	}
+	return rt.Build()
+}
+
+// peerPathMTUOf returns the path MTU of the peer that addr is routed to, if
+// known.
+func (t *Wrapper) peerPathMTUOf(addr netip.Addr) (mtu int, ok bool) {
+	mtus := t.peerPathMTU.Load()
+	if len(mtus) == 0 {
+		return 0, false
+	}
+	peer, ok := t.peerRoutes.Load().Lookup(addr)
+	if !ok {
+		return 0, false
+	}
+	mtu, ok = mtus[peer]
+	return mtu, ok
+}
+
+// clampTCPMSS clamps the MSS of p, if it's a TCP SYN or SYN-ACK, to fit
+// mtu. It reports whether it changed p.
+func clampTCPMSS(p *packet.Parsed, mtu int) bool {
+	if p.IPProto != ipproto.TCP {
+		return false
+	}
+	ipHeaderLen := 20
+	if p.IPVersion == 6 {
+		ipHeaderLen = 40
+	}
+	mss := mtu - ipHeaderLen - 20
+	return mss > 0 && p.ClampTCPMSS(uint16(mss))
+}
+
+// enforcePathMTU fits the outbound packet p to the path MTU of the peer
+// it's routed to, if known. See SetPeerPathMTU.
+func (t *Wrapper) enforcePathMTU(p *packet.Parsed) filter.Response {
+	mtu, ok := t.peerPathMTUOf(p.Dst.Addr())
+	if !ok {
+		return filter.Accept
+	}
+	if clampTCPMSS(p, mtu) {
+		metricTCPMSSClamped.Add(1)
+	}
+	if p.Len() > mtu && p.DontFragment() {
+		metricPacketOutDropTooBig.Add(1)
+		if icmp := packet.TooBig(p, mtu); icmp != nil {
+			t.InjectInboundCopy(icmp)
+		}
+		return filter.DropSilently
+	}
+	return filter.Accept
+}
+
+// clampInboundTCPMSS clamps the MSS of the inbound TCP SYN or SYN-ACK p to
+// the path MTU of the peer it came from, if known, so that the local side
+// of the connection doesn't send segments too big for the path either.
+func (t *Wrapper) clampInboundTCPMSS(p *packet.Parsed) {
+	if mtu, ok := t.peerPathMTUOf(p.Src.Addr()); ok && clampTCPMSS(p, mtu) {
+		metricTCPMSSClampedIn.Add(1)
+	}
+}
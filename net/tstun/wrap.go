@@ -187,6 +187,13 @@ type Wrapper struct {
 	// stats maintains per-connection counters.
 	stats atomic.Pointer[connstats.Statistics]
 
+	// peerRoutes maps destination IPs to the peers they're routed to.
+	peerRoutes atomic.Pointer[table.RoutingTable]
+	// peerPathMTU are the path MTUs of peers, set by SetPeerPathMTU.
+	// It's replaced, not modified, under peerPathMTUMu.
+	peerPathMTU   syncs.AtomicValue[map[key.NodePublic]int]
+	peerPathMTUMu sync.Mutex
+
 	captureHook syncs.AtomicValue[capture.Callback]
 }
 
@@ -631,6 +638,7 @@ func natConfigFromWGConfig(wcfg *wgcfg.Config) *natV4Config {
 // SetNetMap is called when a new NetworkMap is received.
 // It currently (2023-03-01) only updates the IPv4 NAT configuration.
 func (t *Wrapper) SetWGConfig(wcfg *wgcfg.Config) {
+	t.peerRoutes.Store(peerRoutesFromWGConfig(wcfg))
 	cfg := natConfigFromWGConfig(wcfg)
 	old := t.natV4Config.Swap(cfg)
 	if !reflect.DeepEqual(old, cfg) {
@@ -697,6 +705,10 @@ func (t *Wrapper) filterPacketOutboundToWireGuard(p *packet.Parsed) filter.Respo
 		return filter.Drop
 	}
 
+	if res := t.enforcePathMTU(p); res.IsDrop() {
+		return res
+	}
+
 	if t.PostFilterPacketOutboundToWireGuard != nil {
 		if res := t.PostFilterPacketOutboundToWireGuard(p, t); res.IsDrop() {
 			return res
@@ -907,6 +919,8 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		return filter.Drop
 	}
 
+	t.clampInboundTCPMSS(p)
+
 	if t.PostFilterPacketInboundFromWireGaurd != nil {
 		if res := t.PostFilterPacketInboundFromWireGaurd(p, t); res.IsDrop() {
 			return res
@@ -884,3 +884,119 @@ type captureRecord struct {
 			captured, want)
 	}
 }
+
+func TestEnforcePathMTU(t *testing.T) {
+	chtun, tw := newChannelTUN(t.Logf, false)
+	defer tw.Close()
+
+	peer := key.NewNode().Public()
+	tw.SetWGConfig(&wgcfg.Config{
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}},
+	})
+
+	// big returns a UDP packet to dst of the given size, with the DF bit
+	// set if df.
+	big := func(dst string, size int, df bool) *packet.Parsed {
+		b := make([]byte, size)
+		copy(b, udp4("100.64.0.1", dst, 1, 2))
+		binary.BigEndian.PutUint16(b[2:4], uint16(size))
+		if df {
+			b[6] = 0x40
+		}
+		p := new(packet.Parsed)
+		p.Decode(b)
+		return p
+	}
+
+	if got := tw.enforcePathMTU(big("100.64.0.2", 1400, true)); got != filter.Accept {
+		t.Errorf("unknown path MTU: got %v; want Accept", got)
+	}
+
+	tw.SetPeerPathMTU(peer, 1300)
+	if got := tw.enforcePathMTU(big("100.64.0.2", 1300, true)); got != filter.Accept {
+		t.Errorf("packet fitting the path MTU: got %v; want Accept", got)
+	}
+	if got := tw.enforcePathMTU(big("100.64.0.2", 1400, false)); got != filter.Accept {
+		t.Errorf("fragmentable packet: got %v; want Accept", got)
+	}
+	if got := tw.enforcePathMTU(big("100.64.0.3", 1400, true)); got != filter.Accept {
+		t.Errorf("packet to another peer: got %v; want Accept", got)
+	}
+
+	res := make(chan filter.Response, 1)
+	go func() {
+		res <- tw.enforcePathMTU(big("100.64.0.2", 1400, true))
+	}()
+	var icmp packet.Parsed
+	icmp.Decode(<-chtun.Inbound)
+	if got := <-res; got != filter.DropSilently {
+		t.Errorf("packet too big: got %v; want DropSilently", got)
+	}
+	if icmp.IPProto != ipproto.ICMPv4 || icmp.Dst.Addr() != netip.MustParseAddr("100.64.0.1") {
+		t.Fatalf("injected %v; want ICMPv4 to 100.64.0.1", &icmp)
+	}
+	if h := icmp.ICMP4Header(); h.Type != packet.ICMP4Unreachable || h.Code != packet.ICMP4FragmentationNeeded {
+		t.Errorf("injected ICMP type, code = %v, %v; want unreachable, fragmentation needed", h.Type, h.Code)
+	}
+
+	tw.SetPeerPathMTU(peer, 0)
+	if got := tw.enforcePathMTU(big("100.64.0.2", 1400, true)); got != filter.Accept {
+		t.Errorf("cleared path MTU: got %v; want Accept", got)
+	}
+}
+
+func TestClampInboundTCPMSS(t *testing.T) {
+	_, tw := newChannelTUN(t.Logf, false)
+	defer tw.Close()
+
+	peer := key.NewNode().Public()
+	tw.SetWGConfig(&wgcfg.Config{
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}},
+	})
+
+	// synAck returns a TCP SYN-ACK from src advertising an MSS of 1460.
+	synAck := func(src string) *packet.Parsed {
+		tcp := make([]byte, 24)
+		binary.BigEndian.PutUint16(tcp[0:], 443)
+		binary.BigEndian.PutUint16(tcp[2:], 12345)
+		tcp[12] = 6 << 4 // data offset: 6 words
+		tcp[13] = byte(packet.TCPSyn | packet.TCPAck)
+		copy(tcp[20:], []byte{2, 4, 0x05, 0xb4}) // MSS 1460
+		b := packet.Generate(packet.IP4Header{
+			IPProto: ipproto.TCP,
+			Src:     netip.MustParseAddr(src),
+			Dst:     netip.MustParseAddr("100.64.0.1"),
+		}, tcp)
+		p := new(packet.Parsed)
+		p.Decode(b)
+		return p
+	}
+	mss := func(p *packet.Parsed) uint16 {
+		b := p.Buffer()
+		return binary.BigEndian.Uint16(b[len(b)-2:])
+	}
+
+	p := synAck("100.64.0.2")
+	tw.clampInboundTCPMSS(p)
+	if got := mss(p); got != 1460 {
+		t.Errorf("MSS with unknown path MTU = %d; want 1460", got)
+	}
+
+	tw.SetPeerPathMTU(peer, 1200)
+	p = synAck("100.64.0.2")
+	tw.clampInboundTCPMSS(p)
+	if got := mss(p); got != 1160 {
+		t.Errorf("MSS = %d; want 1160", got)
+	}
+	p = synAck("100.64.0.3")
+	tw.clampInboundTCPMSS(p)
+	if got := mss(p); got != 1460 {
+		t.Errorf("MSS from another peer = %d; want 1460", got)
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package recorder implements a server which receives SSH session
+// recordings from Mirage SSH servers, as configured by
+// tailcfg.SSHAction.Recorders, and serves a web UI to find and replay them.
+//
+// A Server is an http.Handler, so it can be served on a tsnet.Server
+// listener or on any other listener reachable from the tailnet.
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// maxHeaderSize is the largest recording header a Server accepts.
+const maxHeaderSize = 64 << 10
+
+// Header is the header line of a recording, an asciinema cast file
+// header with Mirage-specific fields. It matches tailssh.CastHeader.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env"`
+	Command   string            `json:"command,omitempty"`
+
+	SrcNode       string               `json:"srcNode"`
+	SrcNodeID     tailcfg.StableNodeID `json:"srcNodeID"`
+	SrcNodeTags   []string             `json:"srcNodeTags,omitempty"`
+	SrcNodeUserID tailcfg.UserID       `json:"srcNodeUserID,omitempty"`
+	SrcNodeUser   string               `json:"srcNodeUser,omitempty"`
+	SSHUser       string               `json:"sshUser"`
+	LocalUser     string               `json:"localUser"`
+	ConnectionID  string               `json:"connectionID"`
+}
+
+// Recording is the index entry of a recorded session.
+type Recording struct {
+	// ID identifies the recording. Its cast file is stored as ID+".cast",
+	// and this entry as ID+".json".
+	ID string
+
+	// Node is the name of the SSH server node which sent the recording,
+	// and NodeID its ID. They are empty if the Server has no WhoIs func.
+	Node   string               `json:",omitempty"`
+	NodeID tailcfg.StableNodeID `json:",omitempty"`
+
+	// Addr is the address the recording was sent from.
+	Addr string `json:",omitempty"`
+
+	// Start is when the recording started, and End when it finished.
+	// End is zero for a recording in progress.
+	Start time.Time
+	End   time.Time `json:",omitempty"`
+
+	// Size is the size of the cast file in bytes.
+	Size int64
+
+	// Truncated is whether the upload of the recording ended with an
+	// error, so the recording may be incomplete.
+	Truncated bool `json:",omitempty"`
+
+	// Header is the header of the cast file.
+	Header Header
+}
+
+// InProgress reports whether r is still being recorded.
+func (r *Recording) InProgress() bool {
+	return r.End.IsZero()
+}
+
+// Duration returns how long the session lasted, or has lasted so far.
+func (r *Recording) Duration() time.Duration {
+	if r.InProgress() {
+		return time.Since(r.Start).Round(time.Second)
+	}
+	return r.End.Sub(r.Start).Round(time.Second)
+}
+
+// User returns the Mirage user who connected, or the tags of the
+// node they connected from.
+func (r *Recording) User() string {
+	if r.Header.SrcNodeUser != "" {
+		return r.Header.SrcNodeUser
+	}
+	return strings.Join(r.Header.SrcNodeTags, ",")
+}
+
+// Options are the optional parts of a Server.
+type Options struct {
+	// Logf is the logger to use. If nil, logging is discarded.
+	Logf logger.Logf
+
+	// WhoIs, if non-nil, identifies the node a recording is sent from.
+	// Recordings are only accepted from addresses it knows.
+	// LocalClient.WhoIs is suitable.
+	WhoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// DisableUI disables the web UI, so that only recordings are accepted.
+	DisableUI bool
+
+	// UIAllow are the login names of the users, and the tags of the
+	// nodes, allowed to use the web UI and JSON API, as identified by
+	// WhoIs. Everyone else, and everyone if WhoIs is nil, is refused.
+	UIAllow []string
+}
+
+// Server receives SSH session recordings at /record and stores them in
+// a Store. Unless disabled, it also serves a web UI and a JSON API to
+// list and replay them.
+type Server struct {
+	store Store
+	opts  Options
+	logf  logger.Logf
+
+	mu   sync.Mutex
+	recs map[string]*Recording // by ID
+}
+
+// NewServer returns a Server storing recordings in store, indexing the
+// recordings already there.
+func NewServer(ctx context.Context, store Store, opts Options) (*Server, error) {
+	s := &Server{
+		store: store,
+		opts:  opts,
+		logf:  opts.Logf,
+		recs:  make(map[string]*Recording),
+	}
+	if s.logf == nil {
+		s.logf = logger.Discard
+	}
+	if err := s.loadIndex(ctx); err != nil {
+		return nil, fmt.Errorf("indexing recordings: %w", err)
+	}
+	return s, nil
+}
+
+// loadIndex indexes the recordings in s.store.
+func (s *Server) loadIndex(ctx context.Context) error {
+	names, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool)
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		rec, err := s.readIndexEntry(ctx, name)
+		if err != nil {
+			s.logf("recorder: skipping index entry %s: %v", name, err)
+			continue
+		}
+		rec.ID = id
+		s.recs[id] = rec
+		indexed[id] = true
+	}
+	// A cast file without an index entry is from an upload which was
+	// interrupted by the recorder stopping. Index what there is of it.
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".cast")
+		if !ok || indexed[id] {
+			continue
+		}
+		rec, err := s.recoverRecording(ctx, id)
+		if err != nil {
+			s.logf("recorder: skipping %s: %v", name, err)
+			continue
+		}
+		s.recs[id] = rec
+		s.logf("recorder: recovered interrupted recording %s", id)
+	}
+	return nil
+}
+
+func (s *Server) readIndexEntry(ctx context.Context, name string) (*Recording, error) {
+	rc, err := s.store.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	rec := new(Recording)
+	if err := json.NewDecoder(rc).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// recoverRecording indexes the cast file of recording id, which has no
+// index entry, and writes one for it.
+func (s *Server) recoverRecording(ctx context.Context, id string) (*Recording, error) {
+	rc, err := s.store.Get(ctx, id+".cast")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	br := bufio.NewReaderSize(rc, maxHeaderSize)
+	rec := &Recording{ID: id, Truncated: true}
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if err := json.Unmarshal(line, &rec.Header); err != nil {
+		return nil, fmt.Errorf("decoding header: %w", err)
+	}
+	n, err := io.Copy(io.Discard, br)
+	if err != nil {
+		return nil, err
+	}
+	rec.Size = int64(len(line)) + n
+	rec.Start = time.Unix(rec.Header.Timestamp, 0)
+	rec.End = rec.Start
+	if err := s.writeIndexEntry(ctx, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (s *Server) writeIndexEntry(ctx context.Context, rec *Recording) error {
+	j, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, rec.ID+".json", bytes.NewReader(j))
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/record" {
+		s.serveRecord(w, r)
+		return
+	}
+	if s.opts.DisableUI {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.authorizeUI(r); err != nil {
+		s.logf("recorder: refusing UI request from %v: %v", r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.serveUI(w, r)
+}
+
+// serveRecord receives a recording, as sent by tailssh: an HTTP POST of
+// an asciinema cast file, streamed for the length of the session.
+func (s *Server) serveRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	rec := &Recording{
+		ID:    newID(now),
+		Addr:  r.RemoteAddr,
+		Start: now,
+	}
+	if s.opts.WhoIs != nil {
+		who, err := s.opts.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			s.logf("recorder: rejecting recording from unknown peer %v: %v", r.RemoteAddr, err)
+			http.Error(w, "unknown peer", http.StatusForbidden)
+			return
+		}
+		rec.Node = strings.TrimSuffix(who.Node.Name, ".")
+		rec.NodeID = who.Node.StableID
+	}
+
+	// Reading the body makes net/http send the "100 Continue" which
+	// the SSH server waits for before starting the session.
+	br := bufio.NewReaderSize(r.Body, maxHeaderSize)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		http.Error(w, "reading header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(line, &rec.Header); err != nil {
+		http.Error(w, "invalid header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	header := bytes.Clone(line) // line is only valid until br is next read
+
+	s.mu.Lock()
+	s.recs[rec.ID] = rec
+	s.mu.Unlock()
+	s.logf("recorder: recording %s: %s@%s from %s (%s)", rec.ID, rec.Header.LocalUser, rec.Node, rec.Header.SrcNode, rec.User())
+
+	// Storage continues even if the SSH server goes away, so that an
+	// interrupted session is still kept.
+	ctx := context.Background()
+	body := &uploadReader{r: io.MultiReader(bytes.NewReader(header), br)}
+	putErr := s.store.Put(ctx, rec.ID+".cast", body)
+	if body.err != nil {
+		s.logf("recorder: recording %s ended with error: %v", rec.ID, body.err)
+	}
+
+	s.mu.Lock()
+	rec.End = time.Now()
+	rec.Size = body.n
+	rec.Truncated = body.err != nil || putErr != nil
+	entry := *rec
+	s.mu.Unlock()
+
+	if putErr != nil {
+		s.logf("recorder: storing recording %s: %v", rec.ID, putErr)
+		s.mu.Lock()
+		delete(s.recs, rec.ID)
+		s.mu.Unlock()
+		http.Error(w, "storing recording failed", http.StatusInternalServerError)
+		return
+	}
+	if err := s.writeIndexEntry(ctx, &entry); err != nil {
+		s.logf("recorder: storing index entry for %s: %v", rec.ID, err)
+		http.Error(w, "storing recording failed", http.StatusInternalServerError)
+		return
+	}
+	s.logf("recorder: recording %s finished, %d bytes", rec.ID, entry.Size)
+}
+
+// uploadReader reads an uploaded recording, counting its size. A read
+// error, such as from the SSH server going away mid-session, is recorded
+// and reported as io.EOF, so that what was received is stored.
+type uploadReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.n += int64(n)
+	if err != nil && err != io.EOF {
+		u.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// newID returns a new recording ID, which sorts by start time.
+func newID(now time.Time) string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b[:])
+}
+
+// Query selects recordings from a Server's index. Zero fields match
+// all recordings.
+type Query struct {
+	// Node matches the name of the SSH server node, or of the node
+	// connecting to it.
+	Node string
+	// User matches the Mirage user connecting, or the SSH user or local
+	// user they connected as.
+	User string
+	// Since and Until match the start time of the session.
+	Since, Until time.Time
+}
+
+func (q Query) matches(rec *Recording) bool {
+	if q.Node != "" && !matchName(q.Node, rec.Node) && !matchName(q.Node, rec.Header.SrcNode) {
+		return false
+	}
+	if q.User != "" && q.User != rec.Header.SrcNodeUser && q.User != rec.Header.SSHUser && q.User != rec.Header.LocalUser {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Start.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !rec.Start.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// matchName reports whether name is the node name fqdn, either in full or
+// as its first label.
+func matchName(name, fqdn string) bool {
+	if fqdn == "" {
+		return false
+	}
+	host, _, _ := strings.Cut(fqdn, ".")
+	return strings.EqualFold(name, fqdn) || strings.EqualFold(name, host)
+}
+
+// Recordings returns the recordings matching q, most recent first.
+func (s *Server) Recordings(q Query) []Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Recording
+	for _, rec := range s.recs {
+		if q.matches(rec) {
+			out = append(out, *rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.After(out[j].Start)
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out
+}
+
+// Recording returns the index entry of recording id.
+func (s *Server) Recording(id string) (_ Recording, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.recs[id]
+	if !ok {
+		return Recording{}, false
+	}
+	return *rec, true
+}
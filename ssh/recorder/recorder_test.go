@@ -0,0 +1,378 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func castFile(srcNode, srcUser, localUser string) string {
+	h, err := json.Marshal(Header{
+		Version:     2,
+		Width:       80,
+		Height:      24,
+		Timestamp:   time.Now().Unix(),
+		SrcNode:     srcNode,
+		SrcNodeUser: srcUser,
+		SSHUser:     localUser,
+		LocalUser:   localUser,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(h) + "\n" + `[0.1,"o","hello\r\n"]` + "\n"
+}
+
+func newTestServer(t *testing.T, dir string, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	store, err := NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Logf = t.Logf
+	s, err := NewServer(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func upload(t *testing.T, ts *httptest.Server, body string) int {
+	t.Helper()
+	res, err := http.Post(ts.URL+"/record", "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func get(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	t.Helper()
+	res, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "server.example.ts.net.", StableID: "nServer"},
+			UserProfile: &tailcfg.UserProfile{LoginName: "carol@example.com"},
+		}, nil
+	}
+	s, ts := newTestServer(t, dir, Options{WhoIs: whoIs, UIAllow: []string{"carol@example.com"}})
+
+	casts := []string{
+		castFile("laptop.example.ts.net.", "alice@example.com", "root"),
+		castFile("desktop.example.ts.net.", "bob@example.com", "bob"),
+	}
+	for _, c := range casts {
+		if code := upload(t, ts, c); code != 200 {
+			t.Fatalf("upload: status %d", code)
+		}
+	}
+	if code := upload(t, ts, "not json\n"); code != http.StatusBadRequest {
+		t.Errorf("upload of bad header: status %d, want 400", code)
+	}
+
+	recs := s.Recordings(Query{})
+	if len(recs) != 2 {
+		t.Fatalf("got %d recordings, want 2", len(recs))
+	}
+	for _, rec := range recs {
+		if rec.Node != "server.example.ts.net" || rec.NodeID != "nServer" {
+			t.Errorf("recording %s from node %q (%q)", rec.ID, rec.Node, rec.NodeID)
+		}
+		if rec.InProgress() || rec.Truncated {
+			t.Errorf("recording %s: in progress %v, truncated %v", rec.ID, rec.InProgress(), rec.Truncated)
+		}
+	}
+
+	tests := []struct {
+		q    Query
+		want []string // local users
+	}{
+		{Query{User: "alice@example.com"}, []string{"root"}},
+		{Query{User: "bob"}, []string{"bob"}},
+		{Query{Node: "laptop"}, []string{"root"}},
+		{Query{Node: "server"}, []string{"bob", "root"}},
+		{Query{Node: "other"}, nil},
+		{Query{Since: time.Now().Add(-time.Hour)}, []string{"bob", "root"}},
+		{Query{Until: time.Now().Add(-time.Hour)}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, rec := range s.Recordings(tt.q) {
+			got = append(got, rec.Header.LocalUser)
+		}
+		if !sameSet(got, tt.want) {
+			t.Errorf("Recordings(%+v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	var apiRecs []Recording
+	code, body := get(t, ts, "/api/recordings?user=root")
+	if code != 200 {
+		t.Fatalf("/api/recordings: status %d", code)
+	}
+	if err := json.Unmarshal([]byte(body), &apiRecs); err != nil {
+		t.Fatal(err)
+	}
+	if len(apiRecs) != 1 || apiRecs[0].Header.SrcNodeUser != "alice@example.com" {
+		t.Errorf("/api/recordings?user=root = %+v", apiRecs)
+	}
+	id := apiRecs[0].ID
+
+	if code, body := get(t, ts, "/recordings/"+id+".cast"); code != 200 || body != casts[0] {
+		t.Errorf("cast = %d, %q; want 200, %q", code, body, casts[0])
+	}
+	if code, body := get(t, ts, "/recordings/"+id); code != 200 || !strings.Contains(body, id+".cast") {
+		t.Errorf("player = %d, %q", code, body)
+	}
+	if code, body := get(t, ts, "/?node=laptop"); code != 200 || !strings.Contains(body, id) {
+		t.Errorf("list = %d, %q", code, body)
+	}
+	for _, p := range []string{"/recordings/nope", "/recordings/nope.cast", "/recordings/../" + id + ".json"} {
+		if code, _ := get(t, ts, p); code != 404 {
+			t.Errorf("%s: status %d, want 404", p, code)
+		}
+	}
+
+	// A new server over the same store finds the same recordings, plus
+	// one whose upload was interrupted before it was indexed.
+	if err := os.WriteFile(filepath.Join(dir, "20230101T000000Z-00000000.cast"), []byte(castFile("laptop", "alice@example.com", "alice")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := newTestServer(t, dir, Options{})
+	if got := len(s2.Recordings(Query{})); got != 3 {
+		t.Fatalf("after reload, got %d recordings, want 3", got)
+	}
+	rec, ok := s2.Recording("20230101T000000Z-00000000")
+	if !ok || !rec.Truncated || rec.Header.LocalUser != "alice" {
+		t.Errorf("recovered recording = %+v, %v", rec, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20230101T000000Z-00000000.json")); err != nil {
+		t.Errorf("recovered recording not indexed: %v", err)
+	}
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]int)
+	for _, s := range a {
+		m[s]++
+	}
+	for _, s := range b {
+		m[s]--
+	}
+	for _, n := range m {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServerWhoIsRejects(t *testing.T) {
+	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return nil, errors.New("no match for IP:port")
+	}
+	s, ts := newTestServer(t, t.TempDir(), Options{WhoIs: whoIs})
+	if code := upload(t, ts, castFile("laptop", "alice@example.com", "root")); code != http.StatusForbidden {
+		t.Errorf("upload from unknown peer: status %d, want 403", code)
+	}
+	if n := len(s.Recordings(Query{})); n != 0 {
+		t.Errorf("got %d recordings, want 0", n)
+	}
+}
+
+func TestServerDisableUI(t *testing.T) {
+	_, ts := newTestServer(t, t.TempDir(), Options{DisableUI: true})
+	if code := upload(t, ts, castFile("laptop", "alice@example.com", "root")); code != 200 {
+		t.Errorf("upload: status %d", code)
+	}
+	if code, _ := get(t, ts, "/api/recordings"); code != 404 {
+		t.Errorf("/api/recordings: status %d, want 404", code)
+	}
+}
+
+func TestServerUIAllow(t *testing.T) {
+	var who *apitype.WhoIsResponse
+	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return who, nil
+	}
+	_, ts := newTestServer(t, t.TempDir(), Options{
+		WhoIs:   whoIs,
+		UIAllow: []string{"alice@example.com", "tag:audit"},
+	})
+	tests := []struct {
+		name string
+		who  *apitype.WhoIsResponse
+		want int
+	}{
+		{
+			name: "allowed-user",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			},
+			want: 200,
+		},
+		{
+			name: "other-user",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "desktop."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "allowed-tag",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "audit.", Tags: []string{"tag:audit"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+			},
+			want: 200,
+		},
+		{
+			// A tagged node is identified by its tags, not by the
+			// user who tagged it.
+			name: "other-tag",
+			who: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "server.", Tags: []string{"tag:server"}},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			},
+			want: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			who = tt.who
+			for _, p := range []string{"/", "/api/recordings"} {
+				if code, _ := get(t, ts, p); code != tt.want {
+					t.Errorf("%s: status %d, want %d", p, code, tt.want)
+				}
+			}
+		})
+	}
+
+	// Without WhoIs to identify anyone, the UI is refused to everyone,
+	// while recordings are still accepted.
+	_, ts = newTestServer(t, t.TempDir(), Options{UIAllow: []string{"alice@example.com"}})
+	if code, _ := get(t, ts, "/api/recordings"); code != http.StatusForbidden {
+		t.Errorf("without WhoIs: status %d, want 403", code)
+	}
+	if code := upload(t, ts, castFile("laptop", "alice@example.com", "root")); code != 200 {
+		t.Errorf("upload without WhoIs: status %d", code)
+	}
+}
+
+func TestServerPlayerAssets(t *testing.T) {
+	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{Name: "laptop."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		}, nil
+	}
+	s, ts := newTestServer(t, t.TempDir(), Options{WhoIs: whoIs, UIAllow: []string{"alice@example.com"}})
+	if code := upload(t, ts, castFile("laptop", "alice@example.com", "root")); code != 200 {
+		t.Fatalf("upload: status %d", code)
+	}
+	recs := s.Recordings(Query{})
+	if len(recs) != 1 {
+		t.Fatalf("got %d recordings, want 1", len(recs))
+	}
+	_, body := get(t, ts, "/recordings/"+recs[0].ID)
+	if strings.Contains(body, "https://") {
+		t.Errorf("player page loads remote resources: %s", body)
+	}
+	if got := strings.Contains(body, "/static/asciinema-player.min.js"); got != hasPlayer {
+		t.Errorf("player page uses player = %v, want %v", got, hasPlayer)
+	}
+
+	want := 404
+	if hasPlayer {
+		want = 200
+	}
+	for _, name := range playerFiles {
+		if code, _ := get(t, ts, "/static/"+name); code != want {
+			t.Errorf("/static/%s: status %d, want %d", name, code, want)
+		}
+	}
+	if code, _ := get(t, ts, "/static/README.md"); code != 404 {
+		t.Errorf("/static/README.md: status %d, want 404", code)
+	}
+}
+
+func TestServerKeepsPartialRecording(t *testing.T) {
+	dir := t.TempDir()
+	s, ts := newTestServer(t, dir, Options{})
+
+	// Start an upload and leave it streaming, as for a session still
+	// in progress when the recorder stops.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := http.Post(ts.URL+"/record", "application/octet-stream", pr)
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	defer func() {
+		pw.Close()
+		<-done
+	}()
+	c := castFile("laptop", "alice@example.com", "root")
+	if _, err := io.WriteString(pw, c); err != nil {
+		t.Fatal(err)
+	}
+
+	var id string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if recs := s.Recordings(Query{}); len(recs) == 1 {
+			id = recs[0].ID
+			if b, _ := os.ReadFile(filepath.Join(dir, id+".cast")); string(b) == c {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the recording to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A new server over the same store recovers what was received.
+	s2, _ := newTestServer(t, dir, Options{})
+	rec, ok := s2.Recording(id)
+	if !ok || !rec.Truncated || rec.Size != int64(len(c)) || rec.Header.LocalUser != "root" {
+		t.Errorf("recovered recording = %+v, %v", rec, ok)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store is where a Server keeps recordings and their index entries.
+//
+// Names are slash-separated paths, such as "20230102T150405Z-ab12cd34.cast".
+type Store interface {
+	// Put stores everything read from r under name, replacing anything
+	// already there. If r returns an error, nothing is stored.
+	//
+	// If the process stops while Put runs, what was read so far should be
+	// kept under name where the store allows, so that the Server can
+	// recover the recording when it's next started.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get returns the contents stored under name. It returns an error
+	// satisfying errors.Is(err, fs.ErrNotExist) if there are none.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the names of everything stored, in no particular order.
+	List(ctx context.Context) ([]string, error)
+}
+
+// DirStore is a Store which keeps recordings in a local directory.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns a DirStore which keeps recordings in dir,
+// creating it if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (s *DirStore) path(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put implements Store. The contents are written in place, so that what
+// was received of a recording is kept if the recorder stops mid-session.
+func (s *DirStore) Put(ctx context.Context, name string, r io.Reader) (err error) {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(p)
+		}
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Get implements Store.
+func (s *DirStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// List implements Store.
+func (s *DirStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,230 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recorder
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+//go:generate go run update-player.go
+
+//go:embed recorder.tmpl.html
+var embeddedTemplate string
+
+// staticFiles holds the asciinema player, as downloaded by go generate.
+// It is served locally rather than from a CDN so that the UI, which can
+// read every recording, runs no code from third-party hosts.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// playerFiles are the files in staticFiles served under /static/.
+var playerFiles = []string{
+	"asciinema-player.min.js",
+	"asciinema-player.css",
+}
+
+// hasPlayer reports whether the player files were embedded. Without
+// them, the UI only offers recordings for download.
+var hasPlayer = func() bool {
+	for _, name := range playerFiles {
+		if _, err := fs.Stat(staticFiles, "static/"+name); err != nil {
+			return false
+		}
+	}
+	return true
+}()
+
+var tmpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"fmtTime": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+}).Parse(embeddedTemplate))
+
+// queryFromRequest parses the Query in r's URL parameters. Times may be
+// given as RFC 3339 timestamps or as dates, in UTC.
+func queryFromRequest(r *http.Request) (Query, error) {
+	q := Query{
+		Node: strings.TrimSpace(r.FormValue("node")),
+		User: strings.TrimSpace(r.FormValue("user")),
+	}
+	var err error
+	if q.Since, err = parseTime(r.FormValue("since")); err != nil {
+		return Query{}, err
+	}
+	if q.Until, err = parseTime(r.FormValue("until")); err != nil {
+		return Query{}, err
+	}
+	return q, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// authorizeUI returns an error unless r is from a user or node allowed to
+// use the web UI by Options.UIAllow.
+func (s *Server) authorizeUI(r *http.Request) error {
+	if s.opts.WhoIs == nil {
+		return errors.New("no WhoIs to identify users with")
+	}
+	who, err := s.opts.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range s.opts.UIAllow {
+		if who.Node != nil && who.Node.IsTagged() {
+			if slices.Contains(who.Node.Tags, allowed) {
+				return nil
+			}
+		} else if who.UserProfile != nil && who.UserProfile.LoginName == allowed {
+			return nil
+		}
+	}
+	return errors.New("not in the allowed users or tags")
+}
+
+// serveUI serves the web UI and JSON API:
+//
+//	GET /                      list of recordings
+//	GET /api/recordings        list of recordings, as JSON
+//	GET /recordings/<id>       player for a recording
+//	GET /recordings/<id>.cast  recording, as an asciinema cast file
+//	GET /static/<file>         asciinema player script and stylesheet
+//
+// The lists take node, user, since and until parameters, as in Query.
+func (s *Server) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case r.URL.Path == "/":
+		s.serveList(w, r)
+	case r.URL.Path == "/api/recordings":
+		s.serveListJSON(w, r)
+	case strings.HasPrefix(r.URL.Path, "/recordings/"):
+		id := strings.TrimPrefix(r.URL.Path, "/recordings/")
+		if id, ok := strings.CutSuffix(id, ".cast"); ok {
+			s.serveCast(w, r, id)
+		} else {
+			s.servePlayer(w, r, id)
+		}
+	case strings.HasPrefix(r.URL.Path, "/static/"):
+		serveStatic(w, r, strings.TrimPrefix(r.URL.Path, "/static/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveList(w http.ResponseWriter, r *http.Request) {
+	q, err := queryFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = tmpl.ExecuteTemplate(w, "list", map[string]any{
+		"Node":       q.Node,
+		"User":       q.User,
+		"Since":      r.FormValue("since"),
+		"Until":      r.FormValue("until"),
+		"Recordings": s.Recordings(q),
+	})
+	if err != nil {
+		s.logf("recorder: rendering list: %v", err)
+	}
+}
+
+func (s *Server) serveListJSON(w http.ResponseWriter, r *http.Request) {
+	q, err := queryFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs := s.Recordings(q)
+	if recs == nil {
+		recs = []Recording{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(recs)
+}
+
+func (s *Server) servePlayer(w http.ResponseWriter, r *http.Request, id string) {
+	rec, ok := s.Recording(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := tmpl.ExecuteTemplate(w, "play", struct {
+		*Recording
+		Player bool
+	}{&rec, hasPlayer})
+	if err != nil {
+		s.logf("recorder: rendering player: %v", err)
+	}
+}
+
+func serveStatic(w http.ResponseWriter, r *http.Request, name string) {
+	if !slices.Contains(playerFiles, name) {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := staticFiles.ReadFile("static/" + name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+}
+
+func (s *Server) serveCast(w http.ResponseWriter, r *http.Request, id string) {
+	rec, ok := s.Recording(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if rec.InProgress() {
+		http.Error(w, "recording in progress", http.StatusConflict)
+		return
+	}
+	rc, err := s.store.Get(r.Context(), id+".cast")
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.logf("recorder: reading %s: %v", id, err)
+		http.Error(w, "reading recording failed", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.cast"`)
+	io.Copy(w, rc)
+}
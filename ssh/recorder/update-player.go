@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build ignore
+
+// The update-player command downloads the asciinema player embedded in
+// the recorder's web UI into the static directory.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// playerVersion is the version of the asciinema-player npm package to
+// embed.
+const playerVersion = "3.6.1"
+
+// files maps the files wanted from the package to their names in the
+// static directory.
+var files = map[string]string{
+	"package/dist/bundle/asciinema-player.min.js": "asciinema-player.min.js",
+	"package/dist/bundle/asciinema-player.css":    "asciinema-player.css",
+	"package/LICENSE": "asciinema-player.LICENSE",
+}
+
+func main() {
+	var meta struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	}
+	b, err := get("https://registry.npmjs.org/asciinema-player/" + playerVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		log.Fatal(err)
+	}
+	want, ok := strings.CutPrefix(meta.Dist.Integrity, "sha512-")
+	if !ok {
+		log.Fatalf("unsupported integrity %q", meta.Dist.Integrity)
+	}
+	tgz, err := get(meta.Dist.Tarball)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sum := sha512.Sum512(tgz)
+	if got := base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		log.Fatalf("%s: sha512 %s, want %s", meta.Dist.Tarball, got, want)
+	}
+	if err := extract(tgz); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func get(url string) ([]byte, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func extract(tgz []byte) error {
+	zr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	found := 0
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := files[h.Name]
+		if !ok {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join("static", name), b, 0644); err != nil {
+			return err
+		}
+		found++
+	}
+	if found != len(files) {
+		return fmt.Errorf("found %d of the %d wanted files in the package", found, len(files))
+	}
+	return nil
+}
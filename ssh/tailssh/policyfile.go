@@ -0,0 +1,317 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// policyFilePollInterval is how often a local SSH policy file is checked
+// for changes.
+const policyFilePollInterval = 5 * time.Second
+
+var warnSSHPolicyFile = health.NewWarnable()
+
+// policyFile is a local file containing an SSHPolicy, which is used along
+// with the control plane's SSH policy as per its mode.
+type policyFile struct {
+	path string
+	mode ipnlocal.SSHPolicyFileMode
+	logf logger.Logf
+
+	mu     sync.Mutex
+	loaded bool               // whether stamp is of a load attempt
+	stamp  fileStamp          // of the file when last loaded
+	pol    *tailcfg.SSHPolicy // last valid policy, or nil
+	err    error              // why the file as last loaded isn't in use, or nil
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func newPolicyFile(path string, mode ipnlocal.SSHPolicyFileMode, logf logger.Logf) *policyFile {
+	pf := &policyFile{path: path, mode: mode, logf: logf}
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.reloadLocked()
+	return pf
+}
+
+// policy returns the last valid policy in the file, reloading it first
+// if it has changed. It is nil if the file has no valid policy, or has
+// been removed. The error, if any, is why the file's current contents
+// aren't in use.
+func (pf *policyFile) policy() (*tailcfg.SSHPolicy, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.reloadLocked()
+	return pf.pol, pf.err
+}
+
+// reloadLocked reloads the file if it has changed since it was last
+// loaded. It reports whether the policy in use changed.
+func (pf *policyFile) reloadLocked() (changed bool) {
+	var stamp fileStamp
+	fi, err := os.Stat(pf.path)
+	if err == nil {
+		stamp = fileStamp{exists: true, modTime: fi.ModTime(), size: fi.Size()}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		pf.logf("ssh policy file: %v", err)
+		return false // keep what we have; it may be a transient error
+	}
+	if pf.loaded && stamp == pf.stamp {
+		return false
+	}
+	pf.loaded = true
+	pf.stamp = stamp
+
+	pol, err := loadSSHPolicyFile(pf.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removing the file removes its policy.
+			changed = pf.pol != nil
+			pf.pol = nil
+		}
+		pf.err = err
+		pf.logf("ssh policy file: %v", err)
+		warnSSHPolicyFile.Set(fmt.Errorf("local SSH policy file not in use: %w", err))
+		return changed
+	}
+	pf.logf("ssh policy file: loaded %d rules from %v (mode %v)", len(pol.Rules), pf.path, pf.mode)
+	pf.pol = pol
+	pf.err = nil
+	warnSSHPolicyFile.Set(nil)
+	return true
+}
+
+// watch reloads the file every policyFilePollInterval until done is
+// closed, calling onChange whenever the policy in use changes.
+func (pf *policyFile) watch(done <-chan struct{}, onChange func()) {
+	t := time.NewTicker(policyFilePollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		pf.mu.Lock()
+		changed := pf.reloadLocked()
+		pf.mu.Unlock()
+		if changed {
+			onChange()
+		}
+	}
+}
+
+// loadSSHPolicyFile reads and validates the SSHPolicy in the JSON file
+// at path.
+func loadSSHPolicyFile(path string) (*tailcfg.SSHPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	pol := new(tailcfg.SSHPolicy)
+	if err := dec.Decode(pol); err != nil {
+		return nil, fmt.Errorf("%s: invalid JSON: %w", path, err)
+	}
+	if err := validateSSHPolicy(pol); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pol, nil
+}
+
+// validateSSHPolicy reports an error if pol has rules which are
+// malformed, rather than merely not matching anything.
+func validateSSHPolicy(pol *tailcfg.SSHPolicy) error {
+	for i, r := range pol.Rules {
+		if err := validateSSHRule(r); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateSSHRule(r *tailcfg.SSHRule) error {
+	if r == nil {
+		return errors.New("null rule")
+	}
+	a := r.Action
+	if a == nil {
+		return errors.New("no action")
+	}
+	if !a.Reject && !a.Accept && a.HoldAndDelegate == "" {
+		return errors.New("action must set one of reject, accept or holdAndDelegate")
+	}
+	if !a.Reject && len(r.SSHUsers) == 0 {
+		return errors.New("no sshUsers")
+	}
+	if len(r.Principals) == 0 {
+		return errors.New("no principals")
+	}
+	for i, p := range r.Principals {
+		if err := validateSSHPrincipal(p); err != nil {
+			return fmt.Errorf("principal %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateSSHPrincipal(p *tailcfg.SSHPrincipal) error {
+	if p == nil {
+		return errors.New("null principal")
+	}
+	if !p.Any && p.Node.IsZero() && p.NodeIP == "" && p.UserLogin == "" {
+		return errors.New("must set one of node, nodeIP, userLogin or any")
+	}
+	if p.NodeIP != "" {
+		if _, err := netip.ParseAddr(p.NodeIP); err != nil {
+			return fmt.Errorf("nodeIP: %w", err)
+		}
+	}
+	if len(p.PubKeys) == 1 && strings.HasPrefix(p.PubKeys[0], "https://") {
+		return nil
+	}
+	for _, k := range p.PubKeys {
+		if _, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k)); err != nil {
+			return fmt.Errorf("pubKeys: %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// sshPolicies returns the SSH policies in effect: the control plane's,
+// and the local policy file's, either of which may be nil. It reports
+// false if the SSH server shouldn't be running.
+func (srv *server) sshPolicies() (control, local *tailcfg.SSHPolicy, ok bool) {
+	lb := srv.lb
+	if !lb.ShouldRunSSH() {
+		return nil, nil, false
+	}
+	nm := lb.NetMap()
+	if nm == nil {
+		return nil, nil, false
+	}
+	if !envknob.SSHIgnoreTailnetPolicy() {
+		control = nm.SSHPolicy
+	}
+	if srv.policyFile == nil {
+		return control, nil, true
+	}
+	local, _ = srv.policyFile.policy()
+	switch srv.policyFile.mode {
+	case ipnlocal.SSHPolicyFileOverride:
+		control = nil
+	case ipnlocal.SSHPolicyFileFallback:
+		if control != nil && len(control.Rules) > 0 {
+			local = nil
+		}
+	}
+	return control, local, true
+}
+
+// ExplainPolicy implements ipnlocal.SSHServer. It evaluates the SSH policy
+// as for a connection from src as sshUser, without a public key.
+func (srv *server) ExplainPolicy(src netip.Addr, sshUser string) (*apitype.SSHPolicyExplanation, error) {
+	node, uprof, ok := srv.lb.WhoIs(netip.AddrPortFrom(src, 0))
+	if !ok {
+		return nil, fmt.Errorf("unknown Mirage identity for %v", src)
+	}
+	c := &conn{
+		srv:    srv,
+		connID: "explain",
+		info: &sshConnInfo{
+			sshUser: sshUser,
+			src:     netip.AddrPortFrom(src, 0),
+			node:    node,
+			uprof:   uprof,
+		},
+	}
+	e := &apitype.SSHPolicyExplanation{Matched: -1}
+	if pf := srv.policyFile; pf != nil {
+		e.File = pf.path
+		e.FileMode = string(pf.mode)
+		if _, err := pf.policy(); err != nil {
+			e.FileError = err.Error()
+		}
+	}
+	control, local, ok := srv.sshPolicies()
+	if !ok {
+		return e, nil
+	}
+	switch {
+	case control != nil && local != nil:
+		e.Source = "control+file"
+	case control != nil:
+		e.Source = "control"
+	case local != nil:
+		e.Source = "file"
+	}
+	for _, p := range []struct {
+		source string
+		pol    *tailcfg.SSHPolicy
+	}{
+		{"control", control},
+		{"file", local},
+	} {
+		if p.pol == nil {
+			continue
+		}
+		for i, r := range p.pol.Rules {
+			re := apitype.SSHRuleExplanation{Source: p.source, Index: i, Rule: r}
+			_, localUser, err := c.matchRule(r, nil)
+			switch {
+			case err == nil:
+				re.Result = "matched"
+			case errors.Is(err, errPrincipalMatch) && c.principalNeedsPubKey(r):
+				re.Result = "principal matched, but requires a public key"
+			default:
+				re.Result = err.Error()
+			}
+			e.Rules = append(e.Rules, re)
+			if err == nil {
+				e.Matched = len(e.Rules) - 1
+				e.LocalUser = localUser
+				return e, nil
+			}
+		}
+	}
+	return e, nil
+}
+
+// principalNeedsPubKey reports whether r has a principal which matches
+// c's Mirage identity but also requires a public key.
+func (c *conn) principalNeedsPubKey(r *tailcfg.SSHRule) bool {
+	for _, p := range r.Principals {
+		if p != nil && len(p.PubKeys) > 0 && c.principalMatchesTailscaleIdentity(p) {
+			return true
+		}
+	}
+	return false
+}
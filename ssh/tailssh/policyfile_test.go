@@ -0,0 +1,238 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/tailcfg"
+)
+
+func TestLoadSSHPolicyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string // substring, or empty for success
+	}{
+		{
+			name: "valid",
+			json: `{"rules": [
+				{"principals": [{"userLogin": "alice@example.com"}], "sshUsers": {"*": "="}, "action": {"accept": true}},
+				{"principals": [{"nodeIP": "100.64.0.1", "pubKeys": ["https://github.com/alice.keys"]}], "sshUsers": {"root": "root"}, "action": {"accept": true}},
+				{"principals": [{"any": true}], "action": {"reject": true, "message": "no"}}
+			]}`,
+		},
+		{
+			name: "empty",
+			json: `{"rules": []}`,
+		},
+		{
+			name:    "bad-json",
+			json:    `{"rules": [`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "unknown-field",
+			json:    `{"rules": [{"principal": [{"any": true}], "sshUsers": {"*": "="}, "action": {"accept": true}}]}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "no-action",
+			json:    `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "="}}]}`,
+			wantErr: "rule 0: no action",
+		},
+		{
+			name:    "empty-action",
+			json:    `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "="}, "action": {}}]}`,
+			wantErr: "rule 0: action must set",
+		},
+		{
+			name:    "no-users",
+			json:    `{"rules": [{"principals": [{"any": true}], "action": {"accept": true}}]}`,
+			wantErr: "rule 0: no sshUsers",
+		},
+		{
+			name:    "no-principals",
+			json:    `{"rules": [{"sshUsers": {"*": "="}, "action": {"accept": true}}]}`,
+			wantErr: "rule 0: no principals",
+		},
+		{
+			name:    "empty-principal",
+			json:    `{"rules": [{"principals": [{}], "sshUsers": {"*": "="}, "action": {"accept": true}}]}`,
+			wantErr: "rule 0: principal 0: must set one of",
+		},
+		{
+			name:    "bad-ip",
+			json:    `{"rules": [{"principals": [{"nodeIP": "100.64.0.300"}], "sshUsers": {"*": "="}, "action": {"accept": true}}]}`,
+			wantErr: "rule 0: principal 0: nodeIP",
+		},
+		{
+			name:    "bad-pubkey",
+			json:    `{"rules": [{"principals": [{"any": true, "pubKeys": ["ssh-ed25519 nope"]}], "sshUsers": {"*": "="}, "action": {"accept": true}}]}`,
+			wantErr: "rule 0: principal 0: pubKeys",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ssh-policy.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadSSHPolicyFile(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh-policy.json")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const rule = `{"principals": [{"any": true}], "sshUsers": {"*": "="}, "action": {"accept": true}}`
+
+	pf := newPolicyFile(path, ipnlocal.SSHPolicyFileFallback, t.Logf)
+	if pol, err := pf.policy(); pol != nil || err == nil {
+		t.Fatalf("missing file: got %v, %v; want nil policy and an error", pol, err)
+	}
+
+	write(`{"rules": [` + rule + `]}`)
+	pol, err := pf.policy()
+	if err != nil || pol == nil || len(pol.Rules) != 1 {
+		t.Fatalf("after writing file: got %v, %v; want 1 rule", pol, err)
+	}
+
+	// An invalid change is reported, and the last valid policy kept.
+	write(`{"rules": [` + rule + `, {"principals": []}]}`)
+	pol, err = pf.policy()
+	if err == nil || pol == nil || len(pol.Rules) != 1 {
+		t.Fatalf("after invalid change: got %v, %v; want 1 rule and an error", pol, err)
+	}
+
+	write(`{"rules": [` + rule + `, ` + rule + `]}`)
+	pol, err = pf.policy()
+	if err != nil || pol == nil || len(pol.Rules) != 2 {
+		t.Fatalf("after valid change: got %v, %v; want 2 rules", pol, err)
+	}
+
+	// Removing the file removes its policy.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	pf.mu.Lock()
+	changed := pf.reloadLocked()
+	pf.mu.Unlock()
+	if !changed {
+		t.Error("removing file: reloadLocked reported no change")
+	}
+	if pol, _ := pf.policy(); pol != nil {
+		t.Errorf("after removing file: got %v; want nil", pol)
+	}
+}
+
+func TestSSHPolicyFileModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh-policy.json")
+	const fileRules = `{"rules": [{"principals": [{"userLogin": "peer"}], "sshUsers": {"*": "="}, "action": {"accept": true, "message": "file"}}]}`
+	if err := os.WriteFile(path, []byte(fileRules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	controlRule := &tailcfg.SSHRule{
+		Principals: []*tailcfg.SSHPrincipal{{Any: true}},
+		SSHUsers:   map[string]string{"root": "root"},
+		Action:     &tailcfg.SSHAction{Accept: true, Message: "control"},
+	}
+
+	tests := []struct {
+		mode        ipnlocal.SSHPolicyFileMode
+		controlRule *tailcfg.SSHRule
+		want        []string // messages of rules in effect
+	}{
+		{ipnlocal.SSHPolicyFileFallback, nil, []string{"file"}},
+		{ipnlocal.SSHPolicyFileFallback, controlRule, []string{"control"}},
+		{ipnlocal.SSHPolicyFileMerge, nil, []string{"file"}},
+		{ipnlocal.SSHPolicyFileMerge, controlRule, []string{"control", "file"}},
+		{ipnlocal.SSHPolicyFileOverride, nil, []string{"file"}},
+		{ipnlocal.SSHPolicyFileOverride, controlRule, []string{"file"}},
+	}
+	for _, tt := range tests {
+		srv := &server{
+			lb:         &localState{sshEnabled: true, matchingRule: tt.controlRule},
+			logf:       t.Logf,
+			policyFile: newPolicyFile(path, tt.mode, t.Logf),
+		}
+		c := &conn{srv: srv}
+		pol, ok := c.sshPolicy()
+		if !ok {
+			t.Errorf("mode %v, control rule %v: no policy", tt.mode, tt.controlRule != nil)
+			continue
+		}
+		var got []string
+		for _, r := range pol.Rules {
+			got = append(got, r.Action.Message)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("mode %v, control rule %v: got rules %q; want %q", tt.mode, tt.controlRule != nil, got, tt.want)
+		}
+	}
+}
+
+func TestExplainPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh-policy.json")
+	const fileRules = `{"rules": [
+		{"principals": [{"userLogin": "someone-else"}], "sshUsers": {"*": "="}, "action": {"accept": true}},
+		{"principals": [{"userLogin": "peer", "pubKeys": ["https://example.com/peer.keys"]}], "sshUsers": {"*": "="}, "action": {"accept": true}},
+		{"principals": [{"userLogin": "peer"}], "sshUsers": {"admin": "root"}, "action": {"accept": true}},
+		{"principals": [{"userLogin": "peer"}], "sshUsers": {"*": "="}, "action": {"accept": true}}
+	]}`
+	if err := os.WriteFile(path, []byte(fileRules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		lb:         &localState{sshEnabled: true},
+		logf:       t.Logf,
+		policyFile: newPolicyFile(path, ipnlocal.SSHPolicyFileFallback, t.Logf),
+	}
+	e, err := srv.ExplainPolicy(netip.MustParseAddr("100.64.0.2"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Source != "file" || e.File != path || e.FileMode != "fallback" || e.FileError != "" {
+		t.Errorf("got source %q, file %q (%q), file error %q", e.Source, e.File, e.FileMode, e.FileError)
+	}
+	wantResults := []string{
+		errPrincipalMatch.Error(),
+		"principal matched, but requires a public key",
+		errUserMatch.Error(),
+		"matched",
+	}
+	if len(e.Rules) != len(wantResults) {
+		t.Fatalf("got %d rules explained; want %d", len(e.Rules), len(wantResults))
+	}
+	for i, want := range wantResults {
+		if r := e.Rules[i]; r.Source != "file" || r.Index != i || r.Result != want {
+			t.Errorf("rule %d: got %s rule %d: %q; want file rule %d: %q", i, r.Source, r.Index, r.Result, i, want)
+		}
+	}
+	if e.Matched != 3 || e.LocalUser != "alice" {
+		t.Errorf("got match %d as %q; want 3 as %q", e.Matched, e.LocalUser, "alice")
+	}
+}
@@ -68,6 +68,7 @@ type ipnLocalBackend interface {
 	Dialer() *tsdial.Dialer
 	TailscaleVarRoot() string
 	NodeKey() key.NodePublic
+	SSHPolicyFile() (path string, mode ipnlocal.SSHPolicyFileMode)
 }
 
 type server struct {
@@ -77,6 +78,8 @@ type server struct {
 
 	pubKeyHTTPClient *http.Client     // or nil for http.DefaultClient
 	timeNow          func() time.Time // or nil for time.Now
+	policyFile       *policyFile      // or nil if there's no local SSH policy file
+	stopWatch        chan struct{}    // closed by Shutdown to stop watching policyFile
 
 	sessionWaitGroup sync.WaitGroup
 
@@ -95,6 +98,7 @@ func (srv *server) now() time.Time {
 }
 
 func init() {
+	ipnlocal.RegisterSSHPolicyFileLoader(loadSSHPolicyFile)
 	ipnlocal.RegisterNewSSHServer(func(logf logger.Logf, lb *ipnlocal.LocalBackend) (ipnlocal.SSHServer, error) {
 		tsd, err := os.Executable()
 		if err != nil {
@@ -105,7 +109,15 @@ func init() {
 			logf:           logf,
 			tailscaledPath: tsd,
 		}
-
+		path, mode := lb.SSHPolicyFile()
+		if path == "" && envknob.SSHPolicyFile() != "" {
+			path, mode = envknob.SSHPolicyFile(), ipnlocal.SSHPolicyFileFallback
+		}
+		if path != "" {
+			srv.policyFile = newPolicyFile(path, mode, logf)
+			srv.stopWatch = make(chan struct{})
+			go srv.policyFile.watch(srv.stopWatch, srv.OnPolicyChange)
+		}
 		return srv, nil
 	})
 }
@@ -157,6 +169,9 @@ func (srv *server) HandleSSHConn(nc net.Conn) error {
 // Shutdown terminates all active sessions.
 func (srv *server) Shutdown() {
 	srv.mu.Lock()
+	if srv.stopWatch != nil && !srv.shutdownCalled {
+		close(srv.stopWatch)
+	}
 	srv.shutdownCalled = true
 	for c := range srv.activeConns {
 		c.Close()
@@ -421,6 +436,7 @@ func (srv *server) newConn() (*conn, error) {
 	c := &conn{srv: srv}
 	now := srv.now()
 	c.connID = fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5))
+	fwdHandler := &ssh.ForwardedTCPHandler{}
 	c.Server = &ssh.Server{
 		Version:              "Tailscale",
 		ServerConfigCallback: c.ServerConfig,
@@ -429,18 +445,23 @@ func (srv *server) newConn() (*conn, error) {
 		PublicKeyHandler:    c.PublicKeyHandler,
 		PasswordHandler:     c.fakePasswordHandler,
 
-		Handler:                     c.handleSessionPostSSHAuth,
-		LocalPortForwardingCallback: c.mayForwardLocalPortTo,
+		Handler:                       c.handleSessionPostSSHAuth,
+		LocalPortForwardingCallback:   c.mayForwardLocalPortTo,
+		ReversePortForwardingCallback: c.mayReversePortForwardTo,
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": c.handleSessionPostSSHAuth,
 		},
 		// Note: the direct-tcpip channel handler and LocalPortForwardingCallback
-		// only adds support for forwarding ports from the local machine.
-		// TODO(maisem/bradfitz): add remote port forwarding support.
+		// add support for forwarding ports from the local machine, and the
+		// tcpip-forward request handlers and ReversePortForwardingCallback
+		// for forwarding ports back to the client.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
 			"direct-tcpip": ssh.DirectTCPIPHandler,
 		},
-		RequestHandlers: map[string]ssh.RequestHandler{},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        fwdHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": fwdHandler.HandleSSHRequest,
+		},
 	}
 	ss := c.Server
 	for k, v := range ssh.DefaultRequestHandlers {
@@ -473,6 +494,56 @@ func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, de
 	return false
 }
 
+// mayReversePortForwardTo reports whether the ctx should be allowed to
+// listen on the specified host and port, forwarding connections back to
+// the client.
+//
+// Only this node's loopback and Tailscale addresses may be bound, so that
+// forwarded ports aren't exposed beyond the machine and the tailnet.
+func (c *conn) mayReversePortForwardTo(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	if c.finalAction == nil || !c.finalAction.AllowRemotePortForwarding {
+		return false
+	}
+	if !c.mayBindForwardedPort(bindHost) {
+		c.logf("denied remote port forward: %q is not a loopback or Tailscale address", bindHost)
+		return false
+	}
+	// The listener is opened by tailscaled, so mirror sshd and only let
+	// root bind privileged ports.
+	if bindPort != 0 && bindPort < 1024 && (c.localUser == nil || c.localUser.Uid != "0") {
+		c.logf("denied remote port forward: port %d is privileged", bindPort)
+		return false
+	}
+	metricRemotePortForward.Add(1)
+	return true
+}
+
+// mayBindForwardedPort reports whether a remotely forwarded port may be
+// bound on host, which must be "localhost", a loopback address or one of
+// this node's Tailscale addresses.
+func (c *conn) mayBindForwardedPort(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	nm := c.srv.lb.NetMap()
+	if nm == nil {
+		return false
+	}
+	for _, pfx := range nm.Addresses {
+		if pfx.IsSingleIP() && pfx.Addr() == ip {
+			return true
+		}
+	}
+	return false
+}
+
 // havePubKeyPolicy reports whether any policy rule may provide access by means
 // of a ssh.PublicKey.
 func (c *conn) havePubKeyPolicy() bool {
@@ -501,35 +572,23 @@ func (c *conn) havePubKeyPolicy() bool {
 	return false
 }
 
-// sshPolicy returns the SSHPolicy for current node.
-// If there is no SSHPolicy in the netmap, it returns a debugPolicy
-// if one is defined.
+// sshPolicy returns the SSHPolicy for current node: the control plane's,
+// the local policy file's, or both combined, as per the file's mode.
 func (c *conn) sshPolicy() (_ *tailcfg.SSHPolicy, ok bool) {
-	lb := c.srv.lb
-	if !lb.ShouldRunSSH() {
-		return nil, false
-	}
-	nm := lb.NetMap()
-	if nm == nil {
+	control, local, ok := c.srv.sshPolicies()
+	if !ok {
 		return nil, false
 	}
-	if pol := nm.SSHPolicy; pol != nil && !envknob.SSHIgnoreTailnetPolicy() {
-		return pol, true
-	}
-	debugPolicyFile := envknob.SSHPolicyFile()
-	if debugPolicyFile != "" {
-		c.logf("reading debug SSH policy file: %v", debugPolicyFile)
-		f, err := os.ReadFile(debugPolicyFile)
-		if err != nil {
-			c.logf("error reading debug SSH policy file: %v", err)
-			return nil, false
-		}
-		p := new(tailcfg.SSHPolicy)
-		if err := json.Unmarshal(f, p); err != nil {
-			c.logf("invalid JSON in %v: %v", debugPolicyFile, err)
-			return nil, false
-		}
-		return p, true
+	switch {
+	case control != nil && local != nil:
+		rules := make([]*tailcfg.SSHRule, 0, len(control.Rules)+len(local.Rules))
+		rules = append(rules, control.Rules...)
+		rules = append(rules, local.Rules...)
+		return &tailcfg.SSHPolicy{Rules: rules}, true
+	case control != nil:
+		return control, true
+	case local != nil:
+		return local, true
 	}
 	return nil, false
 }
@@ -1840,6 +1899,7 @@ func envEq(a, b string) bool {
 	metricPolicyChangeKick     = clientmetric.NewCounter("ssh_policy_change_kick")
 	metricSFTP                 = clientmetric.NewCounter("ssh_sftp_requests")
 	metricLocalPortForward     = clientmetric.NewCounter("ssh_local_port_forward_requests")
+	metricRemotePortForward    = clientmetric.NewCounter("ssh_remote_port_forward_requests")
 )
 
 // userVisibleError is a wrapper around an error that implements
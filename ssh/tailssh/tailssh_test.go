@@ -318,6 +318,10 @@ func (ts *localState) NodeKey() key.NodePublic {
 	return key.NewNode().Public()
 }
 
+func (ts *localState) SSHPolicyFile() (string, ipnlocal.SSHPolicyFileMode) {
+	return "", ""
+}
+
 func newSSHRule(action *tailcfg.SSHAction) *tailcfg.SSHRule {
 	return &tailcfg.SSHRule{
 		SSHUsers: map[string]string{
@@ -819,6 +823,126 @@ func TestSSHAuthFlow(t *testing.T) {
 	}
 }
 
+func TestSSHRemotePortForwarding(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	tests := []struct {
+		name       string
+		allow      bool
+		bindAddr   string
+		wantListen bool
+	}{
+		{name: "not-allowed", allow: false, bindAddr: "127.0.0.1:0"},
+		{name: "loopback", allow: true, bindAddr: "127.0.0.1:0", wantListen: true},
+		{name: "wildcard", allow: true, bindAddr: "0.0.0.0:0"},
+		{name: "non-local", allow: true, bindAddr: "192.0.2.1:0"},
+	}
+	s := &server{
+		logf: t.Logf,
+	}
+	defer s.Shutdown()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.lb = &localState{
+				sshEnabled: true,
+				matchingRule: newSSHRule(&tailcfg.SSHAction{
+					Accept:                    true,
+					AllowRemotePortForwarding: tc.allow,
+				}),
+			}
+			sc, dc := memnet.NewTCPConn(src, dst, 1024)
+			cfg := &gossh.ClientConfig{
+				User:            "alice",
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.HandleSSHConn(dc); err != nil {
+					t.Errorf("HandleSSHConn: %v", err)
+				}
+			}()
+			defer wg.Wait()
+			defer sc.Close()
+
+			c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+			if err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			client := gossh.NewClient(c, chans, reqs)
+			defer client.Close()
+
+			ln, err := client.Listen("tcp", tc.bindAddr)
+			if !tc.wantListen {
+				if err == nil {
+					ln.Close()
+					t.Fatalf("Listen(%q) succeeded; want error", tc.bindAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Listen(%q): %v", tc.bindAddr, err)
+			}
+			port := ln.Addr().(*net.TCPAddr).Port
+			if port == 0 {
+				t.Fatal("no port assigned")
+			}
+
+			// Echo back what arrives over the forwarded port.
+			go func() {
+				for {
+					c, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer c.Close()
+						io.Copy(c, c)
+					}()
+				}
+			}()
+
+			addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dialing forwarded port: %v", err)
+			}
+			defer conn.Close()
+			const msg = "hello, reverse tunnel"
+			if _, err := io.WriteString(conn, msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(msg))
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("reading echo: %v", err)
+			}
+			if string(buf) != msg {
+				t.Errorf("echo = %q; want %q", buf, msg)
+			}
+
+			// Closing the listener sends cancel-tcpip-forward, which
+			// must stop the server listening.
+			if err := ln.Close(); err != nil {
+				t.Fatalf("closing listener: %v", err)
+			}
+			if err := tstest.WaitFor(10*time.Second, func() error {
+				c, err := net.Dial("tcp", addr)
+				if err == nil {
+					c.Close()
+					return errors.New("forwarded port still open")
+				}
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
 func TestSSH(t *testing.T) {
 	var logf logger.Logf = t.Logf
 	sys := &tsd.System{}
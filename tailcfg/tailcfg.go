@@ -99,7 +99,9 @@
 //   - 60: 2023-04-06: Client understands IsWireGuardOnly
 //   - 61: 2023-04-18: Client understand SSHAction.SSHRecorderFailureAction
 //   - 62: 2023-05-05: Client can notify control over noise for SSHEventNotificationRequest recording failure events
-const CurrentCapabilityVersion CapabilityVersion = 62
+//   - 63: 2026-10-16: Client answers CNAME, TXT, MX and SRV DNSConfig.ExtraRecords
+//   - 64: 2026-10-16: Client understands SSHAction.AllowRemotePortForwarding
+const CurrentCapabilityVersion CapabilityVersion = 64
 
 type StableID string
 
@@ -1264,10 +1266,19 @@ type DNSRecord struct {
 
 	// Type is the DNS record type.
 	// Empty means A or AAAA, depending on value.
-	// Other values are currently ignored.
+	// "CNAME", "TXT", "MX" and "SRV" are supported as of
+	// CapabilityVersion 63. Other values are currently ignored.
 	Type string `json:",omitempty"`
 
-	// Value is the IP address in string form.
+	// Value is the record data in string form: for A and AAAA
+	// records, the IP address. For other types, it's the record data
+	// as in a zone file, without quoting:
+	//
+	//	CNAME: "target.example.com"
+	//	TXT:   "v=spf1 -all"
+	//	MX:    "10 mail.example.com" (preference, exchange)
+	//	SRV:   "10 5 5060 sip.example.com" (priority, weight, port, target)
+	//
 	// TODO(bradfitz): if we ever add support for record types
 	// with non-UTF8 binary data, add ValueBytes []byte that
 	// would take precedence.
@@ -2048,6 +2059,11 @@ type SSHAction struct {
 	// to use local port forwarding if requested.
 	AllowLocalPortForwarding bool `json:"allowLocalPortForwarding,omitempty"`
 
+	// AllowRemotePortForwarding, if true, allows accepted connections
+	// to use remote port forwarding if requested. Forwarded ports may
+	// only be bound to the node's loopback or Tailscale addresses.
+	AllowRemotePortForwarding bool `json:"allowRemotePortForwarding,omitempty"`
+
 	// Recorders defines the destinations of the SSH session recorders.
 	// The recording will be uploaded to http://addr:port/record.
 	Recorders []netip.AddrPort `json:"recorders,omitempty"`
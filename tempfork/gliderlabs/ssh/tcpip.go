@@ -119,6 +119,9 @@ func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *go
 		}
 		_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
 		destPort, _ := strconv.Atoi(destPortStr)
+		// Track the listener by the port actually bound, which is what
+		// clients send in cancel-tcpip-forward if they asked for port 0.
+		addr = net.JoinHostPort(reqPayload.BindAddr, destPortStr)
 		h.Lock()
 		h.forwards[addr] = ln
 		h.Unlock()
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
+)
+
+// KeySigner signs both AUMs and node-key signatures using a key trusted
+// by the key authority.
+//
+// key.NLPrivate implements KeySigner for the network-lock key of a node.
+// Keys held elsewhere, such as in an ssh-agent, can be used through
+// NewCryptoSigner.
+type KeySigner interface {
+	Signer
+
+	// KeyID returns the KeyID of the signing key.
+	KeyID() tkatype.KeyID
+
+	// SignNKS signs the NodeKeySignature identified by sigHash.
+	SignNKS(tkatype.NKSSigHash) ([]byte, error)
+}
+
+// NewCryptoSigner returns a KeySigner that signs with s, which must hold
+// an ed25519 key.
+func NewCryptoSigner(s crypto.Signer) (KeySigner, error) {
+	pub, ok := s.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is of type %T, not ed25519", s.Public())
+	}
+	return cryptoSigner{s: s, pub: pub}, nil
+}
+
+// cryptoSigner is a KeySigner for an ed25519 crypto.Signer.
+type cryptoSigner struct {
+	s   crypto.Signer
+	pub ed25519.PublicKey
+}
+
+// KeyID implements KeySigner.
+func (c cryptoSigner) KeyID() tkatype.KeyID {
+	// See Key.ID: the KeyID of a 25519 key is its public key.
+	return tkatype.KeyID(c.pub)
+}
+
+func (c cryptoSigner) sign(digest []byte) ([]byte, error) {
+	// Ed25519 signs the message itself rather than a hash of it,
+	// which crypto.Hash(0) asks for.
+	sig, err := c.s.Sign(rand.Reader, digest, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	// The key may be held by another process or machine, so
+	// make sure the signature is one that will verify.
+	if !ed25519.Verify(c.pub, digest, sig) {
+		return nil, errors.New("signer produced an invalid signature")
+	}
+	return sig, nil
+}
+
+// SignAUM implements Signer.
+func (c cryptoSigner) SignAUM(sigHash tkatype.AUMSigHash) ([]tkatype.Signature, error) {
+	sig, err := c.sign(sigHash[:])
+	if err != nil {
+		return nil, err
+	}
+	return []tkatype.Signature{{KeyID: c.KeyID(), Signature: sig}}, nil
+}
+
+// SignNKS implements KeySigner.
+func (c cryptoSigner) SignNKS(sigHash tkatype.NKSSigHash) ([]byte, error) {
+	return c.sign(sigHash[:])
+}
+
+// SignNodeKey returns a SigDirect signature authorizing nodeKey, made by
+// signer. rotationPublic, if specified, must be an ed25519 public key,
+// which may later sign rotations of nodeKey.
+func SignNodeKey(nodeKey key.NodePublic, rotationPublic []byte, signer KeySigner) (*NodeKeySignature, error) {
+	p, err := nodeKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	sig := NodeKeySignature{
+		SigKind:        SigDirect,
+		KeyID:          signer.KeyID(),
+		Pubkey:         p,
+		WrappingPubkey: rotationPublic,
+	}
+	sig.Signature, err = signer.SignNKS(sig.SigHash())
+	if err != nil {
+		return nil, fmt.Errorf("signature failed: %w", err)
+	}
+	return &sig, nil
+}
+
+// SignUpdates signs updates, a chain of AUMs made by an UpdateBuilder
+// without a Signer, for instance to sign them on another machine.
+//
+// An AUM's hash covers its signatures, so each update after the first
+// is made to point at its newly signed parent before being signed itself.
+// As that would invalidate existing signatures, only the first update may
+// already be signed. The updates are modified in place.
+func SignUpdates(updates []AUM, signer Signer) error {
+	for i := range updates {
+		if i > 0 {
+			if len(updates[i].Signatures) > 0 {
+				return fmt.Errorf("update %d is already signed", i)
+			}
+			parent := updates[i-1].Hash()
+			updates[i].PrevAUMHash = parent[:]
+		}
+		sigs, err := signer.SignAUM(updates[i].SigHash())
+		if err != nil {
+			return fmt.Errorf("signing update %d: %w", i, err)
+		}
+		updates[i].Signatures = append(updates[i].Signatures, sigs...)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tka
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"tailscale.com/types/key"
+)
+
+func TestCryptoSigner(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	signer, err := NewCryptoSigner(ed25519.PrivateKey(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Kind: Key25519, Public: pub, Votes: 1}
+	if got, want := signer.KeyID(), k.MustID(); string(got) != string(want) {
+		t.Errorf("KeyID() = %x, want %x", got, want)
+	}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{k},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, signer)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	nodeKey := key.NewNode().Public()
+	sig, err := SignNodeKey(nodeKey, nil, signer)
+	if err != nil {
+		t.Fatalf("SignNodeKey() failed: %v", err)
+	}
+	if err := a.NodeKeyAuthorized(nodeKey, sig.Serialize()); err != nil {
+		t.Errorf("NodeKeyAuthorized() failed: %v", err)
+	}
+}
+
+func TestSignUpdates(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	k := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{k},
+		DisablementSecrets: [][]byte{DisablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Build the updates without a signer, as on a machine without
+	// the signing key.
+	pub2, _ := testingKey25519(t, 2)
+	pub3, _ := testingKey25519(t, 3)
+	b := a.NewUpdater(nil)
+	if err := b.AddKey(Key{Kind: Key25519, Public: pub2, Votes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddKey(Key{Kind: Key25519, Public: pub3, Votes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize(storage)
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.VerifyUpdates(updates); err == nil {
+		t.Fatal("VerifyUpdates() succeeded on unsigned updates")
+	}
+
+	// Round-trip them through their serialized form, as when they're
+	// exported for signing elsewhere.
+	for i := range updates {
+		var u AUM
+		if err := u.Unserialize(updates[i].Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		updates[i] = u
+	}
+
+	if err := SignUpdates(updates, signer25519(priv)); err != nil {
+		t.Fatalf("SignUpdates() failed: %v", err)
+	}
+	if err := a.VerifyUpdates(updates); err != nil {
+		t.Fatalf("VerifyUpdates() failed: %v", err)
+	}
+	if err := a.Inform(storage, updates); err != nil {
+		t.Fatalf("could not apply signed updates: %v", err)
+	}
+	for _, pub := range [][]byte{pub2, pub3} {
+		if !a.KeyTrusted(pub) {
+			t.Errorf("key %x not trusted after update", pub)
+		}
+	}
+
+	if err := SignUpdates(updates, signer25519(priv)); err == nil {
+		t.Error("SignUpdates() succeeded on signed updates")
+	}
+}
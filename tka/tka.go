@@ -674,6 +674,26 @@ func (a *Authority) Inform(storage Chonk, updates []AUM) error {
 	return nil
 }
 
+// VerifyUpdates returns a nil error if updates are a chain of well-formed,
+// correctly signed AUMs that apply to the current head of the authority.
+// Unlike Inform, nothing is applied or stored.
+func (a *Authority) VerifyUpdates(updates []AUM) error {
+	if len(updates) == 0 {
+		return errors.New("no updates")
+	}
+	state := a.state
+	for i, update := range updates {
+		if err := aumVerify(update, state, false); err != nil {
+			return fmt.Errorf("update %d invalid: %v", i, err)
+		}
+		var err error
+		if state, err = state.applyVerifiedAUM(update); err != nil {
+			return fmt.Errorf("update %d cannot be applied: %v", i, err)
+		}
+	}
+	return nil
+}
+
 // NodeKeyAuthorized checks if the provided nodeKeySignature authorizes
 // the given node key.
 func (a *Authority) NodeKeyAuthorized(nodeKey key.NodePublic, nodeKeySignature tkatype.MarshaledSignature) error {
@@ -0,0 +1,275 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/types/nettype"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// packetFlowIdleTimeout is how long a UDP flow to a ListenPacket conn
+	// may go without traffic in either direction before it's forgotten.
+	// Replies can only be sent to peers with a live flow.
+	packetFlowIdleTimeout = 2 * time.Minute
+
+	// packetQueueLen is the number of datagrams a ListenPacket conn
+	// queues before dropping new ones, like a socket receive buffer.
+	packetQueueLen = 128
+
+	// maxPacketSize is the largest datagram read from a flow.
+	maxPacketSize = 64 << 10
+)
+
+// ListenPacket announces a UDP port on the Tailscale network and returns a
+// net.PacketConn receiving the datagrams of all peers sending to it. The
+// network must be "udp", "udp4" or "udp6", and addr must have an empty or
+// IP literal host part.
+//
+// ReadFrom reports the Tailscale IP:port of the sending peer. WriteTo can
+// only reply to peers that have sent a datagram to the conn within the
+// last two minutes; it returns an error for other addresses.
+//
+// It will start the server if it has not been started yet.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("unsupported network type")
+	}
+	bindHostOrZero, port, err := parseListenAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+
+	key := listenKey{network, bindHostOrZero, port, false}
+	pc := &packetListener{
+		s:        s,
+		key:      key,
+		addr:     addr,
+		incoming: make(chan packet, packetQueueLen),
+		closedc:  make(chan struct{}),
+		deadline: make(chan struct{}),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.listeners[key]
+	if _, pcOK := s.packetConns[key]; ok || pcOK {
+		return nil, fmt.Errorf("tsnet: listener already open for %s, %s", network, addr)
+	}
+	mak.Set(&s.packetConns, key, pc)
+	return pc, nil
+}
+
+// packetConnForDstAddr is like listenerForDstAddr, but for ListenPacket
+// conns.
+func (s *Server) packetConnForDstAddr(dst netip.AddrPort) (_ *packetListener, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range [2]netip.Addr{0: dst.Addr()} {
+		for _, net := range [2]string{
+			networkForFamily("udp", dst.Addr().Is6()),
+			"udp",
+		} {
+			if pc, ok := s.packetConns[listenKey{net, a, dst.Port(), false}]; ok {
+				return pc, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// packet is a datagram received by a packetListener.
+type packet struct {
+	b   []byte
+	src netip.AddrPort
+}
+
+// packetListener is the net.PacketConn returned by ListenPacket. It
+// demultiplexes the per-peer UDP flows netstack hands to tsnet into a
+// single conn.
+type packetListener struct {
+	s        *Server
+	key      listenKey
+	addr     string
+	incoming chan packet
+	closedc  chan struct{} // closed by closeLocked
+	closed   bool          // guarded by s.mu
+
+	mu       sync.Mutex
+	flows    map[netip.AddrPort]nettype.ConnPacketConn // by peer src
+	readAt   time.Time                                 // read deadline, or zero
+	deadline chan struct{}                             // closed when readAt changes
+}
+
+// handle reads the datagrams of the flow c from src into pc until the
+// flow is idle for packetFlowIdleTimeout or pc is closed.
+func (pc *packetListener) handle(src netip.AddrPort, c nettype.ConnPacketConn) {
+	pc.mu.Lock()
+	select {
+	case <-pc.closedc:
+		pc.mu.Unlock()
+		c.Close()
+		return
+	default:
+	}
+	if old, ok := pc.flows[src]; ok {
+		// netstack only starts a new flow for a peer once the old
+		// one's endpoint is gone.
+		old.Close()
+	}
+	mak.Set(&pc.flows, src, c)
+	pc.mu.Unlock()
+	defer func() {
+		pc.mu.Lock()
+		defer pc.mu.Unlock()
+		if pc.flows[src] == c {
+			delete(pc.flows, src)
+		}
+		c.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(packetFlowIdleTimeout))
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case pc.incoming <- packet{append([]byte(nil), buf[:n]...), src}:
+		case <-pc.closedc:
+			return
+		default:
+			// Queue full; drop the datagram.
+		}
+	}
+}
+
+func (pc *packetListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, again, err := pc.readFrom(b)
+		if !again {
+			return n, addr, err
+		}
+	}
+}
+
+// readFrom waits for a datagram until the current read deadline. It
+// reports again if the deadline was changed while waiting.
+func (pc *packetListener) readFrom(b []byte) (n int, addr net.Addr, again bool, err error) {
+	pc.mu.Lock()
+	readAt, deadline := pc.readAt, pc.deadline
+	pc.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !readAt.IsZero() {
+		d := time.Until(readAt)
+		if d <= 0 {
+			return 0, nil, false, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-pc.incoming:
+		return copy(b, p.b), net.UDPAddrFromAddrPort(p.src), false, nil
+	case <-pc.closedc:
+		return 0, nil, false, fmt.Errorf("tsnet: %w", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, false, os.ErrDeadlineExceeded
+	case <-deadline:
+		return 0, nil, true, nil
+	}
+}
+
+func (pc *packetListener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.closedc:
+		return 0, fmt.Errorf("tsnet: %w", net.ErrClosed)
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("tsnet: unsupported address type %T", addr)
+	}
+	dst := ua.AddrPort()
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	pc.mu.Lock()
+	c, ok := pc.flows[dst]
+	pc.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("tsnet: no UDP flow from %v", dst)
+	}
+	n, err := c.Write(b)
+	if err == nil {
+		c.SetReadDeadline(time.Now().Add(packetFlowIdleTimeout))
+	}
+	return n, err
+}
+
+func (pc *packetListener) Close() error {
+	pc.s.mu.Lock()
+	defer pc.s.mu.Unlock()
+	return pc.closeLocked()
+}
+
+// closeLocked closes the conn and its flows.
+// It must be called with pc.s.mu held.
+func (pc *packetListener) closeLocked() error {
+	if pc.closed {
+		return fmt.Errorf("tsnet: %w", net.ErrClosed)
+	}
+	if v, ok := pc.s.packetConns[pc.key]; ok && v == pc {
+		delete(pc.s.packetConns, pc.key)
+	}
+	close(pc.closedc)
+	pc.closed = true
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, c := range pc.flows {
+		c.Close()
+	}
+	return nil
+}
+
+func (pc *packetListener) LocalAddr() net.Addr { return packetAddr{pc} }
+
+func (pc *packetListener) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+func (pc *packetListener) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.readAt = t
+	close(pc.deadline)
+	pc.deadline = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op; writes to a flow never block for long.
+func (pc *packetListener) SetWriteDeadline(t time.Time) error { return nil }
+
+// Server returns the tsnet Server associated with the conn.
+func (pc *packetListener) Server() *Server { return pc.s }
+
+type packetAddr struct{ pc *packetListener }
+
+func (a packetAddr) Network() string { return a.pc.key.network }
+func (a packetAddr) String() string  { return a.pc.addr }
@@ -124,10 +124,11 @@ type Server struct {
 	logtail          *logtail.Logger
 	logid            logid.PublicID
 
-	mu        sync.Mutex
-	listeners map[listenKey]*listener
-	dialer    *tsdial.Dialer
-	closed    bool
+	mu          sync.Mutex
+	listeners   map[listenKey]*listener
+	packetConns map[listenKey]*packetListener
+	dialer      *tsdial.Dialer
+	closed      bool
 }
 
 // Dial connects to the address on the tailnet.
@@ -375,6 +376,9 @@ func (s *Server) Close() error {
 	for _, ln := range s.listeners {
 		ln.closeLocked()
 	}
+	for _, pc := range s.packetConns {
+		pc.closeLocked()
+	}
 
 	wg.Wait()
 	s.closed = true
@@ -514,6 +518,9 @@ func (s *Server) start() (reterr error) {
 	s.dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 		return ns.DialContextTCP(ctx, dst)
 	}
+	s.dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+		return ns.DialContextUDP(ctx, dst)
+	}
 
 	if s.Store == nil {
 		stateFile := filepath.Join(s.rootPath, "miraged.state")
@@ -754,6 +761,9 @@ func (s *Server) getTCPHandlerForFlow(src, dst netip.AddrPort) (handler func(net
 }
 
 func (s *Server) getUDPHandlerForFlow(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool) {
+	if pc, ok := s.packetConnForDstAddr(dst); ok {
+		return func(c nettype.ConnPacketConn) { pc.handle(src, c) }, true
+	}
 	ln, ok := s.listenerForDstAddr("udp", dst, false)
 	if !ok {
 		return nil, true // don't handle, don't forward to localhost
@@ -963,36 +973,45 @@ func (s *Server) ListenFunnel(network, addr string, opts ...FunnelOption) (net.L
 	listenOnBoth    = listenOn("listen-on-both")
 )
 
-func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, error) {
-	switch network {
-	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
-	default:
-		return nil, errors.New("unsupported network type")
-	}
+// parseListenAddr parses the addr argument of Listen and ListenPacket into
+// the IP to bind to, which is the zero value if unspecified, and the port.
+func parseListenAddr(network, addr string) (bindHostOrZero netip.Addr, port uint16, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("tsnet: %w", err)
+		return netip.Addr{}, 0, fmt.Errorf("tsnet: %w", err)
 	}
-	port, err := net.LookupPort(network, portStr)
-	if err != nil || port < 0 || port > math.MaxUint16 {
+	port64, err := net.LookupPort(network, portStr)
+	if err != nil || port64 < 0 || port64 > math.MaxUint16 {
 		// LookupPort returns an error on out of range values so the bounds
 		// checks on port should be unnecessary, but harmless. If they do
 		// match, worst case this error message says "invalid port: <nil>".
-		return nil, fmt.Errorf("invalid port: %w", err)
+		return netip.Addr{}, 0, fmt.Errorf("invalid port: %w", err)
 	}
-	var bindHostOrZero netip.Addr
 	if host != "" {
 		bindHostOrZero, err = netip.ParseAddr(host)
 		if err != nil {
-			return nil, fmt.Errorf("invalid Listen addr %q; host part must be empty or IP literal", host)
+			return netip.Addr{}, 0, fmt.Errorf("invalid Listen addr %q; host part must be empty or IP literal", host)
 		}
 		if strings.HasSuffix(network, "4") && !bindHostOrZero.Is4() {
-			return nil, fmt.Errorf("invalid non-IPv4 addr %v for network %q", host, network)
+			return netip.Addr{}, 0, fmt.Errorf("invalid non-IPv4 addr %v for network %q", host, network)
 		}
 		if strings.HasSuffix(network, "6") && !bindHostOrZero.Is6() {
-			return nil, fmt.Errorf("invalid non-IPv6 addr %v for network %q", host, network)
+			return netip.Addr{}, 0, fmt.Errorf("invalid non-IPv6 addr %v for network %q", host, network)
 		}
 	}
+	return bindHostOrZero, uint16(port64), nil
+}
+
+func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, error) {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("unsupported network type")
+	}
+	bindHostOrZero, port, err := parseListenAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := s.Start(); err != nil {
 		return nil, err
@@ -1001,12 +1020,12 @@ func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, erro
 	var keys []listenKey
 	switch lnOn {
 	case listenOnTailnet:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), false})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, false})
 	case listenOnFunnel:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), true})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, true})
 	case listenOnBoth:
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), false})
-		keys = append(keys, listenKey{network, bindHostOrZero, uint16(port), true})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, false})
+		keys = append(keys, listenKey{network, bindHostOrZero, port, true})
 	}
 
 	ln := &listener{
@@ -1018,7 +1037,8 @@ func (s *Server) listen(network, addr string, lnOn listenOn) (net.Listener, erro
 	}
 	s.mu.Lock()
 	for _, key := range keys {
-		if _, ok := s.listeners[key]; ok {
+		_, ok := s.listeners[key]
+		if _, pcOK := s.packetConns[key]; ok || pcOK {
 			s.mu.Unlock()
 			return nil, fmt.Errorf("tsnet: listener already open for %s, %s", network, addr)
 		}
@@ -281,6 +281,87 @@ func TestConn(t *testing.T) {
 	}
 }
 
+func TestListenPacket(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL := startControl(t)
+	s1, s1ip := startServer(t, ctx, controlURL, "s1")
+	s2, s2ip := startServer(t, ctx, controlURL, "s2")
+
+	pc, err := s1.ListenPacket("udp", ":5353")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := s1.Listen("udp", ":5353"); err == nil {
+		t.Errorf("Listen on a port used by ListenPacket succeeded; want error")
+	}
+
+	// Two flows from s2 to the same port, read from the one conn.
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := s2.Dial(ctx, "udp", fmt.Sprintf("%s:5353", s1ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	buf := make([]byte, 1500)
+	for i, c := range clients {
+		want := fmt.Sprintf("hello %d", i)
+		if _, err := io.WriteString(c, want); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			t.Fatalf("ReadFrom addr is %T, want *net.UDPAddr", addr)
+		}
+		wantSrc := c.LocalAddr().(*net.UDPAddr).AddrPort()
+		if got := ua.AddrPort(); got.Addr() != s2ip || got.Port() != wantSrc.Port() {
+			t.Errorf("ReadFrom addr = %v, want %v:%d", got, s2ip, wantSrc.Port())
+		}
+
+		// Reply, and check it reaches the right flow.
+		if _, err := pc.WriteTo([]byte("re: "+want), addr); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err = c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != "re: "+want {
+			t.Errorf("reply = %q, want %q", got, "re: "+want)
+		}
+	}
+
+	// Replies need a flow.
+	if _, err := pc.WriteTo([]byte("hi"), &net.UDPAddr{IP: s2ip.AsSlice(), Port: 1}); err == nil {
+		t.Errorf("WriteTo without a flow succeeded; want error")
+	}
+
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom past deadline error = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	pc.Close()
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom after Close error = %v, want net.ErrClosed", err)
+	}
+}
+
 func TestLoopbackLocalAPI(t *testing.T) {
 	tstest.ResourceCheck(t)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -250,6 +250,22 @@ func (s *Server) ensureKeyPairLocked() {
 	s.pubKey = s.privKey.Public()
 }
 
+// UseKeysOf makes s use the same keys as other, as another replica of the
+// same control plane would. It must be called before s serves requests.
+func (s *Server) UseKeysOf(other *Server) {
+	other.mu.Lock()
+	other.ensureKeyPairLocked()
+	noisePriv, priv := other.noisePrivKey, other.privKey
+	other.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noisePrivKey = noisePriv
+	s.noisePubKey = noisePriv.Public()
+	s.privKey = priv
+	s.pubKey = priv.Public()
+}
+
 func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
 	_, legacyKey := s.publicKeys()
 	if r.FormValue("v") == "" {
@@ -636,6 +652,9 @@ func (s *Server) UpdateNode(n *tailcfg.Node) (peersToUpdate []tailcfg.NodeID) {
 	if n.Key.IsZero() {
 		panic("zero nodekey")
 	}
+	if s.nodes == nil {
+		s.nodes = map[key.NodePublic]*tailcfg.Node{}
+	}
 	s.nodes[n.Key] = n.Clone()
 	return s.nodeIDsLocked(n.ID)
 }
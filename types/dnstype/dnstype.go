@@ -8,6 +8,7 @@
 
 import (
 	"net/netip"
+	"time"
 )
 
 // Resolver is the configuration for one DNS resolver.
@@ -16,11 +17,13 @@ type Resolver struct {
 	//  - A plain IP address for a "classic" UDP+TCP DNS resolver.
 	//    This is the common format as sent by the control plane.
 	//  - An IP:port, for tests.
-	//  - "https://resolver.com/path" for DNS over HTTPS; currently
-	//    as of 2022-09-08 only used for certain well-known resolvers
-	//    (see the publicdns package) for which the IP addresses to dial DoH are
-	//    known ahead of time, so bootstrap DNS resolution is not required.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "https://resolver.com/path" for DNS over HTTPS. For
+	//    well-known resolvers (see the publicdns package) the IP
+	//    addresses to dial are known ahead of time; other hosts are
+	//    resolved per BootstrapResolution.
+	//  - "tls://resolver.com" or "tls://resolver.com:port" for DNS over
+	//    TCP+TLS, port 853 by default. The host is resolved per
+	//    BootstrapResolution.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -29,8 +32,6 @@ type Resolver struct {
 	// BootstrapResolution may be empty, in which case clients should
 	// look up the DoT/DoH server using their local "classic" DNS
 	// resolver.
-	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 }
 
@@ -51,3 +52,41 @@ func (r *Resolver) IPPort() (ipp netip.AddrPort, ok bool) {
 	}
 	return
 }
+
+// QueryLogEntry describes a DNS query handled by the MagicDNS resolver
+// (100.100.100.100), as reported by the LocalAPI's DNS query log.
+type QueryLogEntry struct {
+	// Time is when the query arrived.
+	Time time.Time
+
+	// Name is the queried name, with a trailing dot.
+	Name string
+
+	// Type is the query type, such as "A" or "AAAA".
+	Type string
+
+	// Resolution is how the query was answered: "local" for MagicDNS
+	// names and extra records, "blocked" for names in a blocklist,
+	// "cached" for responses from the forwarder's cache, and
+	// "forwarded" for queries sent to an upstream resolver.
+	Resolution string
+
+	// Route is the DNS suffix of the route the query was forwarded
+	// with, such as "corp.example.com." or "." for the default route.
+	// It's empty for queries that weren't forwarded.
+	Route string `json:",omitempty"`
+
+	// Upstream is the address of the upstream resolver that answered
+	// a forwarded query, if any.
+	Upstream string `json:",omitempty"`
+
+	// RCode is the response code, such as "NOERROR" or "NXDOMAIN". It's
+	// empty if no response was sent.
+	RCode string `json:",omitempty"`
+
+	// Latency is how long it took to answer the query.
+	Latency time.Duration
+
+	// Err is the error forwarding the query, if any.
+	Err string `json:",omitempty"`
+}
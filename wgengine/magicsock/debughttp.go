@@ -69,6 +69,9 @@ type D struct {
 	}
 	fmt.Fprintf(w, "</ul>\n")
 
+	fmt.Fprintf(w, "<h2 id=derphome><a href=#derphome>#</a> Home DERP choice</h2>")
+	printDERPHomeDecisionHTML(w, c.derpMap, c.derpHomeDecision, now)
+
 	fmt.Fprintf(w, "<h2 id=ipport><a href=#ipport>#</a> ip:port to endpoint</h2><ul>")
 	{
 		type kv struct {
@@ -204,3 +207,41 @@ func ipPortLess(a, b netip.AddrPort) bool {
 	}
 	return a.Port() < b.Port()
 }
+
+func printDERPHomeDecisionHTML(w io.Writer, dm *tailcfg.DERPMap, d derpHomeDecision, now time.Time) {
+	if d.at.IsZero() {
+		fmt.Fprintf(w, "<p>Not picked yet.</p>\n")
+		return
+	}
+	fmt.Fprintf(w, "<p>Picked derp-%d %v ago: %s</p>\n", d.region, now.Sub(d.at).Round(time.Second), html.EscapeString(d.reason))
+	fmt.Fprintf(w, "<p>Policy: pin=%d avoid=%v peer-aware=%v</p>\n", d.policy.Pin, d.policy.Avoid, d.policy.PeerAware)
+	if dm == nil {
+		return
+	}
+	peerAware := d.policy.PeerAware
+	fmt.Fprintf(w, "<table><tr><th>Region</th><th>Latency</th>")
+	if peerAware {
+		fmt.Fprintf(w, "<th>Peers</th><th>Active peers</th>")
+	}
+	fmt.Fprintf(w, "<th></th></tr>\n")
+	for _, rid := range dm.RegionIDs() {
+		r := dm.Regions[rid]
+		lat := "-"
+		if l, ok := d.latency[rid]; ok {
+			lat = l.Round(time.Millisecond).String()
+		}
+		var note string
+		if rid == d.region {
+			note = "🏠"
+		} else if d.policy.avoids(rid) {
+			note = "avoided"
+		}
+		fmt.Fprintf(w, "<tr><td>%d - %v</td><td>%s</td>", rid, html.EscapeString(r.RegionCode), lat)
+		if peerAware {
+			rp := d.peers[rid]
+			fmt.Fprintf(w, "<td>%d</td><td>%d</td>", rp.all, rp.active)
+		}
+		fmt.Fprintf(w, "<td>%s</td></tr>\n", note)
+	}
+	fmt.Fprintf(w, "</table>\n")
+}
@@ -44,6 +44,12 @@
 	// debugSendCallMeUnknownPeer sends a CallMeMaybe to a non-existent destination every
 	// time we send a real CallMeMaybe to test the PeerGoneNotHere logic.
 	debugSendCallMeUnknownPeer = envknob.RegisterBool("TS_DEBUG_SEND_CALLME_UNKNOWN_PEER")
+	// debugEnablePMTUD enables path MTU discovery, setting the
+	// don't-fragment bit on magicsock's sockets.
+	debugEnablePMTUD = envknob.RegisterBool("TS_DEBUG_ENABLE_PMTUD")
+	// debugDisableIfacePaths disables binding sockets to each local
+	// network interface to find paths to peers through each of them.
+	debugDisableIfacePaths = envknob.RegisterBool("TS_DEBUG_DISABLE_INTERFACE_PATHS")
 	// Hey you! Adding a new debugknob? Make sure to stub it out in the debugknob_stubs.go
 	// file too.
 )
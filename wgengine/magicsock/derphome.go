@@ -0,0 +1,272 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/mak"
+)
+
+// By default, the home DERP region is the one netcheck finds to have the
+// lowest latency. Peers in different parts of the world then often have
+// different homes, and the traffic relayed between them crosses two
+// regions. With DERPHomePolicy.PeerAware, a region that's not much slower
+// than the fastest one is preferred if more of our peers, weighted by how
+// recently we've exchanged traffic with them, have it as their home.
+
+const (
+	// derpHomeActiveWindow is how recently a packet must have been sent to
+	// or received from a peer for it to count as active.
+	derpHomeActiveWindow = 10 * time.Minute
+
+	// derpHomeActivePeerWeight is how many idle peers an active peer
+	// counts as.
+	derpHomeActivePeerWeight = 10
+
+	// derpHomeMinLatencyTolerance is the minimum latency, over that of
+	// the fastest region, of the regions that PeerAware can pick.
+	derpHomeMinLatencyTolerance = 25 * time.Millisecond
+)
+
+// DERPHomePolicy configures how the home DERP region is picked.
+// The zero value picks the region with the lowest latency.
+type DERPHomePolicy struct {
+	// Pin, if non-zero, is the ID of the region to always use as home,
+	// if it's in the DERP map.
+	Pin int
+
+	// Avoid are the IDs of the regions never to use as home, unless
+	// there's no other.
+	Avoid []int
+
+	// PeerAware is whether to prefer the regions that the most active
+	// peers use as their home over ones with slightly lower latency.
+	PeerAware bool
+}
+
+// IsZero reports whether p is the default policy.
+func (p DERPHomePolicy) IsZero() bool {
+	return p.Pin == 0 && len(p.Avoid) == 0 && !p.PeerAware
+}
+
+func (p DERPHomePolicy) avoids(regionID int) bool {
+	for _, id := range p.Avoid {
+		if id == regionID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p DERPHomePolicy) equal(o DERPHomePolicy) bool {
+	return p.Pin == o.Pin && p.PeerAware == o.PeerAware && slices.Equal(p.Avoid, o.Avoid)
+}
+
+// derpRegionPeers counts the peers whose home is a DERP region.
+type derpRegionPeers struct {
+	all    int // peers in the netmap
+	active int // those of them with recent traffic
+}
+
+// weight returns how much the peers count toward picking the region as
+// home: idle peers count once, active ones derpHomeActivePeerWeight times.
+func (rp derpRegionPeers) weight() int {
+	return rp.all - rp.active + rp.active*derpHomeActivePeerWeight
+}
+
+// derpHomeDecision is the outcome of picking the home DERP region, kept
+// for the debug page.
+type derpHomeDecision struct {
+	region int    // picked region; 0 if none, meaning a fallback one is used
+	reason string // why region was picked
+	at     time.Time
+
+	// The inputs the decision was made with.
+	policy  DERPHomePolicy
+	latency map[int]time.Duration
+	peers   map[int]derpRegionPeers
+}
+
+// pickDERPHome picks the home DERP region among regionIDs according to
+// policy, given the latency measured by netcheck to each region (empty if
+// none could be), the peers homed in each region, the current home region
+// cur, and netcheck's preferred region, which is sticky to cur.
+// It returns 0 if there's no latency to go by and nothing else to decide
+// on.
+func pickDERPHome(policy DERPHomePolicy, regionIDs []int, latency map[int]time.Duration, peers map[int]derpRegionPeers, cur, preferred int) (region int, reason string) {
+	var note string
+	if policy.Pin != 0 {
+		for _, id := range regionIDs {
+			if id == policy.Pin {
+				return id, "pinned by prefs"
+			}
+		}
+		note = fmt.Sprintf("pinned derp-%d not in DERP map; ", policy.Pin)
+	}
+
+	var cands []int
+	for _, id := range regionIDs {
+		if !policy.avoids(id) {
+			cands = append(cands, id)
+		}
+	}
+	if len(cands) == 0 {
+		note += "all regions avoided; "
+		cands = regionIDs
+	}
+	isCand := func(id int) bool {
+		for _, c := range cands {
+			if c == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	best := 0
+	for _, id := range cands {
+		if d, ok := latency[id]; ok && (best == 0 || d < latency[best]) {
+			best = id
+		}
+	}
+
+	// mostPeers returns the region among ids with the highest peer
+	// weight, preferring cur and then earlier ones on ties, or 0 if none
+	// has any peers.
+	mostPeers := func(ids []int) int {
+		var most, mostWeight int
+		for _, id := range ids {
+			w := peers[id].weight()
+			if w > mostWeight || (w == mostWeight && w > 0 && id == cur) {
+				most, mostWeight = id, w
+			}
+		}
+		return most
+	}
+
+	if best == 0 {
+		// No latency data, perhaps because UDP is blocked.
+		if policy.PeerAware {
+			if id := mostPeers(cands); id != 0 {
+				rp := peers[id]
+				return id, fmt.Sprintf("%sno latency data; %d peers (%d active) homed there", note, rp.all, rp.active)
+			}
+		}
+		if isCand(cur) {
+			return cur, note + "no latency data; keeping current home"
+		}
+		return 0, note + "no latency data"
+	}
+
+	base, baseReason := best, "lowest latency"
+	if preferred != 0 && preferred != best && isCand(preferred) {
+		if _, ok := latency[preferred]; ok {
+			base, baseReason = preferred, "netcheck's preferred"
+		}
+	}
+	if preferred != 0 && !isCand(preferred) {
+		note += fmt.Sprintf("netcheck's preferred derp-%d avoided; ", preferred)
+	}
+	baseReason = note + baseReason
+	if !policy.PeerAware {
+		return base, fmt.Sprintf("%s (%v)", baseReason, latency[base].Round(time.Millisecond))
+	}
+
+	tolerance := latency[best] / 2
+	if tolerance < derpHomeMinLatencyTolerance {
+		tolerance = derpHomeMinLatencyTolerance
+	}
+	var near []int
+	for _, id := range cands {
+		if d, ok := latency[id]; ok && d <= latency[best]+tolerance {
+			near = append(near, id)
+		}
+	}
+	// Put base first, so it wins ties when cur isn't among them.
+	sort.SliceStable(near, func(i, j int) bool { return near[i] == base && near[j] != base })
+	id := mostPeers(near)
+	if id == 0 {
+		return base, fmt.Sprintf("%s (%v); no peers homed within %v of it", baseReason, latency[base].Round(time.Millisecond), tolerance.Round(time.Millisecond))
+	}
+	rp := peers[id]
+	if id == base {
+		return id, fmt.Sprintf("%s (%v) and %d peers (%d active) homed there", baseReason, latency[id].Round(time.Millisecond), rp.all, rp.active)
+	}
+	return id, fmt.Sprintf("%s%d peers (%d active) homed there, at %v vs %v to derp-%d", note, rp.all, rp.active, latency[id].Round(time.Millisecond), latency[best].Round(time.Millisecond), best)
+}
+
+// SetDERPHomePolicy sets how the home DERP region is picked, and picks it
+// again if the policy changed.
+func (c *Conn) SetDERPHomePolicy(p DERPHomePolicy) {
+	c.mu.Lock()
+	if p.equal(c.derpHomePolicy) {
+		c.mu.Unlock()
+		return
+	}
+	p.Avoid = append([]int(nil), p.Avoid...)
+	c.derpHomePolicy = p
+	c.mu.Unlock()
+
+	c.logf("magicsock: home DERP policy now %+v", p)
+	c.ReSTUN("derp-home-policy")
+}
+
+// derpRegionPeersLocked counts the peers homed in each DERP region.
+// c.mu must be held.
+func (c *Conn) derpRegionPeersLocked() map[int]derpRegionPeers {
+	var ret map[int]derpRegionPeers
+	now := mono.Now()
+	c.peerMap.forEachEndpoint(func(de *endpoint) {
+		de.mu.Lock()
+		derpAddr, lastSend := de.derpAddr, de.lastSend
+		de.mu.Unlock()
+		if !derpAddr.IsValid() {
+			return
+		}
+		rid := int(derpAddr.Port())
+		rp := ret[rid]
+		rp.all++
+		if now.Sub(lastSend) < derpHomeActiveWindow || now.Sub(de.lastRecv.LoadAtomic()) < derpHomeActiveWindow {
+			rp.active++
+		}
+		mak.Set(&ret, rid, rp)
+	})
+	return ret
+}
+
+// pickDERPHome picks the home DERP region according to c.derpHomePolicy
+// and the netcheck report, recording why for the debug page. It returns 0
+// if a fallback one should be picked.
+func (c *Conn) pickDERPHome(report *netcheck.Report) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.wantDerpLocked() {
+		return 0
+	}
+
+	policy := c.derpHomePolicy
+	var peers map[int]derpRegionPeers
+	if policy.PeerAware {
+		peers = c.derpRegionPeersLocked()
+	}
+	region, reason := pickDERPHome(policy, c.derpMap.RegionIDs(), report.RegionLatency, peers, c.myDerp, report.PreferredDERP)
+	if region != c.derpHomeDecision.region && !policy.IsZero() {
+		c.logf("magicsock: home DERP policy picked derp-%d: %s", region, reason)
+	}
+	c.derpHomeDecision = derpHomeDecision{
+		region:  region,
+		reason:  reason,
+		at:      time.Now(),
+		policy:  policy,
+		latency: report.RegionLatency,
+		peers:   peers,
+	}
+	return region
+}
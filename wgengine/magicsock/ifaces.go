@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netns"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/util/mak"
+)
+
+// On machines with more than one uplink, such as laptops with both Wi-Fi
+// and Ethernet or servers with several ISPs, magicsock opens a UDP socket
+// bound to each of the interfaces, in addition to the main sockets whose
+// packets go wherever the routing table says. Discovery pings to peers are
+// also sent through each of those sockets, the latency of each path is
+// tracked per interface, and packets to a peer's bestAddr go through the
+// interface with the lowest latency. When that path stops answering the
+// heartbeat pings, they fail over to the next best one, or the main socket.
+
+// ifacePathMaxLost is the number of pings in a row without a pong after
+// which a path through an interface is considered down.
+const ifacePathMaxLost = 2
+
+// ifaceConn is a UDP socket bound to a local network interface.
+type ifaceConn struct {
+	name  string // interface name
+	index int    // interface index
+	is6   bool
+	pconn *net.UDPConn
+}
+
+// ifacePath is the state of the path to an endpoint through a local
+// network interface.
+type ifacePath struct {
+	latency time.Duration // round-trip time of the latest pong
+	pongAt  mono.Time     // when the latest pong was received; zero if none
+	lost    int           // pings without a pong since the latest pong
+}
+
+// isUp reports whether the path got a pong to one of its latest pings.
+func (p *ifacePath) isUp() bool {
+	return !p.pongAt.IsZero() && p.lost < ifacePathMaxLost
+}
+
+// ifaceReadResult is a WireGuard packet received on an ifaceConn.
+// A nil b is a signal from connBind.Close to check whether it's closed.
+type ifaceReadResult struct {
+	b  []byte // copied; ownership passed to receiver
+	ep *endpoint
+}
+
+// wantIfaceConns returns the local network interfaces, by address family,
+// that magicsock should bind sockets to: those with usable addresses of
+// the family, if there's more than one.
+func (c *Conn) wantIfaceConns() (want []ifaceConn) {
+	if c.netMon == nil || debugDisableIfacePaths() {
+		return nil
+	}
+	st := c.netMon.InterfaceState()
+	if st == nil {
+		return nil
+	}
+	var v4, v6 []ifaceConn
+	for name, iface := range st.Interface {
+		var has4, has6 bool
+		for _, ip := range st.UsableAddrs(name) {
+			has4 = has4 || ip.Is4()
+			has6 = has6 || ip.Is6()
+		}
+		if has4 {
+			v4 = append(v4, ifaceConn{name: name, index: iface.Index})
+		}
+		if has6 {
+			v6 = append(v6, ifaceConn{name: name, index: iface.Index, is6: true})
+		}
+	}
+	if len(v4) > 1 {
+		want = append(want, v4...)
+	}
+	if len(v6) > 1 {
+		want = append(want, v6...)
+	}
+	return want
+}
+
+// updateIfaceConns opens and closes the sockets bound to each local
+// network interface to match the current ones.
+func (c *Conn) updateIfaceConns() {
+	c.ifaceConnsMu.Lock()
+	defer c.ifaceConnsMu.Unlock()
+	if c.closing.Load() {
+		return
+	}
+
+	old := c.ifaceConns.Load()
+	var conns []*ifaceConn
+	for _, w := range c.wantIfaceConns() {
+		if ic := findIfaceConn(old, w.name, w.is6); ic != nil && ic.index == w.index {
+			conns = append(conns, ic)
+			continue
+		}
+		network := "udp4"
+		if w.is6 {
+			network = "udp6"
+		}
+		lc := netns.ListenerOnInterface(c.logf, w.name, w.index)
+		pc, err := lc.ListenPacket(context.Background(), network, ":0")
+		if err != nil {
+			c.logf("[v1] magicsock: unable to bind %v to interface %q: %v", network, w.name, err)
+			continue
+		}
+		ic := &ifaceConn{name: w.name, index: w.index, is6: w.is6, pconn: pc.(*net.UDPConn)}
+		c.logf("magicsock: bound %v to interface %q on %v", network, w.name, ic.pconn.LocalAddr())
+		conns = append(conns, ic)
+		go c.runIfaceReader(ic)
+	}
+	for _, ic := range old {
+		if findIfaceConn(conns, ic.name, ic.is6) != ic {
+			ic.pconn.Close()
+		}
+	}
+	c.ifaceConns.Store(conns)
+}
+
+// closeIfaceConns closes all the sockets bound to local network
+// interfaces.
+func (c *Conn) closeIfaceConns() {
+	c.ifaceConnsMu.Lock()
+	defer c.ifaceConnsMu.Unlock()
+	for _, ic := range c.ifaceConns.Load() {
+		ic.pconn.Close()
+	}
+	c.ifaceConns.Store(nil)
+}
+
+func findIfaceConn(conns []*ifaceConn, name string, is6 bool) *ifaceConn {
+	for _, ic := range conns {
+		if ic.name == name && ic.is6 == is6 {
+			return ic
+		}
+	}
+	return nil
+}
+
+// ifaceConn returns the socket bound to the local network interface iface
+// for the given address family, or nil if there's none.
+func (c *Conn) ifaceConn(iface string, is6 bool) *ifaceConn {
+	if iface == "" {
+		return nil
+	}
+	return findIfaceConn(c.ifaceConns.Load(), iface, is6)
+}
+
+// runIfaceReader reads packets from ic until it's closed, handling STUN
+// and disco packets and passing WireGuard ones to receiveIfaces.
+func (c *Conn) runIfaceReader(ic *ifaceConn) {
+	var epCache ippEndpointCache
+	buf := make([]byte, 65535)
+	for {
+		n, ipp, err := ic.pconn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.logf("magicsock: reading from interface %q: %v", ic.name, err)
+			}
+			return
+		}
+		ep, ok := c.receiveIP(buf[:n], ipp, &epCache)
+		if !ok {
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		select {
+		case <-c.donec:
+			return
+		case c.ifaceRecvCh <- ifaceReadResult{b: b, ep: ep}:
+		}
+	}
+}
+
+// receiveIfaces is a ReceiveFunc for the WireGuard packets read from the
+// sockets bound to local network interfaces.
+func (c *connBind) receiveIfaces(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+	for r := range c.ifaceRecvCh {
+		if c.isClosed() {
+			break
+		}
+		if r.b == nil {
+			continue
+		}
+		sizes[0] = copy(buffs[0], r.b)
+		eps[0] = r.ep
+		return 1, nil
+	}
+	return 0, net.ErrClosed
+}
+
+// sendUDPVia sends UDP packet b to addr through the local network
+// interface iface.
+// See sendAddr's docs on the return value meanings.
+func (c *Conn) sendUDPVia(iface string, addr netip.AddrPort, b []byte) (sent bool, err error) {
+	ic := c.ifaceConn(iface, addr.Addr().Is6())
+	if ic == nil {
+		// The interface went away.
+		return false, nil
+	}
+	if _, err := ic.pconn.WriteToUDPAddrPort(b, addr); err != nil {
+		metricSendUDPError.Add(1)
+		return false, err
+	}
+	metricSendUDP.Add(1)
+	return true, nil
+}
+
+// sendUDPBatchVia is like sendUDPBatch, but sends through the local
+// network interface iface, if non-empty and still there.
+func (c *Conn) sendUDPBatchVia(iface string, addr netip.AddrPort, buffs [][]byte) (sent bool, err error) {
+	ic := c.ifaceConn(iface, addr.Addr().Is6())
+	if ic == nil {
+		return c.sendUDPBatch(addr, buffs)
+	}
+	for _, b := range buffs {
+		if _, err := ic.pconn.WriteToUDPAddrPort(b, addr); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// startIfacePingsLocked pings ep through each of the local network
+// interfaces of its address family.
+// de.mu must be held.
+func (de *endpoint) startIfacePingsLocked(ep netip.AddrPort, now mono.Time) {
+	for _, ic := range de.c.ifaceConns.Load() {
+		if ic.is6 == ep.Addr().Is6() {
+			de.startDiscoPingViaLocked(ep, ic.name, now, pingDiscovery, 0)
+		}
+	}
+}
+
+// addIfacePongLocked records a pong to a ping sent through the local
+// network interface iface.
+// endpoint.mu must be held.
+func (st *endpointState) addIfacePongLocked(iface string, latency time.Duration, now mono.Time) {
+	p, ok := st.ifacePaths[iface]
+	if !ok {
+		p = new(ifacePath)
+		mak.Set(&st.ifacePaths, iface, p)
+	}
+	p.latency = latency
+	p.pongAt = now
+	p.lost = 0
+}
+
+// noteIfacePingLostLocked records that the ping sp, sent through a local
+// network interface, got no pong.
+// de.mu must be held.
+func (de *endpoint) noteIfacePingLostLocked(sp sentPing) {
+	st, ok := de.endpointState[sp.to]
+	if !ok {
+		return
+	}
+	p, ok := st.ifacePaths[sp.iface]
+	if !ok {
+		p = new(ifacePath)
+		mak.Set(&st.ifacePaths, sp.iface, p)
+	}
+	p.lost++
+	de.updateBestIfaceLocked()
+}
+
+// updateBestIfaceLocked picks the local network interface to send to
+// de.bestAddr through: the one with the lowest latency among those whose
+// path is up, or none, meaning the main socket, if its own latency is
+// lower still. The one in use is kept unless another is at least 10%
+// faster, to avoid flapping between similar ones.
+// de.mu must be held.
+func (de *endpoint) updateBestIfaceLocked() {
+	var st *endpointState
+	if de.bestAddr.IsValid() {
+		st = de.endpointState[de.bestAddr.AddrPort]
+	}
+	adjusted := func(iface string, latency time.Duration) time.Duration {
+		if iface != de.bestIface {
+			latency += latency / 10
+		}
+		return latency
+	}
+	best, bestLatency := "", adjusted("", de.bestAddr.latency)
+	if st != nil {
+		is6 := de.bestAddr.Addr().Is6()
+		for iface, p := range st.ifacePaths {
+			if !p.isUp() || de.c.ifaceConn(iface, is6) == nil {
+				continue
+			}
+			if l := adjusted(iface, p.latency); l < bestLatency {
+				best, bestLatency = iface, l
+			}
+		}
+	}
+	if best == de.bestIface {
+		return
+	}
+	if best != "" {
+		de.c.logf("magicsock: disco: node %v %v now sending to %v via interface %q", de.publicKey.ShortString(), de.discoShort(), de.bestAddr.AddrPort, best)
+	} else if de.bestAddr.IsValid() {
+		de.c.logf("magicsock: disco: node %v %v now sending to %v via the default route", de.publicKey.ShortString(), de.discoShort(), de.bestAddr.AddrPort)
+	}
+	de.bestIface = best
+}
+
+// ifacePathStatusLocked returns the status of the paths to the endpoint at
+// addr through each of the local network interfaces, sorted by interface
+// name. active is the interface in use, if any.
+// endpoint.mu must be held.
+func (st *endpointState) ifacePathStatusLocked(addr netip.AddrPort, active string) []*ipnstate.PeerInterfacePath {
+	var ret []*ipnstate.PeerInterfacePath
+	for iface, p := range st.ifacePaths {
+		ps := &ipnstate.PeerInterfacePath{
+			Interface: iface,
+			Addr:      addr.String(),
+			Down:      !p.isUp(),
+			Active:    iface == active,
+		}
+		if !p.pongAt.IsZero() {
+			ps.LatencySeconds = p.latency.Seconds()
+		}
+		ret = append(ret, ps)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Interface < ret[j].Interface })
+	return ret
+}
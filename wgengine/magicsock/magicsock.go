@@ -285,8 +285,9 @@ type Conn struct {
 	derpActiveFunc         func()
 	idleFunc               func() time.Duration // nil means unknown
 	testOnlyPacketListener nettype.PacketListener
-	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
-	netMon                 *netmon.Monitor      // or nil
+	noteRecvActivity       func(key.NodePublic)      // or nil, see Options.NoteRecvActivity
+	peerPathMTUFunc        func(key.NodePublic, int) // or nil, see Options.PeerPathMTUFunc
+	netMon                 *netmon.Monitor           // or nil
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -327,6 +328,17 @@ type Conn struct {
 	// It must have buffer size > 0; see issue 3736.
 	derpRecvCh chan derpReadResult
 
+	// ifaceRecvCh is used by receiveIfaces to read WireGuard packets
+	// from the ifaceConns. See ifaces.go.
+	ifaceRecvCh chan ifaceReadResult
+
+	// ifaceConnsMu serializes updates of ifaceConns.
+	ifaceConnsMu sync.Mutex
+
+	// ifaceConns are the UDP sockets bound to each local network
+	// interface, if there's more than one. See ifaces.go.
+	ifaceConns syncs.AtomicValue[[]*ifaceConn]
+
 	// bind is the wireguard-go conn.Bind for Conn.
 	bind *connBind
 
@@ -340,6 +352,11 @@ type Conn struct {
 	// logging.
 	noV4, noV6 atomic.Bool
 
+	// dfV4 and dfV6 are whether the IPv4 and IPv6 sockets have the
+	// don't-fragment bit set on their packets, which path MTU probes
+	// need in order not to be fragmented on their way.
+	dfV4, dfV6 atomic.Bool
+
 	// noV4Send is whether IPv4 UDP is known to be unable to transmit
 	// at all. This could happen if the socket is in an invalid state
 	// (as can happen on darwin after a network link status change).
@@ -481,6 +498,11 @@ type Conn struct {
 	// peer. It's only used to quiet logging, so we only log on change.
 	peerLastDerp map[key.NodePublic]int
 
+	// derpHomePolicy configures how the home DERP region is picked.
+	derpHomePolicy DERPHomePolicy
+	// derpHomeDecision is why the latest home DERP region was picked.
+	derpHomeDecision derpHomeDecision
+
 	// wgPinger is the WireGuard only pinger used for latency measurements.
 	wgPinger lazy.SyncValue[*ping.Pinger]
 }
@@ -583,6 +605,14 @@ type Options struct {
 	// not hold Conn.mu while calling it.
 	NoteRecvActivity func(key.NodePublic)
 
+	// PeerPathMTUFunc, if provided, is a func for magicsock to call
+	// whenever the path MTU of a peer's current direct path changes,
+	// with the largest packet size, in bytes, that can be sent through
+	// the tunnel to it, or zero if unknown.
+	// It's called with magicsock's locks held, so it must not call
+	// back into the Conn.
+	PeerPathMTUFunc func(key.NodePublic, int)
+
 	// NetMon is the network monitor to use.
 	// With one, the portmapper won't be used.
 	NetMon *netmon.Monitor
@@ -614,7 +644,8 @@ func (o *Options) derpActiveFunc() func() {
 func newConn() *Conn {
 	discoPrivate := key.NewDisco()
 	c := &Conn{
-		derpRecvCh:   make(chan derpReadResult, 1), // must be buffered, see issue 3736
+		derpRecvCh:   make(chan derpReadResult, 1),  // must be buffered, see issue 3736
+		ifaceRecvCh:  make(chan ifaceReadResult, 1), // must be buffered, see connBind.Close
 		derpStarted:  make(chan struct{}),
 		peerLastDerp: make(map[key.NodePublic]int),
 		peerMap:      newPeerMap(),
@@ -652,6 +683,7 @@ func NewConn(opts Options) (*Conn, error) {
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.peerPathMTUFunc = opts.PeerPathMTUFunc
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), opts.NetMon, nil, c.onPortMapChanged)
 	if opts.NetMon != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.NetMon.GatewayAndSelfIP)
@@ -675,6 +707,7 @@ func NewConn(opts Options) (*Conn, error) {
 	}
 
 	c.ignoreSTUNPackets()
+	c.updateIfaceConns()
 
 	if d4, err := c.listenRawDisco("ip4"); err == nil {
 		c.logf("[v1] using BPF disco receiver for IPv4")
@@ -871,7 +904,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		UPnP:                  report.UPnP,
 		PMP:                   report.PMP,
 		PCP:                   report.PCP,
-		HavePortMap:           c.portMapper.HaveMapping(),
+		HavePortMap:           c.portMapper.HaveMapping() || c.portMapper.HavePinhole(),
 	}
 	for rid, d := range report.RegionV4Latency {
 		ni.DERPLatency[fmt.Sprintf("%d-v4", rid)] = d.Seconds()
@@ -883,7 +916,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	ni.OSHasIPv6.Set(report.OSHasIPv6)
 	ni.WorkingUDP.Set(report.UDP)
 	ni.WorkingICMPv4.Set(report.ICMPv4)
-	ni.PreferredDERP = report.PreferredDERP
+	ni.PreferredDERP = c.pickDERPHome(report)
 
 	if ni.PreferredDERP == 0 {
 		// Perhaps UDP is blocked. Pick a deterministic but arbitrary
@@ -921,20 +954,24 @@ func (c *Conn) pickDERPFallback() int {
 		return 0
 	}
 
-	// TODO: figure out which DERP region most of our peers are using,
-	// and use that region as our fallback.
-	//
-	// If we already had selected something in the past and it has any
-	// peers, we want to stay on it. If there are no peers at all,
-	// stay on whatever DERP we previously picked. If we need to pick
-	// one and have no peer info, pick a region randomly.
-	//
-	// We used to do the above for legacy clients, but never updated
-	// it for disco.
+	// If we already had selected something in the past, stay on it. If
+	// we need to pick one, pick a region randomly, among those not
+	// avoided by c.derpHomePolicy if any. With the policy's PeerAware,
+	// pickDERPHome has already picked the one that most of our peers
+	// are using, if they're using any.
 
-	if c.myDerp != 0 {
+	if c.myDerp != 0 && !c.derpHomePolicy.avoids(c.myDerp) {
 		return c.myDerp
 	}
+	var allowed []int
+	for _, id := range ids {
+		if !c.derpHomePolicy.avoids(id) {
+			allowed = append(allowed, id)
+		}
+	}
+	if len(allowed) > 0 {
+		ids = allowed
+	}
 
 	h := fnv.New64()
 	fmt.Fprintf(h, "%p/%d", c, processStartUnixNano) // arbitrary
@@ -1191,6 +1228,12 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		addAddr(portmapExt, tailcfg.EndpointPortmapped)
 		c.setNetInfoHavePortMap()
 	}
+	// Our IPv6 address is only reachable through a stateful firewall
+	// once it has a pinhole for us.
+	if pinholeExt, ok := c.portMapper.GetCachedPinholeOrStartCreatingOne(); ok {
+		addAddr(pinholeExt, tailcfg.EndpointPortmapped)
+		c.setNetInfoHavePortMap()
+	}
 
 	if nr.GlobalV4 != "" {
 		addAddr(ipp(nr.GlobalV4), tailcfg.EndpointSTUN)
@@ -2062,6 +2105,13 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 // The dstKey should only be non-zero if the dstDisco key
 // unambiguously maps to exactly one peer.
 func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDisco key.DiscoPublic, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+	return c.sendDiscoMessageVia("", dst, dstKey, dstDisco, m, logLevel)
+}
+
+// sendDiscoMessageVia is like sendDiscoMessage, but if iface is non-empty,
+// it sends m to the UDP address dst through the local network interface
+// iface. See ifaces.go.
+func (c *Conn) sendDiscoMessageVia(iface string, dst netip.AddrPort, dstKey key.NodePublic, dstDisco key.DiscoPublic, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	isDERP := dst.Addr() == derpMagicIPAddr
 	if _, isPong := m.(*disco.Pong); isPong && !isDERP && dst.Addr().Is4() {
 		time.Sleep(debugIPv4DiscoPingPenalty())
@@ -2090,7 +2140,11 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 
 	box := di.sharedKey.Seal(m.AppendMarshal(nil))
 	pkt = append(pkt, box...)
-	sent, err = c.sendAddr(dst, dstKey, pkt)
+	if iface != "" {
+		sent, err = c.sendUDPVia(iface, dst, pkt)
+	} else {
+		sent, err = c.sendAddr(dst, dstKey, pkt)
+	}
 	if sent {
 		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco()) {
 			node := "?"
@@ -3069,7 +3123,7 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 		return nil, 0, errors.New("magicsock: connBind already open")
 	}
 	c.closed = false
-	fns := []conn.ReceiveFunc{c.receiveIPv4(), c.receiveIPv6(), c.receiveDERP}
+	fns := []conn.ReceiveFunc{c.receiveIPv4(), c.receiveIPv6(), c.receiveDERP, c.receiveIfaces}
 	if runtime.GOOS == "js" {
 		fns = []conn.ReceiveFunc{c.receiveDERP}
 	}
@@ -3109,6 +3163,12 @@ func (c *connBind) Close() error {
 	// which will then check connBind.Closed.
 	// connBind.Closed takes c.mu, but c.derpRecvCh is buffered.
 	c.derpRecvCh <- derpReadResult{}
+	// Likewise for receiveIfaces. If ifaceRecvCh is full, the packet
+	// in it unblocks it instead.
+	select {
+	case c.ifaceRecvCh <- ifaceReadResult{}:
+	default:
+	}
 	return nil
 }
 
@@ -3146,6 +3206,7 @@ func (c *Conn) Close() error {
 	// They will frequently have been closed already by a call to connBind.Close.
 	c.pconn6.Close()
 	c.pconn4.Close()
+	c.closeIfaceConns()
 
 	// Wait on goroutines updating right at the end, once everything is
 	// already closed. We want everything else in the Conn to be
@@ -3334,6 +3395,7 @@ func (c *Conn) bindSocket(ruc *RebindingUDPConn, network string, curPortFate cur
 			continue
 		}
 		trySetSocketBuffer(pconn, c.logf)
+		c.setDontFragment(pconn, network)
 		// Success.
 		if debugBindSocket() {
 			c.logf("magicsock: bindSocket: successfully listened %v port %d", network, port)
@@ -3373,6 +3435,7 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 		return fmt.Errorf("magicsock: Rebind IPv4 failed: %w", err)
 	}
 	c.portMapper.SetLocalPort(c.LocalPort())
+	c.portMapper.SetLocalPort6(uint16(c.pconn6.LocalAddr().Port))
 	return nil
 }
 
@@ -3394,6 +3457,7 @@ func (c *Conn) Rebind() {
 	}
 
 	c.maybeCloseDERPsOnRebind(ifIPs)
+	c.updateIfaceConns()
 	c.resetEndpointStates()
 }
 
@@ -4135,6 +4199,8 @@ type endpoint struct {
 	bestAddr           addrLatency // best non-DERP path; zero if none
 	bestAddrAt         mono.Time   // time best address re-confirmed
 	trustBestAddrUntil mono.Time   // time when bestAddr expires
+	pathMTU            int         // path MTU of bestAddr last reported to Conn.peerPathMTUFunc
+	bestIface          string      // local network interface to send to bestAddr through; empty for the main socket
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netip.AddrPort]*endpointState
 	isCallMeMaybeEP    map[netip.AddrPort]bool
@@ -4239,6 +4305,18 @@ type endpointState struct {
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	// pathMTU is the largest packet size that path MTU probes found can
+	// be sent through the tunnel to this endpoint, or zero if unknown.
+	// pathMTUAt is when the probes that found it were sent, and
+	// pathMTUProbedAt is when the latest probes were.
+	pathMTU         int
+	pathMTUAt       mono.Time
+	pathMTUProbedAt mono.Time
+
+	// ifacePaths are the paths to this endpoint through each of the
+	// local network interfaces, keyed by interface name.
+	ifacePaths map[string]*ifacePath
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
@@ -4284,6 +4362,8 @@ func (de *endpoint) deleteEndpointLocked(why string, ep netip.AddrPort) {
 		})
 		de.bestAddr = addrLatency{}
 	}
+	de.updatePathMTULocked()
+	de.updateBestIfaceLocked()
 }
 
 // pongHistoryCount is how many pongReply values we keep per endpointState
@@ -4301,6 +4381,8 @@ type sentPing struct {
 	at      mono.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	size    int    // on-the-wire size of a pingPathMTU probe, IP header included
+	iface   string // local network interface the ping was sent through, if not the main socket
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -4463,7 +4545,7 @@ func (de *endpoint) heartbeat() {
 	udpAddr, _, _ := de.addrForSendLocked(now)
 	if udpAddr.IsValid() {
 		// We have a preferred path. Ping that every 2 seconds.
-		de.startDiscoPingLocked(udpAddr, now, pingHeartbeat)
+		de.startDiscoPingViaLocked(udpAddr, de.bestIface, now, pingHeartbeat, 0)
 	}
 
 	if de.wantFullPingLocked(now) {
@@ -4520,17 +4602,17 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 	now := mono.Now()
 	udpAddr, derpAddr, _ := de.addrForSendLocked(now)
 	if derpAddr.IsValid() {
-		de.startDiscoPingLocked(derpAddr, now, pingCLI)
+		de.startDiscoPingLocked(derpAddr, now, pingCLI, 0)
 	}
 	if udpAddr.IsValid() && now.Before(de.trustBestAddrUntil) {
 		// Already have an active session, so just ping the address we're using.
 		// Otherwise "tailscale ping" results to a node on the local network
 		// can look like they're bouncing between, say 10.0.0.0/9 and the peer's
 		// IPv6 address, both 1ms away, and it's random who replies first.
-		de.startDiscoPingLocked(udpAddr, now, pingCLI)
+		de.startDiscoPingLocked(udpAddr, now, pingCLI, 0)
 	} else {
 		for ep := range de.endpointState {
-			de.startDiscoPingLocked(ep, now, pingCLI)
+			de.startDiscoPingLocked(ep, now, pingCLI, 0)
 		}
 	}
 	de.noteActiveLocked()
@@ -4561,6 +4643,10 @@ func (de *endpoint) send(buffs [][]byte) error {
 
 	now := mono.Now()
 	udpAddr, derpAddr, startWGPing := de.addrForSendLocked(now)
+	var iface string
+	if udpAddr == de.bestAddr.AddrPort {
+		iface = de.bestIface
+	}
 
 	if de.isWireguardOnly {
 		if startWGPing {
@@ -4577,7 +4663,7 @@ func (de *endpoint) send(buffs [][]byte) error {
 	}
 	var err error
 	if udpAddr.IsValid() {
-		_, err = de.c.sendUDPBatch(udpAddr, buffs)
+		_, err = de.c.sendUDPBatchVia(iface, udpAddr, buffs)
 		// TODO(raggi): needs updating for accuracy, as in error conditions we may have partial sends.
 		if stats := de.c.stats.Load(); err == nil && stats != nil {
 			var txBytes int
@@ -4616,6 +4702,9 @@ func (de *endpoint) discoPingTimeout(txid stun.TxID) {
 		de.c.dlogf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort())
 	}
 	de.removeSentDiscoPingLocked(txid, sp)
+	if sp.iface != "" {
+		de.noteIfacePingLostLocked(sp)
+	}
 }
 
 // forgetDiscoPing is called by a timer when a ping either fails to send or
@@ -4642,10 +4731,15 @@ func (de *endpoint) removeSentDiscoPingLocked(txid stun.TxID, sp sentPing) {
 //
 // The caller should use de.discoKey as the discoKey argument.
 // It is passed in so that sendDiscoPing doesn't need to lock de.mu.
-func (de *endpoint) sendDiscoPing(ep netip.AddrPort, discoKey key.DiscoPublic, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.c.sendDiscoMessage(ep, de.publicKey, discoKey, &disco.Ping{
+//
+// If size is non-zero, the ping is padded so that its packet is size
+// bytes long on the wire. If iface is non-empty, it's sent through that
+// local network interface.
+func (de *endpoint) sendDiscoPing(ep netip.AddrPort, iface string, discoKey key.DiscoPublic, txid stun.TxID, size int, logLevel discoLogLevel) {
+	sent, _ := de.c.sendDiscoMessageVia(iface, ep, de.publicKey, discoKey, &disco.Ping{
 		TxID:    [12]byte(txid),
 		NodeKey: de.c.publicKeyAtomic.Load(),
+		Padding: pathMTUProbePadding(ep, size),
 	}, logLevel)
 	if !sent {
 		de.forgetDiscoPing(txid)
@@ -4668,9 +4762,21 @@ func (de *endpoint) sendDiscoPing(ep netip.AddrPort, discoKey key.DiscoPublic, t
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingPathMTU means that the purpose of a ping was to probe
+	// whether packets of its size fit the path MTU.
+	pingPathMTU
 )
 
-func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpose discoPingPurpose) {
+// startDiscoPingLocked sends a ping for purpose to ep. A non-zero size
+// is the on-the-wire size of the ping packet, used by pingPathMTU.
+func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpose discoPingPurpose, size int) {
+	de.startDiscoPingViaLocked(ep, "", now, purpose, size)
+}
+
+// startDiscoPingViaLocked is like startDiscoPingLocked, but if iface is
+// non-empty, it sends the ping through that local network interface.
+func (de *endpoint) startDiscoPingViaLocked(ep netip.AddrPort, iface string, now mono.Time, purpose discoPingPurpose, size int) {
 	if runtime.GOOS == "js" {
 		return
 	}
@@ -4695,12 +4801,14 @@ func (de *endpoint) startDiscoPingLocked(ep netip.AddrPort, now mono.Time, purpo
 		at:      now,
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.discoPingTimeout(txid) }),
 		purpose: purpose,
+		size:    size,
+		iface:   iface,
 	}
 	logLevel := discoLog
-	if purpose == pingHeartbeat {
+	if purpose == pingHeartbeat || purpose == pingPathMTU {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, epDisco.key, txid, logLevel)
+	go de.sendDiscoPing(ep, iface, epDisco.key, txid, size, logLevel)
 }
 
 func (de *endpoint) sendDiscoPingsLocked(now mono.Time, sendCallMeMaybe bool) {
@@ -4725,7 +4833,8 @@ func (de *endpoint) sendDiscoPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 			de.c.dlogf("[v1] magicsock: disco: send, starting discovery for %v (%v)", de.publicKey.ShortString(), de.discoShort())
 		}
 
-		de.startDiscoPingLocked(ep, now, pingDiscovery)
+		de.startDiscoPingLocked(ep, now, pingDiscovery, 0)
+		de.startIfacePingsLocked(ep, now)
 	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && derpAddr.IsValid() {
@@ -4995,6 +5104,26 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	now := mono.Now()
 	latency := now.Sub(sp.at)
 
+	if sp.iface != "" {
+		if st, ok := de.endpointState[sp.to]; ok && !isDerp {
+			st.addIfacePongLocked(sp.iface, latency, now)
+			if sp.to == de.bestAddr.AddrPort && sp.iface == de.bestIface {
+				de.bestAddrAt = now
+				de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			}
+			de.updateBestIfaceLocked()
+		}
+		return
+	}
+
+	if sp.purpose == pingPathMTU {
+		if st, ok := de.endpointState[sp.to]; ok && !isDerp {
+			st.addPathMTUProbeLocked(sp)
+			de.updatePathMTULocked()
+		}
+		return
+	}
+
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
 		if !ok {
@@ -5050,7 +5179,10 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 			de.bestAddr.latency = latency
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			de.maybeProbePathMTULocked(now)
 		}
+		de.updatePathMTULocked()
+		de.updateBestIfaceLocked()
 	}
 	return
 }
@@ -5225,6 +5357,13 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 
 	if udpAddr, derpAddr, _ := de.addrForSendLocked(now); udpAddr.IsValid() && !derpAddr.IsValid() {
 		ps.CurAddr = udpAddr.String()
+		if st, ok := de.endpointState[udpAddr]; ok {
+			ps.PathMTU = st.pathMTU
+			ps.InterfacePaths = st.ifacePathStatusLocked(udpAddr, de.bestIface)
+		}
+		if udpAddr == de.bestAddr.AddrPort {
+			ps.CurInterface = de.bestIface
+		}
 	}
 }
 
@@ -5268,6 +5407,8 @@ func (de *endpoint) resetLocked() {
 	for txid, sp := range de.sentPing {
 		de.removeSentDiscoPingLocked(txid, sp)
 	}
+	de.updatePathMTULocked()
+	de.updateBestIfaceLocked()
 }
 
 func (de *endpoint) numStopAndReset() int64 {
@@ -21,6 +21,10 @@ func trySetSocketBuffer(pconn nettype.PacketConn, logf logger.Logf) {
 	portableTrySetSocketBuffer(pconn, logf)
 }
 
+func trySetDontFragment(pconn nettype.PacketConn, network string) error {
+	return errors.New("setting don't-fragment not supported on this OS")
+}
+
 func tryEnableUDPOffload(pconn nettype.PacketConn) (hasTX bool, hasRX bool) {
 	return false, false
 }
@@ -318,6 +318,32 @@ func trySetSocketBuffer(pconn nettype.PacketConn, logf logger.Logf) {
 	}
 }
 
+// trySetDontFragment sets the don't-fragment bit on the packets sent by
+// pconn, the socket for network ("udp4" or "udp6"), so that packets too big
+// for the path are dropped instead of fragmented.
+func trySetDontFragment(pconn nettype.PacketConn, network string) error {
+	c, ok := pconn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("unexpected socket type %T", pconn)
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	err = rc.Control(func(fd uintptr) {
+		if network == "udp4" {
+			setErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		} else {
+			setErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
+
 const (
 	// TODO(jwhited): upstream to unix?
 	socketOptionLevelUDP   = 17
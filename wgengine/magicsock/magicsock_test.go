@@ -2859,3 +2859,191 @@ type endpointDetails struct {
 		}
 	}
 }
+
+func TestPathMTUProbe(t *testing.T) {
+	shared := key.NewDisco().Shared(key.NewDisco().Public())
+	for _, ep := range []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:41641"),
+		netip.MustParseAddrPort("[2001:db8::1]:41641"),
+	} {
+		sizes := pathMTUProbeSizesFor(ep, 1280)
+		if got := tunMTUForWireSize(ep, sizes[len(sizes)-1]); got != 1280 {
+			t.Errorf("%v: largest probe carries %d bytes; want the TUN MTU", ep, got)
+		}
+		if got := tunMTUForWireSize(ep, sizes[0]); got >= 1280-500 {
+			t.Errorf("%v: smallest probe carries %d bytes; want probes well under the TUN MTU", ep, got)
+		}
+		for i, size := range sizes {
+			if i > 0 && size <= sizes[i-1] {
+				t.Errorf("%v: probe sizes %v not increasing", ep, sizes)
+			}
+			ping := &disco.Ping{
+				NodeKey: key.NewNode().Public(),
+				Padding: pathMTUProbePadding(ep, size),
+			}
+			// Mirror the packet built by Conn.sendDiscoMessage.
+			pkt := append([]byte(disco.Magic), key.NewDisco().Public().AppendTo(nil)...)
+			pkt = append(pkt, shared.Seal(ping.AppendMarshal(nil))...)
+			if got := ipHeaderLen(ep) + udpHeaderLen + len(pkt); got != size {
+				t.Errorf("%v: probe of size %d is %d bytes on the wire", ep, size, got)
+			}
+		}
+	}
+
+	ep := netip.MustParseAddrPort("1.2.3.4:41641")
+	if sizes := pathMTUProbeSizesFor(ep, 65536); sizes[len(sizes)-1] != maxPathMTUProbeSize {
+		t.Errorf("probe sizes for the largest TUN MTU = %v; want at most %d", sizes, maxPathMTUProbeSize)
+	}
+
+	st := &endpointState{}
+	round1, round2 := mono.Time(1), mono.Time(2)
+	st.addPathMTUProbeLocked(sentPing{to: ep, at: round1, size: 1400})
+	st.addPathMTUProbeLocked(sentPing{to: ep, at: round1, size: 1500})
+	st.addPathMTUProbeLocked(sentPing{to: ep, at: round1, size: 1360})
+	if want := 1500 - 20 - 8 - 32; st.pathMTU != want {
+		t.Errorf("pathMTU = %d; want %d", st.pathMTU, want)
+	}
+	// A newer round replaces the result, so it can go down.
+	st.addPathMTUProbeLocked(sentPing{to: ep, at: round2, size: 1400})
+	if want := 1400 - 20 - 8 - 32; st.pathMTU != want {
+		t.Errorf("pathMTU after new round = %d; want %d", st.pathMTU, want)
+	}
+	// Late pongs from an older round are ignored.
+	st.addPathMTUProbeLocked(sentPing{to: ep, at: round1, size: 1492})
+	if want := 1400 - 20 - 8 - 32; st.pathMTU != want {
+		t.Errorf("pathMTU after stale pong = %d; want %d", st.pathMTU, want)
+	}
+}
+
+func TestUpdateBestIface(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.ifaceConns.Store([]*ifaceConn{{name: "eth0"}, {name: "wlan0"}})
+
+	addr := netip.MustParseAddrPort("1.2.3.4:41641")
+	st := &endpointState{}
+	de := &endpoint{
+		c:             c,
+		bestAddr:      addrLatency{addr, 20 * time.Millisecond},
+		endpointState: map[netip.AddrPort]*endpointState{addr: st},
+	}
+	check := func(want string) {
+		t.Helper()
+		de.updateBestIfaceLocked()
+		if de.bestIface != want {
+			t.Errorf("bestIface = %q; want %q", de.bestIface, want)
+		}
+	}
+
+	check("")
+	st.addIfacePongLocked("wlan0", 15*time.Millisecond, mono.Now())
+	check("wlan0")
+	// eth0 is faster, but not by enough to switch.
+	st.addIfacePongLocked("eth0", 14*time.Millisecond, mono.Now())
+	check("wlan0")
+	st.addIfacePongLocked("eth0", 5*time.Millisecond, mono.Now())
+	check("eth0")
+
+	// Fail over when the path in use stops answering.
+	for i := 0; i < ifacePathMaxLost; i++ {
+		de.noteIfacePingLostLocked(sentPing{to: addr, iface: "eth0"})
+	}
+	if de.bestIface != "wlan0" {
+		t.Errorf("after eth0 went down, bestIface = %q; want wlan0", de.bestIface)
+	}
+
+	// Interfaces without a socket anymore aren't used.
+	c.ifaceConns.Store([]*ifaceConn{{name: "eth0"}})
+	check("")
+
+	ps := st.ifacePathStatusLocked(addr, de.bestIface)
+	if len(ps) != 2 {
+		t.Fatalf("got %d interface paths; want 2", len(ps))
+	}
+	if ps[0].Interface != "eth0" || !ps[0].Down || ps[1].Interface != "wlan0" || ps[1].Down || ps[1].LatencySeconds != 0.015 {
+		t.Errorf("ifacePathStatusLocked = %+v, %+v", ps[0], ps[1])
+	}
+}
+
+func TestPickDERPHome(t *testing.T) {
+	ms := time.Millisecond
+	ids := []int{1, 2, 3}
+	latency := map[int]time.Duration{1: 20 * ms, 2: 35 * ms, 3: 120 * ms}
+	tests := []struct {
+		name      string
+		policy    DERPHomePolicy
+		latency   map[int]time.Duration
+		peers     map[int]derpRegionPeers
+		cur       int
+		preferred int
+		want      int
+	}{
+		{name: "lowest", latency: latency, preferred: 1, want: 1},
+		{name: "netcheck_sticky", latency: latency, cur: 2, preferred: 2, want: 2},
+		{name: "pinned", policy: DERPHomePolicy{Pin: 3}, latency: latency, preferred: 1, want: 3},
+		{name: "pinned_missing", policy: DERPHomePolicy{Pin: 9}, latency: latency, preferred: 1, want: 1},
+		{name: "avoided", policy: DERPHomePolicy{Avoid: []int{1}}, latency: latency, preferred: 1, want: 2},
+		{name: "all_avoided", policy: DERPHomePolicy{Avoid: []int{1, 2, 3}}, latency: latency, preferred: 1, want: 1},
+		{
+			name:      "peers_nearby",
+			policy:    DERPHomePolicy{PeerAware: true},
+			latency:   latency,
+			peers:     map[int]derpRegionPeers{2: {all: 3, active: 1}},
+			preferred: 1,
+			want:      2,
+		},
+		{
+			name:      "peers_too_far",
+			policy:    DERPHomePolicy{PeerAware: true},
+			latency:   latency,
+			peers:     map[int]derpRegionPeers{3: {all: 10, active: 10}},
+			preferred: 1,
+			want:      1,
+		},
+		{
+			name:      "active_outweighs_idle",
+			policy:    DERPHomePolicy{PeerAware: true},
+			latency:   latency,
+			peers:     map[int]derpRegionPeers{1: {all: 5}, 2: {all: 1, active: 1}},
+			preferred: 1,
+			want:      2,
+		},
+		{
+			name:      "tie_keeps_current",
+			policy:    DERPHomePolicy{PeerAware: true},
+			latency:   latency,
+			peers:     map[int]derpRegionPeers{1: {all: 2}, 2: {all: 2}},
+			cur:       2,
+			preferred: 1,
+			want:      2,
+		},
+		{
+			name:      "tie_prefers_netcheck",
+			policy:    DERPHomePolicy{PeerAware: true},
+			latency:   latency,
+			peers:     map[int]derpRegionPeers{1: {all: 2}, 2: {all: 2}},
+			preferred: 1,
+			want:      1,
+		},
+		{
+			name:   "no_latency_peers",
+			policy: DERPHomePolicy{PeerAware: true},
+			peers:  map[int]derpRegionPeers{3: {all: 1, active: 1}},
+			cur:    1,
+			want:   3,
+		},
+		{name: "no_latency_current", cur: 2, want: 2},
+		{name: "no_latency", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := pickDERPHome(tt.policy, ids, tt.latency, tt.peers, tt.cur, tt.preferred)
+			if got != tt.want {
+				t.Errorf("pickDERPHome = %d (%s); want %d", got, reason, tt.want)
+			}
+			if reason == "" {
+				t.Error("empty reason")
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package magicsock
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/tstun"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/types/nettype"
+)
+
+// Path MTU discovery sends disco pings to the best UDP address of a peer,
+// with the don't-fragment bit set, padded to the size of packets of the TUN
+// MTU and to the sizes of common link MTUs below that, and takes the
+// largest one that got a pong as the path MTU. It's then reported through
+// Options.PeerPathMTUFunc, so that the TUN can keep larger packets to the
+// peer from black-holing.
+//
+// It's off unless TS_DEBUG_ENABLE_PMTUD is set: the don't-fragment bit is
+// set on the sockets, so on all packets sent over them, and WireGuard
+// packets too big for the path are then dropped rather than fragmented.
+
+// pathMTUProbeSizes are the on-the-wire sizes, IP header included, of the
+// path MTU probes smaller than a packet of the TUN MTU: the MTUs of common
+// links, down to 576, the smallest that IPv4 hosts must accept.
+var pathMTUProbeSizes = [...]int{576, 1000, 1100, 1200, 1280, 1360, 1400, 1440, 1460, 1480, 1492, 1500}
+
+// maxPathMTUProbeSize is the largest path MTU probe, the largest IPv4
+// packet.
+const maxPathMTUProbeSize = 65535
+
+const (
+	// pathMTUProbeInterval is how often the path MTU to the best address
+	// of an active peer is probed again.
+	pathMTUProbeInterval = 10 * time.Minute
+
+	// udpHeaderLen is the length of a UDP header.
+	udpHeaderLen = 8
+
+	// wireguardOverhead is the number of bytes WireGuard adds to the
+	// packets it tunnels: a 16 byte data message header and a 16 byte
+	// Poly1305 authentication tag.
+	wireguardOverhead = 32
+
+	// discoPingLen is the UDP payload length of an unpadded disco ping
+	// with a NodeKey: the magic, the sender's disco key, and a NaCl box
+	// (a nonce, a 16 byte authenticator, and the message type, version,
+	// TxID and NodeKey).
+	discoPingLen = len(disco.Magic) + key.DiscoPublicRawLen + disco.NonceLen + 16 + 2 + 12 + key.NodePublicRawLen
+)
+
+// ipHeaderLen returns the length of the IP header of packets to ep.
+func ipHeaderLen(ep netip.AddrPort) int {
+	if ep.Addr().Is4() {
+		return 20
+	}
+	return 40
+}
+
+// pathMTUProbePadding returns the padding that makes a disco ping to ep
+// size bytes long on the wire. It returns 0 if size is 0.
+func pathMTUProbePadding(ep netip.AddrPort, size int) int {
+	if size == 0 {
+		return 0
+	}
+	if n := size - ipHeaderLen(ep) - udpHeaderLen - discoPingLen; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// pathMTUProbeSizesFor returns the on-the-wire sizes of the path MTU
+// probes to ep, in increasing order: those of pathMTUProbeSizes that carry
+// less than tunMTU bytes through the tunnel, and the size of packets that
+// carry tunMTU bytes.
+func pathMTUProbeSizesFor(ep netip.AddrPort, tunMTU int) []int {
+	top := tunMTU + ipHeaderLen(ep) + udpHeaderLen + wireguardOverhead
+	if top > maxPathMTUProbeSize {
+		top = maxPathMTUProbeSize
+	}
+	var sizes []int
+	for _, size := range pathMTUProbeSizes {
+		if size < top {
+			sizes = append(sizes, size)
+		}
+	}
+	return append(sizes, top)
+}
+
+// tunMTUForWireSize returns the largest packet size that can be sent
+// through the tunnel to ep in packets that are size bytes long on the
+// wire.
+func tunMTUForWireSize(ep netip.AddrPort, size int) int {
+	return size - ipHeaderLen(ep) - udpHeaderLen - wireguardOverhead
+}
+
+// setDontFragment sets the don't-fragment bit on the packets of pconn, the
+// socket for network ("udp4" or "udp6"), if path MTU discovery is enabled,
+// and records whether path MTU probes can be sent over it.
+func (c *Conn) setDontFragment(pconn nettype.PacketConn, network string) {
+	df := false
+	if debugEnablePMTUD() {
+		if err := trySetDontFragment(pconn, network); err != nil {
+			c.logf("[v1] magicsock: path MTU discovery disabled on %v: %v", network, err)
+		} else {
+			df = true
+		}
+	}
+	if network == "udp4" {
+		c.dfV4.Store(df)
+	} else {
+		c.dfV6.Store(df)
+	}
+}
+
+// canProbePathMTU reports whether path MTU probes can be sent to ep.
+func (c *Conn) canProbePathMTU(ep netip.AddrPort) bool {
+	if ep.Addr().Is4() {
+		return c.dfV4.Load()
+	}
+	return c.dfV6.Load()
+}
+
+// maybeProbePathMTULocked starts probing the path MTU to de.bestAddr if it
+// hasn't been recently.
+// de.mu must be held.
+func (de *endpoint) maybeProbePathMTULocked(now mono.Time) {
+	ep := de.bestAddr.AddrPort
+	if !ep.IsValid() || !de.c.canProbePathMTU(ep) {
+		return
+	}
+	st, ok := de.endpointState[ep]
+	if !ok {
+		return
+	}
+	if !st.pathMTUProbedAt.IsZero() && now.Sub(st.pathMTUProbedAt) < pathMTUProbeInterval {
+		return
+	}
+	st.pathMTUProbedAt = now
+	for _, size := range pathMTUProbeSizesFor(ep, int(tstun.DefaultMTU())) {
+		de.startDiscoPingLocked(ep, now, pingPathMTU, size)
+	}
+}
+
+// addPathMTUProbeLocked records that the path MTU probe sp got a pong.
+// The probes of a newer round replace the results of older ones, so that
+// the path MTU can also go down.
+// endpoint.mu must be held.
+func (st *endpointState) addPathMTUProbeLocked(sp sentPing) {
+	mtu := tunMTUForWireSize(sp.to, sp.size)
+	switch {
+	case sp.at.After(st.pathMTUAt):
+		st.pathMTU = mtu
+		st.pathMTUAt = sp.at
+	case sp.at == st.pathMTUAt && mtu > st.pathMTU:
+		st.pathMTU = mtu
+	}
+}
+
+// updatePathMTULocked reports the path MTU of de.bestAddr to
+// Conn.peerPathMTUFunc, if it changed.
+// de.mu must be held.
+func (de *endpoint) updatePathMTULocked() {
+	var mtu int
+	if de.bestAddr.IsValid() {
+		if st, ok := de.endpointState[de.bestAddr.AddrPort]; ok {
+			mtu = st.pathMTU
+		}
+	}
+	if mtu == de.pathMTU {
+		return
+	}
+	de.c.dlogf("[v1] magicsock: disco: node %v %v path MTU via %v now %d", de.publicKey.ShortString(), de.discoShort(), de.bestAddr.AddrPort, mtu)
+	de.pathMTU = mtu
+	if f := de.c.peerPathMTUFunc; f != nil {
+		f(de.publicKey, mtu)
+	}
+}
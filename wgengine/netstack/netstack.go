@@ -579,6 +579,10 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 			return true
 		}
 	}
+	// Handle UDP to ports of the Tailscale IP(s) forwarded by serve.
+	if ns.lb != nil && p.IPProto == ipproto.UDP && isLocal && ns.lb.ShouldInterceptUDPPort(p.Dst.Port()) {
+		return true
+	}
 	if p.IPVersion == 6 && !isLocal && viaRange.Contains(dstIP) {
 		return ns.lb != nil && ns.lb.ShouldHandleViaIP(dstIP)
 	}
@@ -1058,6 +1062,12 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 		return
 	}
 
+	if ns.lb != nil && ns.isLocalIP(dstAddr.Addr()) && ns.lb.ShouldInterceptUDPPort(dstAddr.Port()) {
+		c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+		go ns.lb.HandleInterceptedUDPFlow(dstAddr.Port(), srcAddr, c)
+		return
+	}
+
 	if get := ns.GetUDPHandlerForFlow; get != nil {
 		h, intercept := get(srcAddr, dstAddr)
 		if intercept {
@@ -28,6 +28,7 @@
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/linuxfw"
 	"tailscale.com/util/multierr"
 	"tailscale.com/version/distro"
 )
@@ -127,11 +128,6 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, netMon *netmon.Moni
 		return nil, err
 	}
 
-	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
-	}
-
 	v6err := checkIPv6(logf)
 	if v6err != nil {
 		logf("disabling tunneled IPv6 due to system IPv6 config: %v", v6err)
@@ -142,14 +138,32 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, netMon *netmon.Moni
 		logf("v6nat = %v", supportsV6NAT)
 	}
 
-	var ipt6 netfilterRunner
-	if supportsV6 {
-		// The iptables package probes for `ip6tables` and errors out
-		// if unavailable. We want that to be a non-fatal error.
-		ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	var ipt4, ipt6 netfilterRunner
+	if useNftables(logf) {
+		logf("router: using nftables")
+		ipt4, err = newNftablesRunner(false)
 		if err != nil {
 			return nil, err
 		}
+		if supportsV6 {
+			ipt6, err = newNftablesRunner(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		ipt4, err = iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, err
+		}
+		if supportsV6 {
+			// The iptables package probes for `ip6tables` and errors out
+			// if unavailable. We want that to be a non-fatal error.
+			ipt6, err = iptables.NewWithProtocol(iptables.ProtocolIPv6)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	cmd := osCommandRunner{
@@ -159,6 +173,45 @@ func newUserspaceRouter(logf logger.Logf, tunDev tun.Device, netMon *netmon.Moni
 	return newUserspaceRouterAdvanced(logf, tunname, netMon, ipt4, ipt6, cmd, supportsV6, supportsV6NAT)
 }
 
+// firewallMode, if set to "iptables" or "nftables", forces the router to
+// program netfilter that way instead of detecting which to use.
+var firewallMode = envknob.RegisterString("TS_DEBUG_FIREWALL_MODE")
+
+// useNftables reports whether the router should program netfilter with
+// nftables directly, rather than with the iptables commands.
+//
+// iptables is used if it's already in use or if there's no sign of
+// either, for compatibility with existing setups; nftables is used if
+// the iptables commands are missing or if only nftables has rules.
+func useNftables(logf logger.Logf) bool {
+	switch mode := firewallMode(); mode {
+	case "iptables":
+		return false
+	case "nftables":
+		return true
+	case "", "auto":
+	default:
+		logf("router: unknown TS_DEBUG_FIREWALL_MODE %q; detecting", mode)
+	}
+
+	if _, err := exec.LookPath("iptables"); err != nil {
+		logf("router: iptables not found; using nftables")
+		return true
+	}
+	nipt, err := linuxfw.DetectIptables()
+	if err != nil {
+		logf("router: detecting iptables: %v", err)
+	}
+	if nipt > 0 {
+		return false
+	}
+	nnft, err := linuxfw.DetectNetfilter()
+	if err != nil {
+		logf("router: detecting nftables: %v", err)
+	}
+	return nnft > 0
+}
+
 func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, netMon *netmon.Monitor, netfilter4, netfilter6 netfilterRunner, cmd commandRunner, supportsV6, supportsV6NAT bool) (Router, error) {
 	r := &linuxRouter{
 		logf:          logf,
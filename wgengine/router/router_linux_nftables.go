@@ -0,0 +1,593 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// NOTE: linux_{386,loong64,arm,armbe} are currently unsupported due to missing
+// support in upstream dependencies.
+
+//go:build linux && !(386 || loong64 || arm || armbe)
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/josharian/native"
+	"golang.org/x/sys/unix"
+)
+
+// nftConn is the subset of *nftables.Conn used by nftablesRunner. It
+// exists purely to swap in a fake implementation in tests.
+type nftConn interface {
+	ListChains() ([]*nftables.Chain, error)
+	GetRules(*nftables.Table, *nftables.Chain) ([]*nftables.Rule, error)
+	AddTable(*nftables.Table) *nftables.Table
+	DelTable(*nftables.Table)
+	AddChain(*nftables.Chain) *nftables.Chain
+	FlushChain(*nftables.Chain)
+	DelChain(*nftables.Chain)
+	AddRule(*nftables.Rule) *nftables.Rule
+	InsertRule(*nftables.Rule) *nftables.Rule
+	DelRule(*nftables.Rule) error
+	Flush() error
+}
+
+// nftTableNames maps the iptables tables the router uses to the
+// nftables tables nftablesRunner creates and owns in their stead.
+var nftTableNames = map[string]string{
+	"filter": "ts-filter",
+	"nat":    "ts-nat",
+}
+
+// nftBaseChain describes the nftables base chain standing in for a
+// built-in iptables chain.
+type nftBaseChain struct {
+	typ  nftables.ChainType
+	hook *nftables.ChainHook
+	prio *nftables.ChainPriority
+}
+
+// nftBaseChains are the base chains nftablesRunner creates on demand, by
+// iptables "table/chain".
+var nftBaseChains = map[string]nftBaseChain{
+	"filter/INPUT":    {nftables.ChainTypeFilter, nftables.ChainHookInput, nftables.ChainPriorityFilter},
+	"filter/FORWARD":  {nftables.ChainTypeFilter, nftables.ChainHookForward, nftables.ChainPriorityFilter},
+	"nat/POSTROUTING": {nftables.ChainTypeNAT, nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource},
+}
+
+// nftablesRunner is a netfilterRunner that programs nftables directly
+// over netlink, for systems without a working iptables. It accepts the
+// same table, chain and rule arguments as the iptables commands, for the
+// subset of rules the router uses, and translates them.
+//
+// Rather than adding to other tables, it keeps its chains in tables of
+// its own (see nftTableNames), with base chains hooked at the same points
+// as the built-in iptables chains the router jumps from. Each rule
+// carries its iptables arguments as its comment, which is how the runner
+// finds its rules again and how `nft list ruleset` shows them.
+//
+// Unlike with iptables, an accept verdict in one nftables table doesn't
+// stop other tables from dropping the packet, so forwarding still needs
+// the host's own firewall to allow it.
+type nftablesRunner struct {
+	conn   nftConn
+	family nftables.TableFamily // nftables.TableFamilyIPv4 or nftables.TableFamilyIPv6
+}
+
+// newNftablesRunner returns a netfilterRunner programming the IPv4 or,
+// if v6, IPv6 rules of nftables.
+func newNftablesRunner(v6 bool) (netfilterRunner, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	family := nftables.TableFamilyIPv4
+	if v6 {
+		family = nftables.TableFamilyIPv6
+	}
+	return &nftablesRunner{conn: conn, family: family}, nil
+}
+
+// nftExitError is returned by nftablesRunner where the iptables command
+// would have failed with a specific exit code, so that callers can check
+// it with errCode either way.
+type nftExitError struct {
+	code int
+	msg  string
+}
+
+func (e *nftExitError) Error() string { return e.msg }
+func (e *nftExitError) ExitCode() int { return e.code }
+
+func errNoChain(table, chain string) error {
+	return &nftExitError{1, fmt.Sprintf("nftables: chain %s/%s does not exist", table, chain)}
+}
+
+func (n *nftablesRunner) table(table string) (*nftables.Table, error) {
+	name, ok := nftTableNames[table]
+	if !ok {
+		return nil, fmt.Errorf("nftables: unsupported table %q", table)
+	}
+	return &nftables.Table{Name: name, Family: n.family}, nil
+}
+
+// findChain returns the chain named chain in the nftables table for the
+// iptables table, or nil if it doesn't exist.
+func (n *nftablesRunner) findChain(table, chain string) (*nftables.Chain, error) {
+	t, err := n.table(table)
+	if err != nil {
+		return nil, err
+	}
+	chains, err := n.conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("nftables: listing chains: %w", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name == t.Name && c.Table.Family == t.Family && c.Name == chain {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// chain is like findChain, but creates the base chains that stand in
+// for built-in iptables chains, as iptables always has those. It returns
+// an error if any other chain doesn't exist.
+func (n *nftablesRunner) chain(table, chain string) (*nftables.Chain, error) {
+	c, err := n.findChain(table, chain)
+	if err != nil || c != nil {
+		return c, err
+	}
+	base, ok := nftBaseChains[table+"/"+chain]
+	if !ok {
+		return nil, errNoChain(table, chain)
+	}
+	t, err := n.table(table)
+	if err != nil {
+		return nil, err
+	}
+	n.conn.AddTable(t)
+	c = n.conn.AddChain(&nftables.Chain{
+		Name:     chain,
+		Table:    t,
+		Type:     base.typ,
+		Hooknum:  base.hook,
+		Priority: base.prio,
+	})
+	if err := n.conn.Flush(); err != nil {
+		return nil, fmt.Errorf("nftables: creating %s/%s: %w", table, chain, err)
+	}
+	return c, nil
+}
+
+// findRule returns the rule in c that was added with args, or nil if
+// there's none.
+func (n *nftablesRunner) findRule(c *nftables.Chain, args []string) (*nftables.Rule, error) {
+	rules, err := n.conn.GetRules(c.Table, c)
+	if err != nil {
+		return nil, fmt.Errorf("nftables: listing rules of %s: %w", c.Name, err)
+	}
+	comment := nftRuleComment(args)
+	for _, r := range rules {
+		if bytes.Equal(r.UserData, comment) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+func (n *nftablesRunner) newRule(c *nftables.Chain, args []string) (*nftables.Rule, error) {
+	exprs, err := nftExprs(n.family, args)
+	if err != nil {
+		return nil, fmt.Errorf("nftables: translating %q: %w", strings.Join(args, " "), err)
+	}
+	return &nftables.Rule{
+		Table:    c.Table,
+		Chain:    c,
+		Exprs:    exprs,
+		UserData: nftRuleComment(args),
+	}, nil
+}
+
+// Insert inserts the rule args at the 1-based position pos of the chain.
+func (n *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	c, err := n.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	r, err := n.newRule(c, args)
+	if err != nil {
+		return err
+	}
+	if pos <= 1 {
+		n.conn.InsertRule(r)
+	} else {
+		rules, err := n.conn.GetRules(c.Table, c)
+		if err != nil {
+			return fmt.Errorf("nftables: listing rules of %s/%s: %w", table, chain, err)
+		}
+		if pos > len(rules)+1 {
+			return fmt.Errorf("nftables: bad position %d in %s/%s", pos, table, chain)
+		}
+		// Add after the rule currently preceding pos.
+		r.Position = rules[pos-2].Handle
+		n.conn.AddRule(r)
+	}
+	return n.conn.Flush()
+}
+
+// Append appends the rule args to the end of the chain.
+func (n *nftablesRunner) Append(table, chain string, args ...string) error {
+	c, err := n.chain(table, chain)
+	if err != nil {
+		return err
+	}
+	r, err := n.newRule(c, args)
+	if err != nil {
+		return err
+	}
+	n.conn.AddRule(r)
+	return n.conn.Flush()
+}
+
+// Exists reports whether the rule args is in the chain.
+func (n *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	c, err := n.findChain(table, chain)
+	if err != nil || c == nil {
+		return false, err
+	}
+	r, err := n.findRule(c, args)
+	return r != nil, err
+}
+
+// Delete deletes the rule args from the chain.
+func (n *nftablesRunner) Delete(table, chain string, args ...string) error {
+	c, err := n.findChain(table, chain)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	r, err := n.findRule(c, args)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return &nftExitError{1, fmt.Sprintf("nftables: rule %q not found in %s/%s", strings.Join(args, " "), table, chain)}
+	}
+	if err := n.conn.DelRule(r); err != nil {
+		return fmt.Errorf("nftables: deleting rule from %s/%s: %w", table, chain, err)
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: deleting rule from %s/%s: %w", table, chain, err)
+	}
+	return n.cleanupTable(table)
+}
+
+// ClearChain removes all rules from the chain.
+func (n *nftablesRunner) ClearChain(table, chain string) error {
+	c, err := n.findChain(table, chain)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	n.conn.FlushChain(c)
+	return n.conn.Flush()
+}
+
+// NewChain creates the regular chain, and its table if needed.
+func (n *nftablesRunner) NewChain(table, chain string) error {
+	c, err := n.findChain(table, chain)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		return fmt.Errorf("nftables: chain %s/%s already exists", table, chain)
+	}
+	t, err := n.table(table)
+	if err != nil {
+		return err
+	}
+	n.conn.AddTable(t)
+	n.conn.AddChain(&nftables.Chain{Name: chain, Table: t})
+	return n.conn.Flush()
+}
+
+// DeleteChain deletes the empty chain, and its table once only empty
+// base chains are left in it.
+func (n *nftablesRunner) DeleteChain(table, chain string) error {
+	c, err := n.findChain(table, chain)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errNoChain(table, chain)
+	}
+	rules, err := n.conn.GetRules(c.Table, c)
+	if err != nil {
+		return fmt.Errorf("nftables: listing rules of %s/%s: %w", table, chain, err)
+	}
+	if len(rules) != 0 {
+		return fmt.Errorf("nftables: chain %s/%s is not empty", table, chain)
+	}
+	n.conn.DelChain(c)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: deleting %s/%s: %w", table, chain, err)
+	}
+	return n.cleanupTable(table)
+}
+
+// cleanupTable deletes the nftables table for the iptables table if
+// nothing but empty base chains are left in it, so that no trace of the
+// runner remains once the router has removed its chains and hooks.
+func (n *nftablesRunner) cleanupTable(table string) error {
+	t, err := n.table(table)
+	if err != nil {
+		return err
+	}
+	chains, err := n.conn.ListChains()
+	if err != nil {
+		return fmt.Errorf("nftables: listing chains: %w", err)
+	}
+	found := false
+	for _, c := range chains {
+		if c.Table.Name != t.Name || c.Table.Family != t.Family {
+			continue
+		}
+		found = true
+		if c.Hooknum == nil {
+			return nil
+		}
+		rules, err := n.conn.GetRules(c.Table, c)
+		if err != nil {
+			return fmt.Errorf("nftables: listing rules of %s: %w", c.Name, err)
+		}
+		if len(rules) != 0 {
+			return nil
+		}
+	}
+	if !found {
+		return nil
+	}
+	n.conn.DelTable(t)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("nftables: deleting table %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// nftRuleComment returns the nftables rule user data for a rule with the
+// iptables arguments args: a comment, as `nft` encodes them.
+func nftRuleComment(args []string) []byte {
+	s := strings.Join(args, " ")
+	// A NFTNL_UDATA_RULE_COMMENT TLV, with a NUL-terminated value.
+	b := []byte{0, byte(len(s) + 1)}
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+// nftExprs translates the iptables rule arguments args into nftables
+// expressions for the given family. Only the matches and targets the
+// router uses are supported:
+//
+//	[!] -i/-o <interface>
+//	[!] -s <address or prefix>
+//	[!] -m mark --mark <value>/<mask>
+//	-j ACCEPT|DROP|RETURN|MASQUERADE|ts-<chain>
+//	-j MARK --set-mark <value>/<mask>
+func nftExprs(family nftables.TableFamily, args []string) ([]expr.Any, error) {
+	var (
+		exprs     []expr.Any
+		neg       bool
+		hasTarget bool
+	)
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		next := func() (string, error) {
+			if len(args) == 0 {
+				return "", fmt.Errorf("missing value for %q", arg)
+			}
+			v := args[0]
+			args = args[1:]
+			return v, nil
+		}
+		if hasTarget {
+			return nil, fmt.Errorf("unexpected %q after target", arg)
+		}
+		op := expr.CmpOpEq
+		if neg {
+			op = expr.CmpOpNeq
+		}
+
+		switch arg {
+		case "!":
+			if neg {
+				return nil, fmt.Errorf("repeated %q", arg)
+			}
+			neg = true
+			continue
+		case "-i", "-o":
+			name, err := next()
+			if err != nil {
+				return nil, err
+			}
+			key := expr.MetaKeyIIFNAME
+			if arg == "-o" {
+				key = expr.MetaKeyOIFNAME
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: key, Register: 1},
+				&expr.Cmp{Op: op, Register: 1, Data: nftIfname(name)},
+			)
+		case "-s":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			e, err := nftSourceExprs(family, v, op)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+		case "-m":
+			if m, err := next(); err != nil {
+				return nil, err
+			} else if m != "mark" {
+				return nil, fmt.Errorf("unsupported match %q", m)
+			}
+			if opt, err := next(); err != nil {
+				return nil, err
+			} else if opt != "--mark" {
+				return nil, fmt.Errorf("unsupported mark option %q", opt)
+			}
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			val, mask, err := parseMark(v)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: nftUint32(mask), Xor: nftUint32(0)},
+				&expr.Cmp{Op: op, Register: 1, Data: nftUint32(val)},
+			)
+		case "-j":
+			if neg {
+				return nil, fmt.Errorf("cannot negate %q", arg)
+			}
+			target, err := next()
+			if err != nil {
+				return nil, err
+			}
+			e, err := nftTargetExprs(target, next)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+			hasTarget = true
+		default:
+			return nil, fmt.Errorf("unsupported argument %q", arg)
+		}
+		neg = false
+	}
+	if !hasTarget {
+		return nil, fmt.Errorf("missing target")
+	}
+	return exprs, nil
+}
+
+// nftTargetExprs returns the expressions for the iptables target, using
+// next to get the target's options.
+func nftTargetExprs(target string, next func() (string, error)) ([]expr.Any, error) {
+	switch target {
+	case "ACCEPT":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}, nil
+	case "DROP":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}, nil
+	case "RETURN":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}, nil
+	case "MASQUERADE":
+		return []expr.Any{&expr.Masq{}}, nil
+	case "MARK":
+		if opt, err := next(); err != nil {
+			return nil, err
+		} else if opt != "--set-mark" {
+			return nil, fmt.Errorf("unsupported MARK option %q", opt)
+		}
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		val, mask, err := parseMark(v)
+		if err != nil {
+			return nil, err
+		}
+		// mark = (mark & ^mask) | val
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: nftUint32(^mask), Xor: nftUint32(val)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		}, nil
+	}
+	if strings.HasPrefix(target, "ts-") {
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: target}}, nil
+	}
+	return nil, fmt.Errorf("unsupported target %q", target)
+}
+
+// nftSourceExprs returns the expressions matching packets whose source
+// address is, or is not per op, in the address or prefix s.
+func nftSourceExprs(family nftables.TableFamily, s string, op expr.CmpOp) ([]expr.Any, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		ip, ipErr := netip.ParseAddr(s)
+		if ipErr != nil {
+			return nil, err
+		}
+		p = netip.PrefixFrom(ip, ip.BitLen())
+	}
+	if p.Addr().Is4() != (family == nftables.TableFamilyIPv4) {
+		return nil, fmt.Errorf("address %v does not match table family", p)
+	}
+	offset, length := uint32(12), uint32(4) // IPv4 source address
+	if p.Addr().Is6() {
+		offset, length = 8, 16
+	}
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+	}
+	if p.Bits() < p.Addr().BitLen() {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+			Xor:            make([]byte, length),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: p.Masked().Addr().AsSlice()}), nil
+}
+
+// parseMark parses an iptables "value/mask" mark.
+func parseMark(s string) (val, mask uint32, err error) {
+	vs, ms, ok := strings.Cut(s, "/")
+	if !ok {
+		ms = "0xffffffff"
+	}
+	v, err := strconv.ParseUint(vs, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad mark %q: %w", s, err)
+	}
+	m, err := strconv.ParseUint(ms, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad mark %q: %w", s, err)
+	}
+	return uint32(v), uint32(m), nil
+}
+
+// nftIfname returns the interface name as nftables compares it: NUL
+// padded to IFNAMSIZ.
+func nftIfname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name+"\x00")
+	return b
+}
+
+// nftUint32 returns v in host byte order, as nftables expects meta values.
+func nftUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	native.Endian.PutUint32(b, v)
+	return b
+}
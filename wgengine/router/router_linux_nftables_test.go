@@ -0,0 +1,336 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux && !(386 || loong64 || arm || armbe)
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	fakeFirewalls = append(fakeFirewalls, struct {
+		name  string
+		newOS func(*testing.T) *fakeOS
+	}{"nftables", newFakeNftablesOS})
+}
+
+func newFakeNftablesOS(t *testing.T) *fakeOS {
+	o := NewFakeOS(t)
+	o.netfilter4 = newFakeNftablesRunner(t, nftables.TableFamilyIPv4)
+	o.netfilter6 = newFakeNftablesRunner(t, nftables.TableFamilyIPv6)
+	return o
+}
+
+// fakeNftablesRunner is an nftablesRunner over a fakeNftConn.
+type fakeNftablesRunner struct {
+	*nftablesRunner
+	conn *fakeNftConn
+}
+
+func newFakeNftablesRunner(t *testing.T, family nftables.TableFamily) *fakeNftablesRunner {
+	conn := &fakeNftConn{t: t}
+	return &fakeNftablesRunner{
+		nftablesRunner: &nftablesRunner{conn: conn, family: family},
+		conn:           conn,
+	}
+}
+
+// rules returns the rules by their iptables table and chain, so that
+// they compare equal to the iptables fake's.
+func (n *fakeNftablesRunner) rules() map[string][]string {
+	ret := make(map[string][]string)
+	for _, c := range n.conn.chains {
+		k := strings.TrimPrefix(c.Table.Name, "ts-") + "/" + c.Name
+		for _, r := range n.conn.rules[n.conn.key(c.Table, c)] {
+			ret[k] = append(ret[k], string(r.UserData[2:len(r.UserData)-1]))
+		}
+	}
+	return ret
+}
+
+// fakeNftConn implements nftConn, applying changes immediately rather
+// than on Flush.
+type fakeNftConn struct {
+	t          *testing.T
+	tables     []*nftables.Table
+	chains     []*nftables.Chain
+	rules      map[string][]*nftables.Rule // by key
+	lastHandle uint64
+}
+
+func (c *fakeNftConn) key(t *nftables.Table, ch *nftables.Chain) string {
+	return t.Name + "/" + ch.Name
+}
+
+func (c *fakeNftConn) hasTable(t *nftables.Table) bool {
+	return slices.ContainsFunc(c.tables, func(x *nftables.Table) bool { return x.Name == t.Name })
+}
+
+func (c *fakeNftConn) chainIndex(ch *nftables.Chain) int {
+	return slices.IndexFunc(c.chains, func(x *nftables.Chain) bool {
+		return x.Table.Name == ch.Table.Name && x.Name == ch.Name
+	})
+}
+
+func (c *fakeNftConn) ListChains() ([]*nftables.Chain, error) {
+	return slices.Clone(c.chains), nil
+}
+
+func (c *fakeNftConn) GetRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	if c.chainIndex(ch) < 0 {
+		return nil, fmt.Errorf("no chain %s", c.key(t, ch))
+	}
+	return slices.Clone(c.rules[c.key(t, ch)]), nil
+}
+
+func (c *fakeNftConn) AddTable(t *nftables.Table) *nftables.Table {
+	if !c.hasTable(t) {
+		c.tables = append(c.tables, t)
+	}
+	return t
+}
+
+func (c *fakeNftConn) DelTable(t *nftables.Table) {
+	if !c.hasTable(t) {
+		c.t.Errorf("DelTable: no table %s", t.Name)
+		return
+	}
+	i := slices.IndexFunc(c.tables, func(x *nftables.Table) bool { return x.Name == t.Name })
+	c.tables = slices.Delete(c.tables, i, i+1)
+	var chains []*nftables.Chain
+	for _, ch := range c.chains {
+		if ch.Table.Name == t.Name {
+			delete(c.rules, c.key(t, ch))
+			continue
+		}
+		chains = append(chains, ch)
+	}
+	c.chains = chains
+}
+
+func (c *fakeNftConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	if !c.hasTable(ch.Table) {
+		c.t.Errorf("AddChain: no table %s", ch.Table.Name)
+	}
+	if c.chainIndex(ch) < 0 {
+		c.chains = append(c.chains, ch)
+	}
+	return ch
+}
+
+func (c *fakeNftConn) FlushChain(ch *nftables.Chain) {
+	delete(c.rules, c.key(ch.Table, ch))
+}
+
+func (c *fakeNftConn) DelChain(ch *nftables.Chain) {
+	i := c.chainIndex(ch)
+	if i < 0 {
+		c.t.Errorf("DelChain: no chain %s", c.key(ch.Table, ch))
+		return
+	}
+	if len(c.rules[c.key(ch.Table, ch)]) != 0 {
+		c.t.Errorf("DelChain: chain %s is not empty", c.key(ch.Table, ch))
+		return
+	}
+	c.chains = slices.Delete(c.chains, i, i+1)
+}
+
+// addRule adds r at the index of the rule with handle r.Position, plus
+// offset, or at def if r.Position is zero.
+func (c *fakeNftConn) addRule(r *nftables.Rule, offset int, def func(rules []*nftables.Rule) int) *nftables.Rule {
+	if c.chainIndex(r.Chain) < 0 {
+		c.t.Errorf("no chain %s", c.key(r.Table, r.Chain))
+		return r
+	}
+	if c.rules == nil {
+		c.rules = make(map[string][]*nftables.Rule)
+	}
+	k := c.key(r.Table, r.Chain)
+	rules := c.rules[k]
+	i := def(rules)
+	if r.Position != 0 {
+		i = slices.IndexFunc(rules, func(x *nftables.Rule) bool { return x.Handle == r.Position })
+		if i < 0 {
+			c.t.Errorf("no rule with handle %d in %s", r.Position, k)
+			return r
+		}
+		i += offset
+	}
+	c.lastHandle++
+	r.Handle = c.lastHandle
+	c.rules[k] = slices.Insert(rules, i, r)
+	return r
+}
+
+func (c *fakeNftConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	return c.addRule(r, 1, func(rules []*nftables.Rule) int { return len(rules) })
+}
+
+func (c *fakeNftConn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	return c.addRule(r, 0, func([]*nftables.Rule) int { return 0 })
+}
+
+func (c *fakeNftConn) DelRule(r *nftables.Rule) error {
+	k := c.key(r.Table, r.Chain)
+	i := slices.IndexFunc(c.rules[k], func(x *nftables.Rule) bool { return x.Handle == r.Handle })
+	if i < 0 {
+		return errors.New("no such rule")
+	}
+	c.rules[k] = slices.Delete(c.rules[k], i, i+1)
+	return nil
+}
+
+func (c *fakeNftConn) Flush() error { return nil }
+
+func TestNftablesRunner(t *testing.T) {
+	n := newFakeNftablesRunner(t, nftables.TableFamilyIPv4)
+
+	if err := n.ClearChain("filter", "ts-input"); errCode(err) != 1 {
+		t.Fatalf("ClearChain of missing chain = %v; want exit code 1", err)
+	}
+	if err := n.NewChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-j", "DROP"},
+		{"-j", "ACCEPT"},
+	} {
+		if err := n.Append("filter", "ts-input", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.Insert("filter", "ts-input", 2, "-j", "RETURN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Insert("filter", "ts-input", 1, "-i", "lo", "-s", "100.64.0.1", "-j", "ACCEPT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Insert("filter", "INPUT", 1, "-j", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"filter/ts-input": {"-i lo -s 100.64.0.1 -j ACCEPT", "-j DROP", "-j RETURN", "-j ACCEPT"},
+		"filter/INPUT":    {"-j ts-input"},
+	}
+	if diff := cmp.Diff(n.rules(), want); diff != "" {
+		t.Fatalf("rules (-got+want):\n%s", diff)
+	}
+	if ok, err := n.Exists("filter", "ts-input", "-j", "RETURN"); err != nil || !ok {
+		t.Errorf("Exists = %v, %v; want true", ok, err)
+	}
+	if ok, err := n.Exists("nat", "POSTROUTING", "-j", "ts-postrouting"); err != nil || ok {
+		t.Errorf("Exists in missing chain = %v, %v; want false", ok, err)
+	}
+	if err := n.Delete("filter", "ts-input", "-j", "MASQUERADE"); errCode(err) != 1 {
+		t.Errorf("Delete of missing rule = %v; want exit code 1", err)
+	}
+	if err := n.DeleteChain("filter", "ts-input"); err == nil {
+		t.Errorf("DeleteChain of non-empty chain succeeded")
+	}
+
+	// Removing everything removes the table.
+	if err := n.Delete("filter", "INPUT", "-j", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ClearChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DeleteChain("filter", "ts-input"); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.conn.tables) != 0 || len(n.conn.chains) != 0 {
+		t.Errorf("tables %v, chains %v left; want none", n.conn.tables, n.conn.chains)
+	}
+}
+
+func TestNftExprs(t *testing.T) {
+	tests := []struct {
+		family nftables.TableFamily
+		args   string
+		want   []expr.Any
+	}{
+		{
+			family: nftables.TableFamilyIPv4,
+			args:   "! -i tailscale0 -s 100.64.0.0/10 -j DROP",
+			want: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: nftIfname("tailscale0")},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 192, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{100, 64, 0, 0}},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		},
+		{
+			family: nftables.TableFamilyIPv6,
+			args:   "-i lo -s fd7a:115c:a1e0::1 -j ACCEPT",
+			want: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfname("lo")},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		},
+		{
+			family: nftables.TableFamilyIPv4,
+			args:   "-i tailscale0 -j MARK --set-mark 0x40000/0xff0000",
+			want: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfname("tailscale0")},
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: nftUint32(0xff00ffff), Xor: nftUint32(0x40000)},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			},
+		},
+		{
+			family: nftables.TableFamilyIPv4,
+			args:   "-m mark --mark 0x40000/0xff0000 -j MASQUERADE",
+			want: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: nftUint32(0xff0000), Xor: nftUint32(0)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftUint32(0x40000)},
+				&expr.Masq{},
+			},
+		},
+		{
+			family: nftables.TableFamilyIPv4,
+			args:   "-j ts-postrouting",
+			want:   []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: "ts-postrouting"}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := nftExprs(tt.family, strings.Fields(tt.args))
+		if err != nil {
+			t.Errorf("nftExprs(%q): %v", tt.args, err)
+			continue
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("nftExprs(%q) (-got+want):\n%s", tt.args, diff)
+		}
+	}
+
+	for _, args := range []string{
+		"-p udp -j ACCEPT",
+		"-j LOG",
+		"! -j ACCEPT",
+		"-s 100.64.0.0/10",
+		"-s fd7a::/48 -j ACCEPT",
+		"-j ACCEPT -i lo",
+		"-i",
+	} {
+		if _, err := nftExprs(nftables.TableFamilyIPv4, strings.Fields(args)); err == nil {
+			t.Errorf("nftExprs(%q) succeeded; want error", args)
+		}
+	}
+}
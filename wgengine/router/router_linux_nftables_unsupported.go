@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux && (386 || loong64 || arm || armbe)
+
+package router
+
+import "errors"
+
+// newNftablesRunner is not supported on this platform.
+func newNftablesRunner(v6 bool) (netfilterRunner, error) {
+	return nil, errors.New("nftables is not supported on this platform")
+}
@@ -327,41 +327,62 @@ func TestRouterStates(t *testing.T) {
 	mon.Start()
 	defer mon.Close()
 
-	fake := NewFakeOS(t)
-	router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
-	if err != nil {
-		t.Fatalf("failed to create router: %v", err)
-	}
-	if err := router.Up(); err != nil {
-		t.Fatalf("failed to up router: %v", err)
-	}
+	for _, fw := range fakeFirewalls {
+		t.Run(fw.name, func(t *testing.T) {
+			fake := fw.newOS(t)
+			router, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", mon, fake.netfilter4, fake.netfilter6, fake, true, true)
+			if err != nil {
+				t.Fatalf("failed to create router: %v", err)
+			}
+			if err := router.Up(); err != nil {
+				t.Fatalf("failed to up router: %v", err)
+			}
 
-	testState := func(t *testing.T, i int) {
-		t.Helper()
-		if err := router.Set(states[i].in); err != nil {
-			t.Fatalf("failed to set router config: %v", err)
-		}
-		got := fake.String()
-		want := adjustFwmask(t, strings.TrimSpace(states[i].want))
-		if diff := cmp.Diff(got, want); diff != "" {
-			t.Fatalf("unexpected OS state (-got+want):\n%s", diff)
-		}
-	}
+			testState := func(t *testing.T, i int) {
+				t.Helper()
+				if err := router.Set(states[i].in); err != nil {
+					t.Fatalf("failed to set router config: %v", err)
+				}
+				got := fake.String()
+				want := adjustFwmask(t, strings.TrimSpace(states[i].want))
+				if diff := cmp.Diff(got, want); diff != "" {
+					t.Fatalf("unexpected OS state (-got+want):\n%s", diff)
+				}
+			}
 
-	for i, state := range states {
-		t.Run(state.name, func(t *testing.T) { testState(t, i) })
-	}
+			for i, state := range states {
+				t.Run(state.name, func(t *testing.T) { testState(t, i) })
+			}
 
-	// Cycle through a bunch of states in pseudorandom order, to
-	// verify that we transition cleanly from state to state no matter
-	// the order.
-	for randRun := 0; randRun < 5*len(states); randRun++ {
-		i := rand.Intn(len(states))
-		state := states[i]
-		t.Run(state.name, func(t *testing.T) { testState(t, i) })
+			// Cycle through a bunch of states in pseudorandom order, to
+			// verify that we transition cleanly from state to state no matter
+			// the order.
+			for randRun := 0; randRun < 5*len(states); randRun++ {
+				i := rand.Intn(len(states))
+				state := states[i]
+				t.Run(state.name, func(t *testing.T) { testState(t, i) })
+			}
+		})
 	}
 }
 
+// fakeFirewalls are the netfilter implementations TestRouterStates runs
+// the router against.
+var fakeFirewalls = []struct {
+	name  string
+	newOS func(*testing.T) *fakeOS
+}{
+	{"iptables", NewFakeOS},
+}
+
+// fakeNetfilterRunner is a netfilterRunner whose rules tests can inspect.
+type fakeNetfilterRunner interface {
+	netfilterRunner
+
+	// rules returns the arguments of the rules in each "table/chain".
+	rules() map[string][]string
+}
+
 type fakeNetfilter struct {
 	t *testing.T
 	n map[string][]string
@@ -473,6 +494,8 @@ func (n *fakeNetfilter) DeleteChain(table, chain string) error {
 	}
 }
 
+func (n *fakeNetfilter) rules() map[string][]string { return n.n }
+
 // fakeOS implements commandRunner and provides v4 and v6
 // netfilterRunners, but captures changes without touching the OS.
 type fakeOS struct {
@@ -481,8 +504,8 @@ type fakeOS struct {
 	ips        []string
 	routes     []string
 	rules      []string
-	netfilter4 *fakeNetfilter
-	netfilter6 *fakeNetfilter
+	netfilter4 fakeNetfilterRunner
+	netfilter6 fakeNetfilterRunner
 }
 
 func NewFakeOS(t *testing.T) *fakeOS {
@@ -516,23 +539,25 @@ func (o *fakeOS) String() string {
 	}
 
 	var chains []string
-	for chain := range o.netfilter4.n {
+	rules4 := o.netfilter4.rules()
+	for chain := range rules4 {
 		chains = append(chains, chain)
 	}
 	sort.Strings(chains)
 	for _, chain := range chains {
-		for _, rule := range o.netfilter4.n[chain] {
+		for _, rule := range rules4[chain] {
 			fmt.Fprintf(&b, "v4/%s %s\n", chain, rule)
 		}
 	}
 
 	chains = nil
-	for chain := range o.netfilter6.n {
+	rules6 := o.netfilter6.rules()
+	for chain := range rules6 {
 		chains = append(chains, chain)
 	}
 	sort.Strings(chains)
 	for _, chain := range chains {
-		for _, rule := range o.netfilter6.n[chain] {
+		for _, rule := range rules6[chain] {
 			fmt.Fprintf(&b, "v6/%s %s\n", chain, rule)
 		}
 	}
@@ -42,7 +42,9 @@ func errCode(err error) int {
 	if err == nil {
 		return 0
 	}
-	var e *exec.ExitError
+	// Matches *exec.ExitError, as well as the errors of netfilterRunners
+	// that report the exit code iptables would have.
+	var e interface{ ExitCode() int }
 	if ok := errors.As(err, &e); ok {
 		return e.ExitCode()
 	}
@@ -325,6 +325,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteRecvActivity,
+		PeerPathMTUFunc:  e.tundev.SetPeerPathMTU,
 		NetMon:           e.netMon,
 	}
 